@@ -0,0 +1,129 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// descriptive names for the single-letter flags, used as config file
+// keys and environment variable names
+var flagLongNames = map[string]string{
+	"i": "input",
+	"f": "output",
+	"t": "trips-explicit",
+	"r": "per-route",
+	"p": "projection",
+	"m": "mots",
+	"s": "stations",
+	"o": "text-output",
+	"c": "config",
+}
+
+// return the config file key of a flag
+func cfgKey(flagName string) string {
+	if long, ok := flagLongNames[flagName]; ok {
+		return long
+	}
+	return flagName
+}
+
+// return the environment variable name of a flag
+func envName(flagName string) string {
+	return "GTFS2SHP_" + strings.ToUpper(strings.Replace(cfgKey(flagName), "-", "_", -1))
+}
+
+// applyDefaults sets all flags not explicitly given on the command line
+// from environment variables, or from the config file at cfgPath. The
+// precedence is flag > environment variable > config file.
+func applyDefaults(cfgPath string) error {
+	cfg := make(map[string]string)
+
+	if len(cfgPath) > 0 {
+		var err error
+		cfg, err = readConfigFile(cfgPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	known := make(map[string]bool)
+	var err error
+
+	flag.VisitAll(func(f *flag.Flag) {
+		known[cfgKey(f.Name)] = true
+
+		if err != nil || set[f.Name] {
+			return
+		}
+
+		if val, ok := os.LookupEnv(envName(f.Name)); ok {
+			if e := flag.Set(f.Name, val); e != nil {
+				err = fmt.Errorf("invalid value '%s' for %s: %s", val, envName(f.Name), e)
+			}
+		} else if val, ok := cfg[cfgKey(f.Name)]; ok {
+			if e := flag.Set(f.Name, val); e != nil {
+				err = fmt.Errorf("invalid value '%s' for '%s' in %s: %s", val, cfgKey(f.Name), cfgPath, e)
+			}
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for k := range cfg {
+		if !known[k] {
+			return fmt.Errorf("unknown option '%s' in %s", k, cfgPath)
+		}
+	}
+
+	return nil
+}
+
+// read a config file consisting of {key}={value} lines, lines
+// starting with # are ignored
+func readConfigFile(path string) (map[string]string, error) {
+	ret := make(map[string]string)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open config file (%s)", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		tupl := strings.SplitN(line, "=", 2)
+
+		if len(tupl) != 2 {
+			return nil, fmt.Errorf("could not read line %d of config file %s", lineNum, path)
+		}
+
+		ret[strings.TrimSpace(tupl[0])] = strings.TrimSpace(tupl[1])
+	}
+
+	return ret, scanner.Err()
+}
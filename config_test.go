@@ -0,0 +1,91 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyDefaults(t *testing.T) {
+	defer func(cmd *flag.FlagSet) { flag.CommandLine = cmd }(flag.CommandLine)
+
+	// restored after the test, unset for each case
+	t.Setenv("GTFS2SHP_PROJECTION", "")
+	t.Setenv("GTFS2SHP_PRECISION", "")
+
+	tests := []struct {
+		args      []string
+		env       string
+		cfg       string
+		want      string
+		precision int
+	}{
+		{nil, "", "", "4326", -1},
+		{nil, "", "projection=3857\nprecision=2", "3857", 2},
+		{nil, "25832", "# comment\nprojection=3857", "25832", -1},
+		{[]string{"-p", "2056"}, "25832", "projection=3857", "2056", -1},
+		{[]string{"-p", "2056"}, "", "projection = 3857\nprecision=3", "2056", 3},
+	}
+
+	for _, test := range tests {
+		flag.CommandLine = flag.NewFlagSet("gtfs2shp", flag.ContinueOnError)
+		projection := flag.String("p", "4326", "")
+		precision := flag.Int("precision", -1, "")
+
+		if err := flag.CommandLine.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+
+		os.Unsetenv("GTFS2SHP_PROJECTION")
+		os.Unsetenv("GTFS2SHP_PRECISION")
+		if len(test.env) > 0 {
+			os.Setenv("GTFS2SHP_PROJECTION", test.env)
+		}
+
+		cfgPath := ""
+		if len(test.cfg) > 0 {
+			cfgPath = filepath.Join(t.TempDir(), "gtfs2shp.cfg")
+			if err := os.WriteFile(cfgPath, []byte(test.cfg), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := applyDefaults(cfgPath); err != nil {
+			t.Fatalf("args %v, env %q, config %q: %s", test.args, test.env, test.cfg, err)
+		}
+
+		if *projection != test.want || *precision != test.precision {
+			t.Errorf("args %v, env %q, config %q: got projection %s, precision %d, want %s, %d", test.args, test.env, test.cfg, *projection, *precision, test.want, test.precision)
+		}
+	}
+
+	// invalid values and unknown keys are errors
+	os.Unsetenv("GTFS2SHP_PROJECTION")
+	for _, cfg := range []string{"precision=two", "projektion=3857", "projection"} {
+		flag.CommandLine = flag.NewFlagSet("gtfs2shp", flag.ContinueOnError)
+		flag.String("p", "4326", "")
+		flag.Int("precision", -1, "")
+		flag.CommandLine.Parse(nil)
+
+		cfgPath := filepath.Join(t.TempDir(), "gtfs2shp.cfg")
+		if err := os.WriteFile(cfgPath, []byte(cfg), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := applyDefaults(cfgPath); err == nil {
+			t.Errorf("config %q accepted", cfg)
+		}
+	}
+
+	os.Setenv("GTFS2SHP_PRECISION", "two")
+	if err := applyDefaults(""); err == nil {
+		t.Error("invalid environment variable accepted")
+	}
+}
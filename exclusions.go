@@ -0,0 +1,116 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package main
+
+import (
+	"fmt"
+	"github.com/patrickbr/gtfsparser"
+	"sort"
+)
+
+// the trips, routes and stops excluded from the outputs by filters and
+// validation. A nil log records nothing
+type exclusionLog struct {
+	ids        map[string]map[string]bool // remaining IDs by entity type
+	exclusions []validationIssue
+}
+
+// return a log of the entities excluded from feed from now on
+func newExclusionLog(feed *gtfsparser.Feed) *exclusionLog {
+	return &exclusionLog{ids: feedEntityIDs(feed)}
+}
+
+// record the trips, routes and stops removed from feed since the last
+// update, with their reason in issues if given there, or reason
+// otherwise
+func (l *exclusionLog) update(feed *gtfsparser.Feed, reason string, issues []validationIssue) {
+	if l == nil {
+		return
+	}
+
+	reasons := make(map[[2]string]string, len(issues))
+	for _, issue := range issues {
+		reasons[[2]string{issue.entity, issue.id}] = issue.reason
+	}
+
+	ids := feedEntityIDs(feed)
+
+	for entity, before := range l.ids {
+		for id := range before {
+			if ids[entity][id] {
+				continue
+			}
+
+			r, ok := reasons[[2]string{entity, id}]
+			if !ok {
+				r = reason
+			}
+			l.exclusions = append(l.exclusions, validationIssue{entity, id, r})
+		}
+	}
+
+	l.ids = ids
+}
+
+// record the remaining routes not of a type in motMap, and their trips,
+// as excluded by the route type filter
+func (l *exclusionLog) updateMOTs(feed *gtfsparser.Feed, motMap map[int16]bool) {
+	if l == nil || len(motMap) == 0 {
+		return
+	}
+
+	for id, route := range feed.Routes {
+		if !motMap[route.Type] {
+			l.exclusions = append(l.exclusions, validationIssue{"route", id, fmt.Sprintf("route type %d not selected with -m", route.Type)})
+		}
+	}
+
+	for id, trip := range feed.Trips {
+		if !motMap[trip.Route.Type] {
+			l.exclusions = append(l.exclusions, validationIssue{"trip", id, fmt.Sprintf("route type %d not selected with -m", trip.Route.Type)})
+		}
+	}
+}
+
+// write the recorded exclusions to the CSV file path, sorted by entity
+// type and ID, and return their number. An existing file is only
+// replaced if replace is set
+func (l *exclusionLog) write(path string, replace bool) (int, error) {
+	if l == nil {
+		return 0, nil
+	}
+
+	sort.Slice(l.exclusions, func(i, j int) bool {
+		if l.exclusions[i].entity != l.exclusions[j].entity {
+			return l.exclusions[i].entity < l.exclusions[j].entity
+		}
+		return l.exclusions[i].id < l.exclusions[j].id
+	})
+
+	return len(l.exclusions), writeIssuesCsv(path, l.exclusions, replace)
+}
+
+// return the IDs of the trips, routes and stops of feed by entity type
+func feedEntityIDs(feed *gtfsparser.Feed) map[string]map[string]bool {
+	ret := map[string]map[string]bool{
+		"trip":  make(map[string]bool, len(feed.Trips)),
+		"route": make(map[string]bool, len(feed.Routes)),
+		"stop":  make(map[string]bool, len(feed.Stops)),
+	}
+
+	for id := range feed.Trips {
+		ret["trip"][id] = true
+	}
+	for id := range feed.Routes {
+		ret["route"][id] = true
+	}
+	for id := range feed.Stops {
+		ret["stop"][id] = true
+	}
+
+	return ret
+}
@@ -0,0 +1,138 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package main
+
+import (
+	"github.com/patrickbr/gtfsparser"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExclusionLogUpdate(t *testing.T) {
+	tests := []struct {
+		name   string
+		remove func(feed *gtfsparser.Feed)
+		issues []validationIssue
+		want   []validationIssue
+	}{
+		{
+			"nothing removed",
+			func(feed *gtfsparser.Feed) {},
+			[]validationIssue{{"trip", "t1", "kept anyway"}},
+			[]validationIssue{},
+		},
+		{
+			"default reason",
+			func(feed *gtfsparser.Feed) { delete(feed.Trips, "t1") },
+			nil,
+			[]validationIssue{{"trip", "t1", "filtered"}},
+		},
+		{
+			"reasons of issues",
+			func(feed *gtfsparser.Feed) {
+				delete(feed.Stops, "C")
+				delete(feed.Trips, "t2")
+				delete(feed.Routes, "r2")
+			},
+			[]validationIssue{{"stop", "C", "no coordinates"}, {"trip", "t1", "not removed"}, {"route", "C", "other entity type"}},
+			[]validationIssue{{"route", "r2", "filtered"}, {"stop", "C", "no coordinates"}, {"trip", "t2", "filtered"}},
+		},
+	}
+
+	for _, test := range tests {
+		feed := fixtureFeed(t)
+		l := newExclusionLog(feed)
+
+		test.remove(feed)
+		l.update(feed, "filtered", test.issues)
+
+		if got := append([]validationIssue{}, sortIssues(l.exclusions)...); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got exclusions %v, want %v", test.name, got, test.want)
+		}
+
+		// entities are only recorded by the update following their removal
+		n := len(l.exclusions)
+		delete(feed.Stops, "A")
+		l.update(feed, "later", nil)
+
+		if len(l.exclusions) != n+1 || l.exclusions[n] != (validationIssue{"stop", "A", "later"}) {
+			t.Errorf("%s: got exclusions %v after a second update", test.name, l.exclusions)
+		}
+	}
+}
+
+func TestExclusionLogUpdateMOTs(t *testing.T) {
+	tests := []struct {
+		motMap map[int16]bool
+		want   []validationIssue
+	}{
+		{map[int16]bool{}, []validationIssue{}},
+		{map[int16]bool{0: true, 3: true}, []validationIssue{}},
+		{map[int16]bool{3: true}, []validationIssue{{"route", "r2", "route type 0 not selected with -m"}, {"trip", "t2", "route type 0 not selected with -m"}}},
+		{map[int16]bool{2: true}, []validationIssue{
+			{"route", "r1", "route type 3 not selected with -m"},
+			{"route", "r2", "route type 0 not selected with -m"},
+			{"trip", "t1", "route type 3 not selected with -m"},
+			{"trip", "t2", "route type 0 not selected with -m"},
+		}},
+	}
+
+	for _, test := range tests {
+		feed := fixtureFeed(t)
+		l := newExclusionLog(feed)
+
+		l.updateMOTs(feed, test.motMap)
+
+		if got := sortIssues(append([]validationIssue{}, l.exclusions...)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("MOTs %v: got exclusions %v, want %v", test.motMap, got, test.want)
+		}
+	}
+}
+
+func TestExclusionLogNil(t *testing.T) {
+	feed := fixtureFeed(t)
+	path := filepath.Join(t.TempDir(), "out.exclusions.csv")
+
+	var l *exclusionLog
+
+	delete(feed.Trips, "t1")
+	l.update(feed, "filtered", nil)
+	l.updateMOTs(feed, map[int16]bool{3: true})
+
+	if n, err := l.write(path, false); n != 0 || err != nil {
+		t.Errorf("nil log wrote %d exclusions (%v)", n, err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("nil log created %s", path)
+	}
+}
+
+func TestExclusionLogWrite(t *testing.T) {
+	feed := fixtureFeed(t)
+	path := filepath.Join(t.TempDir(), "out.exclusions.csv")
+
+	l := newExclusionLog(feed)
+	delete(feed.Trips, "t2")
+	delete(feed.Stops, "C")
+	l.update(feed, "filtered", nil)
+
+	if n, err := l.write(path, false); n != 2 || err != nil {
+		t.Fatalf("wrote %d exclusions (%v), want 2", n, err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "type,id,reason\nstop,C,filtered\ntrip,t2,filtered\n"; string(content) != want {
+		t.Errorf("got exclusions CSV %q, want %q", content, want)
+	}
+}
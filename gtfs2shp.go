@@ -12,12 +12,25 @@ import (
 	"github.com/patrickbr/gtfs2shp/shape"
 	"github.com/patrickbr/gtfsparser"
 	gtfs "github.com/patrickbr/gtfsparser/gtfs"
+	"io"
 	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func main() {
+	os.Exit(run())
+}
+
+// run gtfs2shp and return its exit code, after the deferred cleanups
+// like releasing the output lock have run. Panics are reported on stderr
+// with exit code 1
+func run() (code int) {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "gtfs2shp - 2016 by P. Brosi\n\nUsage:\n\n  %s -f <outputfile> -i <input GTFS>\n\nAllowed options:\n\n", os.Args[0])
 		flag.PrintDefaults()
@@ -26,24 +39,137 @@ func main() {
 	routeTypeMapping := make(map[int16]string, 0)
 	outputFldMapping := make(map[string]string, 0)
 	routeAddFlds := make([]string, 0)
+	tripAddFlds := make([]string, 0)
+	stopAddFlds := make([]string, 0)
 
-	gtfsPath := flag.String("i", "", "gtfs input path, zip or directory")
+	gtfsPath := flag.String("i", "", "gtfs input path, zip or directory, or an s3:// or gs:// URL")
 	shapeFilePath := flag.String("f", "out.shp", "shapefile output file")
 	tripsExplicit := flag.Bool("t", false, "output each trip explicitly (creating a distinct geometry for every trip)")
 	perRoute := flag.Bool("r", false, "output shapes per route")
+	holidays := flag.String("holidays", "", "with -t, comma separated list of holiday dates (YYYYMMDD) for the Holiday attribute")
+	representativeTrips := flag.Bool("representative-trips", false, "with -t, only output one representative trip per route, direction and stop pattern")
 	projection := flag.String("p", "4326", "output projection, either as SRID or as proj4 projection string")
+	layerMots := flag.String("layer-m", "", "semicolon separated list of {layer}:{MOTs} overriding -m for single layers, with * for all MOTs, like routes:2;stations:*. Layers are as for -layer-p")
+	layerProjections := flag.String("layer-p", "", "semicolon separated list of {layer}:{projection} overriding the output projection of single layers, like stations:25832;shapes:3857. Layers are "+strings.Join(shape.OutputLayers, ", "))
+	spatialIndex := flag.Bool("spatial-index", false, "write a .qix quadtree spatial index for each written shapefile")
+	extentAttrs := flag.Bool("extent-attrs", false, "add bounding box and centroid attributes (in the output projection) to line features")
+	summary := flag.Bool("summary", false, "write a JSON summary of all written layers with their geometry counts and extents into <outputfilename>.summary.json")
+	metadata := flag.Bool("metadata", false, "write FGDC metadata for each written layer into <layer>.shp.xml, with the citation taken from feed_info.txt")
+	report := flag.Bool("report", false, "write a self-contained HTML conversion report with a feed summary, statistics per route type, warnings and a map preview into <outputfilename>.report.html")
+	dictionary := flag.String("dictionary", "", "write a data dictionary of all written attribute columns into <outputfilename>.dictionary.json ('json') or <outputfilename>.dictionary.csv ('csv')")
+	incremental := flag.String("incremental", "", "summary file of a previous run (see -summary), only layers whose contents changed since then are replaced. Implies -summary")
+	precision := flag.Int("precision", -1, "number of decimal places of output coordinates (in the output projection), -1 keeps the full precision")
+	simplify := flag.Float64("simplify", 0, "simplify the lines of the trips, route shapes and aggregated shapes with a tolerance in meters, keeping the vertex nearest to each served stop")
 	mots := flag.String("m", "", "route types (MOT) to consider, as a comma separated list (see GTFS spec). Empty keeps all.")
 	stations := flag.Bool("s", false, "output station point geometries as well (will be written into <outputfilename>-stations.shp)")
+	stationsCsv := flag.Bool("stations-csv", false, "output stations into a CSV file <outputfilename>.stations.csv as well, with WGS84 and projected coordinates")
+	splitStationsByMode := flag.Bool("split-stations-by-mode", false, "with -s, write the stations served by each route type into separate files <outputfilename>.stations.{route_type}.shp")
+	routeTypeFile := flag.String("route-type-file", "", "CSV file reclassifying route types before filtering and aggregation, with the columns new_route_type and route_id (for single routes) or route_type (for all routes of a type)")
 	routeTypeNameMapping := flag.String("route-type-mapping", "", "semicolon-separated list of mapping of {route_type}:{string} to be used on output")
 	outputFldNameMapping := flag.String("output-field-name-mapping", "", "semicolon-separated list of mapping of {field name}:{new field name} to alter output field names")
-	writeAddRouteFlds := flag.String("write-add-route-fields", "", "semicolon-separated list of additional route fields to be included in output")
+	writeAddRouteFlds := flag.String("write-add-route-fields", "", "semicolon-separated list of additional route fields to be included in output, a trailing * includes all fields with the prefix before it")
+	autoAddRouteFlds := flag.Bool("auto-add-route-fields", false, "include common producer extension fields of routes.txt present in the feed, like route_branding_url and vehicle_type, in the output")
+	writeAddTripFlds := flag.String("write-add-trip-fields", "", "semicolon-separated list of additional trip fields to be included in the explicit trips output")
+	writeAddStopFlds := flag.String("write-add-stop-fields", "", "semicolon-separated list of additional stop fields to be included in the stations output")
+	stopNameLangs := flag.String("stop-name-languages", "", "comma separated list of languages (like de,en) of stop name translations from translations.txt to include in the stations output, as one Name_{language} column each")
+	routeGroups := flag.String("route-groups", "", "with -r or -write-route-overview-csv, aggregate routes marketed as a single line into one route, either by an additional routes.txt field (like network_id or as_route) or by a CSV file with the columns route_id and group_id")
 	writeRouteOverviewCsv := flag.Bool("write-route-overview-csv", false, "write a route overview CSV")
+	modeShareCsv := flag.Bool("mode-share-csv", false, "write the network km and vehicle km per route type, for all agencies and per agency, into <outputfilename>.modeshare.csv")
+	hourlyCsv := flag.String("hourly-csv", "", "write a matrix of the number of departures per route (lines) and hour of day (columns) on this date (YYYYMMDD) into <outputfilename>.hourly.csv")
+	shapeSharingCsv := flag.Bool("shape-sharing-csv", false, "write the number of routes and trips using each shape, and the shapes with identical geometries, into <outputfilename>.shape_sharing.csv")
+	calendarCsv := flag.Bool("calendar-csv", false, "write a matrix of the number of trips per date (lines) and route (columns) into <outputfilename>.calendar.csv")
+	splitDirection := flag.Bool("split-direction", false, "with -r, aggregate the trips of direction 0 and direction 1 separately and write their route shapes into separate files <outputfilename>.dir0.shp and <outputfilename>.dir1.shp")
+	normalizeDirection := flag.Bool("normalize-direction", false, "with -r, orient all route shape variants in the direction of direction_id=0 travel, reversing variants mostly travelled in direction 1")
+	splitModeClasses := flag.Bool("split-mode-classes", false, "with -r, write water, aerial and funicular routes into separate files <outputfilename>.{water,aerial,funicular}.shp")
+	routeOverviewTotals := flag.Bool("route-overview-totals", false, "append total rows per route type and for the whole network to the route overview CSV")
+	around := flag.String("around", "", "only output stops within a circle around a location, given as {lat},{lon},{radius in meters}, like 52.52,13.405,500")
+	aroundRoutes := flag.Bool("around-routes", false, "with -around, also only convert trips (and thus routes) passing through the circle")
+	nearRoute := flag.String("near-route", "", "with -s, only output stops within a distance of a route's geometries, given as {route_id},{meters}")
+	schematic := flag.Bool("schematic", false, "experimental: output an octilinear schematic of the aggregated shapes (will be written into <outputfilename>.schematic.shp)")
+	schematicGrid := flag.Float64("schematic-grid", 0, "grid size of the schematic in units of the output projection, 0 derives it from the network extent")
+	stopEvents := flag.String("stop-events", "", "output a point for every stop time of the given trips (comma separated trip IDs, or * for all trips) into <outputfilename>.stopevents.shp")
+	stopChains := flag.Bool("stop-chains", false, "output one line per route, direction and stop pattern, connecting its consecutive stops with straight segments independent of the shapes (will be written into <outputfilename>.stopchains.shp)")
+	interlines := flag.Bool("interlines", false, "output links between consecutive trips of the same block with their layover times (will be written into <outputfilename>.interlines.shp)")
+	buffers := flag.String("buffers", "", "output one corridor polygon per route covering everything within a distance of its geometries (will be written into <outputfilename>.buffers.shp), given in meters either for all routes or per route type as a comma separated list of {route_type}:{meters}, with * for all other types, like *:300,2:800")
+	corridors := flag.Float64("corridors", 0, "output the network center lines, dissolving the shapes of different routes running within this many meters of each other into single corridor lines with summed frequencies (will be written into <outputfilename>.corridors.shp)")
+	maplibreStyle := flag.String("maplibre-style", "", "write a MapLibre GL style drawing the route shapes in their route colors with line widths per route type into <outputfilename>.style.json. The value is the URL the converted shapes are published at, either a GeoJSON file (.geojson or .json) or vector tiles (a {z}/{x}/{y} URL template, a TileJSON URL or a pmtiles:// URL)")
+	labelPoints := flag.Bool("label-points", false, "output one label anchor point per route variant, at the midpoint along its line (will be written into <outputfilename>.labels.shp)")
+	shapePoints := flag.Bool("shape-points", false, "output every shape vertex as a measured point geometry (will be written into <outputfilename>.shapepoints.shp)")
+	stopLocTypes := flag.String("stop-location-types", "", "stop location types to output with -s, as a comma separated list (0=stop, 1=station, 2=entrance, 3=node, 4=boarding area). Empty keeps all.")
+	elevations := flag.String("elevations", "", "CSV file with shape point elevations (columns shape_id, shape_pt_sequence, shape_pt_elevation), line and shape point layers are written with Z values")
+	force2D := flag.Bool("force-2d", false, "write 2D geometries even if elevations are given, for compatibility with tools not supporting Z values")
+	minServiceDays := flag.Int("min-service-days", 0, "exclude trips whose service operates on fewer than this many days from all outputs and statistics")
+	schoolCalendar := flag.String("exclude-school-trips", "", "CSV file with the school days of the service period (column date as YYYYMMDD, optional column school_day with 1 for school days), trips only operating on school days are excluded from all outputs and statistics")
+	exclusionsCsv := flag.Bool("exclusions-csv", false, "list every trip, route and stop excluded by validation or filters, with the reason, in <outputfilename>.exclusions.csv")
+	tripFilter := flag.String("trip-filter", "", "only convert trips matching this expression over their GTFS attributes (trip_id, headsign, trip_short_name, direction_id, block_id, service_id, shape_id, route_id, route_short_name, route_long_name, route_type, agency_id), in the syntax of -where with ~ for regular expression matches, like 'headsign ~ \"Airport\"'")
+	where := flag.String("where", "", "only write features matching this SQL-like expression over their output attributes, like \"R_Type IN (0,1) AND Frequency > 50\". Layers without all referenced fields are written unfiltered")
+	boundary := flag.String("boundary", "", "GeoJSON file with a boundary polygon (in WGS84), adds the vehicle km inside and outside of it to the route overview CSV")
+	delayCsv := flag.String("delays", "", "CSV file with observed trip delays (columns trip_id, delay in seconds), adds average delay and punctuality to route shapes")
+	headwayWindow := flag.String("headway-window", "", "with -r, add the minimum, maximum and median headway between the departures from the first stop within this service window to the route shapes, given as {YYYYMMDD},{HH:MM}-{HH:MM} in GTFS time, like 20240506,07:00-09:00")
+	punctualityThreshold := flag.Float64("punctuality-threshold", 300, "maximum delay in seconds for a trip observation to count as punctual. Observations more than 60 seconds early never count as punctual")
+	schema := flag.String("schema", "", "output schema version (see SCHEMA.md), either 'v1', 'v2' or 'v3'. Empty selects the latest version")
+	timezone := flag.String("tz", "", "timezone of departure and arrival times in the output (like Europe/Berlin), or 'stop' for the local time of each stop. Empty keeps the agency timezone")
+	sharedTripGeoms := flag.Bool("shared-trip-geoms", false, "with -t, write each distinct trip geometry only once into <outputfilename>.tripgeoms.shp, referenced by the trips via their Geom_id attribute")
+	routeGeometry := flag.String("route-geometry", "", "represent each route by a single feature in the route shapes (-r), label points and buffers, using either its 'longest' variant, its 'most-frequent' variant or the 'union' of all variants. By default, route shapes and label points are written per variant")
+	shapelessTrips := flag.String("shapeless-trips", "straight", "with -t, geometry of trips without a shape, either 'straight' (straight lines between the stops), 'great-circle' (great circle arcs between the stops, densified to 1 km) or 'skip'")
+	missingValues := flag.String("missing-values", "nan", "representation of undefined numeric values, either 'nan', 'empty' (NULL in shapefiles) or '-1'")
+	missingStops := flag.String("missing-stops", "skip", "treatment of stop times referencing stops missing from the feed (with -lenient or -drop-invalid), either 'skip' (connect the neighbouring stops), 'break' (break stop-based geometries at missing stops and stops without coordinates) or 'drop' (drop the affected trips)")
+	nullStops := flag.String("null-stops", "drop", "treatment of stops without coordinates (missing or 0,0), either 'drop', 'parent' (inherit the parent station coordinates, drop if not possible) or 'keep'. Affected stops are listed in <outputfilename>.null_stops.csv")
+	dedupPoints := flag.Bool("dedup-shape-points", true, "remove consecutive duplicate shape points (zero-length segments). Cleaned shapes are listed in <outputfilename>.shape_cleanup.csv")
+	fromStop := flag.String("from-stop", "", "clip the trips of routes to start at this stop, given by stop ID or name. Restrict to a route by prefixing the route ID or short name, like '5:Central'. Separate several entries by ';'")
+	toStop := flag.String("to-stop", "", "clip the trips of routes to end at this stop, given like -from-stop. Trips not serving the stops are dropped")
+	maxSpeed := flag.String("max-speed", "", "report trips with segments between consecutive stops implying a scheduled speed above this limit in km/h, given either for all routes or per route type like -buffers, like *:150,2:350. Affected trips are listed in <outputfilename>.speeding.csv")
+	dropSpeeding := flag.Bool("drop-speeding", false, "with -max-speed, drop the affected trips from all outputs")
+	clampValidity := flag.Bool("clamp-feed-validity", true, "only count service days within the validity window declared in feed_info.txt (feed_start_date, feed_end_date). Services active beyond it are listed in <outputfilename>.feed_validity.csv")
+	normalizeDistUnits := flag.Bool("normalize-dist-units", true, "detect shapes whose shape_dist_traveled values are not given in meters (like kilometers or miles) and convert them and the stop times of their trips to meters. Converted shapes are listed in <outputfilename>.dist_units.csv")
+	snapEndpoints := flag.Float64("snap-endpoints", 0, "trim or extend shapes to start and end exactly at the first and last stop of their trips, if the stop is within this many meters of the shape. Changed shapes are listed in <outputfilename>.shape_snapping.csv. 0 disables snapping")
+	strict := flag.Bool("strict", false, "validate the feed and abort if it contains invalid coordinates or dangling references")
+	lenient := flag.Bool("lenient", false, "skip entities with invalid coordinates or dangling references, with a report. Implies -drop-invalid")
+	ignoreErrors := flag.Bool("ignore-errors", false, "use default values for optional GTFS fields that cannot be parsed instead of aborting")
+	dropInvalid := flag.Bool("drop-invalid", false, "drop erroneous GTFS entities (lines of any file) while parsing instead of aborting, with a report of the dropped entities")
+	idSanitization := flag.String("id-sanitization", "none", "treatment of non-ASCII or overly long trip/route/stop/shape IDs, either 'none', 'sanitize' or 'hash'. Changed IDs are listed in <outputfilename>.ids.csv")
+	maxIDLength := flag.Int("max-id-length", 254, "maximum length of output IDs with -id-sanitization")
+	maxMem := flag.String("max-mem", "", "maximum memory to use, e.g. 512M or 4G. The whole feed is still held in memory: trips are written in batches sharing a shape, and the tool aborts early with an error if the feed cannot be processed within the limit. Empty means no limit")
+	force := flag.Bool("force", false, "replace existing output files")
+	lockWait := flag.Duration("lock-wait", 0, "if another gtfs2shp process is writing outputs with the same basename (guarded by <outputfilename>.lock), wait up to this long for it to finish, like 10m, instead of failing immediately")
+	textOutPath := flag.String("o", "", "write the route overview CSV, the stations CSV or the JSON summary (only one of them may be selected) to this file or named pipe instead of next to the shapefile, - writes to stdout")
+	profile := flag.String("profile", "", "write a CPU ('cpu') or heap ('mem') profile of the run into <outputfilename>.{cpu,mem}.pprof, and print the time spent parsing and writing")
+	configPath := flag.String("c", "", "config file with {option}={value} lines, options can also be set via GTFS2SHP_{OPTION} environment variables")
 
 	flag.Parse()
 
+	if len(*configPath) == 0 {
+		*configPath = os.Getenv(envName("c"))
+	}
+
+	if e := applyDefaults(*configPath); e != nil {
+		fmt.Fprintln(os.Stderr, e)
+		return 1
+	}
+
 	if len(*gtfsPath) == 0 {
 		fmt.Fprintln(os.Stderr, "No GTFS location specified, see --help")
-		os.Exit(1)
+		return 1
+	}
+
+	if *nullStops != "drop" && *nullStops != "parent" && *nullStops != "keep" {
+		fmt.Fprintln(os.Stderr, "Unknown treatment of stops without coordinates", *nullStops)
+		return 1
+	}
+
+	if *strict && *lenient {
+		fmt.Fprintln(os.Stderr, "-strict and -lenient cannot be used together")
+		return 1
+	}
+
+	if *strict && (*ignoreErrors || *dropInvalid) {
+		fmt.Fprintln(os.Stderr, "-strict cannot be used together with -ignore-errors or -drop-invalid")
+		return 1
+	}
+
+	// the validation of -lenient needs the parser to drop erroneous lines
+	if *lenient {
+		*dropInvalid = true
 	}
 
 	for _, pairs := range strings.Split(*routeTypeNameMapping, ";") {
@@ -54,14 +180,14 @@ func main() {
 
 		if len(tupl) != 2 {
 			fmt.Println("Could not read mapping tuple", pairs)
-			os.Exit(1)
+			return 1
 		}
 
 		mot, e := strconv.Atoi(tupl[0])
 
 		if e != nil {
 			fmt.Println(e)
-			os.Exit(1)
+			return 1
 		}
 
 		routeTypeMapping[int16(mot)] = tupl[1]
@@ -74,7 +200,7 @@ func main() {
 
 		if len(tupl) != 2 {
 			fmt.Println("Could not read mapping tuple", pairs)
-			os.Exit(1)
+			return 1
 		}
 
 		outputFldMapping[tupl[0]] = tupl[1]
@@ -88,23 +214,701 @@ func main() {
 		routeAddFlds = append(routeAddFlds, field)
 	}
 
+	if *autoAddRouteFlds {
+		routeAddFlds = append(routeAddFlds, shape.RouteExtensionFlds...)
+	}
+
+	for _, field := range strings.Split(*writeAddTripFlds, ";") {
+		if len(field) == 0 {
+			continue
+		}
+
+		tripAddFlds = append(tripAddFlds, field)
+	}
+
+	for _, field := range strings.Split(*writeAddStopFlds, ";") {
+		if len(field) == 0 {
+			continue
+		}
+
+		stopAddFlds = append(stopAddFlds, field)
+	}
+
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Println("Error:", r)
+			fmt.Fprintln(os.Stderr, "Error:", r)
+			code = 1
 		}
 	}()
 
 	sw := shape.NewShapeWriter(*projection, getMotMap(*mots), outputFldMapping)
 
+	if len(*layerProjections) > 0 {
+		for _, pair := range strings.Split(*layerProjections, ";") {
+			layer, pr, found := strings.Cut(strings.TrimSpace(pair), ":")
+			if !found {
+				fmt.Fprintln(os.Stderr, "Could not read -layer-p value", fmt.Errorf("invalid layer projection '%s', expected {layer}:{projection}", pair))
+				return 1
+			}
+
+			if e := sw.SetLayerProjection(layer, pr); e != nil {
+				fmt.Fprintln(os.Stderr, "Could not read -layer-p value", e)
+				return 1
+			}
+		}
+	}
+
+	if len(*layerMots) > 0 {
+		for _, pair := range strings.Split(*layerMots, ";") {
+			layer, mots, found := strings.Cut(strings.TrimSpace(pair), ":")
+			if !found {
+				fmt.Fprintln(os.Stderr, "Could not read -layer-m value", fmt.Errorf("invalid layer MOTs '%s', expected {layer}:{MOTs}", pair))
+				return 1
+			}
+
+			if e := sw.SetLayerMOTs(layer, getMotMap(mots)); e != nil {
+				fmt.Fprintln(os.Stderr, "Could not read -layer-m value", e)
+				return 1
+			}
+		}
+	}
+
+	writeOpts := shape.WriteOptions{
+		PunctualityThreshold: *punctualityThreshold,
+		StopLocTypes:         getLocTypeMap(*stopLocTypes),
+		OverviewTotals:       *routeOverviewTotals,
+		SplitModeClasses:     *splitModeClasses,
+		SplitDirection:       *splitDirection,
+		NormalizeDirection:   *normalizeDirection,
+		SplitStationsByMode:  *splitStationsByMode,
+		RepresentativeTrips:  *representativeTrips,
+		SharedTripGeoms:      *sharedTripGeoms,
+		TripAddFlds:          tripAddFlds,
+		StopAddFlds:          stopAddFlds,
+		StopNameLangs:        getLangList(*stopNameLangs),
+		SpatialIndex:         *spatialIndex,
+		Force:                *force,
+		ExtentAttrs:          *extentAttrs,
+		RoundCoords:          *precision >= 0,
+		Precision:            *precision,
+		SchematicGrid:        *schematicGrid,
+		Simplify:             *simplify,
+	}
+
+	if len(*delayCsv) > 0 {
+		delays, e := shape.ReadTripDelays(*delayCsv)
+		if e != nil {
+			fmt.Fprintln(os.Stderr, e)
+			return 1
+		}
+		writeOpts.TripDelays = delays
+	}
+
+	var schoolDays shape.SchoolDays
+	if len(*schoolCalendar) > 0 {
+		days, e := shape.ReadSchoolDays(*schoolCalendar)
+		if e != nil {
+			fmt.Fprintln(os.Stderr, e)
+			return 1
+		}
+		schoolDays = days
+	}
+
+	var tripFilterExpr *shape.Where
+	if len(*tripFilter) > 0 {
+		w, e := shape.ParseTripFilter(*tripFilter)
+		if e != nil {
+			fmt.Fprintln(os.Stderr, e)
+			return 1
+		}
+		tripFilterExpr = w
+	}
+
+	if len(*where) > 0 {
+		w, e := shape.ParseWhere(*where)
+		if e != nil {
+			fmt.Fprintln(os.Stderr, e)
+			return 1
+		}
+		writeOpts.Where = w
+	}
+
+	if len(*elevations) > 0 {
+		elevs, e := shape.ReadElevations(*elevations)
+		if e != nil {
+			fmt.Fprintln(os.Stderr, e)
+			return 1
+		}
+		writeOpts.Elevations = elevs
+		writeOpts.Force2D = *force2D
+	}
+
+	if len(*boundary) > 0 {
+		b, e := shape.ReadBoundary(*boundary)
+		if e != nil {
+			fmt.Fprintln(os.Stderr, e)
+			return 1
+		}
+		writeOpts.Boundary = b
+	}
+
+	if len(*around) > 0 {
+		c, e := getCircle(*around)
+		if e != nil {
+			fmt.Fprintln(os.Stderr, "Could not read -around value", e)
+			return 1
+		}
+		writeOpts.Around = c
+	}
+
+	if len(*nearRoute) > 0 {
+		sep := strings.LastIndex(*nearRoute, ",")
+		if sep < 0 {
+			fmt.Fprintln(os.Stderr, "Could not read -near-route value", *nearRoute)
+			return 1
+		}
+
+		dist, e := strconv.ParseFloat((*nearRoute)[sep+1:], 64)
+		if e != nil {
+			fmt.Fprintln(os.Stderr, "Could not read -near-route distance", e)
+			return 1
+		}
+
+		writeOpts.NearRoute = (*nearRoute)[:sep]
+		writeOpts.NearRouteDist = dist
+	}
+
+	if len(*buffers) > 0 {
+		def, widths, e := getRouteTypeValues(*buffers, "buffer width", "meters")
+		if e != nil {
+			fmt.Fprintln(os.Stderr, "Could not read -buffers value", e)
+			return 1
+		}
+
+		writeOpts.BufferWidth = def
+		writeOpts.BufferWidths = widths
+	}
+
+	if *corridors < 0 {
+		fmt.Fprintln(os.Stderr, "-corridors must not be negative")
+		return 1
+	}
+	writeOpts.CorridorTolerance = *corridors
+
+	speedLimit := 0.0
+	var speedLimits map[int16]float64
+
+	if len(*maxSpeed) > 0 {
+		var e error
+		speedLimit, speedLimits, e = getRouteTypeValues(*maxSpeed, "speed", "km/h")
+		if e != nil {
+			fmt.Fprintln(os.Stderr, "Could not read -max-speed value", e)
+			return 1
+		}
+	}
+
+	switch *missingValues {
+	case "nan":
+		writeOpts.MissingValues = shape.MissingNaN
+	case "empty":
+		writeOpts.MissingValues = shape.MissingEmpty
+	case "-1":
+		writeOpts.MissingValues = shape.MissingMinusOne
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown missing value representation", *missingValues)
+		return 1
+	}
+
+	if len(*dictionary) > 0 && *dictionary != "json" && *dictionary != "csv" {
+		fmt.Fprintln(os.Stderr, "Unknown dictionary format", *dictionary)
+		return 1
+	}
+
+	if len(*timezone) > 0 && *timezone != shape.StopTimezones {
+		if _, e := time.LoadLocation(*timezone); e != nil {
+			fmt.Fprintln(os.Stderr, "Unknown timezone", *timezone)
+			return 1
+		}
+	}
+	writeOpts.Timezone = *timezone
+
+	switch *shapelessTrips {
+	case "straight":
+		writeOpts.ShapelessTrips = shape.ShapelessStraight
+	case "great-circle":
+		writeOpts.ShapelessTrips = shape.ShapelessGreatCircle
+	case "skip":
+		writeOpts.ShapelessTrips = shape.ShapelessSkip
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown shapeless trip geometry", *shapelessTrips)
+		return 1
+	}
+
+	switch *routeGeometry {
+	case "":
+		writeOpts.RouteGeometry = shape.RouteGeomVariants
+	case "longest":
+		writeOpts.RouteGeometry = shape.RouteGeomLongest
+	case "most-frequent":
+		writeOpts.RouteGeometry = shape.RouteGeomMostFrequent
+	case "union":
+		writeOpts.RouteGeometry = shape.RouteGeomUnion
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown route geometry", *routeGeometry)
+		return 1
+	}
+
+	switch *missingStops {
+	case "skip":
+		writeOpts.MissingStops = shape.MissingStopsSkip
+	case "break":
+		writeOpts.MissingStops = shape.MissingStopsBreak
+	case "drop":
+		writeOpts.MissingStops = shape.MissingStopsDrop
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown treatment of missing stops", *missingStops)
+		return 1
+	}
+
+	switch *idSanitization {
+	case "none":
+		writeOpts.IDSanitization = shape.IDKeep
+	case "sanitize":
+		writeOpts.IDSanitization = shape.IDSanitize
+	case "hash":
+		writeOpts.IDSanitization = shape.IDHash
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown ID sanitization", *idSanitization)
+		return 1
+	}
+	writeOpts.MaxIDLength = *maxIDLength
+
+	switch *schema {
+	case "":
+	case "v1":
+		writeOpts.Schema = 1
+	case "v2":
+		writeOpts.Schema = 2
+	case "v3":
+		writeOpts.Schema = 3
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown schema version", *schema)
+		return 1
+	}
+
+	if len(*headwayWindow) > 0 {
+		win, e := getHeadwayWindow(*headwayWindow)
+		if e != nil {
+			fmt.Fprintln(os.Stderr, "Could not read -headway-window value", e)
+			return 1
+		}
+		writeOpts.HeadwayWindow = win
+	}
+
+	var hourlyDate gtfs.Date
+	if len(*hourlyCsv) > 0 {
+		d, e := getDate(*hourlyCsv)
+		if e != nil {
+			fmt.Fprintln(os.Stderr, e)
+			return 1
+		}
+		hourlyDate = d
+	}
+
+	for _, date := range strings.Split(*holidays, ",") {
+		if len(date) == 0 {
+			continue
+		}
+
+		d, e := getDate(date)
+		if e != nil {
+			fmt.Fprintln(os.Stderr, e)
+			return 1
+		}
+
+		if writeOpts.Holidays == nil {
+			writeOpts.Holidays = make(map[gtfs.Date]bool)
+		}
+		writeOpts.Holidays[d] = true
+	}
+
+	var routeTypeMap *shape.RouteTypeMap
+	if len(*routeTypeFile) > 0 {
+		m, e := shape.ReadRouteTypeMap(*routeTypeFile)
+		if e != nil {
+			fmt.Fprintln(os.Stderr, e)
+			return 1
+		}
+		routeTypeMap = m
+	}
+
+	if strings.HasSuffix(*routeGroups, ".csv") {
+		groups, e := shape.ReadRouteGroups(*routeGroups)
+		if e != nil {
+			fmt.Fprintln(os.Stderr, e)
+			return 1
+		}
+		writeOpts.RouteGroups = groups
+	} else {
+		writeOpts.RouteGroupField = *routeGroups
+	}
+
+	if len(*maxMem) > 0 {
+		limit, e := parseByteSize(*maxMem)
+		if e != nil {
+			fmt.Fprintln(os.Stderr, e)
+			return 1
+		}
+
+		if limit > 0 {
+			// make the garbage collector work harder near the limit
+			debug.SetMemoryLimit(int64(limit))
+			writeOpts.MaxMem = limit
+		}
+	}
+
+	if len(*incremental) > 0 {
+		prev, e := shape.ReadSummaryJSON(*incremental)
+		if e != nil && !os.IsNotExist(e) {
+			fmt.Fprintln(os.Stderr, e)
+			return 1
+		}
+
+		writeOpts.Incremental = true
+		writeOpts.PrevLayers = prev
+		*summary = true
+	}
+
+	// the CSV files written here may be replaced like the layers
+	replace := *force || writeOpts.Incremental
+
+	// status messages go to stderr if stdout is used for output
+	msgOut := io.Writer(os.Stdout)
+	var textOut io.WriteCloser
+
+	if len(*textOutPath) > 0 {
+		if boolCount(*writeRouteOverviewCsv, *stationsCsv, *summary) != 1 {
+			fmt.Fprintln(os.Stderr, "-o requires exactly one of -write-route-overview-csv, -stations-csv and -summary")
+			return 1
+		}
+
+		if *textOutPath == "-" {
+			msgOut = os.Stderr
+		}
+	}
+
+	sw.SetWriteOpts(writeOpts)
+
+	// no output may be touched before the lock is held
+	unlock, e := acquireLock(*shapeFilePath, *lockWait)
+	if e != nil {
+		fmt.Fprintln(os.Stderr, e)
+		return 1
+	}
+	defer unlock()
+
+	if len(*textOutPath) > 0 {
+		textOut, e = openOutput(*textOutPath, *force)
+		if e != nil {
+			fmt.Fprintln(os.Stderr, e)
+			return 1
+		}
+		defer textOut.Close()
+	}
+
+	if len(*profile) > 0 {
+		stop, e := startProfile(*profile, strings.TrimSuffix(*shapeFilePath, filepath.Ext(*shapeFilePath))+"."+*profile+".pprof")
+		if e != nil {
+			fmt.Fprintln(os.Stderr, e)
+			return 1
+		}
+		defer stop()
+	}
+
+	start := time.Now()
+
+	feedPath := *gtfsPath
+	removeFeed := func() {}
+	if isRemotePath(*gtfsPath) {
+		local, cleanup, e := fetchRemoteFeed(*gtfsPath)
+		if e != nil {
+			fmt.Fprintln(os.Stderr, e)
+			return 1
+		}
+		feedPath = local
+		removeFeed = cleanup
+	}
+
+	if writeOpts.MaxMem > 0 {
+		estimate, e := estimateFeedMem(feedPath)
+		if e == nil && estimate > writeOpts.MaxMem {
+			removeFeed()
+			fmt.Fprintf(os.Stderr, "Feed in '%s' needs an estimated %d MB of memory, exceeding the limit of %d MB\n", *gtfsPath, estimate>>20, writeOpts.MaxMem>>20)
+			return 1
+		}
+	}
+
 	feed := gtfsparser.NewFeed()
-	feed.SetParseOpts(gtfsparser.ParseOptions{false, false, false, false, "", false, false, false, len(routeAddFlds) > 0, gtfs.Date{}, gtfs.Date{}, make([]gtfsparser.Polygon, 0), false, make(map[int16]bool, 0), make(map[int16]bool, 0), false, false, false, false})
-	e := feed.Parse(*gtfsPath)
+	parseOpts := shape.ParseOptions(writeOpts, routeAddFlds)
+	parseOpts.UseDefValueOnError = *ignoreErrors
+	parseOpts.DropErroneous = *dropInvalid
+	feed.SetParseOpts(parseOpts)
+	e = feed.Parse(feedPath)
+	parsed := time.Now()
+
+	// the downloaded copy of a remote feed is no longer needed
+	removeFeed()
 
 	if e != nil {
 		fmt.Fprintf(os.Stderr, "Error while parsing GTFS feed in '%s':\n ", *gtfsPath)
 		fmt.Fprintf(os.Stderr, e.Error())
-		os.Exit(1)
+		return 1
 	} else {
+		if writeOpts.MaxMem > 0 {
+			runtime.GC()
+
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+
+			if stats.HeapAlloc > writeOpts.MaxMem {
+				fmt.Fprintf(os.Stderr, "Parsed feed needs %d MB of memory, exceeding the limit of %d MB\n", stats.HeapAlloc>>20, writeOpts.MaxMem>>20)
+				return 1
+			}
+		}
+
+		// warnings are also listed in the conversion report
+		warnings := make([]string, 0)
+		warn := func(format string, a ...interface{}) {
+			msg := fmt.Sprintf(format, a...)
+			fmt.Fprintln(os.Stderr, msg)
+			warnings = append(warnings, strings.TrimSuffix(msg, ":"))
+		}
+
+		if dropped := droppedEntities(feed.ErrorStats); len(dropped) > 0 {
+			fmt.Fprintln(os.Stderr, "Dropped erroneous entities while parsing:")
+			for _, d := range dropped {
+				fmt.Fprintf(os.Stderr, " %s\n", d)
+			}
+			warnings = append(warnings, "Dropped erroneous entities while parsing: "+strings.Join(dropped, ", "))
+		}
+
+		var excl *exclusionLog
+		if *exclusionsCsv {
+			excl = newExclusionLog(feed)
+		}
+
+		if routeTypeMap != nil {
+			changed := shape.ReclassifyRouteTypes(feed, routeTypeMap)
+			issues := make([]validationIssue, 0, len(changed))
+			for id, change := range changed {
+				issues = append(issues, validationIssue{"route", id, change})
+			}
+			sort.Slice(issues, func(i, j int) bool { return issues[i].id < issues[j].id })
+
+			if len(issues) > 0 {
+				warn("Reclassified the route type of %d routes:", len(issues))
+				printIssues(os.Stderr, issues)
+			}
+
+			if e := writeQaCsv(*shapeFilePath, ".route_types.csv", issues, replace); e != nil {
+				fmt.Fprintln(os.Stderr, e)
+				return 1
+			}
+		}
+
+		if *clampValidity {
+			clamped := shape.ClampToFeedValidity(feed)
+			issues := make([]validationIssue, 0, len(clamped))
+			for id, change := range clamped {
+				issues = append(issues, validationIssue{"service", id, change})
+			}
+			sort.Slice(issues, func(i, j int) bool { return issues[i].id < issues[j].id })
+
+			if len(issues) > 0 {
+				start, end := shape.FeedValidity(feed)
+				warn("Clamped %d services extending beyond the feed validity (%s to %s):", len(issues), dateString(start), dateString(end))
+				printIssues(os.Stderr, issues)
+			}
+
+			if e := writeQaCsv(*shapeFilePath, ".feed_validity.csv", issues, replace); e != nil {
+				fmt.Fprintln(os.Stderr, e)
+				return 1
+			}
+		}
+
+		if *strict || *lenient {
+			issues := validateFeed(feed, *lenient)
+
+			if len(issues) > 0 && *strict {
+				fmt.Fprintf(os.Stderr, "Feed validation failed with %d issues:\n", len(issues))
+				printIssues(os.Stderr, issues)
+				return 1
+			} else if len(issues) > 0 {
+				warn("Skipped %d invalid entities:", len(issues))
+				printIssues(os.Stderr, issues)
+			}
+
+			excl.update(feed, "invalid", issues)
+		}
+
+		if stats := sw.HandleMissingStops(feed); stats.Trips > 0 {
+			if stats.DroppedTrips > 0 {
+				warn("Dropped %d trips with %d stop times referencing missing stops", stats.DroppedTrips, stats.StopTimes)
+			} else {
+				warn("Removed %d stop times referencing missing stops from %d trips", stats.StopTimes, stats.Trips)
+			}
+		}
+		excl.update(feed, "references missing stops", nil)
+
+		// prefix patterns are expanded to the fields present in the feed
+		routeAddFlds = shape.ExpandAddFlds(feed.RoutesAddFlds, routeAddFlds)
+
+		if tripFilterExpr != nil {
+			shape.FilterTrips(feed, tripFilterExpr)
+			excl.update(feed, "not matching -trip-filter", nil)
+		}
+
+		if writeOpts.Around != nil && *aroundRoutes {
+			if n := shape.FilterTripsAround(feed, writeOpts.Around); n > 0 {
+				warn("Excluded %d trips not passing through the -around circle", n)
+			}
+			excl.update(feed, "not passing through -around", nil)
+		}
+
+		if *minServiceDays > 0 || schoolDays != nil {
+			rare, school := shape.ExcludeSpecialTrips(feed, *minServiceDays, schoolDays)
+
+			if rare > 0 {
+				warn("Excluded %d trips operating on fewer than %d days", rare, *minServiceDays)
+			}
+			if school > 0 {
+				warn("Excluded %d trips only operating on school days", school)
+			}
+
+			excl.update(feed, "operating on too few days or only on school days", nil)
+		}
+
+		if *nullStops != "keep" {
+			issues := handleNullStops(feed, *nullStops == "parent")
+
+			if len(issues) > 0 {
+				warn("Found %d stops without coordinates:", len(issues))
+				printIssues(os.Stderr, issues)
+			}
+
+			if e := writeQaCsv(*shapeFilePath, ".null_stops.csv", issues, replace); e != nil {
+				fmt.Fprintln(os.Stderr, e)
+				return 1
+			}
+
+			excl.update(feed, "no coordinates", issues)
+		}
+
+		if *dedupPoints {
+			issues := dedupShapePoints(feed)
+
+			if len(issues) > 0 {
+				warn("Removed duplicate points from %d shapes:", len(issues))
+				printIssues(os.Stderr, issues)
+			}
+
+			if e := writeQaCsv(*shapeFilePath, ".shape_cleanup.csv", issues, replace); e != nil {
+				fmt.Fprintln(os.Stderr, e)
+				return 1
+			}
+		}
+
+		if *normalizeDistUnits {
+			converted := shape.NormalizeShapeDistUnits(feed)
+			issues := make([]validationIssue, 0, len(converted))
+			for id, change := range converted {
+				issues = append(issues, validationIssue{"shape", id, change})
+			}
+			sort.Slice(issues, func(i, j int) bool { return issues[i].id < issues[j].id })
+
+			if len(issues) > 0 {
+				warn("Converted the shape_dist_traveled values of %d shapes to meters:", len(issues))
+				printIssues(os.Stderr, issues)
+			}
+
+			if e := writeQaCsv(*shapeFilePath, ".dist_units.csv", issues, replace); e != nil {
+				fmt.Fprintln(os.Stderr, e)
+				return 1
+			}
+		}
+
+		if *snapEndpoints > 0 {
+			snapped := shape.SnapShapeEndpoints(feed, *snapEndpoints)
+			issues := make([]validationIssue, 0, len(snapped))
+			for id, change := range snapped {
+				issues = append(issues, validationIssue{"shape", id, change})
+			}
+			sort.Slice(issues, func(i, j int) bool { return issues[i].id < issues[j].id })
+
+			if len(issues) > 0 {
+				warn("Snapped the endpoints of %d shapes to their terminal stops:", len(issues))
+				printIssues(os.Stderr, issues)
+			}
+
+			if e := writeQaCsv(*shapeFilePath, ".shape_snapping.csv", issues, replace); e != nil {
+				fmt.Fprintln(os.Stderr, e)
+				return 1
+			}
+		}
+
+		if len(*maxSpeed) > 0 {
+			speeding := shape.FindSpeeding(feed, speedLimit, speedLimits, *dropSpeeding)
+			issues := make([]validationIssue, 0, len(speeding))
+			for id, desc := range speeding {
+				issues = append(issues, validationIssue{"trip", id, desc})
+			}
+			sort.Slice(issues, func(i, j int) bool { return issues[i].id < issues[j].id })
+
+			if len(issues) > 0 {
+				if *dropSpeeding {
+					warn("Dropped %d trips with implausible speeds:", len(issues))
+				} else {
+					warn("Found %d trips with implausible speeds:", len(issues))
+				}
+				printIssues(os.Stderr, issues)
+			}
+
+			if e := writeQaCsv(*shapeFilePath, ".speeding.csv", issues, replace); e != nil {
+				fmt.Fprintln(os.Stderr, e)
+				return 1
+			}
+
+			excl.update(feed, "implausible speed", issues)
+		}
+
+		if len(*fromStop) > 0 || len(*toStop) > 0 {
+			ranges, e := shape.ParseStopRanges(feed, *fromStop, *toStop)
+			if e != nil {
+				fmt.Fprintln(os.Stderr, "Could not read -from-stop or -to-stop value", e)
+				return 1
+			}
+
+			if clipped, dropped := sw.ClipToStopRanges(feed, ranges); clipped+dropped > 0 {
+				warn("Clipped %d trips to their stop range, dropped %d trips not serving it", clipped, dropped)
+			}
+			excl.update(feed, "not serving -from-stop or -to-stop", nil)
+		}
+
+		excl.updateMOTs(feed, getMotMap(*mots))
+		if excl != nil {
+			exclFile := strings.TrimSuffix(*shapeFilePath, filepath.Ext(*shapeFilePath)) + ".exclusions.csv"
+			num, e := excl.write(exclFile, replace)
+			if e != nil {
+				fmt.Fprintln(os.Stderr, e)
+				return 1
+			}
+			if num > 0 {
+				warn("Excluded %d entities, listed in %s", num, exclFile)
+			}
+		}
+
+		sw.MapIDs(feed)
+
 		n := 0
 
 		if *tripsExplicit {
@@ -115,17 +919,118 @@ func main() {
 			n += sw.WriteShapes(feed, *shapeFilePath)
 		}
 
-		if *writeRouteOverviewCsv {
+		if *writeRouteOverviewCsv && textOut != nil {
+			sw.WriteRouteOverviewCsvTo(feed, routeTypeMapping, routeAddFlds, textOut)
+		} else if *writeRouteOverviewCsv {
 			sw.WriteRouteOverviewCsv(feed, routeTypeMapping, routeAddFlds, *shapeFilePath)
 		}
 
+		if *calendarCsv {
+			sw.WriteCalendarCsv(feed, *shapeFilePath)
+		}
+
+		if len(*hourlyCsv) > 0 {
+			sw.WriteHourlyCsv(feed, hourlyDate, *shapeFilePath)
+		}
+
+		if *shapeSharingCsv {
+			sw.WriteShapeSharingCsv(feed, *shapeFilePath)
+		}
+
+		if *modeShareCsv {
+			sw.WriteModeShareCsv(feed, routeTypeMapping, *shapeFilePath)
+		}
+
 		// write stations if requested
 		if *stations {
 			n += sw.WriteStops(feed, *shapeFilePath)
 		}
 
-		fmt.Printf("Written %d geometries.\n", n)
+		if *stationsCsv && textOut != nil {
+			sw.WriteStopsCsvTo(feed, textOut)
+		} else if *stationsCsv {
+			sw.WriteStopsCsv(feed, *shapeFilePath)
+		}
+
+		if *schematic {
+			n += sw.WriteSchematic(feed, *shapeFilePath)
+		}
+
+		if len(*stopEvents) > 0 {
+			tripIDs := make(map[string]bool)
+			if *stopEvents != "*" {
+				for _, id := range strings.Split(*stopEvents, ",") {
+					tripIDs[id] = true
+				}
+			}
+			n += sw.WriteStopEvents(feed, tripIDs, *shapeFilePath)
+		}
+
+		if *labelPoints {
+			n += sw.WriteLabelPoints(feed, *shapeFilePath)
+		}
+
+		if *stopChains {
+			n += sw.WriteStopChains(feed, *shapeFilePath)
+		}
+
+		if *interlines {
+			n += sw.WriteInterlines(feed, *shapeFilePath)
+		}
+
+		if len(*buffers) > 0 {
+			n += sw.WriteBuffers(feed, *shapeFilePath)
+		}
+
+		if *corridors > 0 {
+			n += sw.WriteCorridors(feed, *shapeFilePath)
+		}
+
+		if len(*maplibreStyle) > 0 {
+			sw.WriteStyle(feed, *maplibreStyle, *shapeFilePath)
+		}
+
+		// write shape points if requested
+		if *shapePoints {
+			n += sw.WriteShapePoints(feed, *shapeFilePath)
+		}
+
+		if writeOpts.IDSanitization != shape.IDKeep {
+			sw.WriteIDMapCsv(*shapeFilePath)
+		}
+
+		if *summary && textOut != nil {
+			sw.WriteSummaryJSONTo(textOut)
+		} else if *summary {
+			sw.WriteSummaryJSON(*shapeFilePath)
+		}
+
+		if len(*dictionary) > 0 {
+			sw.WriteDictionary(*shapeFilePath, *dictionary)
+		}
+
+		if *metadata {
+			sw.WriteMetadata(feed, strings.Join(os.Args[1:], " "))
+		}
+
+		if *report {
+			sw.WriteReport(feed, routeTypeMapping, warnings, *shapeFilePath)
+		}
+
+		if writeOpts.Incremental {
+			for _, layer := range sw.Layers() {
+				fmt.Fprintf(msgOut, "%s: %s\n", layer.File, layer.Status)
+			}
+		}
+
+		fmt.Fprintf(msgOut, "Written %d geometries.\n", n-sw.Filtered())
+
+		if len(*profile) > 0 {
+			fmt.Fprintf(os.Stderr, "Parsing took %s, writing took %s.\n", parsed.Sub(start), time.Since(parsed))
+		}
 	}
+
+	return 0
 }
 
 func getMotMap(motList string) map[int16]bool {
@@ -142,3 +1047,190 @@ func getMotMap(motList string) map[int16]bool {
 
 	return ret
 }
+
+func getLocTypeMap(locTypeList string) map[int8]bool {
+	arr := strings.Split(locTypeList, ",")
+
+	ret := map[int8]bool{}
+
+	for _, a := range arr {
+		i, err := strconv.Atoi(a)
+		if err == nil && i >= 0 && i < 5 {
+			ret[int8(i)] = true
+		}
+	}
+
+	return ret
+}
+
+func getLangList(langList string) []string {
+	ret := make([]string, 0)
+
+	for _, a := range strings.Split(langList, ",") {
+		if a = strings.TrimSpace(a); len(a) > 0 {
+			ret = append(ret, a)
+		}
+	}
+
+	return ret
+}
+
+// parse values per route type like buffer widths, given either as a
+// single value, or as {route_type}:{unit} pairs with * for the default
+// value. what names the value and unit its unit in error messages
+func getRouteTypeValues(str string, what string, unit string) (float64, map[int16]float64, error) {
+	if w, err := strconv.ParseFloat(str, 64); err == nil {
+		return w, nil, nil
+	}
+
+	def := 0.0
+	ret := make(map[int16]float64)
+
+	for _, pair := range strings.Split(str, ",") {
+		typ, val, found := strings.Cut(pair, ":")
+		if !found {
+			return 0, nil, fmt.Errorf("invalid %s '%s', expected {route_type}:{%s}", what, pair, unit)
+		}
+
+		w, err := strconv.ParseFloat(val, 64)
+		if err != nil || w < 0 {
+			return 0, nil, fmt.Errorf("invalid %s '%s'", what, val)
+		}
+
+		if typ == "*" {
+			def = w
+			continue
+		}
+
+		t, err := strconv.ParseInt(typ, 10, 16)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid route type '%s'", typ)
+		}
+		ret[int16(t)] = w
+	}
+
+	return def, ret, nil
+}
+
+func getDate(str string) (gtfs.Date, error) {
+	t, err := time.Parse("20060102", str)
+
+	if err != nil {
+		return gtfs.Date{}, fmt.Errorf("invalid date '%s', expected YYYYMMDD", str)
+	}
+
+	return gtfs.NewDate(uint8(t.Day()), uint8(t.Month()), uint16(t.Year())), nil
+}
+
+// parse a circle like 52.52,13.405,500
+func getCircle(str string) (*shape.Circle, error) {
+	parts := strings.Split(str, ",")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid circle '%s', expected {lat},{lon},{radius in meters}", str)
+	}
+
+	vals := make([]float64, 3)
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid circle '%s', expected {lat},{lon},{radius in meters}", str)
+		}
+		vals[i] = v
+	}
+
+	if !validCoord(vals[0], vals[1]) {
+		return nil, fmt.Errorf("invalid center %f,%f", vals[0], vals[1])
+	}
+	if vals[2] <= 0 {
+		return nil, fmt.Errorf("radius must be positive")
+	}
+
+	return &shape.Circle{Lat: vals[0], Lon: vals[1], Radius: vals[2]}, nil
+}
+
+// format a date as YYYY-MM-DD, or "open" if it is empty
+func dateString(d gtfs.Date) string {
+	if d.IsEmpty() {
+		return "open"
+	}
+	return fmt.Sprintf("%04d-%02d-%02d", d.Year(), d.Month(), d.Day())
+}
+
+// parse a service window like 20240506,07:00-09:00. Times may exceed
+// 24:00 for service after midnight
+func getHeadwayWindow(str string) (*shape.HeadwayWindow, error) {
+	date, times, found := strings.Cut(str, ",")
+	from, to, found2 := strings.Cut(times, "-")
+	if !found || !found2 {
+		return nil, fmt.Errorf("invalid service window '%s', expected {YYYYMMDD},{HH:MM}-{HH:MM}", str)
+	}
+
+	d, err := getDate(strings.TrimSpace(date))
+	if err != nil {
+		return nil, err
+	}
+
+	secs := func(t string) (int, error) {
+		h, m, ok := strings.Cut(strings.TrimSpace(t), ":")
+		hour, err := strconv.Atoi(h)
+		if !ok || err != nil || hour < 0 {
+			return 0, fmt.Errorf("invalid time '%s', expected HH:MM", t)
+		}
+		minute, err := strconv.Atoi(m)
+		if err != nil || minute < 0 || minute > 59 {
+			return 0, fmt.Errorf("invalid time '%s', expected HH:MM", t)
+		}
+		return hour*3600 + minute*60, nil
+	}
+
+	start, err := secs(from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := secs(to)
+	if err != nil {
+		return nil, err
+	}
+	if end <= start {
+		return nil, fmt.Errorf("service window '%s' ends before it starts", str)
+	}
+
+	return &shape.HeadwayWindow{Date: d, Start: start, End: end}, nil
+}
+
+// return the number of true values
+func boolCount(vals ...bool) int {
+	n := 0
+	for _, v := range vals {
+		if v {
+			n++
+		}
+	}
+	return n
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// open a text output, - is stdout. Existing regular files are only
+// replaced if force is set, named pipes and devices are always opened
+func openOutput(path string, force bool) (io.WriteCloser, error) {
+	if path == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+
+	return createOutput(path, force)
+}
+
+// create an output file. Existing regular files are only replaced if
+// replace is set
+func createOutput(path string, replace bool) (*os.File, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() && !replace {
+		return nil, fmt.Errorf("output file %s already exists", path)
+	}
+
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+}
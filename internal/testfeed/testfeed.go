@@ -0,0 +1,303 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+// Package testfeed programmatically builds small synthetic GTFS feeds
+// for tests and benchmarks
+package testfeed
+
+import (
+	"bufio"
+	"encoding/csv"
+	"github.com/patrickbr/gtfsparser"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// primary key columns of the GTFS files, used to address rows by ID
+var keys = map[string]string{
+	"agency.txt":   "agency_id",
+	"stops.txt":    "stop_id",
+	"routes.txt":   "route_id",
+	"trips.txt":    "trip_id",
+	"calendar.txt": "service_id",
+}
+
+// a GTFS file under construction
+type table struct {
+	cols []string
+	rows []map[string]string
+}
+
+// Builder builds a GTFS feed. All methods return the builder for
+// chaining, fields not given are left empty
+type Builder struct {
+	tables map[string]*table
+	files  []string
+}
+
+// StopTime is a stop of a trip, with its arrival and departure times as
+// GTFS times like 08:15:00. Empty times are interpolated by the parser
+type StopTime struct {
+	Stop string
+	Arr  string
+	Dep  string
+	Dist string // shape_dist_traveled, may be empty
+}
+
+// At returns a stop time at stop with equal arrival and departure
+func At(stop string, time string) StopTime {
+	return StopTime{Stop: stop, Arr: time, Dep: time}
+}
+
+// New returns a builder for a feed with a single agency "agency" in the
+// timezone Europe/Berlin
+func New() *Builder {
+	b := &Builder{tables: make(map[string]*table)}
+	return b.Agency("agency", "Test Transit", "Europe/Berlin")
+}
+
+// Add adds a row with the given fields to file
+func (b *Builder) Add(file string, fields map[string]string) *Builder {
+	t, ok := b.tables[file]
+	if !ok {
+		t = &table{}
+		b.tables[file] = t
+		b.files = append(b.files, file)
+	}
+
+	row := make(map[string]string, len(fields))
+	for col, val := range fields {
+		row[col] = val
+	}
+	t.rows = append(t.rows, row)
+
+	t.addCols(fields)
+
+	return b
+}
+
+// Set sets field to val in the row of file with the given ID, like the
+// block_id of a trip or the wheelchair_boarding of a stop
+func (b *Builder) Set(file string, id string, field string, val string) *Builder {
+	t, ok := b.tables[file]
+	if !ok {
+		panic("testfeed: no rows in " + file)
+	}
+
+	// search backwards, rows are usually set right after they were added
+	for i := len(t.rows) - 1; i >= 0; i-- {
+		row := t.rows[i]
+		if row[keys[file]] == id {
+			row[field] = val
+			t.addCols(map[string]string{field: val})
+			return b
+		}
+	}
+
+	panic("testfeed: no row " + id + " in " + file)
+}
+
+// Agency adds an agency
+func (b *Builder) Agency(id string, name string, tz string) *Builder {
+	return b.Add("agency.txt", map[string]string{
+		"agency_id":       id,
+		"agency_name":     name,
+		"agency_url":      "http://example.com/" + id,
+		"agency_timezone": tz,
+	})
+}
+
+// Stop adds a stop (location type 0)
+func (b *Builder) Stop(id string, name string, lat float64, lon float64) *Builder {
+	return b.Add("stops.txt", map[string]string{
+		"stop_id":   id,
+		"stop_name": name,
+		"stop_lat":  formatFloat(lat),
+		"stop_lon":  formatFloat(lon),
+	})
+}
+
+// Station adds a station (location type 1) and makes it the parent
+// station of the given stops
+func (b *Builder) Station(id string, name string, lat float64, lon float64, children ...string) *Builder {
+	b.Stop(id, name, lat, lon).Set("stops.txt", id, "location_type", "1")
+	for _, child := range children {
+		b.Set("stops.txt", child, "parent_station", id)
+	}
+	return b
+}
+
+// Route adds a route of the given route type operated by the first agency
+func (b *Builder) Route(id string, shortName string, routeType int) *Builder {
+	return b.Add("routes.txt", map[string]string{
+		"route_id":         id,
+		"agency_id":        b.tables["agency.txt"].rows[0]["agency_id"],
+		"route_short_name": shortName,
+		"route_type":       strconv.Itoa(routeType),
+	})
+}
+
+// Calendar adds a weekly service. days gives the operation days from
+// monday to sunday, like "1111100" for weekdays; start and end are GTFS
+// dates like 20240101
+func (b *Builder) Calendar(id string, days string, start string, end string) *Builder {
+	row := map[string]string{"service_id": id, "start_date": start, "end_date": end}
+	for i, day := range []string{"monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday"} {
+		row[day] = days[i : i+1]
+	}
+	return b.Add("calendar.txt", row)
+}
+
+// CalendarDate adds (exceptionType 1) or removes (exceptionType 2) a
+// service date
+func (b *Builder) CalendarDate(service string, date string, exceptionType int) *Builder {
+	return b.Add("calendar_dates.txt", map[string]string{
+		"service_id":     service,
+		"date":           date,
+		"exception_type": strconv.Itoa(exceptionType),
+	})
+}
+
+// Shape adds a shape through the given lat, lon points, with the
+// distance traveled given as the index of each point
+func (b *Builder) Shape(id string, points ...[2]float64) *Builder {
+	for i, p := range points {
+		b.Add("shapes.txt", map[string]string{
+			"shape_id":            id,
+			"shape_pt_lat":        formatFloat(p[0]),
+			"shape_pt_lon":        formatFloat(p[1]),
+			"shape_pt_sequence":   strconv.Itoa(i),
+			"shape_dist_traveled": strconv.Itoa(i),
+		})
+	}
+	return b
+}
+
+// Trip adds a trip of route on service along shape (may be empty),
+// stopping at stops
+func (b *Builder) Trip(id string, route string, service string, shape string, stops ...StopTime) *Builder {
+	b.Add("trips.txt", map[string]string{
+		"trip_id":    id,
+		"route_id":   route,
+		"service_id": service,
+		"shape_id":   shape,
+	})
+
+	for i, st := range stops {
+		b.Add("stop_times.txt", map[string]string{
+			"trip_id":             id,
+			"stop_id":             st.Stop,
+			"stop_sequence":       strconv.Itoa(i),
+			"arrival_time":        st.Arr,
+			"departure_time":      st.Dep,
+			"shape_dist_traveled": st.Dist,
+		})
+	}
+
+	return b
+}
+
+// Frequency adds a frequency-based service to trip between start and
+// end, given as GTFS times
+func (b *Builder) Frequency(trip string, start string, end string, headway int, exact bool) *Builder {
+	exactTimes := "0"
+	if exact {
+		exactTimes = "1"
+	}
+	return b.Add("frequencies.txt", map[string]string{
+		"trip_id":      trip,
+		"start_time":   start,
+		"end_time":     end,
+		"headway_secs": strconv.Itoa(headway),
+		"exact_times":  exactTimes,
+	})
+}
+
+// Write writes the feed as GTFS text files into dir
+func (b *Builder) Write(dir string) error {
+	for _, file := range b.files {
+		if err := b.tables[file].write(filepath.Join(dir, file)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Feed writes the feed into a temporary directory and returns it parsed,
+// with additional fields kept. t fails if the feed cannot be parsed
+func (b *Builder) Feed(t testing.TB) *gtfsparser.Feed {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := b.Write(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	feed := gtfsparser.NewFeed()
+	feed.SetParseOpts(gtfsparser.ParseOptions{KeepAddFlds: true})
+	if err := feed.Parse(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	return feed
+}
+
+// add columns not yet present in the table, in alphabetical order
+func (t *table) addCols(fields map[string]string) {
+	cols := make([]string, 0)
+	for col := range fields {
+		found := false
+		for _, c := range t.cols {
+			found = found || c == col
+		}
+		if !found {
+			cols = append(cols, col)
+		}
+	}
+
+	sort.Strings(cols)
+	t.cols = append(t.cols, cols...)
+}
+
+// write the table as a CSV file into path
+func (t *table) write(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	buf := bufio.NewWriter(file)
+	w := csv.NewWriter(buf)
+	w.Write(t.cols)
+
+	for _, row := range t.rows {
+		rec := make([]string, len(t.cols))
+		for i, col := range t.cols {
+			rec[i] = row[col]
+		}
+		w.Write(rec)
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := buf.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
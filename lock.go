@@ -0,0 +1,107 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// interval in which a held lock is checked again while waiting for it
+const lockPollInterval = 500 * time.Millisecond
+
+// return the lock file of the outputs with the basename of outFile
+func lockFileName(outFile string) string {
+	return strings.TrimSuffix(outFile, filepath.Ext(outFile)) + ".lock"
+}
+
+// create the lock file of the outputs of outFile, holding the process ID
+// and host of this process. If another running process holds the lock,
+// wait up to wait for it to be released, and fail afterwards. Locks of
+// processes on this host which are no longer running are taken over.
+// Returns a function releasing the lock
+func acquireLock(outFile string, wait time.Duration) (func(), error) {
+	lockFile := lockFileName(outFile)
+	host, _ := os.Hostname()
+	if len(host) == 0 {
+		host = "unknown"
+	}
+	deadline := time.Now().Add(wait)
+
+	for {
+		f, err := os.OpenFile(lockFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%d %s\n", os.Getpid(), host)
+			f.Close()
+			if err != nil {
+				os.Remove(lockFile)
+				return nil, fmt.Errorf("could not write lock file %s (%s)", lockFile, err)
+			}
+			return func() { os.Remove(lockFile) }, nil
+		}
+
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("could not create lock file %s (%s)", lockFile, err)
+		}
+
+		pid, lockHost, ok := readLock(lockFile)
+		if ok && lockHost == host && !processRunning(pid) {
+			// left behind by an aborted run
+			os.Remove(lockFile)
+			continue
+		}
+
+		if !time.Now().Before(deadline) {
+			holder := "another process"
+			if ok {
+				holder = fmt.Sprintf("process %d on %s", pid, lockHost)
+			}
+			return nil, fmt.Errorf("output %s is being written by %s (lock file %s). Remove the lock file if this process is no longer running", outFile, holder, lockFile)
+		}
+
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// return the process ID and host stored in lockFile
+func readLock(lockFile string) (int, string, bool) {
+	content, err := os.ReadFile(lockFile)
+	if err != nil {
+		return 0, "", false
+	}
+
+	fields := strings.Fields(string(content))
+	if len(fields) != 2 {
+		return 0, "", false
+	}
+
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, "", false
+	}
+
+	return pid, fields[1], true
+}
+
+// check whether the process pid is running. Processes which cannot be
+// checked count as running
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	err = p.Signal(syscall.Signal(0))
+
+	return err == nil || !errors.Is(err, os.ErrProcessDone)
+}
@@ -0,0 +1,132 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// return the host name stored in lock files written by this process
+func lockHost() string {
+	host, _ := os.Hostname()
+	if len(host) == 0 {
+		host = "unknown"
+	}
+	return host
+}
+
+// return the ID of a process which is no longer running
+func finishedPid(t *testing.T) int {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestAcquireLock(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out.shp")
+
+	unlock, err := acquireLock(out, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pid, host, ok := readLock(lockFileName(out))
+	if !ok || pid != os.Getpid() || host != lockHost() {
+		t.Errorf("got lock of process %d on %s (%v), want %d on %s", pid, host, ok, os.Getpid(), lockHost())
+	}
+
+	// this process is still running, so the lock is not taken over
+	if _, err := acquireLock(out, 0); err == nil {
+		t.Error("acquired a lock held by a running process")
+	}
+
+	unlock()
+
+	if _, err := os.Stat(lockFileName(out)); !os.IsNotExist(err) {
+		t.Errorf("lock file not removed on release (%v)", err)
+	}
+
+	unlock, err = acquireLock(out, 0)
+	if err != nil {
+		t.Fatalf("could not acquire a released lock (%s)", err)
+	}
+	unlock()
+}
+
+func TestAcquireLockStale(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		takeOver bool
+	}{
+		{"finished process on this host", fmt.Sprintf("%d %s\n", finishedPid(t), lockHost()), true},
+		{"finished process on another host", fmt.Sprintf("%d %s-other\n", finishedPid(t), lockHost()), false},
+		{"running process on this host", fmt.Sprintf("%d %s\n", os.Getpid(), lockHost()), false},
+		{"unreadable lock", "garbage", false},
+	}
+
+	for _, test := range tests {
+		out := filepath.Join(t.TempDir(), "out.shp")
+		if err := os.WriteFile(lockFileName(out), []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		unlock, err := acquireLock(out, 0)
+		if (err == nil) != test.takeOver {
+			t.Errorf("%s: got error %v, want lock taken over: %v", test.name, err, test.takeOver)
+		}
+
+		if err == nil {
+			if pid, _, _ := readLock(lockFileName(out)); pid != os.Getpid() {
+				t.Errorf("%s: got lock of process %d after takeover, want %d", test.name, pid, os.Getpid())
+			}
+			unlock()
+		}
+	}
+}
+
+func TestReadLock(t *testing.T) {
+	tests := []struct {
+		content string
+		pid     int
+		host    string
+		ok      bool
+	}{
+		{"123 host\n", 123, "host", true},
+		{"  42   other.example.org  ", 42, "other.example.org", true},
+		{"", 0, "", false},
+		{"123", 0, "", false},
+		{"123 host extra\n", 0, "", false},
+		{"abc host\n", 0, "", false},
+	}
+
+	dir := t.TempDir()
+
+	for i, test := range tests {
+		lockFile := filepath.Join(dir, fmt.Sprintf("%d.lock", i))
+		if err := os.WriteFile(lockFile, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		pid, host, ok := readLock(lockFile)
+		if pid != test.pid || host != test.host || ok != test.ok {
+			t.Errorf("readLock(%q) = %d, %q, %v, want %d, %q, %v", test.content, pid, host, ok, test.pid, test.host, test.ok)
+		}
+	}
+
+	if _, _, ok := readLock(filepath.Join(dir, "missing.lock")); ok {
+		t.Error("read a missing lock file")
+	}
+}
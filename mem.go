@@ -0,0 +1,88 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// rough ratio between the memory needed for a parsed feed and the
+// size of its uncompressed CSV files
+const feedMemFactor = 3
+
+// parse a memory size like 512M, 4G or 1048576 into bytes
+func parseByteSize(in string) (uint64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(in)), "B")
+
+	mult := uint64(1)
+
+	if len(s) > 0 {
+		switch s[len(s)-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+	}
+
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+
+	val, err := strconv.ParseFloat(s, 64)
+	if err != nil || val < 0 {
+		return 0, fmt.Errorf("invalid memory size '%s'", in)
+	}
+
+	return uint64(val * float64(mult)), nil
+}
+
+// estimate the memory needed to hold the feed at path (zip or
+// directory) in memory, from the size of its uncompressed files
+func estimateFeedMem(path string) (uint64, error) {
+	size := uint64(0)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	if info.IsDir() {
+		files, err := filepath.Glob(filepath.Join(path, "*.txt"))
+		if err != nil {
+			return 0, err
+		}
+		for _, file := range files {
+			if fi, err := os.Stat(file); err == nil {
+				size += uint64(fi.Size())
+			}
+		}
+	} else {
+		r, err := zip.OpenReader(path)
+		if err != nil {
+			return 0, err
+		}
+		defer r.Close()
+
+		for _, file := range r.File {
+			if strings.HasSuffix(file.Name, ".txt") {
+				size += file.UncompressedSize64
+			}
+		}
+	}
+
+	return size * feedMemFactor, nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// start a CPU ("cpu") or heap ("mem") profile written into path, and
+// return a function to be called once the run is complete
+func startProfile(mode string, path string) (func(), error) {
+	if mode != "cpu" && mode != "mem" {
+		return nil, fmt.Errorf("unknown profile type %s", mode)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not create profile file (%s)", err)
+	}
+
+	switch mode {
+	case "cpu":
+		if err := pprof.StartCPUProfile(file); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("could not start CPU profile (%s)", err)
+		}
+
+		return func() {
+			pprof.StopCPUProfile()
+			file.Close()
+		}, nil
+	default:
+		return func() {
+			// get up-to-date statistics
+			runtime.GC()
+			if err := pprof.WriteHeapProfile(file); err != nil {
+				fmt.Fprintf(os.Stderr, "Could not write heap profile (%s)\n", err)
+			}
+			file.Close()
+		}, nil
+	}
+}
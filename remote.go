@@ -0,0 +1,226 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package main
+
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"google.golang.org/api/iterator"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// object storage holding a GTFS feed
+type remoteStore interface {
+	// list the keys of all objects starting with prefix
+	list(ctx context.Context, prefix string) ([]string, error)
+
+	// open the object with key
+	open(ctx context.Context, key string) (io.ReadCloser, error)
+
+	close() error
+}
+
+// Amazon S3 bucket (or a bucket of an S3 compatible service)
+type s3Store struct {
+	client *s3.Client
+	bucket string
+}
+
+// Google Cloud Storage bucket
+type gcsStore struct {
+	client *storage.Client
+	bucket string
+}
+
+// check if path is an object storage URL
+func isRemotePath(path string) bool {
+	return strings.HasPrefix(path, "s3://") || strings.HasPrefix(path, "gs://")
+}
+
+// download the feed at the s3:// or gs:// URL url into a temporary
+// location and return its path, together with a function removing it.
+// The URL may either point to a single object (a zipped feed), or to a
+// prefix under which the extracted .txt files of a feed are stored
+func fetchRemoteFeed(url string) (string, func(), error) {
+	ctx := context.Background()
+
+	scheme, rest, _ := strings.Cut(url, "://")
+	bucket, key, _ := strings.Cut(rest, "/")
+	if len(bucket) == 0 {
+		return "", nil, fmt.Errorf("no bucket in %s", url)
+	}
+
+	store, err := openRemoteStore(ctx, scheme, bucket)
+	if err != nil {
+		return "", nil, err
+	}
+	defer store.close()
+
+	keys, err := store.list(ctx, key)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not list %s (%s)", url, err)
+	}
+
+	dir, err := os.MkdirTemp("", "gtfs2shp")
+	if err != nil {
+		return "", nil, fmt.Errorf("could not create temporary directory (%s)", err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	// a single object, expected to be a zipped feed
+	for _, k := range keys {
+		if len(key) > 0 && k == key {
+			local := filepath.Join(dir, path.Base(key))
+			if err := download(ctx, store, k, local); err != nil {
+				cleanup()
+				return "", nil, fmt.Errorf("could not download %s (%s)", url, err)
+			}
+			return local, cleanup, nil
+		}
+	}
+
+	// the extracted feed files directly below the prefix
+	prefix := key
+	if len(prefix) > 0 && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	n := 0
+	for _, k := range keys {
+		name := strings.TrimPrefix(k, prefix)
+		if len(name) == len(k) && len(prefix) > 0 || strings.Contains(name, "/") || !strings.HasSuffix(name, ".txt") {
+			continue
+		}
+
+		if err := download(ctx, store, k, filepath.Join(dir, name)); err != nil {
+			cleanup()
+			return "", nil, fmt.Errorf("could not download %s://%s/%s (%s)", scheme, bucket, k, err)
+		}
+		n++
+	}
+
+	if n == 0 {
+		cleanup()
+		return "", nil, fmt.Errorf("no GTFS feed found at %s", url)
+	}
+
+	return dir, cleanup, nil
+}
+
+// open the bucket, with credentials taken from the default credential
+// chain of the provider
+func openRemoteStore(ctx context.Context, scheme string, bucket string) (remoteStore, error) {
+	switch scheme {
+	case "s3":
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not load AWS configuration (%s)", err)
+		}
+		return &s3Store{client: s3.NewFromConfig(cfg), bucket: bucket}, nil
+	case "gs":
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not create Google Cloud Storage client (%s)", err)
+		}
+		return &gcsStore{client: client, bucket: bucket}, nil
+	}
+
+	return nil, fmt.Errorf("unknown object storage %s", scheme)
+}
+
+// copy the object with key from store into the local file
+func download(ctx context.Context, store remoteStore, key string, local string) error {
+	r, err := store.open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	file, err := os.Create(local)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func (s *s3Store) list(ctx context.Context, prefix string) ([]string, error) {
+	keys := make([]string, 0)
+
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.ToString(obj.Key))
+		}
+	}
+
+	return keys, nil
+}
+
+func (s *s3Store) open(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Body, nil
+}
+
+func (s *s3Store) close() error {
+	return nil
+}
+
+func (s *gcsStore) list(ctx context.Context, prefix string) ([]string, error) {
+	keys := make([]string, 0)
+
+	it := s.client.Bucket(s.bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, attrs.Name)
+	}
+
+	return keys, nil
+}
+
+func (s *gcsStore) open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.client.Bucket(s.bucket).Object(key).NewReader(ctx)
+}
+
+func (s *gcsStore) close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,99 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/jonas-p/go-shp"
+	"sort"
+	"strings"
+)
+
+// RouteExtensionFlds are patterns of commonly used producer extension
+// fields of routes.txt, like route branding URLs and vehicle type
+// descriptors, see ExpandAddFlds
+var RouteExtensionFlds = []string{
+	"route_branding_*",
+	"brand_*",
+	"vehicle_type*",
+	"vehicle_category*",
+	"network_id",
+	"continuous_*",
+}
+
+// ExpandAddFlds returns the additional fields selected by patterns, in
+// order and each only once. A pattern ending in * selects all fields
+// with the prefix before it present in vals (like Feed.RoutesAddFlds),
+// in alphabetical order, other patterns select the field of that name,
+// even if it is not present
+func ExpandAddFlds(vals map[string]map[string]string, patterns []string) []string {
+	ret := make([]string, 0, len(patterns))
+	seen := make(map[string]bool)
+
+	add := func(fld string) {
+		if !seen[fld] {
+			seen[fld] = true
+			ret = append(ret, fld)
+		}
+	}
+
+	for _, pattern := range patterns {
+		if !strings.HasSuffix(pattern, "*") {
+			add(pattern)
+			continue
+		}
+
+		prefix := strings.TrimSuffix(pattern, "*")
+		matches := make([]string, 0)
+		for fld := range vals {
+			if strings.HasPrefix(fld, prefix) {
+				matches = append(matches, fld)
+			}
+		}
+		sort.Strings(matches)
+
+		for _, fld := range matches {
+			add(fld)
+		}
+	}
+
+	return ret
+}
+
+// return the value of the additional field fld of the entity with the
+// given ID, as kept by the parser in vals (like Feed.TripsAddFlds)
+func addFldVal(vals map[string]map[string]string, fld string, id string) string {
+	if fldVals, ok := vals[fld]; ok {
+		return fldVals[id]
+	}
+	return ""
+}
+
+// return string fields for the additional fields flds, sized to hold
+// their values for the entities with the given IDs
+func (sw *ShapeWriter) addFldFields(vals map[string]map[string]string, flds []string, ids []string) []shp.Field {
+	ret := make([]shp.Field, 0, len(flds))
+
+	for _, fld := range flds {
+		size := uint8(0)
+		for _, id := range ids {
+			fitSize(&size, len(addFldVal(vals, fld, id)))
+		}
+		ret = append(ret, shp.StringField(sw.fldName(fld), size))
+	}
+
+	return ret
+}
+
+// write the values of the additional fields flds of the entity with ID id
+// into the fields starting at fld, and return the next free field
+func (sw *ShapeWriter) writeAddFldAttrs(shape *layer, row int, fld int, vals map[string]map[string]string, flds []string, id string) int {
+	for _, f := range flds {
+		shape.WriteAttribute(row, fld, addFldVal(vals, f, id))
+		fld++
+	}
+	return fld
+}
@@ -7,8 +7,10 @@
 package shape
 
 import (
+	"github.com/patrickbr/gtfsparser"
 	"github.com/patrickbr/gtfsparser/gtfs"
 	"math"
+	"strconv"
 	"strings"
 )
 
@@ -16,17 +18,89 @@ import (
 // gtfs.Route and gtfs.Trip objects sharing the
 // same shape
 type AggrShape struct {
-	Shape                     *gtfs.Shape
-	From                      float64
-	To                        float64
-	Trips                     map[string]*gtfs.Trip
-	Routes                    map[string]*gtfs.Route
-	RouteTripCount            map[*gtfs.Route]int
-	RouteUniqueTripCount      map[*gtfs.Route]int
-	MeterLength               float64
+	// The shape, and the measures of the used part of it (NaN if the
+	// whole shape is used)
+	Shape *gtfs.Shape
+	From  float64
+	To    float64
+
+	// Whether the trips are loops, ending where they started
+	Loop bool
+
+	// The direction_id of the trips if trips were aggregated per
+	// direction, -1 otherwise
+	Direction int8
+
+	// The aggregated trips and their routes, by ID. With route groups,
+	// the routes are the group routes
+	Trips  map[string]*gtfs.Trip
+	Routes map[string]*gtfs.Route
+
+	// Number of trips per route over all active service days, and the
+	// same without trips marked as not to be counted
+	RouteTripCount       map[*gtfs.Route]int
+	RouteUniqueTripCount map[*gtfs.Route]int
+
+	// Number of trips per route in direction 0 and 1
+	Dir0TripCount map[*gtfs.Route]int
+	Dir1TripCount map[*gtfs.Route]int
+
+	// Length of the used part of the shape in meters
+	MeterLength float64
+
+	// Number of served stop events per route, and the number of
+	// wheelchair accessible trips, wheelchair accessible stop events and
+	// trips allowing bikes among them
 	NumStops                  map[*gtfs.Route]int
 	WheelchairAccessibleTrips map[*gtfs.Route]int
 	WheelchairAccessibleStops map[*gtfs.Route]int
+	BikesAllowedTrips         map[*gtfs.Route]int
+
+	// Headways of frequency-based trips per route in seconds, weighted
+	// by their duration (sum of headway * duration and sum of durations)
+	HeadwayExactSum map[*gtfs.Route]float64
+	HeadwayExactDur map[*gtfs.Route]float64
+	HeadwayFreqSum  map[*gtfs.Route]float64
+	HeadwayFreqDur  map[*gtfs.Route]float64
+
+	// Observed delays per route: sum of delays in seconds, number of
+	// observations and number of punctual observations
+	DelaySum    map[*gtfs.Route]float64
+	DelayObs    map[*gtfs.Route]int
+	PunctualObs map[*gtfs.Route]int
+}
+
+// AggregateOptions holds the settings of Aggregate
+type AggregateOptions struct {
+	// Only aggregate trips of these route types, all if empty
+	MOTs map[int16]bool
+
+	// Observed trip delays, and the maximum delay in seconds for an
+	// observation to count as punctual
+	TripDelays           TripDelays
+	PunctualityThreshold float64
+
+	// Aggregate routes into line groups, as in WriteOptions
+	RouteGroups     RouteGroups
+	RouteGroupField string
+}
+
+// Aggregate aggregates the trips of Feed f by the part of their shape
+// they use, as done for the route shapes output, without writing any
+// files. Trips without a shape or with less than two stops are skipped.
+// The returned AggrShapes are keyed by shape ID, followed by the used
+// measure range for trips only using a part of their shape
+func Aggregate(f *gtfsparser.Feed, opts AggregateOptions) map[string]*AggrShape {
+	sw := NewShapeWriter("4326", opts.MOTs, nil)
+	sw.SetWriteOpts(WriteOptions{
+		TripDelays:           opts.TripDelays,
+		PunctualityThreshold: opts.PunctualityThreshold,
+		RouteGroups:          opts.RouteGroups,
+		RouteGroupField:      opts.RouteGroupField,
+	})
+
+	ret, _ := sw.getAggrShapes(f.Trips, f)
+	return ret
 }
 
 // NewAggrShape returns a new AggrShape instance
@@ -34,14 +108,25 @@ func NewAggrShape() *AggrShape {
 	p := AggrShape{
 		From:                      math.NaN(),
 		To:                        math.NaN(),
+		Direction:                 -1,
 		Trips:                     make(map[string]*gtfs.Trip),
 		Routes:                    make(map[string]*gtfs.Route),
 		RouteTripCount:            make(map[*gtfs.Route]int),
 		RouteUniqueTripCount:      make(map[*gtfs.Route]int),
+		Dir0TripCount:             make(map[*gtfs.Route]int),
+		Dir1TripCount:             make(map[*gtfs.Route]int),
 		MeterLength:               0,
 		NumStops:                  make(map[*gtfs.Route]int),
 		WheelchairAccessibleTrips: make(map[*gtfs.Route]int),
 		WheelchairAccessibleStops: make(map[*gtfs.Route]int),
+		BikesAllowedTrips:         make(map[*gtfs.Route]int),
+		HeadwayExactSum:           make(map[*gtfs.Route]float64),
+		HeadwayExactDur:           make(map[*gtfs.Route]float64),
+		HeadwayFreqSum:            make(map[*gtfs.Route]float64),
+		HeadwayFreqDur:            make(map[*gtfs.Route]float64),
+		DelaySum:                  make(map[*gtfs.Route]float64),
+		DelayObs:                  make(map[*gtfs.Route]int),
+		PunctualObs:               make(map[*gtfs.Route]int),
 	}
 	return &p
 }
@@ -73,62 +158,48 @@ func (as *AggrShape) GetRouteIdsString() string {
 	return strings.Join(ids, ",")
 }
 
+// CalcMeterLength calculates the length in meters of the shape between the
+// measures From and To
 func (as *AggrShape) CalcMeterLength() {
-	first := 0
-	last := len(as.Shape.Points) - 1
-
-	haveFirst := false
-
-	if !math.IsNaN(as.From) && !math.IsNaN(as.To) {
-		for i := 0; i < len(as.Shape.Points); i++ {
-			if math.IsNaN(float64(as.Shape.Points[i].Dist_traveled)) {
-				first = 0
-				last = len(as.Shape.Points) - 1
-				break }
-
-			if !haveFirst && float64(as.Shape.Points[i].Dist_traveled) >= as.From {
-				first = i
-				haveFirst = true
-			}
-
-			if haveFirst && float64(as.Shape.Points[i].Dist_traveled) > as.To {
-				last = i - 1
-				break
-			}
-		}
-	}
+	as.MeterLength = shapeMeterLength(as.Shape.Points, as.From, as.To)
+}
+
+// return the length in meters of shape points between the measures from
+// and to
+func shapeMeterLength(points gtfs.ShapePoints, from float64, to float64) float64 {
+	first, last := clipRange(points, from, to)
 
 	mlen := 0.0
 
 	if first > 0 {
-		latdiff := float64(as.Shape.Points[first].Lat) - float64(as.Shape.Points[first-1].Lat)
-		londiff := float64(as.Shape.Points[first].Lon) - float64(as.Shape.Points[first-1].Lon)
+		latdiff := float64(points[first].Lat) - float64(points[first-1].Lat)
+		londiff := float64(points[first].Lon) - float64(points[first-1].Lon)
 
-		dMeasure := float64(as.Shape.Points[first].Dist_traveled) - float64(as.Shape.Points[first-1].Dist_traveled)
+		dMeasure := float64(points[first].Dist_traveled) - float64(points[first-1].Dist_traveled)
 
-		lat := float64(as.Shape.Points[first-1].Lat) + latdiff/dMeasure*((as.From)-float64(as.Shape.Points[first-1].Dist_traveled))
-		lon := float64(as.Shape.Points[first-1].Lon) + londiff/dMeasure*((as.From)-float64(as.Shape.Points[first-1].Dist_traveled))
+		lat := float64(points[first-1].Lat) + latdiff/dMeasure*((from)-float64(points[first-1].Dist_traveled))
+		lon := float64(points[first-1].Lon) + londiff/dMeasure*((from)-float64(points[first-1].Dist_traveled))
 
-		mlen += haversine(float64(lat), float64(lon), float64(as.Shape.Points[first].Lat), float64(as.Shape.Points[first].Lon))
+		mlen += haversine(float64(lat), float64(lon), float64(points[first].Lat), float64(points[first].Lon))
 	}
 
-	if last < len(as.Shape.Points)-1 {
-		latdiff := float64(as.Shape.Points[last+1].Lat) - float64(as.Shape.Points[last].Lat)
-		londiff := float64(as.Shape.Points[last+1].Lon) - float64(as.Shape.Points[last].Lon)
+	if last < len(points)-1 {
+		latdiff := float64(points[last+1].Lat) - float64(points[last].Lat)
+		londiff := float64(points[last+1].Lon) - float64(points[last].Lon)
 
-		dMeasure := float64(as.Shape.Points[last+1].Dist_traveled) - float64(as.Shape.Points[last].Dist_traveled)
+		dMeasure := float64(points[last+1].Dist_traveled) - float64(points[last].Dist_traveled)
 
-		lat := float64(as.Shape.Points[last].Lat) + latdiff/dMeasure*((as.To)-float64(as.Shape.Points[last].Dist_traveled))
-		lon := float64(as.Shape.Points[last].Lon) + londiff/dMeasure*((as.To)-float64(as.Shape.Points[last].Dist_traveled))
+		lat := float64(points[last].Lat) + latdiff/dMeasure*((to)-float64(points[last].Dist_traveled))
+		lon := float64(points[last].Lon) + londiff/dMeasure*((to)-float64(points[last].Dist_traveled))
 
-		mlen += haversine(float64(lat), float64(lon), float64(as.Shape.Points[last].Lat), float64(as.Shape.Points[last].Lon))
+		mlen += haversine(float64(lat), float64(lon), float64(points[last].Lat), float64(points[last].Lon))
 	}
 
 	for i := first + 1; i <= last; i++ {
-		mlen += haversineP(as.Shape.Points[i-1], as.Shape.Points[i])
+		mlen += haversineP(points[i-1], points[i])
 	}
 
-	as.MeterLength = mlen
+	return mlen
 }
 
 // GetShortNamesString returns a comma separated list of
@@ -147,6 +218,22 @@ func (as *AggrShape) GetShortNamesString() string {
 	return strings.Join(sNamesSl, ",")
 }
 
+// return the key trips are aggregated by: the ID of their shape, the used
+// part of it and, if aggregated per direction, their direction
+func aggrShapeKey(shapeID string, from float64, to float64, direction int8) string {
+	ret := shapeID
+
+	if !math.IsNaN(from) && !math.IsNaN(to) {
+		ret += "%%%%%" + strconv.FormatFloat(from, 'f', 1, 64) + ":" + strconv.FormatFloat(to, 'f', 1, 64)
+	}
+
+	if direction >= 0 {
+		ret += "%%%%%dir" + strconv.Itoa(int(direction))
+	}
+
+	return ret
+}
+
 // Calculate the distance in meter between two lat,lng pairs
 func haversine(latA float64, lonA float64, latB float64, lonB float64) float64 {
 	latA = latA * DEG_TO_RAD
@@ -0,0 +1,85 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/patrickbr/gtfsparser"
+	"math"
+)
+
+// Circle is a study area of Radius meters around a location
+type Circle struct {
+	Lat, Lon float64
+	Radius   float64
+}
+
+// Contains checks whether the location lat, lon is within the circle
+func (c *Circle) Contains(lat float64, lon float64) bool {
+	return haversine(c.Lat, c.Lon, lat, lon) <= c.Radius
+}
+
+// check whether a line, given as lat, lon coordinates, passes through
+// the circle
+func (c *Circle) touches(line [][2]float64) bool {
+	frame := localFrame{lat0: c.Lat, lon0: c.Lon, cosLat: math.Cos(c.Lat * DEG_TO_RAD)}
+	center := localPoint{0, 0}
+
+	for i := range line {
+		a := frame.toLocal(line[i])
+		b := a
+		if i > 0 {
+			b = frame.toLocal(line[i-1])
+		}
+		if localSegDist(center, a, b) <= c.Radius {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FilterTripsAround removes all trips from Feed f which do not pass
+// through Circle c, and returns the number of removed trips. Trips are
+// tested with the used part of their shape, or with the straight lines
+// between their stops if they have no shape. Trips passing through the
+// circle are kept as a whole
+func FilterTripsAround(f *gtfsparser.Feed, c *Circle) int {
+	n := 0
+
+	// results by used part of a shape
+	touched := make(map[string]bool)
+
+	for id, trip := range f.Trips {
+		var touches bool
+
+		if trip.Shape != nil {
+			from, to := tripShapeRange(trip)
+			key := aggrShapeKey(trip.Shape.Id, from, to, -1)
+
+			var ok bool
+			if touches, ok = touched[key]; !ok {
+				touches = c.touches(clipShape(trip.Shape.Points, from, to))
+				touched[key] = touches
+			}
+		} else {
+			line := make([][2]float64, 0, len(trip.StopTimes))
+			for _, st := range trip.StopTimes {
+				if hasCoord(st.Stop()) {
+					line = append(line, [2]float64{float64(st.Stop().Lat), float64(st.Stop().Lon)})
+				}
+			}
+			touches = c.touches(line)
+		}
+
+		if !touches {
+			delete(f.Trips, id)
+			n++
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,82 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// file extensions making up a shapefile layer
+var layerExts = []string{".shp", ".shx", ".dbf"}
+
+// return the temporary file name a layer is written to
+func tmpLayerName(fileName string) string {
+	return strings.TrimSuffix(fileName, ".shp") + ".tmp.shp"
+}
+
+// move all files of the layer from to the layer to
+func moveLayer(from string, to string) {
+	for _, ext := range layerExts {
+		if err := os.Rename(strings.TrimSuffix(from, ".shp")+ext, strings.TrimSuffix(to, ".shp")+ext); err != nil {
+			panic(fmt.Sprintf("Could not replace shapefile (%s)", err))
+		}
+	}
+}
+
+// remove all files of the layer fileName
+func removeLayer(fileName string) {
+	for _, ext := range layerExts {
+		os.Remove(strings.TrimSuffix(fileName, ".shp") + ext)
+	}
+}
+
+// check whether all files of the layer fileName exist
+func layerExists(fileName string) bool {
+	for _, ext := range layerExts {
+		if !fileExists(strings.TrimSuffix(fileName, ".shp") + ext) {
+			return false
+		}
+	}
+	return true
+}
+
+// check whether a file exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// panic if an output file (or any file of an output layer) already
+// exists and may not be replaced
+func (sw *ShapeWriter) checkOverwrite(path string) {
+	if sw.opts.Force || sw.opts.Incremental {
+		return
+	}
+
+	paths := []string{path}
+	if strings.HasSuffix(path, ".shp") {
+		paths = nil
+		for _, ext := range layerExts {
+			paths = append(paths, strings.TrimSuffix(path, ".shp")+ext)
+		}
+	}
+
+	for _, p := range paths {
+		if fileExists(p) {
+			panic(fmt.Sprintf("Output file %s already exists", p))
+		}
+	}
+}
+
+// create an output file, which may not replace an existing file
+// unless replacing is allowed
+func (sw *ShapeWriter) createFile(path string) (*os.File, error) {
+	sw.checkOverwrite(path)
+	return os.Create(path)
+}
@@ -0,0 +1,187 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"flag"
+	"fmt"
+	"github.com/patrickbr/gtfs2shp/internal/testfeed"
+	"github.com/patrickbr/gtfsparser"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// size of the synthetic benchmark feed, run with e.g.
+// go test -bench . -feed-routes 500 ./shape/
+var (
+	benchRoutes        = flag.Int("feed-routes", 50, "number of routes of the synthetic benchmark feed")
+	benchTrips         = flag.Int("feed-trips", 40, "number of trips per route of the synthetic benchmark feed")
+	benchStops         = flag.Int("feed-stops", 20, "number of stops per route of the synthetic benchmark feed")
+	benchShapePoints   = flag.Int("feed-shape-points", 10, "number of shape points between two stops of the synthetic benchmark feed")
+	benchPatternsRoute = flag.Int("feed-patterns", 2, "number of stop patterns per route of the synthetic benchmark feed")
+)
+
+// build a synthetic GTFS feed. Routes run parallel to each other, each in
+// both directions and with several stop patterns (skipping stops), and
+// share a transfer stop in their middle
+func syntheticFeed() *testfeed.Builder {
+	feed := testfeed.New().
+		Calendar("wd", "1111100", "20240101", "20241231").
+		Calendar("we", "0000011", "20240101", "20241231").
+		Station("hub", "Hub", 50.0, 8.0)
+
+	for r := 0; r < *benchRoutes; r++ {
+		id := fmt.Sprintf("r%d", r)
+		feed.Route(id, strconv.Itoa(r), []int{0, 1, 2, 3}[r%4])
+
+		for s := 0; s < *benchStops; s++ {
+			lat, lon := benchStopCoord(r, s)
+			feed.Stop(fmt.Sprintf("r%ds%d", r, s), fmt.Sprintf("Stop %d/%d", r, s), lat, lon)
+			if s == *benchStops/2 {
+				feed.Set("stops.txt", fmt.Sprintf("r%ds%d", r, s), "parent_station", "hub")
+			}
+		}
+
+		for d := 0; d < 2; d++ {
+			points := make([][2]float64, 0)
+			for s := 0; s < *benchStops; s++ {
+				alat, alon := benchStopCoord(r, benchStopIdx(s, d))
+
+				if s == *benchStops-1 {
+					points = append(points, [2]float64{alat, alon})
+					break
+				}
+
+				// zigzag between consecutive stops
+				blat, blon := benchStopCoord(r, benchStopIdx(s+1, d))
+				for p := 0; p < *benchShapePoints; p++ {
+					f := float64(p) / float64(*benchShapePoints)
+					points = append(points, [2]float64{alat + (blat-alat)*f, alon + (blon-alon)*f + 0.0001*float64(p%2)})
+				}
+			}
+			feed.Shape(fmt.Sprintf("r%dd%d", r, d), points...)
+		}
+
+		for t := 0; t < *benchTrips; t++ {
+			secs := 5*3600 + t*900
+			pattern := t % *benchPatternsRoute
+			stops := make([]testfeed.StopTime, 0, *benchStops)
+
+			for s := 0; s < *benchStops; s++ {
+				// patterns > 0 skip every (pattern + 1)th inner stop
+				if pattern > 0 && s > 0 && s < *benchStops-1 && s%(pattern+1) == 0 {
+					continue
+				}
+
+				stop := fmt.Sprintf("r%ds%d", r, benchStopIdx(s, t%2))
+				stops = append(stops, testfeed.StopTime{Stop: stop, Arr: isoTime(secs), Dep: isoTime(secs + 30)})
+				secs += 120
+			}
+
+			trip := fmt.Sprintf("r%dt%d", r, t)
+			feed.Trip(trip, id, []string{"wd", "we"}[t%2], fmt.Sprintf("r%dd%d", r, t%2), stops...).
+				Set("trips.txt", trip, "direction_id", strconv.Itoa(t%2)).
+				Set("trips.txt", trip, "block_id", fmt.Sprintf("r%db%d", r, t/4))
+		}
+	}
+
+	return feed
+}
+
+// return the index of the sth stop of a route in direction d
+func benchStopIdx(s int, d int) int {
+	if d == 1 {
+		return *benchStops - 1 - s
+	}
+	return s
+}
+
+// return the coordinate of stop s of route r in the synthetic feed
+func benchStopCoord(r int, s int) (float64, float64) {
+	if s == *benchStops/2 {
+		return 50.0, 8.0
+	}
+	return 50.0 + 0.002*float64(s-*benchStops/2), 8.0 + 0.001*float64(r-*benchRoutes/2)
+}
+
+// parse the synthetic benchmark feed
+func benchFeed(b *testing.B) *gtfsparser.Feed {
+	b.Helper()
+
+	return syntheticFeed().Feed(b)
+}
+
+// return a shape writer writing into a temporary directory
+func benchWriter(b *testing.B) (*ShapeWriter, string) {
+	b.Helper()
+
+	sw := NewShapeWriter("4326", map[int16]bool{}, map[string]string{})
+	sw.SetWriteOpts(WriteOptions{Force: true})
+
+	return sw, filepath.Join(b.TempDir(), "out.shp")
+}
+
+func BenchmarkGetAggrShapes(b *testing.B) {
+	feed := benchFeed(b)
+	sw, _ := benchWriter(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sw.getAggrShapes(feed.Trips, feed)
+	}
+}
+
+func BenchmarkWriteShapes(b *testing.B) {
+	feed := benchFeed(b)
+	sw, out := benchWriter(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sw.WriteShapes(feed, out)
+	}
+}
+
+func BenchmarkWriteRouteShapes(b *testing.B) {
+	feed := benchFeed(b)
+	sw, out := benchWriter(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sw.WriteRouteShapes(feed, map[int16]string{}, nil, out)
+	}
+}
+
+func BenchmarkWriteTripsExplicit(b *testing.B) {
+	feed := benchFeed(b)
+	sw, out := benchWriter(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sw.WriteTripsExplicit(feed, out)
+	}
+}
+
+func BenchmarkWriteStops(b *testing.B) {
+	feed := benchFeed(b)
+	sw, out := benchWriter(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sw.WriteStops(feed, out)
+	}
+}
+
+func BenchmarkWriteRouteOverviewCsv(b *testing.B) {
+	feed := benchFeed(b)
+	sw, out := benchWriter(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sw.WriteRouteOverviewCsv(feed, map[int16]string{}, nil, out)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Boundary is a (multi) polygon in WGS84 coordinates. A point is inside
+// the boundary if it lies within an odd number of its rings, so holes
+// are supported.
+type Boundary struct {
+	rings [][][2]float64 // rings of lon/lat pairs
+
+	mutex  sync.Mutex
+	shares map[string]float64 // by aggregation key
+}
+
+// a GeoJSON object, only the members needed to read polygons
+type geoJSONObj struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Geometry    *geoJSONObj     `json:"geometry"`
+	Features    []geoJSONObj    `json:"features"`
+	Geometries  []geoJSONObj    `json:"geometries"`
+}
+
+// ReadBoundary reads all polygons of a GeoJSON file (a geometry, a
+// feature or a feature collection) in WGS84 into a Boundary
+func ReadBoundary(path string) (*Boundary, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var obj geoJSONObj
+	if err := json.NewDecoder(file).Decode(&obj); err != nil {
+		return nil, fmt.Errorf("could not parse boundary file %s (%s)", path, err)
+	}
+
+	b := &Boundary{shares: make(map[string]float64)}
+
+	if err := b.addGeoJSON(obj); err != nil {
+		return nil, fmt.Errorf("could not parse boundary file %s (%s)", path, err)
+	}
+
+	if len(b.rings) == 0 {
+		return nil, fmt.Errorf("boundary file %s contains no polygon", path)
+	}
+
+	return b, nil
+}
+
+// NewBoundary returns a boundary from rings of lon/lat pairs
+func NewBoundary(rings [][][2]float64) *Boundary {
+	return &Boundary{rings: rings, shares: make(map[string]float64)}
+}
+
+// add the polygon rings of a GeoJSON object
+func (b *Boundary) addGeoJSON(obj geoJSONObj) error {
+	switch obj.Type {
+	case "FeatureCollection":
+		for _, f := range obj.Features {
+			if err := b.addGeoJSON(f); err != nil {
+				return err
+			}
+		}
+	case "Feature":
+		if obj.Geometry != nil {
+			return b.addGeoJSON(*obj.Geometry)
+		}
+	case "GeometryCollection":
+		for _, g := range obj.Geometries {
+			if err := b.addGeoJSON(g); err != nil {
+				return err
+			}
+		}
+	case "Polygon":
+		var rings [][][2]float64
+		if err := json.Unmarshal(obj.Coordinates, &rings); err != nil {
+			return err
+		}
+		b.rings = append(b.rings, rings...)
+	case "MultiPolygon":
+		var polys [][][][2]float64
+		if err := json.Unmarshal(obj.Coordinates, &polys); err != nil {
+			return err
+		}
+		for _, rings := range polys {
+			b.rings = append(b.rings, rings...)
+		}
+	}
+
+	return nil
+}
+
+// Contains checks whether a coordinate lies within the boundary
+func (b *Boundary) Contains(lat float64, lon float64) bool {
+	in := false
+
+	for _, ring := range b.rings {
+		for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+			if (ring[i][1] > lat) != (ring[j][1] > lat) &&
+				lon < (ring[j][0]-ring[i][0])*(lat-ring[i][1])/(ring[j][1]-ring[i][1])+ring[i][0] {
+				in = !in
+			}
+		}
+	}
+
+	return in
+}
+
+// return the share of the length of the part of its shape used by an
+// aggregated shape within the boundary
+func (b *Boundary) share(as *AggrShape) float64 {
+	key := aggrShapeKey(as.Shape.Id, as.From, as.To, -1)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if share, ok := b.shares[key]; ok {
+		return share
+	}
+
+	points := clipShape(as.Shape.Points, as.From, as.To)
+
+	tot := 0.0
+	in := 0.0
+
+	for i := 1; i < len(points); i++ {
+		a := points[i-1]
+		c := points[i]
+		l := haversine(a[0], a[1], c[0], c[1])
+		tot += l
+		in += l * b.segmentShare(a[0], a[1], c[0], c[1])
+	}
+
+	share := 0.0
+	if tot > 0 {
+		share = in / tot
+	}
+
+	b.shares[key] = share
+	return share
+}
+
+// return the share of a segment within the boundary, by splitting it at
+// its intersections with the boundary rings
+func (b *Boundary) segmentShare(aLat, aLon, bLat, bLon float64) float64 {
+	cuts := []float64{0, 1}
+
+	for _, ring := range b.rings {
+		for i := 1; i < len(ring); i++ {
+			if t, ok := intersectParam(aLon, aLat, bLon, bLat, ring[i-1][0], ring[i-1][1], ring[i][0], ring[i][1]); ok {
+				cuts = append(cuts, t)
+			}
+		}
+	}
+
+	sort.Float64s(cuts)
+
+	share := 0.0
+	for i := 1; i < len(cuts); i++ {
+		mid := (cuts[i-1] + cuts[i]) / 2
+		if b.Contains(aLat+(bLat-aLat)*mid, aLon+(bLon-aLon)*mid) {
+			share += cuts[i] - cuts[i-1]
+		}
+	}
+
+	return share
+}
+
+// return the position t (0..1) of the intersection of segment a-b with
+// segment c-d along a-b
+func intersectParam(ax, ay, bx, by, cx, cy, dx, dy float64) (float64, bool) {
+	den := (bx-ax)*(dy-cy) - (by-ay)*(dx-cx)
+	if math.Abs(den) < 1e-15 {
+		return 0, false
+	}
+
+	t := ((cx-ax)*(dy-cy) - (cy-ay)*(dx-cx)) / den
+	u := ((cx-ax)*(by-ay) - (cy-ay)*(bx-ax)) / den
+
+	if t < 0 || t > 1 || u < 0 || u > 1 {
+		return 0, false
+	}
+
+	return t, true
+}
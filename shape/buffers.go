@@ -0,0 +1,371 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/jonas-p/go-shp"
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"math"
+	"sort"
+)
+
+// number of grid cells per buffer width used to trace buffer outlines
+const bufferCellsPerWidth = 4
+
+// maximum number of grid cells along each axis of a buffer grid, the
+// cells grow for larger routes
+const maxBufferGridSize = 4000
+
+// a point in a local planar frame in meters
+type localPoint struct {
+	x, y float64
+}
+
+// an equirectangular projection around a reference coordinate, in meters
+type localFrame struct {
+	lat0, lon0 float64
+	cosLat     float64
+}
+
+// WriteBuffers writes one corridor polygon per route contained in Feed f
+// to <outFile>.buffers.shp, covering everything within the buffer width
+// of the route's geometries. The buffers of all variants of a route are
+// dissolved into a single polygon
+func (sw *ShapeWriter) WriteBuffers(f *gtfsparser.Feed, outFile string) int {
+	defer sw.useLayer("buffers")()
+
+	fileName := sw.getOutFileName(outFile, ".buffers.shp")
+	shape := sw.createLayer(fileName, shp.POLYGON, "buffers")
+	defer sw.closeLayer(shape, fileName)
+
+	aggrShapes, routeShapes := sw.getAggrShapes(f.Trips, f)
+
+	routes := make([]*gtfs.Route, 0, len(routeShapes))
+	for route := range routeShapes {
+		routes = append(routes, route)
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Id < routes[j].Id })
+
+	idSize := uint8(0)
+	shortNameSize := uint8(0)
+	for _, r := range routes {
+		fitSize(&idSize, len(sw.ids.get("route", r.Id)))
+		fitSize(&shortNameSize, len(r.Short_name))
+	}
+
+	shape.SetFields([]shp.Field{
+		shp.StringField(sw.fldName("Route_id"), idSize),
+		shp.StringField(sw.fldName("Short_name"), shortNameSize),
+		shp.NumberField(sw.fldName("R_Type"), 16),
+		shp.FloatField(sw.fldName("Width"), 32, 2),
+		shp.FloatField(sw.fldName("Km2"), 32, 6),
+	})
+
+	n := 0
+
+	for _, r := range routes {
+		width := sw.bufferWidth(r.Type)
+		if width <= 0 {
+			continue
+		}
+
+		lines := make([][][2]float64, 0, len(routeShapes[r]))
+		ids := make([]string, 0, len(routeShapes[r]))
+		for id := range routeShapes[r] {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		if sw.opts.RouteGeometry == RouteGeomLongest || sw.opts.RouteGeometry == RouteGeomMostFrequent {
+			ids = []string{sw.representativeVariant(r, ids, aggrShapes)}
+		}
+
+		for _, id := range ids {
+			as := aggrShapes[id]
+			lines = append(lines, clipShape(as.Shape.Points, as.From, as.To))
+		}
+
+		rings, area := bufferLines(lines, width)
+		if len(rings) == 0 {
+			continue
+		}
+
+		parts := make([][]shp.Point, len(rings))
+		for i, ring := range rings {
+			parts[i] = make([]shp.Point, len(ring))
+			for j, p := range ring {
+				x, y := sw.project(p[0], p[1])
+				parts[i][j] = shp.Point{X: x, Y: y}
+			}
+		}
+
+		polygon := shp.Polygon(*shp.NewPolyLine(parts))
+		shape.Write(&polygon)
+
+		shape.WriteAttribute(n, 0, sw.ids.get("route", r.Id))
+		shape.WriteAttribute(n, 1, r.Short_name)
+		shape.WriteAttribute(n, 2, r.Type)
+		sw.writeFloatAttr(shape, n, 3, width)
+		sw.writeFloatAttr(shape, n, 4, area/1e6)
+
+		n = n + 1
+	}
+
+	return n
+}
+
+// return the buffer width in meters for routes of type t
+func (sw *ShapeWriter) bufferWidth(t int16) float64 {
+	if w, ok := sw.opts.BufferWidths[t]; ok {
+		return w
+	}
+	return sw.opts.BufferWidth
+}
+
+// return the outline of everything within width meters of the lines,
+// given as lat, lon coordinates, as rings of lat, lon coordinates
+// (outer rings clockwise, holes counterclockwise), together with the
+// covered area in square meters. Distances are measured in an
+// equirectangular projection around the center of the lines, which is
+// accurate for corridors of up to some hundred kilometers
+func bufferLines(lines [][][2]float64, width float64) ([][][2]float64, float64) {
+	minLat, minLon := math.Inf(1), math.Inf(1)
+	maxLat, maxLon := math.Inf(-1), math.Inf(-1)
+
+	for _, line := range lines {
+		for _, p := range line {
+			minLat, maxLat = math.Min(minLat, p[0]), math.Max(maxLat, p[0])
+			minLon, maxLon = math.Min(minLon, p[1]), math.Max(maxLon, p[1])
+		}
+	}
+
+	if math.IsInf(minLat, 0) {
+		return nil, 0
+	}
+
+	frame := localFrame{lat0: (minLat + maxLat) / 2, lon0: (minLon + maxLon) / 2}
+	frame.cosLat = math.Cos(frame.lat0 * DEG_TO_RAD)
+
+	segs := make([][2]localPoint, 0)
+	for _, line := range lines {
+		for i := range line {
+			a := frame.toLocal(line[i])
+			b := a
+			if i > 0 {
+				b = frame.toLocal(line[i-1])
+			} else if len(line) > 1 {
+				continue
+			}
+			segs = append(segs, [2]localPoint{b, a})
+		}
+	}
+
+	lo := frame.toLocal([2]float64{minLat, minLon})
+	hi := frame.toLocal([2]float64{maxLat, maxLon})
+
+	cell := width / bufferCellsPerWidth
+	cell = math.Max(cell, math.Max(hi.x-lo.x, hi.y-lo.y)/maxBufferGridSize)
+
+	// the grid covers the buffer with a margin, so all outlines are closed
+	margin := width + 2*cell
+	origin := localPoint{lo.x - margin, lo.y - margin}
+	nx := int(math.Ceil((hi.x-lo.x+2*margin)/cell)) + 1
+	ny := int(math.Ceil((hi.y-lo.y+2*margin)/cell)) + 1
+
+	// distances of the grid corners to the nearest segment, only
+	// computed near the segments
+	dist := make([]float64, nx*ny)
+	for i := range dist {
+		dist[i] = math.Inf(1)
+	}
+
+	for _, s := range segs {
+		x0 := int((math.Min(s[0].x, s[1].x) - width - cell - origin.x) / cell)
+		x1 := int((math.Max(s[0].x, s[1].x)+width+cell-origin.x)/cell) + 1
+		y0 := int((math.Min(s[0].y, s[1].y) - width - cell - origin.y) / cell)
+		y1 := int((math.Max(s[0].y, s[1].y)+width+cell-origin.y)/cell) + 1
+
+		for j := max0(y0); j < ny && j <= y1; j++ {
+			for i := max0(x0); i < nx && i <= x1; i++ {
+				p := localPoint{origin.x + float64(i)*cell, origin.y + float64(j)*cell}
+				if d := localSegDist(p, s[0], s[1]); d < dist[j*nx+i] {
+					dist[j*nx+i] = d
+				}
+			}
+		}
+	}
+
+	rings := traceContours(dist, nx, ny, width, func(i, j float64) localPoint {
+		return localPoint{origin.x + i*cell, origin.y + j*cell}
+	})
+
+	ret := make([][][2]float64, 0, len(rings))
+	area := 0.0
+
+	for _, ring := range rings {
+		pts := make([]shp.Point, len(ring))
+		for i, p := range ring {
+			pts[i] = shp.Point{X: p.x, Y: p.y}
+		}
+
+		pts = simplifyLine(pts, cell/4)
+		if len(pts) < 4 {
+			continue
+		}
+
+		// clockwise outer rings have a negative signed area
+		a := 0.0
+		for i := 1; i < len(pts); i++ {
+			a += pts[i-1].X*pts[i].Y - pts[i].X*pts[i-1].Y
+		}
+		area -= a / 2
+
+		latLons := make([][2]float64, len(pts))
+		for i, p := range pts {
+			latLons[i] = frame.toLatLon(localPoint{p.X, p.Y})
+		}
+		ret = append(ret, latLons)
+	}
+
+	return ret, area
+}
+
+// trace the outlines of the areas where the grid values (nx * ny values,
+// row by row) are below level, using marching squares. The outlines are
+// returned as closed rings with the area on their right side. at maps
+// (fractional) grid coordinates to points
+func traceContours(vals []float64, nx int, ny int, level float64, at func(float64, float64) localPoint) [][]localPoint {
+	// crossings are identified by the grid edge they are on: horizontal
+	// edges from corner k to k+1 as 2k, vertical edges from corner k to
+	// k+nx as 2k+1
+	next := make(map[int]int)
+	points := make(map[int]localPoint)
+
+	inside := func(i, j int) bool {
+		return vals[j*nx+i] < level
+	}
+
+	crossing := func(i0, j0, i1, j1 int) localPoint {
+		a := vals[j0*nx+i0]
+		b := vals[j1*nx+i1]
+		t := 0.5
+		if !math.IsInf(a, 0) && !math.IsInf(b, 0) && a != b {
+			t = (level - a) / (b - a)
+		}
+		return at(float64(i0)+t*float64(i1-i0), float64(j0)+t*float64(j1-j0))
+	}
+
+	for j := 0; j < ny-1; j++ {
+		for i := 0; i < nx-1; i++ {
+			// the corners of the cell counterclockwise, starting bottom left
+			ci := [4]int{i, i + 1, i + 1, i}
+			cj := [4]int{j, j, j + 1, j + 1}
+
+			// the crossings on the cell edges, counterclockwise
+			edges := make([]int, 0, 4)
+			entering := make([]bool, 0, 4)
+
+			for k := 0; k < 4; k++ {
+				a, b := inside(ci[k], cj[k]), inside(ci[(k+1)%4], cj[(k+1)%4])
+				if a == b {
+					continue
+				}
+
+				// the lower left corner of the edge
+				li, lj := ci[k], cj[k]
+				if k >= 2 {
+					li, lj = ci[(k+1)%4], cj[(k+1)%4]
+				}
+
+				id := 2 * (lj*nx + li)
+				if k%2 == 1 {
+					id++
+				}
+
+				if _, ok := points[id]; !ok {
+					points[id] = crossing(ci[k], cj[k], ci[(k+1)%4], cj[(k+1)%4])
+				}
+
+				edges = append(edges, id)
+				entering = append(entering, b)
+			}
+
+			// walking counterclockwise, the area is on the right of a
+			// segment from where the walk enters it to where it leaves
+			for k := range edges {
+				if !entering[k] {
+					continue
+				}
+				for l := 1; l < len(edges); l++ {
+					m := (k + l) % len(edges)
+					if !entering[m] {
+						next[edges[k]] = edges[m]
+						break
+					}
+				}
+			}
+		}
+	}
+
+	rings := make([][]localPoint, 0)
+
+	for len(next) > 0 {
+		start := -1
+		for id := range next {
+			if start < 0 || id < start {
+				start = id
+			}
+		}
+
+		ring := []localPoint{points[start]}
+		for cur := start; ; {
+			nxt, ok := next[cur]
+			if !ok {
+				break
+			}
+			delete(next, cur)
+			ring = append(ring, points[nxt])
+			cur = nxt
+			if cur == start {
+				break
+			}
+		}
+
+		rings = append(rings, ring)
+	}
+
+	return rings
+}
+
+// return the distance between p and the segment from a to b
+func localSegDist(p localPoint, a localPoint, b localPoint) float64 {
+	dx := b.x - a.x
+	dy := b.y - a.y
+
+	t := 0.0
+	if dx != 0 || dy != 0 {
+		t = math.Max(0, math.Min(1, ((p.x-a.x)*dx+(p.y-a.y)*dy)/(dx*dx+dy*dy)))
+	}
+
+	return math.Hypot(a.x+t*dx-p.x, a.y+t*dy-p.y)
+}
+
+func (f localFrame) toLocal(p [2]float64) localPoint {
+	return localPoint{(p[1] - f.lon0) * f.cosLat * metersPerDeg, (p[0] - f.lat0) * metersPerDeg}
+}
+
+func (f localFrame) toLatLon(p localPoint) [2]float64 {
+	return [2]float64{f.lat0 + p.y/metersPerDeg, f.lon0 + p.x/(f.cosLat*metersPerDeg)}
+}
+
+func max0(i int) int {
+	if i < 0 {
+		return 0
+	}
+	return i
+}
@@ -0,0 +1,136 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// return the number of trips generated by trip per active day. Blocks of
+// exact_times=1 frequencies generate explicitly scheduled trips, trips
+// with pure headway blocks are counted as a single trip
+func generatedTrips(trip *gtfs.Trip) int {
+	if trip.Frequencies == nil || len(*trip.Frequencies) == 0 {
+		return 1
+	}
+
+	numExact := 0
+	hasHeadwayOnly := false
+
+	for _, freq := range *trip.Frequencies {
+		dur := float64(freq.End_time.SecondsSinceMidnight() - freq.Start_time.SecondsSinceMidnight())
+		if dur <= 0 || freq.Headway_secs <= 0 {
+			continue
+		}
+
+		if freq.Exact_times {
+			numExact += int(math.Ceil(dur / float64(freq.Headway_secs)))
+		} else {
+			hasHeadwayOnly = true
+		}
+	}
+
+	if hasHeadwayOnly || numExact == 0 {
+		return numExact + 1
+	}
+
+	return numExact
+}
+
+// WriteCalendarCsv writes a matrix of the number of trips per day and
+// route contained in Feed f into <outFile>.calendar.csv, with one line
+// per date between the first and the last service date of the feed
+// and one column per route. Dates without any trip are kept, so gaps
+// in the service of a route become visible
+func (sw *ShapeWriter) WriteCalendarCsv(f *gtfsparser.Feed, outFile string) {
+	csvFile, err := sw.createFile(sw.getOutFileName(outFile, ".calendar.csv"))
+
+	if err != nil {
+		panic(fmt.Sprintf("Could not open CSV file for writing (%s)", err))
+	}
+	defer csvFile.Close()
+
+	sw.initRouteGroups(f)
+
+	// number of trips per active day, per route and service
+	counts := make(map[*gtfs.Route]map[*gtfs.Service]int)
+
+	for _, trip := range f.Trips {
+		if len(sw.motMap) > 0 && !sw.motMap[trip.Route.Type] {
+			continue
+		}
+
+		route := sw.groupRoute(trip.Route)
+		if counts[route] == nil {
+			counts[route] = make(map[*gtfs.Service]int)
+		}
+		counts[route][trip.Service] += generatedTrips(trip)
+	}
+
+	routes := make([]*gtfs.Route, 0, len(counts))
+	var first, last gtfs.Date
+
+	for route, svcs := range counts {
+		routes = append(routes, route)
+
+		for svc := range svcs {
+			if svc.GetFirstActiveDate().IsEmpty() {
+				continue
+			}
+			if first.IsEmpty() || svc.GetFirstActiveDate().GetTime().Before(first.GetTime()) {
+				first = svc.GetFirstActiveDate()
+			}
+			if last.IsEmpty() || svc.GetLastActiveDate().GetTime().After(last.GetTime()) {
+				last = svc.GetLastActiveDate()
+			}
+		}
+	}
+
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Id < routes[j].Id })
+
+	csvwriter := csv.NewWriter(csvFile)
+
+	headers := []string{sw.fldName("Date")}
+	for _, route := range routes {
+		headers = append(headers, sw.ids.get("route", route.Id))
+	}
+	csvwriter.Write(headers)
+	sw.addDictionaryCalendar(filepath.Base(csvFile.Name()), headers)
+
+	if !first.IsEmpty() {
+		lastT := last.GetTime()
+
+		for d := first; !d.GetTime().After(lastT); d = d.GetOffsettedDate(1) {
+			row := []string{isoDate(d)}
+
+			for _, route := range routes {
+				n := 0
+				for svc, num := range counts[route] {
+					if svc.IsActiveOn(d) {
+						n += num
+					}
+				}
+				row = append(row, strconv.Itoa(n))
+			}
+
+			csvwriter.Write(row)
+		}
+	}
+
+	csvwriter.Flush()
+
+	if err := csvwriter.Error(); err != nil {
+		panic(fmt.Sprintf("Could not write CSV file (%s)", err))
+	}
+}
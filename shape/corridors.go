@@ -0,0 +1,381 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/jonas-p/go-shp"
+	"github.com/patrickbr/gtfsparser"
+	"math"
+	"sort"
+	"strings"
+)
+
+// maximum number of nodes of an earlier line skipped between two
+// consecutive snapped samples which are filled in, larger jumps are
+// treated as the line leaving and rejoining the corridor
+const maxCorridorFill = 4
+
+// a center line of a corridor, given as lat, lon coordinates, with the
+// indices of the lines running along it in ascending order
+type corridor struct {
+	line    [][2]float64
+	members []int
+}
+
+// WriteCorridors writes the network center lines of Feed f to
+// <outFile>.corridors.shp. Aggregated shapes running within the corridor
+// tolerance of each other are dissolved into single corridor lines, which
+// carry the summed frequencies of all shapes along them. Corridors follow
+// the geometry of the busiest shape and are split wherever the set of
+// shapes along them changes
+func (sw *ShapeWriter) WriteCorridors(f *gtfsparser.Feed, outFile string) int {
+	defer sw.useLayer("corridors")()
+
+	fileName := sw.getOutFileName(outFile, ".corridors.shp")
+	shape := sw.createLayer(fileName, shp.POLYLINE, "corridors")
+	defer sw.closeLayer(shape, fileName)
+
+	aggrShapes, _ := sw.getAggrShapes(f.Trips, f)
+
+	trips := make(map[string]int, len(aggrShapes))
+	ids := make([]string, 0, len(aggrShapes))
+	for id, as := range aggrShapes {
+		for _, count := range as.RouteTripCount {
+			trips[id] += count
+		}
+		ids = append(ids, id)
+	}
+
+	// busier shapes come first and define the corridor geometries
+	sort.Slice(ids, func(i, j int) bool {
+		if trips[ids[i]] != trips[ids[j]] {
+			return trips[ids[i]] > trips[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+
+	lines := make([][][2]float64, len(ids))
+	for i, id := range ids {
+		as := aggrShapes[id]
+		lines[i] = clipShape(as.Shape.Points, as.From, as.To)
+	}
+
+	corridors := dissolveCorridors(lines, sw.opts.CorridorTolerance)
+
+	routeIDs := make([][]string, len(corridors))
+	names := make([]string, len(corridors))
+
+	idSize := uint8(0)
+	nameSize := uint8(0)
+	for i, c := range corridors {
+		routes := make(map[string]string)
+		for _, m := range c.members {
+			for rid, r := range aggrShapes[ids[m]].Routes {
+				routes[rid] = r.Short_name
+			}
+		}
+
+		shortNames := make(map[string]bool)
+		for rid, name := range routes {
+			routeIDs[i] = append(routeIDs[i], sw.ids.get("route", rid))
+			if len(name) > 0 {
+				shortNames[name] = true
+			}
+		}
+		sort.Strings(routeIDs[i])
+
+		nameList := make([]string, 0, len(shortNames))
+		for name := range shortNames {
+			nameList = append(nameList, name)
+		}
+		sort.Strings(nameList)
+		names[i] = strings.Join(nameList, ",")
+
+		fitSize(&idSize, len(strings.Join(routeIDs[i], ",")))
+		fitSize(&nameSize, len(names[i]))
+	}
+
+	shape.SetFields([]shp.Field{
+		shp.StringField(sw.fldName("RouteIds"), idSize),
+		shp.StringField(sw.fldName("RouteNames"), nameSize),
+		shp.NumberField(sw.fldName("Num_routes"), 16),
+		shp.NumberField(sw.fldName("Frequency"), 16),
+		shp.FloatField(sw.fldName("Km_len"), 32, 4),
+		shp.FloatField(sw.fldName("Km_tot"), 32, 4),
+	})
+
+	for n, c := range corridors {
+		points := make([]shp.Point, len(c.line))
+		meters := 0.0
+		for i, p := range c.line {
+			x, y := sw.project(p[0], p[1])
+			points[i] = shp.Point{X: x, Y: y}
+			if i > 0 {
+				meters += haversine(c.line[i-1][0], c.line[i-1][1], p[0], p[1])
+			}
+		}
+
+		freq := 0
+		for _, m := range c.members {
+			freq += trips[ids[m]]
+		}
+
+		shape.Write(shp.NewPolyLine([][]shp.Point{points}))
+
+		shape.WriteAttribute(n, 0, strings.Join(routeIDs[n], ","))
+		shape.WriteAttribute(n, 1, names[n])
+		shape.WriteAttribute(n, 2, len(routeIDs[n]))
+		shape.WriteAttribute(n, 3, freq)
+		sw.writeFloatAttr(shape, n, 4, meters/1000.0)
+		sw.writeFloatAttr(shape, n, 5, float64(freq)*meters/1000.0)
+	}
+
+	return len(corridors)
+}
+
+// dissolve the lines, given as lat, lon coordinates, into corridor center
+// lines. The lines are resampled every half tolerance, and each sample is
+// snapped to the nearest sample of an earlier line within the tolerance,
+// so earlier lines define the geometry of shared corridors. Sections used
+// by the same lines are then merged into single corridors. With a
+// tolerance of 0, every line is its own corridor
+func dissolveCorridors(lines [][][2]float64, tolerance float64) []corridor {
+	if tolerance <= 0 {
+		ret := make([]corridor, 0, len(lines))
+		for i, line := range lines {
+			if len(line) > 1 {
+				ret = append(ret, corridor{line, []int{i}})
+			}
+		}
+		return ret
+	}
+
+	minLat, maxLat := math.Inf(1), math.Inf(-1)
+	minLon, maxLon := math.Inf(1), math.Inf(-1)
+	for _, line := range lines {
+		for _, p := range line {
+			minLat, maxLat = math.Min(minLat, p[0]), math.Max(maxLat, p[0])
+			minLon, maxLon = math.Min(minLon, p[1]), math.Max(maxLon, p[1])
+		}
+	}
+
+	if math.IsInf(minLat, 0) {
+		return nil
+	}
+
+	frame := localFrame{lat0: (minLat + maxLat) / 2, lon0: (minLon + maxLon) / 2}
+	frame.cosLat = math.Cos(frame.lat0 * DEG_TO_RAD)
+
+	cellOf := func(p localPoint) [2]int {
+		return [2]int{int(math.Floor(p.x / tolerance)), int(math.Floor(p.y / tolerance))}
+	}
+
+	// the nodes, with the line which created them and their position in
+	// that line's path
+	nodes := make([]localPoint, 0)
+	owner := make([]int, 0)
+	ownerPos := make([]int, 0)
+	grid := make(map[[2]int][]int)
+
+	paths := make([][]int, len(lines))
+
+	for li, line := range lines {
+		created := make([]int, 0)
+		path := make([]int, 0)
+
+		for _, p := range resampleLocal(line, frame, tolerance/2) {
+			best := -1
+			bestDist := tolerance
+			c := cellOf(p)
+			for dx := -1; dx <= 1; dx++ {
+				for dy := -1; dy <= 1; dy++ {
+					for _, nd := range grid[[2]int{c[0] + dx, c[1] + dy}] {
+						if d := math.Hypot(nodes[nd].x-p.x, nodes[nd].y-p.y); d <= bestDist {
+							best, bestDist = nd, d
+						}
+					}
+				}
+			}
+
+			if best < 0 {
+				best = len(nodes)
+				nodes = append(nodes, p)
+				owner = append(owner, li)
+				ownerPos = append(ownerPos, len(path))
+				created = append(created, best)
+			} else if len(path) > 0 {
+				// fill in the nodes of the earlier line skipped between
+				// two samples snapped to it
+				last := path[len(path)-1]
+				if o := owner[best]; o != li && owner[last] == o {
+					from, to := ownerPos[last], ownerPos[best]
+					if to-from > 1 && to-from <= maxCorridorFill {
+						path = append(path, paths[o][from+1:to]...)
+					} else if from-to > 1 && from-to <= maxCorridorFill {
+						for k := from - 1; k > to; k-- {
+							path = append(path, paths[o][k])
+						}
+					}
+				}
+			}
+
+			if len(path) == 0 || path[len(path)-1] != best {
+				path = append(path, best)
+			}
+		}
+
+		paths[li] = path
+
+		// nodes only snap to earlier lines
+		for _, nd := range created {
+			c := cellOf(nodes[nd])
+			grid[c] = append(grid[c], nd)
+		}
+	}
+
+	// the lines along each edge between two nodes
+	edges := make(map[[2]int][]int)
+	adj := make(map[int][][2]int)
+	for li, path := range paths {
+		for i := 1; i < len(path); i++ {
+			e := [2]int{path[i-1], path[i]}
+			if e[0] > e[1] {
+				e[0], e[1] = e[1], e[0]
+			}
+
+			members, ok := edges[e]
+			if !ok {
+				adj[e[0]] = append(adj[e[0]], e)
+				adj[e[1]] = append(adj[e[1]], e)
+			}
+			if len(members) == 0 || members[len(members)-1] != li {
+				edges[e] = append(members, li)
+			}
+		}
+	}
+
+	sameMembers := func(a, b [2]int) bool {
+		ma, mb := edges[a], edges[b]
+		if len(ma) != len(mb) {
+			return false
+		}
+		for i := range ma {
+			if ma[i] != mb[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	// nodes where corridors end
+	joint := func(nd int) bool {
+		return len(adj[nd]) != 2 || !sameMembers(adj[nd][0], adj[nd][1])
+	}
+
+	keys := make([][2]int, 0, len(edges))
+	for e := range edges {
+		keys = append(keys, e)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+
+	visited := make(map[[2]int]bool, len(edges))
+	ret := make([]corridor, 0)
+
+	walk := func(start int, e [2]int) {
+		members := edges[e]
+		cur := start
+		chain := []int{start}
+
+		for {
+			visited[e] = true
+			next := e[0]
+			if next == cur {
+				next = e[1]
+			}
+			chain = append(chain, next)
+
+			if joint(next) {
+				break
+			}
+
+			following := adj[next][0]
+			if following == e {
+				following = adj[next][1]
+			}
+			if visited[following] {
+				break
+			}
+			cur, e = next, following
+		}
+
+		line := make([][2]float64, len(chain))
+		for i, nd := range chain {
+			line[i] = frame.toLatLon(nodes[nd])
+		}
+		ret = append(ret, corridor{line, members})
+	}
+
+	// corridors between joints first, then closed loops without joints
+	for _, e := range keys {
+		if visited[e] {
+			continue
+		}
+		if joint(e[0]) {
+			walk(e[0], e)
+		} else if joint(e[1]) {
+			walk(e[1], e)
+		}
+	}
+
+	for _, e := range keys {
+		if !visited[e] {
+			walk(e[0], e)
+		}
+	}
+
+	return ret
+}
+
+// return the points of a line, given as lat, lon coordinates, in the
+// local frame, spaced step meters along the line. The first and last
+// point are always included
+func resampleLocal(line [][2]float64, frame localFrame, step float64) []localPoint {
+	if len(line) == 0 {
+		return nil
+	}
+
+	prev := frame.toLocal(line[0])
+	ret := []localPoint{prev}
+	pending := step
+
+	for i := 1; i < len(line); i++ {
+		p := frame.toLocal(line[i])
+		d := math.Hypot(p.x-prev.x, p.y-prev.y)
+
+		for d >= pending {
+			t := pending / d
+			prev = localPoint{prev.x + t*(p.x-prev.x), prev.y + t*(p.y-prev.y)}
+			ret = append(ret, prev)
+			d -= pending
+			pending = step
+		}
+
+		pending -= d
+		prev = p
+	}
+
+	if last := ret[len(ret)-1]; last != prev {
+		ret = append(ret, prev)
+	}
+
+	return ret
+}
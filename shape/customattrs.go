@@ -0,0 +1,71 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/jonas-p/go-shp"
+	"github.com/patrickbr/gtfsparser/gtfs"
+)
+
+// AttrComputer computes the value of a custom attribute for a single
+// output feature. Depending on the output, trip, route or shape may be
+// nil: explicit trips get the trip and its route, route shapes and the
+// route overview CSV get the route (and the aggregated shape, if
+// available), aggregated shapes only get the shape. An AttrComputer may
+// be called more than once per feature and must be deterministic.
+type AttrComputer func(trip *gtfs.Trip, route *gtfs.Route, shape *AggrShape) string
+
+// a registered custom attribute
+type customAttr struct {
+	name    string
+	compute AttrComputer
+}
+
+// RegisterAttr registers a custom attribute which will be added as
+// an additional column to all trip and route outputs
+func (sw *ShapeWriter) RegisterAttr(name string, compute AttrComputer) {
+	sw.customAttrs = append(sw.customAttrs, customAttr{name, compute})
+}
+
+// return the fields for the custom attributes. visit must call its
+// argument for every feature which will be written
+func (sw *ShapeWriter) getCustomAttrFields(visit func(func(*gtfs.Trip, *gtfs.Route, *AggrShape))) []shp.Field {
+	if len(sw.customAttrs) == 0 {
+		return nil
+	}
+
+	sizes := make([]uint8, len(sw.customAttrs))
+
+	visit(func(trip *gtfs.Trip, route *gtfs.Route, shape *AggrShape) {
+		for i, attr := range sw.customAttrs {
+			fitSize(&sizes[i], len(attr.compute(trip, route, shape)))
+		}
+	})
+
+	ret := make([]shp.Field, len(sw.customAttrs))
+	for i, attr := range sw.customAttrs {
+		ret[i] = shp.StringField(sw.fldName(attr.name), sizes[i])
+	}
+
+	return ret
+}
+
+// write the custom attributes of a feature, starting at field fld
+func (sw *ShapeWriter) writeCustomAttrs(shape attrWriter, row int, fld int, trip *gtfs.Trip, route *gtfs.Route, aggrShape *AggrShape) {
+	for i, attr := range sw.customAttrs {
+		shape.WriteAttribute(row, fld+i, attr.compute(trip, route, aggrShape))
+	}
+}
+
+// return the custom attribute values of a feature
+func (sw *ShapeWriter) getCustomAttrVals(trip *gtfs.Trip, route *gtfs.Route, aggrShape *AggrShape) []string {
+	ret := make([]string, len(sw.customAttrs))
+	for i, attr := range sw.customAttrs {
+		ret[i] = attr.compute(trip, route, aggrShape)
+	}
+	return ret
+}
@@ -0,0 +1,79 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// TripDelays holds observed delays in seconds, keyed by trip ID
+type TripDelays map[string][]float64
+
+// ReadTripDelays reads a CSV archive of observed trip delays, for example
+// extracted from recorded GTFS-RT TripUpdates. The file must have a header
+// containing at least the columns trip_id and delay (in seconds). Each
+// line is a single observation, a trip may be observed multiple times.
+func ReadTripDelays(path string) (TripDelays, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open delay file (%s)", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read header of delay file %s (%s)", path, err)
+	}
+
+	tripIDCol := -1
+	delayCol := -1
+
+	for i, name := range header {
+		switch name {
+		case "trip_id":
+			tripIDCol = i
+		case "delay":
+			delayCol = i
+		}
+	}
+
+	if tripIDCol < 0 || delayCol < 0 {
+		return nil, fmt.Errorf("delay file %s must contain the columns trip_id and delay", path)
+	}
+
+	ret := make(TripDelays)
+
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read delay file %s (%s)", path, err)
+		}
+
+		if tripIDCol >= len(record) || delayCol >= len(record) || len(record[delayCol]) == 0 {
+			continue
+		}
+
+		delay, err := strconv.ParseFloat(record[delayCol], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delay '%s' in line %d of %s", record[delayCol], line, path)
+		}
+
+		ret[record[tripIDCol]] = append(ret[record[tripIDCol]], delay)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,481 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/jonas-p/go-shp"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// DictionaryColumn describes an attribute column of a written output
+type DictionaryColumn struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"` // string, integer or float
+	Width       int    `json:"width,omitempty"`
+	Decimals    int    `json:"decimals,omitempty"`
+	Source      string `json:"source,omitempty"`
+	Unit        string `json:"unit,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// DictionaryEntry describes all attribute columns of a written output file
+type DictionaryEntry struct {
+	File    string             `json:"file"`
+	Columns []DictionaryColumn `json:"columns"`
+}
+
+// documentation of an output column
+type columnDoc struct {
+	typ    string // only used for CSV columns, shapefiles have typed fields
+	source string
+	unit   string
+	desc   string
+}
+
+// column documentation by original column name, per output kind. Columns
+// not found here are looked up in commonColumnDocs
+var columnDocs = map[string]map[string]columnDoc{
+	"trips": {
+		"Id":          {"string", "trips.txt trip_id", "", "trip ID"},
+		"Headsign":    {"string", "trips.txt trip_headsign", "", "trip headsign"},
+		"ShortName":   {"string", "trips.txt trip_short_name", "", "trip short name"},
+		"Dir_id":      {"integer", "trips.txt direction_id", "", "direction ID"},
+		"BlockId":     {"string", "trips.txt block_id", "", "block ID"},
+		"Wheelchr_a":  {"integer", "trips.txt wheelchair_accessible", "", "wheelchair accessibility"},
+		"Bikes_alwd":  {"integer", "trips.txt bikes_allowed", "", "bikes allowed"},
+		"R_ShrtName":  {"string", "routes.txt route_short_name", "", "route short name"},
+		"R_LongName":  {"string", "routes.txt route_long_name", "", "route long name"},
+		"R_Desc":      {"string", "routes.txt route_desc", "", "route description"},
+		"R_Type":      {"integer", "routes.txt route_type", "", "route type"},
+		"R_URL":       {"string", "routes.txt route_url", "", "route URL"},
+		"R_Color":     {"string", "routes.txt route_color", "", "route color"},
+		"R_TextColor": {"string", "routes.txt route_text_color", "", "route text color"},
+		"Mon":         {"integer", "calendar.txt, calendar_dates.txt", "", "1 if the trip operates on a Monday"},
+		"Tue":         {"integer", "calendar.txt, calendar_dates.txt", "", "1 if the trip operates on a Tuesday"},
+		"Wed":         {"integer", "calendar.txt, calendar_dates.txt", "", "1 if the trip operates on a Wednesday"},
+		"Thu":         {"integer", "calendar.txt, calendar_dates.txt", "", "1 if the trip operates on a Thursday"},
+		"Fri":         {"integer", "calendar.txt, calendar_dates.txt", "", "1 if the trip operates on a Friday"},
+		"Sat":         {"integer", "calendar.txt, calendar_dates.txt", "", "1 if the trip operates on a Saturday"},
+		"Sun":         {"integer", "calendar.txt, calendar_dates.txt", "", "1 if the trip operates on a Sunday"},
+		"Holiday":     {"integer", "calendar.txt, calendar_dates.txt, -holidays", "", "1 if the trip operates on a holiday"},
+		"Start_date":  {"string", "first service date", "ISO 8601 date", "first service date"},
+		"Start_ep":    {"integer", "first service date", "s since epoch", "first service date, midnight UTC"},
+		"End_date":    {"string", "last service date", "ISO 8601 date", "last service date"},
+		"End_ep":      {"integer", "last service date", "s since epoch", "last service date, midnight UTC"},
+		"First_dep":   {"string", "stop_times.txt departure_time of the first stop", "ISO 8601 time", "first departure"},
+		"Dep_sec":     {"integer", "stop_times.txt departure_time of the first stop", "s since midnight", "first departure"},
+		"Km":          {"float", "length of the trip geometry", "km", "trip length"},
+		"Runtime":     {"float", "last arrival - first departure", "min", "scheduled runtime"},
+		"Speed":       {"float", "Km / Runtime", "km/h", "average speed"},
+		"Geom_src":    {"string", "shapes.txt, or stops.txt with -shapeless-trips", "", "geometry source: shape, straight or great_circle"},
+		"Service_id":  {"string", "trips.txt service_id", "", "service ID"},
+		"Days":        {"string", "calendar.txt, calendar_dates.txt, -holidays", "", "condensed operation days, like Mo-Fr or Sa,Su+holidays"},
+		"Feat_id":     {"string", "hash of route_id, trip_id", "", "stable feature ID"},
+		"Num_trips":   {"integer", "count of trips", "", "number of represented trips"},
+		"Geom_id":     {"integer", "-shared-trip-geoms", "", "ID of the trip geometry in the trip geometries layer"},
+	},
+	"routes": {
+		"Route_id":    {"string", "routes.txt route_id", "", "route ID, or group ID with -route-groups"},
+		"Short_name":  {"string", "routes.txt route_short_name", "", "route short name"},
+		"Long_name":   {"string", "routes.txt route_long_name", "", "route long name"},
+		"Type":        {"string", "routes.txt route_type, -route-type-mapping", "", "route type"},
+		"Frequency":   {"integer", "count of trips", "", "number of trips over the service period"},
+		"Km_len":      {"float", "length of the route variant geometry", "km", "length"},
+		"Km_tot":      {"float", "sum of Km_len over all trips", "km", "vehicle km over the service period"},
+		"Agency_id":   {"string", "agency.txt agency_id", "", "agency ID"},
+		"Agency_name": {"string", "agency.txt agency_name", "", "agency name"},
+		"Agency_url":  {"string", "agency.txt agency_url", "", "agency URL"},
+		"Wchair_tr":   {"float", "trips.txt wheelchair_accessible", "share", "share of wheelchair accessible trips"},
+		"Wchair_st":   {"float", "stops.txt wheelchair_boarding", "share", "share of wheelchair accessible stop events"},
+		"Bikes_tr":    {"float", "trips.txt bikes_allowed", "share", "share of trips allowing bikes"},
+		"Dir_diff":    {"integer", "trips.txt direction_id", "", "trips in direction 0 minus trips in direction 1"},
+		"Dir_imbal":   {"float", "abs(Dir_diff) / trips with a direction", "share", "direction imbalance"},
+		"Hw_exact":    {"float", "frequencies.txt headway_secs, exact_times=1", "s", "average headway of exact_times=1 frequencies"},
+		"Hw_freq":     {"float", "frequencies.txt headway_secs, exact_times=0", "s", "average headway of exact_times=0 frequencies"},
+		"Stop_dist":   {"float", "trip length / (served stops - 1)", "m", "average distance between served stops"},
+		"Vehicles":    {"integer", "peak of overlapping trips and blocks", "", "estimated peak number of simultaneous vehicles"},
+		"Variant":     {"string", "route name, first and last stop", "", "readable variant name"},
+		"Max_gap":     {"float", "shapes.txt shape_pt_lat, shape_pt_lon", "m", "largest distance between consecutive shape points"},
+		"Max_stop_d":  {"float", "stops.txt stop_lat, stop_lon, shapes.txt", "m", "largest distance of a served stop to the shape"},
+		"Loop":        {"integer", "stop_times.txt first and last stop", "", "1 if the trips end where they started"},
+		"Loop_dir":    {"string", "shapes.txt shape_pt_lat, shape_pt_lon", "", "loop direction, cw or ccw"},
+		"Loop_start":  {"string", "stop_times.txt stop_id", "", "nominal start stop of the loop"},
+		"Loop_km":     {"float", "length of the loop geometry", "km", "loop length"},
+		"Headsign":    {"string", "trips.txt trip_headsign", "", "most common headsign of the variant's trips"},
+		"Feat_id":     {"string", "hash of route_id, shape_id", "", "stable feature ID of the route and variant"},
+		"Avg_delay":   {"float", "-delays", "s", "average observed delay"},
+		"Punctual":    {"float", "-delays, -punctuality-threshold", "share", "share of punctual observations"},
+		"Hw_min":      {"float", "stop_times.txt, frequencies.txt, -headway-window", "s", "minimum headway between departures from the first stop within the service window"},
+		"Hw_max":      {"float", "stop_times.txt, frequencies.txt, -headway-window", "s", "maximum headway between departures from the first stop within the service window"},
+		"Hw_med":      {"float", "stop_times.txt, frequencies.txt, -headway-window", "s", "median headway between departures from the first stop within the service window"},
+		"Km_max":      {"float", "max of Km_len over all route variants", "km", "length of the longest route variant"},
+		"Num_routes":  {"integer", "count of routes", "", "number of summarized routes"},
+		"Km_net":      {"float", "sum of Km_len over distinct route variants", "km", "network length"},
+		"Trips_day":   {"float", "Frequency / days of the service period", "", "average number of trips per day"},
+		"Km_in":       {"float", "Km_tot inside of -boundary", "km", "vehicle km inside of the boundary"},
+		"Km_out":      {"float", "Km_tot outside of -boundary", "km", "vehicle km outside of the boundary"},
+	},
+	"shapes": {
+		"Id":         {"string", "shapes.txt shape_id", "", "shape ID"},
+		"TripIds":    {"string", "trips.txt trip_id", "", "IDs of the trips using the shape"},
+		"RouteIds":   {"string", "routes.txt route_id", "", "IDs of the routes using the shape"},
+		"RouteNames": {"string", "routes.txt route_short_name", "", "short names of the routes using the shape"},
+		"Variant":    {"string", "route name, first and last stop", "", "readable variant name"},
+		"Max_gap":    {"float", "shapes.txt shape_pt_lat, shape_pt_lon", "m", "largest distance between consecutive shape points"},
+		"Max_stop_d": {"float", "stops.txt stop_lat, stop_lon, shapes.txt", "m", "largest distance of a served stop to the shape"},
+		"Frequency":  {"integer", "count of trips", "", "number of trips over the service period"},
+		"Num_routes": {"integer", "count of routes", "", "number of routes using the shape"},
+		"Km_len":     {"float", "length of the shape geometry", "km", "length"},
+		"Km_tot":     {"float", "sum of Km_len over all trips", "km", "vehicle km over the service period"},
+		"Km_day":     {"float", "Km_tot / days of the service period", "km", "average daily vehicle km"},
+		"Headsign":   {"string", "trips.txt trip_headsign", "", "most common headsign of the trips using the shape"},
+		"Feat_id":    {"string", "hash of shape_id", "", "stable feature ID"},
+	},
+	"stations": {
+		"Id":                  {"string", "stops.txt stop_id", "", "stop ID"},
+		"Code":                {"string", "stops.txt stop_code", "", "stop code"},
+		"Name":                {"string", "stops.txt stop_name", "", "stop name"},
+		"Desc":                {"string", "stops.txt stop_desc", "", "stop description"},
+		"Zone_id":             {"string", "stops.txt zone_id", "", "fare zone ID"},
+		"Url":                 {"string", "stops.txt stop_url", "", "stop URL"},
+		"Location_type":       {"integer", "stops.txt location_type", "", "location type"},
+		"Parent_station":      {"string", "stops.txt parent_station", "", "parent station ID"},
+		"Timezone":            {"string", "stops.txt stop_timezone", "", "stop timezone"},
+		"Wheelchair_boarding": {"string", "stops.txt wheelchair_boarding", "", "wheelchair boarding"},
+		"Loc_name":            {"string", "stops.txt location_type", "", "name of the location type"},
+		"Has_transf":          {"integer", "transfers.txt from_stop_id, to_stop_id", "", "1 if the stop or one of its child stops appears in transfers.txt"},
+		"Transfers":           {"integer", "transfers.txt from_stop_id, to_stop_id", "", "number of transfers.txt records of the stop and its child stops"},
+		"Has_pathw":           {"integer", "pathways.txt from_stop_id, to_stop_id", "", "1 if the stop or one of its child stops appears in pathways.txt"},
+		"Pathways":            {"integer", "pathways.txt from_stop_id, to_stop_id", "", "number of pathways.txt records of the stop and its child stops"},
+		"Group_id":            {"string", "stops.txt parent_station, pathways.txt", "", "ID of the station group, the top-level station or stop with the smallest ID among those connected by pathways"},
+		"Frequency":           {"integer", "count of trips", "", "number of trips serving the stop or its child stops over the service period"},
+		"Wchair_tr":           {"float", "trips.txt wheelchair_accessible", "share", "share of wheelchair accessible trips among those serving the stop"},
+		"Bikes_tr":            {"float", "trips.txt bikes_allowed", "share", "share of trips allowing bikes among those serving the stop"},
+		"Feat_id":             {"string", "hash of stop_id", "", "stable feature ID"},
+		"Lat":                 {"float", "stops.txt stop_lat", "degrees", "WGS84 latitude"},
+		"Lon":                 {"float", "stops.txt stop_lon", "degrees", "WGS84 longitude"},
+		"X":                   {"float", "stops.txt stop_lon, stop_lat", "output projection", "projected x coordinate"},
+		"Y":                   {"float", "stops.txt stop_lon, stop_lat", "output projection", "projected y coordinate"},
+	},
+	"labels": {
+		"Route_id":   {"string", "routes.txt route_id", "", "route ID"},
+		"Short_name": {"string", "routes.txt route_short_name", "", "route short name"},
+		"Color":      {"string", "routes.txt route_color", "", "route color"},
+		"Text_color": {"string", "routes.txt route_text_color", "", "route text color"},
+		"Variant":    {"string", "route name, first and last stop", "", "readable variant name"},
+		"Angle":      {"float", "direction of the line at the anchor", "degrees", "label angle, counterclockwise from east"},
+	},
+	"stopchains": {
+		"Route_id":   {"string", "routes.txt route_id", "", "route ID"},
+		"Short_name": {"string", "routes.txt route_short_name", "", "route short name"},
+		"R_Type":     {"integer", "routes.txt route_type", "", "route type"},
+		"Dir_id":     {"integer", "trips.txt direction_id", "", "direction ID"},
+		"Trip_id":    {"string", "trips.txt trip_id", "", "trip with the smallest ID following the pattern"},
+		"From_stop":  {"string", "stop_times.txt stop_id", "", "first stop of the pattern"},
+		"To_stop":    {"string", "stop_times.txt stop_id", "", "last stop of the pattern"},
+		"Num_stops":  {"integer", "count of stop times", "", "number of stops of the pattern"},
+		"Num_trips":  {"integer", "count of trips", "", "number of trips following the pattern"},
+		"Frequency":  {"integer", "count of trips", "", "number of trips over the service period"},
+		"Km":         {"float", "stops.txt stop_lat, stop_lon", "km", "length of the straight segments between the stops"},
+	},
+	"interlines": {
+		"Block_id":   {"string", "trips.txt block_id", "", "block ID"},
+		"Service_id": {"string", "trips.txt service_id", "", "service ID"},
+		"From_trip":  {"string", "trips.txt trip_id", "", "ID of the arriving trip"},
+		"To_trip":    {"string", "trips.txt trip_id", "", "ID of the next trip of the block"},
+		"From_route": {"string", "routes.txt route_id", "", "route ID of the arriving trip"},
+		"To_route":   {"string", "routes.txt route_id", "", "route ID of the next trip"},
+		"From_stop":  {"string", "stop_times.txt stop_id", "", "last stop of the arriving trip"},
+		"To_stop":    {"string", "stop_times.txt stop_id", "", "first stop of the next trip"},
+		"Arr":        {"string", "stop_times.txt arrival_time", "", "arrival at the last stop, ISO 8601 time"},
+		"Dep":        {"string", "stop_times.txt departure_time", "", "departure from the first stop, ISO 8601 time"},
+		"Layover":    {"float", "stop_times.txt arrival_time, departure_time", "minutes", "layover time between the trips"},
+		"Km":         {"float", "stops.txt stop_lat, stop_lon", "km", "straight distance between the stops (deadhead)"},
+		"Interline":  {"integer", "trips.txt route_id", "", "1 if the vehicle changes the route, 0 otherwise"},
+	},
+	"buffers": {
+		"Route_id":   {"string", "routes.txt route_id", "", "route ID"},
+		"Short_name": {"string", "routes.txt route_short_name", "", "route short name"},
+		"R_Type":     {"integer", "routes.txt route_type", "", "route type"},
+		"Width":      {"float", "-buffers", "m", "buffer width around the route geometries"},
+		"Km2":        {"float", "buffer polygon", "km2", "covered area"},
+	},
+	"corridors": {
+		"RouteIds":   {"string", "routes.txt route_id", "", "IDs of the routes running along the corridor"},
+		"RouteNames": {"string", "routes.txt route_short_name", "", "short names of the routes running along the corridor"},
+		"Num_routes": {"integer", "count of routes", "", "number of routes running along the corridor"},
+		"Frequency":  {"integer", "count of trips", "", "number of trips along the corridor over the service period, over all routes"},
+		"Km_len":     {"float", "length of the corridor geometry", "km", "length"},
+		"Km_tot":     {"float", "Frequency * Km_len", "km", "vehicle km over the service period"},
+	},
+	"modeshare": {
+		"Agency_id":   {"string", "agency.txt agency_id", "", "agency ID, * for all agencies"},
+		"Agency_name": {"string", "agency.txt agency_name", "", "agency name"},
+		"Type":        {"string", "routes.txt route_type, -route-type-mapping", "", "route type, * for all types"},
+		"Num_routes":  {"integer", "count of routes", "", "number of routes"},
+		"Frequency":   {"integer", "count of trips", "", "number of trips over the service period"},
+		"Km_net":      {"float", "sum of Km_len over distinct route variants", "km", "network length"},
+		"Km_tot":      {"float", "sum of Km_len over all trips", "km", "vehicle km over the service period"},
+		"Share_net":   {"float", "Km_net / network Km_net", "share", "share of the network length"},
+		"Share_tot":   {"float", "Km_tot / network Km_tot", "share", "share of the vehicle km"},
+	},
+	"shapesharing": {
+		"Shape_id":   {"string", "shapes.txt shape_id", "", "shape ID"},
+		"Num_routes": {"integer", "count of routes", "", "number of routes with trips using the shape"},
+		"RouteIds":   {"string", "routes.txt route_id", "", "IDs of the routes with trips using the shape"},
+		"Num_trips":  {"integer", "count of trips", "", "number of trips using the shape"},
+		"Num_points": {"integer", "count of shapes.txt records", "", "number of shape points"},
+		"Geom_hash":  {"string", "shapes.txt shape_pt_lat, shape_pt_lon", "", "hash of the shape geometry"},
+		"Duplicates": {"string", "shapes.txt shape_id", "", "IDs of other shapes with the same geometry"},
+	},
+	"tripgeoms": {
+		"Geom_id":  {"integer", "distinct trip geometries", "", "trip geometry ID"},
+		"Shape_id": {"string", "shapes.txt shape_id", "", "shape ID, empty for trips without a shape"},
+		"Km":       {"float", "length of the geometry", "km", "length"},
+	},
+	"shapepoints": {
+		"Shape_id": {"string", "shapes.txt shape_id", "", "shape ID"},
+		"Seq":      {"integer", "shapes.txt shape_pt_sequence", "", "point sequence"},
+		"Dist":     {"float", "shapes.txt shape_dist_traveled", "feed units", "distance traveled"},
+	},
+	"stopevents": {
+		"Trip_id": {"string", "stop_times.txt trip_id", "", "trip ID"},
+		"Stop_id": {"string", "stop_times.txt stop_id", "", "stop ID"},
+		"Seq":     {"integer", "stop_times.txt stop_sequence", "", "stop sequence"},
+		"Arr":     {"string", "stop_times.txt arrival_time", "ISO 8601 time", "arrival"},
+		"Dep":     {"string", "stop_times.txt departure_time", "ISO 8601 time", "departure"},
+		"Arr_sec": {"integer", "stop_times.txt arrival_time", "s since midnight", "arrival"},
+		"Dep_sec": {"integer", "stop_times.txt departure_time", "s since midnight", "departure"},
+		"Dwell":   {"integer", "departure_time - arrival_time", "s", "dwell time"},
+		"Dist":    {"float", "stop_times.txt shape_dist_traveled", "feed units", "distance traveled along the shape"},
+	},
+}
+
+// column documentation shared by all output kinds
+var commonColumnDocs = map[string]columnDoc{
+	"Mode_class": {"string", "routes.txt route_type", "", "water, aerial, funicular or land"},
+	"Min_x":      {"float", "bounding box of the geometry", "output projection", "minimum x coordinate"},
+	"Min_y":      {"float", "bounding box of the geometry", "output projection", "minimum y coordinate"},
+	"Max_x":      {"float", "bounding box of the geometry", "output projection", "maximum x coordinate"},
+	"Max_y":      {"float", "bounding box of the geometry", "output projection", "maximum y coordinate"},
+	"Cent_x":     {"float", "length-weighted centroid of the geometry", "output projection", "centroid x coordinate"},
+	"Cent_y":     {"float", "length-weighted centroid of the geometry", "output projection", "centroid y coordinate"},
+}
+
+// the route overview CSV has the columns of the route shapes
+var columnDocKinds = map[string]string{
+	"overview":    "routes",
+	"stationscsv": "stations",
+}
+
+// return the documentation of the output columns of kind, by column name
+// as written to the output. If dbf is true, names are truncated to the
+// DBF field name length
+func (sw *ShapeWriter) columnDocsByName(kind string, dbf bool) map[string]columnDoc {
+	ret := make(map[string]columnDoc)
+
+	name := func(orig string) string {
+		if dbf {
+			return dbfFieldName(sw.fldName(orig))
+		}
+		return sw.fldName(orig)
+	}
+
+	for orig, doc := range commonColumnDocs {
+		ret[name(orig)] = doc
+	}
+
+	if k, ok := columnDocKinds[kind]; ok {
+		kind = k
+	}
+
+	for orig, doc := range columnDocs[kind] {
+		ret[name(orig)] = doc
+	}
+
+	for _, attr := range sw.customAttrs {
+		ret[name(attr.name)] = columnDoc{"string", "custom attribute " + attr.name, "", ""}
+	}
+
+	return ret
+}
+
+// return the documentation of a column not found in the documentation
+// table of kind
+func undocumentedColumn(kind string, name string) columnDoc {
+	switch kind {
+	case "routes", "overview":
+		return columnDoc{"string", "routes.txt " + name, "", "additional route field"}
+	case "trips":
+		return columnDoc{"string", "trips.txt " + name, "", "additional trip field"}
+	case "stations", "stationscsv":
+		if lang := strings.TrimPrefix(name, stopNameFldPrefix); lang != name {
+			return columnDoc{"string", "translations.txt stop_name", "", "stop name in language " + lang}
+		}
+		return columnDoc{"string", "stops.txt " + name, "", "additional stop field"}
+	}
+	return columnDoc{typ: "string"}
+}
+
+// add the shapefile layer fileName of the given kind with its fields to
+// the dictionary
+func (sw *ShapeWriter) addDictionaryLayer(fileName string, kind string, fields []shp.Field) {
+	docs := sw.columnDocsByName(kind, true)
+
+	entry := DictionaryEntry{File: fileName, Columns: make([]DictionaryColumn, 0, len(fields))}
+
+	for _, fld := range fields {
+		name := fld.String()
+		doc, ok := docs[name]
+		if !ok {
+			doc = undocumentedColumn(kind, name)
+		}
+
+		col := DictionaryColumn{
+			Name:        name,
+			Width:       int(fld.Size),
+			Source:      doc.source,
+			Unit:        doc.unit,
+			Description: doc.desc,
+		}
+
+		switch fld.Fieldtype {
+		case 'N':
+			col.Type = "integer"
+		case 'F':
+			col.Type = "float"
+			col.Decimals = int(fld.Precision)
+		default:
+			col.Type = "string"
+		}
+
+		entry.Columns = append(entry.Columns, col)
+	}
+
+	sw.dictionary = append(sw.dictionary, entry)
+}
+
+// add the CSV file fileName of the given kind with its header to the
+// dictionary
+func (sw *ShapeWriter) addDictionaryCsv(fileName string, kind string, header []string) {
+	docs := sw.columnDocsByName(kind, false)
+
+	entry := DictionaryEntry{File: fileName, Columns: make([]DictionaryColumn, 0, len(header))}
+
+	for _, name := range header {
+		doc, ok := docs[name]
+		if !ok {
+			doc = undocumentedColumn(kind, name)
+		}
+
+		entry.Columns = append(entry.Columns, DictionaryColumn{
+			Name:        name,
+			Type:        doc.typ,
+			Source:      doc.source,
+			Unit:        doc.unit,
+			Description: doc.desc,
+		})
+	}
+
+	sw.dictionary = append(sw.dictionary, entry)
+}
+
+// add the calendar matrix CSV fileName with its header to the dictionary
+func (sw *ShapeWriter) addDictionaryCalendar(fileName string, header []string) {
+	entry := DictionaryEntry{File: fileName, Columns: make([]DictionaryColumn, 0, len(header))}
+
+	entry.Columns = append(entry.Columns, DictionaryColumn{Name: header[0], Type: "string", Source: "calendar.txt, calendar_dates.txt", Unit: "ISO 8601 date", Description: "service date"})
+
+	for _, name := range header[1:] {
+		entry.Columns = append(entry.Columns, DictionaryColumn{Name: name, Type: "integer", Source: "count of trips", Description: "number of trips of route " + name + " on this date"})
+	}
+
+	sw.dictionary = append(sw.dictionary, entry)
+}
+
+// add the hourly departures matrix CSV fileName for date d with its
+// header to the dictionary
+func (sw *ShapeWriter) addDictionaryHourly(fileName string, header []string, d gtfs.Date) {
+	entry := DictionaryEntry{File: fileName, Columns: make([]DictionaryColumn, 0, len(header))}
+
+	entry.Columns = append(entry.Columns, DictionaryColumn{Name: header[0], Type: "string", Source: "routes.txt route_id", Description: "route ID"})
+	entry.Columns = append(entry.Columns, DictionaryColumn{Name: header[1], Type: "string", Source: "routes.txt route_short_name", Description: "route short name"})
+
+	for _, name := range header[2:] {
+		entry.Columns = append(entry.Columns, DictionaryColumn{Name: name, Type: "integer", Source: "count of trips", Description: "number of departures of the route between " + name + ":00 and " + name + ":59 on " + isoDate(d)})
+	}
+
+	sw.dictionary = append(sw.dictionary, entry)
+}
+
+// Dictionary returns the descriptions of all outputs written so far
+func (sw *ShapeWriter) Dictionary() []DictionaryEntry {
+	return sw.dictionary
+}
+
+// WriteDictionary writes a data dictionary of all outputs written so far
+// next to outFile, either as JSON ("json") or as CSV ("csv")
+func (sw *ShapeWriter) WriteDictionary(outFile string, format string) {
+	file, err := sw.createFile(sw.getOutFileName(outFile, ".dictionary."+format))
+
+	if err != nil {
+		panic(fmt.Sprintf("Could not open dictionary file for writing (%s)", err))
+	}
+	defer file.Close()
+
+	if format == "csv" {
+		sw.WriteDictionaryCsvTo(file)
+	} else {
+		sw.WriteDictionaryJSONTo(file)
+	}
+}
+
+// WriteDictionaryJSONTo writes the data dictionary as JSON to w
+func (sw *ShapeWriter) WriteDictionaryJSONTo(w io.Writer) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	if err := enc.Encode(struct {
+		Files []DictionaryEntry `json:"files"`
+	}{sw.dictionary}); err != nil {
+		panic(fmt.Sprintf("Could not write dictionary file (%s)", err))
+	}
+}
+
+// WriteDictionaryCsvTo writes the data dictionary as CSV to w, with one
+// line per column
+func (sw *ShapeWriter) WriteDictionaryCsvTo(w io.Writer) {
+	csvwriter := csv.NewWriter(w)
+
+	csvwriter.Write([]string{"file", "name", "type", "width", "decimals", "source", "unit", "description"})
+
+	for _, entry := range sw.dictionary {
+		for _, col := range entry.Columns {
+			width := ""
+			if col.Width > 0 {
+				width = strconv.Itoa(col.Width)
+			}
+			decimals := ""
+			if col.Type == "float" && col.Width > 0 {
+				decimals = strconv.Itoa(col.Decimals)
+			}
+			csvwriter.Write([]string{entry.File, col.Name, col.Type, width, decimals, col.Source, col.Unit, col.Description})
+		}
+	}
+
+	csvwriter.Flush()
+
+	if err := csvwriter.Error(); err != nil {
+		panic(fmt.Sprintf("Could not write dictionary file (%s)", err))
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"fmt"
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"math"
+)
+
+// shapes shorter than this many meters are too short to reliably detect
+// the unit of their shape_dist_traveled values
+const minDistUnitLength = 50
+
+// maximum factor between the measured and the geometric length of a
+// shape for its shape_dist_traveled unit to be detected
+const maxDistUnitDeviation = 1.5
+
+// the shape_dist_traveled units detected, with their length in meters
+var distUnits = []struct {
+	name   string
+	meters float64
+}{
+	{"meters", 1},
+	{"kilometers", 1000},
+	{"miles", 1609.344},
+	{"feet", 0.3048},
+}
+
+// NormalizeShapeDistUnits detects the unit of the shape_dist_traveled
+// values of each shape of Feed f by comparing them to the length of its
+// geometry, and converts the values of shapes not measured in meters,
+// together with the stop times of the trips using them, to meters. Feeds
+// merged from several operators sometimes mix units, which would
+// otherwise produce wrong clipping and aggregation. Returns a description
+// of the conversions, by shape ID
+func NormalizeShapeDistUnits(f *gtfsparser.Feed) map[string]string {
+	factors := make(map[*gtfs.Shape]float64)
+	ret := make(map[string]string)
+
+	for _, shape := range f.Shapes {
+		unit := shapeDistUnit(shape.Points)
+		if unit <= 0 {
+			continue
+		}
+
+		factors[shape] = distUnits[unit].meters
+		for i := range shape.Points {
+			shape.Points[i].Dist_traveled *= float32(distUnits[unit].meters)
+		}
+
+		ret[shape.Id] = fmt.Sprintf("converted from %s", distUnits[unit].name)
+	}
+
+	if len(factors) == 0 {
+		return ret
+	}
+
+	for _, trip := range f.Trips {
+		factor, ok := factors[trip.Shape]
+		if !ok {
+			continue
+		}
+
+		for i := range trip.StopTimes {
+			if trip.StopTimes[i].HasDistanceTraveled() {
+				trip.StopTimes[i].SetShape_dist_traveled(trip.StopTimes[i].Shape_dist_traveled() * float32(factor))
+			}
+		}
+	}
+
+	return ret
+}
+
+// return the index in distUnits of the unit of the shape_dist_traveled
+// values of points, or -1 if it cannot be detected
+func shapeDistUnit(points gtfs.ShapePoints) int {
+	first, last := -1, -1
+	for i, p := range points {
+		if math.IsNaN(float64(p.Dist_traveled)) {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+	}
+
+	if first < 0 || last <= first {
+		return -1
+	}
+
+	measured := float64(points[last].Dist_traveled - points[first].Dist_traveled)
+	length := 0.0
+	for i := first + 1; i <= last; i++ {
+		length += haversineP(points[i-1], points[i])
+	}
+
+	if measured <= 0 || length < minDistUnitLength {
+		return -1
+	}
+
+	// the unit nearest to the ratio of the lengths, on a log scale
+	ret := -1
+	best := math.Log(maxDistUnitDeviation)
+	for i, unit := range distUnits {
+		if d := math.Abs(math.Log(length / measured / unit.meters)); d < best {
+			ret, best = i, d
+		}
+	}
+
+	return ret
+}
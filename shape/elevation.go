@@ -0,0 +1,204 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/jonas-p/go-shp"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"io"
+	"math"
+	"os"
+	"strconv"
+)
+
+// Elevations holds shape point elevations in meters, keyed by shape ID
+// and shape_pt_sequence
+type Elevations map[string]map[uint32]float64
+
+// ReadElevations reads shape point elevations from a CSV file with a
+// header containing at least the columns shape_id, shape_pt_sequence and
+// shape_pt_elevation, like a shapes.txt with the elevation extension
+func ReadElevations(path string) (Elevations, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open elevation file (%s)", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read header of elevation file %s (%s)", path, err)
+	}
+
+	shapeIDCol := -1
+	seqCol := -1
+	elevCol := -1
+
+	for i, name := range header {
+		switch name {
+		case "shape_id":
+			shapeIDCol = i
+		case "shape_pt_sequence":
+			seqCol = i
+		case "shape_pt_elevation":
+			elevCol = i
+		}
+	}
+
+	if shapeIDCol < 0 || seqCol < 0 || elevCol < 0 {
+		return nil, fmt.Errorf("elevation file %s must contain the columns shape_id, shape_pt_sequence and shape_pt_elevation", path)
+	}
+
+	ret := make(Elevations)
+
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read elevation file %s (%s)", path, err)
+		}
+
+		if shapeIDCol >= len(record) || seqCol >= len(record) || elevCol >= len(record) || len(record[elevCol]) == 0 {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(record[seqCol], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shape_pt_sequence '%s' in line %d of %s", record[seqCol], line, path)
+		}
+
+		elev, err := strconv.ParseFloat(record[elevCol], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid elevation '%s' in line %d of %s", record[elevCol], line, path)
+		}
+
+		if _, ok := ret[record[shapeIDCol]]; !ok {
+			ret[record[shapeIDCol]] = make(map[uint32]float64)
+		}
+
+		ret[record[shapeIDCol]][uint32(seq)] = elev
+	}
+
+	return ret, nil
+}
+
+// check whether line geometries are written with Z values
+func (sw *ShapeWriter) hasZ() bool {
+	return len(sw.opts.Elevations) > 0 && !sw.opts.Force2D
+}
+
+// return the shape type of line layers
+func (sw *ShapeWriter) lineType() shp.ShapeType {
+	if sw.hasZ() {
+		return shp.POLYLINEZ
+	}
+	return shp.POLYLINE
+}
+
+// return a line geometry, with the elevations zs if Z values are written.
+// Missing elevations are written as 0
+func (sw *ShapeWriter) newLine(points []shp.Point, zs []float64) shp.Shape {
+	return sw.newLineParts([][]shp.Point{points}, zs)
+}
+
+// return a line geometry of several parts, with the elevations zs of all
+// points of the parts if Z values are written
+func (sw *ShapeWriter) newLineParts(parts [][]shp.Point, zs []float64) shp.Shape {
+	if len(parts) == 0 {
+		parts = [][]shp.Point{{}}
+	}
+
+	line := shp.NewPolyLine(parts)
+
+	if !sw.hasZ() {
+		return line
+	}
+
+	ret := &shp.PolyLineZ{
+		Box:       line.Box,
+		NumParts:  line.NumParts,
+		NumPoints: line.NumPoints,
+		Parts:     line.Parts,
+		Points:    line.Points,
+		ZArray:    make([]float64, len(line.Points)),
+		MArray:    make([]float64, len(line.Points)),
+	}
+
+	for i := range ret.ZArray {
+		if i < len(zs) && !math.IsNaN(zs[i]) {
+			ret.ZArray[i] = zs[i]
+		}
+
+		if i == 0 || ret.ZArray[i] < ret.ZRange[0] {
+			ret.ZRange[0] = ret.ZArray[i]
+		}
+		if i == 0 || ret.ZArray[i] > ret.ZRange[1] {
+			ret.ZRange[1] = ret.ZArray[i]
+		}
+	}
+
+	return ret
+}
+
+// return the points of a line geometry
+func linePoints(line shp.Shape) []shp.Point {
+	switch l := line.(type) {
+	case *shp.PolyLine:
+		return l.Points
+	case *shp.PolyLineZ:
+		return l.Points
+	}
+	return nil
+}
+
+// return the elevations of the line points of a GTFS shape between the
+// measures from and to, in the order of gtfsShapePointsToShpLinePoints.
+// Unknown elevations are NaN
+func (sw *ShapeWriter) shapeElevations(s *gtfs.Shape, from float64, to float64) []float64 {
+	if !sw.hasZ() {
+		return nil
+	}
+
+	elevs := sw.opts.Elevations[s.Id]
+	elev := func(i int) float64 {
+		if z, ok := elevs[s.Points[i].Sequence]; ok {
+			return z
+		}
+		return math.NaN()
+	}
+
+	first, last := clipRange(s.Points, from, to)
+	ret := make([]float64, 0, last-first+3)
+
+	if first > 0 {
+		ret = append(ret, interpolateAt(s.Points, first-1, from, elev(first-1), elev(first)))
+	}
+
+	for i := first; i <= last; i++ {
+		ret = append(ret, elev(i))
+	}
+
+	if last < len(s.Points)-1 {
+		ret = append(ret, interpolateAt(s.Points, last, to, elev(last), elev(last+1)))
+	}
+
+	return ret
+}
+
+// linearly interpolate between the values a and b of the shape points i
+// and i+1 at measure m
+func interpolateAt(points gtfs.ShapePoints, i int, m float64, a float64, b float64) float64 {
+	dMeasure := float64(points[i+1].Dist_traveled) - float64(points[i].Dist_traveled)
+	return a + (b-a)/dMeasure*(m-float64(points[i].Dist_traveled))
+}
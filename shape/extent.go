@@ -0,0 +1,166 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jonas-p/go-shp"
+	"github.com/pebbe/go-proj-4/proj/v5"
+	"io"
+	"math"
+	"path/filepath"
+)
+
+// number of extent attribute fields
+const numExtentFlds = 6
+
+// LayerSummary describes a written shapefile layer
+type LayerSummary struct {
+	File        string    `json:"file"`
+	Geometries  int       `json:"geometries"`
+	Extent      []float64 `json:"extent,omitempty"` // min x, min y, max x, max y
+	Fingerprint string    `json:"fingerprint,omitempty"`
+
+	// new, changed or unchanged in incremental mode
+	Status string `json:"-"`
+
+	// path, layer kind and output projection, for the metadata
+	path    string
+	kind    string
+	outProj *proj.Proj
+}
+
+// return the fields for the bounding box and centroid attributes
+func (sw *ShapeWriter) getExtentFields() []shp.Field {
+	if !sw.opts.ExtentAttrs {
+		return nil
+	}
+
+	return []shp.Field{
+		shp.FloatField(sw.fldName("Min_x"), 32, 10),
+		shp.FloatField(sw.fldName("Min_y"), 32, 10),
+		shp.FloatField(sw.fldName("Max_x"), 32, 10),
+		shp.FloatField(sw.fldName("Max_y"), 32, 10),
+		shp.FloatField(sw.fldName("Cent_x"), 32, 10),
+		shp.FloatField(sw.fldName("Cent_y"), 32, 10),
+	}
+}
+
+// write the bounding box and centroid attributes of a line, starting at
+// field fld. Returns the index of the next field
+func (sw *ShapeWriter) writeExtentAttrs(shape attrWriter, row int, fld int, points []shp.Point) int {
+	return sw.writeExtentAttrsParts(shape, row, fld, [][]shp.Point{points})
+}
+
+// write the bounding box and centroid attributes of a multi-part line,
+// as writeExtentAttrs
+func (sw *ShapeWriter) writeExtentAttrsParts(shape attrWriter, row int, fld int, parts [][]shp.Point) int {
+	if !sw.opts.ExtentAttrs {
+		return fld
+	}
+
+	points := make([]shp.Point, 0)
+	for _, part := range parts {
+		points = append(points, part...)
+	}
+
+	box := shp.BBoxFromPoints(points)
+	x, y := partsCentroid(parts)
+
+	sw.writeFloatAttr(shape, row, fld, box.MinX)
+	sw.writeFloatAttr(shape, row, fld+1, box.MinY)
+	sw.writeFloatAttr(shape, row, fld+2, box.MaxX)
+	sw.writeFloatAttr(shape, row, fld+3, box.MaxY)
+	sw.writeFloatAttr(shape, row, fld+4, x)
+	sw.writeFloatAttr(shape, row, fld+5, y)
+
+	return fld + numExtentFlds
+}
+
+// return the centroid of a multi-part line, with each segment weighted by
+// its length
+func partsCentroid(parts [][]shp.Point) (float64, float64) {
+	x := 0.0
+	y := 0.0
+	l := 0.0
+
+	for _, part := range parts {
+		for i := 1; i < len(part); i++ {
+			segL := math.Hypot(part[i].X-part[i-1].X, part[i].Y-part[i-1].Y)
+			x += (part[i].X + part[i-1].X) / 2 * segL
+			y += (part[i].Y + part[i-1].Y) / 2 * segL
+			l += segL
+		}
+	}
+
+	if l > 0 {
+		return x / l, y / l
+	}
+
+	for _, part := range parts {
+		if len(part) > 0 {
+			return part[0].X, part[0].Y
+		}
+	}
+
+	return math.NaN(), math.NaN()
+}
+
+// add a written layer to the summary
+func (sw *ShapeWriter) addLayerSummary(fileName string, kind string, box shp.Box, status string, fingerprint string) {
+	reader, err := shp.Open(fileName)
+	if err != nil {
+		panic(fmt.Sprintf("Could not read written shapefile (%s)", err))
+	}
+	defer reader.Close()
+
+	summary := LayerSummary{
+		File:        filepath.Base(fileName),
+		Geometries:  reader.AttributeCount(),
+		Fingerprint: fingerprint,
+		Status:      status,
+		path:        fileName,
+		kind:        kind,
+		outProj:     sw.outProj,
+	}
+	if summary.Geometries > 0 {
+		summary.Extent = []float64{box.MinX, box.MinY, box.MaxX, box.MaxY}
+	}
+
+	sw.layers = append(sw.layers, summary)
+}
+
+// WriteSummaryJSON writes a JSON summary of all layers written so far
+func (sw *ShapeWriter) WriteSummaryJSON(outFile string) {
+	file, err := sw.createFile(sw.getOutFileName(outFile, ".summary.json"))
+
+	if err != nil {
+		panic(fmt.Sprintf("Could not open summary file for writing (%s)", err))
+	}
+	defer file.Close()
+
+	sw.WriteSummaryJSONTo(file)
+}
+
+// WriteSummaryJSONTo writes a JSON summary of all layers written so far to w
+func (sw *ShapeWriter) WriteSummaryJSONTo(w io.Writer) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	var missingStops *MissingStopStats
+	if sw.missingStops.Trips > 0 || sw.missingStops.Breaks > 0 {
+		missingStops = &sw.missingStops
+	}
+
+	if err := enc.Encode(struct {
+		Layers       []LayerSummary    `json:"layers"`
+		MissingStops *MissingStopStats `json:"missing_stops,omitempty"`
+	}{sw.layers, missingStops}); err != nil {
+		panic(fmt.Sprintf("Could not write summary file (%s)", err))
+	}
+}
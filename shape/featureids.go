@@ -0,0 +1,31 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+)
+
+// length of the stable feature IDs
+const featIDLen = 16
+
+// return the stable ID of a feature identified by the given original
+// GTFS IDs and keys. It only depends on them, not on the order of the
+// features or on ID sanitization, so features can be tracked across
+// runs and feed versions
+func featureID(parts ...string) string {
+	sum := sha1.Sum([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])[:featIDLen]
+}
+
+// return the key of an aggregated shape variant: the ID of its shape,
+// the used part of it and its direction
+func shapeVariantKey(as *AggrShape) string {
+	return aggrShapeKey(as.Shape.Id, as.From, as.To, as.Direction)
+}
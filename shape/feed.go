@@ -0,0 +1,40 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/patrickbr/gtfsparser"
+)
+
+// ParseOptions returns the options the command line tool parses feeds
+// with for the given write options and additional route fields, to be
+// set with Feed.SetParseOpts. Additional GTFS fields are only kept if
+// some are written. Feeds parsed with other options (and filtered or
+// modified afterwards) can be passed to the Write functions as well, as
+// long as they keep the additional fields to be written
+func ParseOptions(opts WriteOptions, routeAddFlds []string) gtfsparser.ParseOptions {
+	return gtfsparser.ParseOptions{
+		KeepAddFlds:   len(routeAddFlds) > 0 || len(opts.TripAddFlds) > 0 || len(opts.StopAddFlds) > 0 || len(opts.RouteGroupField) > 0,
+		PolygonFilter: make([]gtfsparser.Polygon, 0),
+		MOTFilter:     make(map[int16]bool, 0),
+		MOTFilterNeg:  make(map[int16]bool, 0),
+	}
+}
+
+// FeedChanged drops everything the ShapeWriter derived from the feed
+// passed to previous Write calls, like route groups and service days.
+// Call it before passing another feed, or after modifying the feed. The
+// gaps recorded by HandleMissingStops are kept
+func (sw *ShapeWriter) FeedChanged() {
+	sw.groups = nil
+	sw.nearIdx = nil
+	sw.stopModes = nil
+
+	sw.svcDays.mutex.Lock()
+	sw.svcDays.days = nil
+	sw.svcDays.mutex.Unlock()
+}
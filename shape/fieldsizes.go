@@ -0,0 +1,83 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"runtime"
+	"sync"
+)
+
+// maximum size of a DBF string field
+const maxFieldSize = 254
+
+// parallelFieldSizes scans n items in parallel to determine numFlds
+// attribute field sizes. Each worker keeps its own maximum sizes,
+// which are merged afterwards. scan(i, sizes) must grow sizes to
+// hold the attributes of item i. A panic in scan is raised again in the
+// calling goroutine.
+func parallelFieldSizes(n int, numFlds int, scan func(i int, sizes []uint8)) []uint8 {
+	workers := runtime.NumCPU()
+	if workers > n {
+		workers = n
+	}
+
+	ret := make([]uint8, numFlds)
+
+	if workers < 2 {
+		for i := 0; i < n; i++ {
+			scan(i, ret)
+		}
+		return ret
+	}
+
+	results := make([][]uint8, workers)
+	panics := make([]interface{}, workers)
+	chunk := (n + workers - 1) / workers
+
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		results[w] = make([]uint8, numFlds)
+		wg.Add(1)
+
+		go func(w int) {
+			defer wg.Done()
+			defer func() {
+				panics[w] = recover()
+			}()
+
+			for i := w * chunk; i < n && i < (w+1)*chunk; i++ {
+				scan(i, results[w])
+			}
+		}(w)
+	}
+
+	wg.Wait()
+
+	for _, p := range panics {
+		if p != nil {
+			panic(p)
+		}
+	}
+
+	for _, sizes := range results {
+		for i, size := range sizes {
+			if size > ret[i] {
+				ret[i] = size
+			}
+		}
+	}
+
+	return ret
+}
+
+// fitSize grows size to hold a string of length l
+func fitSize(size *uint8, l int) {
+	if uint8(min(maxFieldSize, l)) > *size {
+		*size = uint8(min(maxFieldSize, l))
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/jonas-p/go-shp"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"math"
+)
+
+// maximum distance in meters between two points of a densified great
+// circle line
+const greatCircleStep = 1000.0
+
+// return the points on the great circle from a to b (in degrees), at most
+// greatCircleStep meters apart, without a itself
+func greatCircle(latA float64, lonA float64, latB float64, lonB float64) [][2]float64 {
+	dist := haversine(latA, lonA, latB, lonB)
+	steps := int(math.Ceil(dist / greatCircleStep))
+
+	if steps < 2 {
+		return [][2]float64{{latB, lonB}}
+	}
+
+	// unit vectors of a and b
+	toVec := func(lat float64, lon float64) [3]float64 {
+		lat, lon = lat*DEG_TO_RAD, lon*DEG_TO_RAD
+		return [3]float64{math.Cos(lat) * math.Cos(lon), math.Cos(lat) * math.Sin(lon), math.Sin(lat)}
+	}
+
+	a := toVec(latA, lonA)
+	b := toVec(latB, lonB)
+
+	// angle between a and b
+	omega := math.Acos(math.Max(-1, math.Min(1, a[0]*b[0]+a[1]*b[1]+a[2]*b[2])))
+	if omega == 0 || math.Sin(omega) == 0 {
+		return [][2]float64{{latB, lonB}}
+	}
+
+	ret := make([][2]float64, 0, steps)
+
+	for i := 1; i < steps; i++ {
+		t := float64(i) / float64(steps)
+
+		// spherical linear interpolation
+		fa := math.Sin((1-t)*omega) / math.Sin(omega)
+		fb := math.Sin(t*omega) / math.Sin(omega)
+
+		x := fa*a[0] + fb*b[0]
+		y := fa*a[1] + fb*b[1]
+		z := fa*a[2] + fb*b[2]
+
+		ret = append(ret, [2]float64{math.Atan2(z, math.Hypot(x, y)) / DEG_TO_RAD, math.Atan2(y, x) / DEG_TO_RAD})
+	}
+
+	return append(ret, [2]float64{latB, lonB})
+}
+
+// return the lines through the stops of parts along great circles,
+// densified to points at most greatCircleStep meters apart, reprojected
+func (sw *ShapeWriter) stationPartsToGreatCircles(parts [][]*gtfs.Stop) [][]shp.Point {
+	ret := make([][]shp.Point, 0, len(parts))
+
+	for _, part := range parts {
+		points := make([]shp.Point, 0, len(part))
+
+		for i, stop := range part {
+			if i == 0 {
+				x, y := sw.project(float64(stop.Lat), float64(stop.Lon))
+				points = append(points, shp.Point{X: x, Y: y})
+				continue
+			}
+
+			last := part[i-1]
+			for _, p := range greatCircle(float64(last.Lat), float64(last.Lon), float64(stop.Lat), float64(stop.Lon)) {
+				x, y := sw.project(p[0], p[1])
+				points = append(points, shp.Point{X: x, Y: y})
+			}
+		}
+
+		ret = append(ret, points)
+	}
+
+	return ret
+}
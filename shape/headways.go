@@ -0,0 +1,63 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"math"
+	"sort"
+)
+
+// HeadwayWindow is the service window headway statistics are computed
+// for: a service date and a time range on it, in seconds since midnight
+// as in GTFS, Start inclusive and End exclusive
+type HeadwayWindow struct {
+	Date  gtfs.Date
+	Start int
+	End   int
+}
+
+// return the minimum, maximum and median headway in seconds between the
+// departures from the first stop of the trips of route r on aggregated
+// shape as within the HeadwayWindow. Returns NaN values if there are
+// less than two departures
+func (sw *ShapeWriter) headwayStats(as *AggrShape, r *gtfs.Route) (float64, float64, float64) {
+	win := sw.opts.HeadwayWindow
+	deps := make([]int, 0)
+
+	for _, trip := range as.Trips {
+		if sw.groupRoute(trip.Route) != r || len(trip.StopTimes) == 0 || !trip.Service.IsActiveOn(win.Date) {
+			continue
+		}
+
+		for _, dep := range tripDepartures(trip) {
+			if dep >= win.Start && dep < win.End {
+				deps = append(deps, dep)
+			}
+		}
+	}
+
+	if len(deps) < 2 {
+		return math.NaN(), math.NaN(), math.NaN()
+	}
+
+	sort.Ints(deps)
+
+	headways := make([]int, len(deps)-1)
+	for i := range headways {
+		headways[i] = deps[i+1] - deps[i]
+	}
+	sort.Ints(headways)
+
+	n := len(headways)
+	median := float64(headways[n/2])
+	if n%2 == 0 {
+		median = float64(headways[n/2-1]+headways[n/2]) / 2
+	}
+
+	return float64(headways[0]), float64(headways[n-1]), median
+}
@@ -0,0 +1,116 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// WriteHourlyCsv writes a matrix of the number of departures per route
+// and hour of day on date d contained in Feed f into <outFile>.hourly.csv,
+// with one line per route and one column per hour. Trips are counted at
+// the hour of their departure from the first stop, trips of the previous
+// service day departing after midnight count towards d. Departures of
+// frequency-based trips are counted individually
+func (sw *ShapeWriter) WriteHourlyCsv(f *gtfsparser.Feed, d gtfs.Date, outFile string) {
+	csvFile, err := sw.createFile(sw.getOutFileName(outFile, ".hourly.csv"))
+
+	if err != nil {
+		panic(fmt.Sprintf("Could not open CSV file for writing (%s)", err))
+	}
+	defer csvFile.Close()
+
+	sw.initRouteGroups(f)
+
+	counts := make(map[*gtfs.Route]*[24]int)
+
+	for _, trip := range f.Trips {
+		if len(sw.motMap) > 0 && !sw.motMap[trip.Route.Type] {
+			continue
+		}
+
+		route := sw.groupRoute(trip.Route)
+		if counts[route] == nil {
+			counts[route] = &[24]int{}
+		}
+
+		if len(trip.StopTimes) == 0 {
+			continue
+		}
+
+		// service days whose trips may depart on d
+		for offset := -1; offset <= 1; offset++ {
+			svcDate := d.GetOffsettedDate(offset)
+			if !trip.Service.IsActiveOn(svcDate) {
+				continue
+			}
+
+			for _, dep := range tripDepartures(trip) {
+				dep = sw.normalizeTime(dep, trip.Route.Agency, trip.StopTimes[0].Stop(), svcDate) + offset*86400
+				if dep >= 0 && dep < 86400 {
+					counts[route][dep/3600]++
+				}
+			}
+		}
+	}
+
+	routes := make([]*gtfs.Route, 0, len(counts))
+	for route := range counts {
+		routes = append(routes, route)
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Id < routes[j].Id })
+
+	csvwriter := csv.NewWriter(csvFile)
+
+	headers := []string{sw.fldName("Route_id"), sw.fldName("Short_name")}
+	for h := 0; h < 24; h++ {
+		headers = append(headers, fmt.Sprintf("%02d", h))
+	}
+	csvwriter.Write(headers)
+	sw.addDictionaryHourly(filepath.Base(csvFile.Name()), headers, d)
+
+	for _, route := range routes {
+		row := []string{sw.ids.get("route", route.Id), route.Short_name}
+		for _, n := range counts[route] {
+			row = append(row, strconv.Itoa(n))
+		}
+		csvwriter.Write(row)
+	}
+
+	csvwriter.Flush()
+
+	if err := csvwriter.Error(); err != nil {
+		panic(fmt.Sprintf("Could not write CSV file (%s)", err))
+	}
+}
+
+// return the departure times of trip from its first stop in seconds
+// since midnight, one per trip generated by its frequencies
+func tripDepartures(trip *gtfs.Trip) []int {
+	if trip.Frequencies == nil || len(*trip.Frequencies) == 0 {
+		return []int{trip.StopTimes[0].Departure_time().SecondsSinceMidnight()}
+	}
+
+	ret := make([]int, 0)
+
+	for _, freq := range *trip.Frequencies {
+		if freq.Headway_secs <= 0 {
+			continue
+		}
+		for t := freq.Start_time.SecondsSinceMidnight(); t < freq.End_time.SecondsSinceMidnight(); t += freq.Headway_secs {
+			ret = append(ret, t)
+		}
+	}
+
+	return ret
+}
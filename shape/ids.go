@@ -0,0 +1,209 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"crypto/sha1"
+	"encoding/csv"
+	"encoding/hex"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// IDSanitization defines how IDs unsuitable for DBF output are treated
+type IDSanitization int
+
+const (
+	// IDKeep writes all IDs unchanged
+	IDKeep IDSanitization = iota
+
+	// IDSanitize replaces non-ASCII characters in IDs and truncates
+	// overly long IDs
+	IDSanitize
+
+	// IDHash replaces non-ASCII or overly long IDs by a hash
+	IDHash
+)
+
+// length of hashed IDs
+const idHashLen = 16
+
+// maps original IDs to the IDs written to the output, per entity type
+type idMapper struct {
+	mode   IDSanitization
+	maxLen int
+	mutex  sync.Mutex
+	out    map[string]map[string]string
+	used   map[string]map[string]bool
+}
+
+func newIDMapper(mode IDSanitization, maxLen int) *idMapper {
+	if maxLen < idHashLen && maxLen > 0 {
+		maxLen = idHashLen
+	}
+	if maxLen <= 0 || maxLen > maxFieldSize {
+		maxLen = maxFieldSize
+	}
+	return &idMapper{
+		mode:   mode,
+		maxLen: maxLen,
+		out:    make(map[string]map[string]string),
+		used:   make(map[string]map[string]bool),
+	}
+}
+
+// return the output ID for an ID of the given entity type. Output IDs
+// are unique per entity type and stable during a run
+func (m *idMapper) get(kind string, id string) string {
+	if m.mode == IDKeep {
+		return id
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.initKind(kind)
+
+	if ret, ok := m.out[kind][id]; ok {
+		return ret
+	}
+
+	return m.assign(kind, id)
+}
+
+// assign the output IDs of the given IDs of an entity type, so that they
+// do not depend on the order the IDs are first used in. Valid IDs are
+// kept unchanged, the others are made unique in the order of their
+// original IDs
+func (m *idMapper) reserve(kind string, ids []string) {
+	if m.mode == IDKeep {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.initKind(kind)
+
+	sorted := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := m.out[kind][id]; !ok {
+			sorted = append(sorted, id)
+		}
+	}
+	sort.Strings(sorted)
+
+	for _, id := range sorted {
+		if m.valid(id) && !m.used[kind][id] {
+			m.out[kind][id] = id
+			m.used[kind][id] = true
+		}
+	}
+
+	for _, id := range sorted {
+		if _, ok := m.out[kind][id]; !ok {
+			m.assign(kind, id)
+		}
+	}
+}
+
+// create the maps of an entity type if missing
+func (m *idMapper) initKind(kind string) {
+	if _, ok := m.out[kind]; !ok {
+		m.out[kind] = make(map[string]string)
+		m.used[kind] = make(map[string]bool)
+	}
+}
+
+// assign a unique output ID to an ID of the given entity type
+func (m *idMapper) assign(kind string, id string) string {
+	ret := id
+
+	if !m.valid(id) {
+		if m.mode == IDHash {
+			sum := sha1.Sum([]byte(id))
+			ret = hex.EncodeToString(sum[:])[:idHashLen]
+		} else {
+			ret = m.sanitize(id)
+		}
+	}
+
+	// make sure the output ID is unique
+	base := ret
+	for i := 2; m.used[kind][ret]; i++ {
+		suffix := "_" + strconv.Itoa(i)
+		if len(base)+len(suffix) > m.maxLen {
+			base = base[:m.maxLen-len(suffix)]
+		}
+		ret = base + suffix
+	}
+
+	m.out[kind][id] = ret
+	m.used[kind][ret] = true
+
+	return ret
+}
+
+// check whether an ID can be written unchanged
+func (m *idMapper) valid(id string) bool {
+	if len(id) > m.maxLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x20 || id[i] > 0x7E {
+			return false
+		}
+	}
+	return true
+}
+
+// replace non-printable and non-ASCII characters with _ and truncate
+func (m *idMapper) sanitize(id string) string {
+	ret := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7E {
+			return '_'
+		}
+		return r
+	}, id)
+
+	if len(ret) > m.maxLen {
+		ret = ret[:m.maxLen]
+	}
+
+	return ret
+}
+
+// write a CSV mapping all changed output IDs back to the original IDs
+func (m *idMapper) writeCsv(w io.Writer) {
+	csvwriter := csv.NewWriter(w)
+	csvwriter.Write([]string{"type", "id", "original_id"})
+
+	kinds := make([]string, 0, len(m.out))
+	for kind := range m.out {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	for _, kind := range kinds {
+		ids := make([]string, 0)
+		for id, outID := range m.out[kind] {
+			if id != outID {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+
+		for _, id := range ids {
+			csvwriter.Write([]string{kind, m.out[kind][id], id})
+		}
+	}
+
+	csvwriter.Flush()
+}
@@ -0,0 +1,157 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ReadSummaryJSON reads the layers of a summary file written by
+// WriteSummaryJSON
+func ReadSummaryJSON(path string) ([]LayerSummary, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var summary struct {
+		Layers []LayerSummary `json:"layers"`
+	}
+
+	if err := json.NewDecoder(file).Decode(&summary); err != nil {
+		return nil, fmt.Errorf("could not read summary file %s (%s)", path, err)
+	}
+
+	return summary.Layers, nil
+}
+
+// Layers returns the summaries of all layers written so far
+func (sw *ShapeWriter) Layers() []LayerSummary {
+	return sw.layers
+}
+
+// replace the layer fileName by its temporary version if its contents
+// changed compared to the previous run. Returns the status of the layer
+// and its fingerprint
+func (sw *ShapeWriter) replaceLayer(fileName string) (string, string) {
+	tmpName := tmpLayerName(fileName)
+
+	fp, err := layerFingerprint(tmpName)
+	if err != nil {
+		panic(fmt.Sprintf("Could not read written shapefile (%s)", err))
+	}
+
+	status := "new"
+
+	for _, prev := range sw.opts.PrevLayers {
+		if prev.File != filepath.Base(fileName) {
+			continue
+		}
+
+		status = "changed"
+
+		if prev.Fingerprint == fp && layerExists(fileName) {
+			removeLayer(tmpName)
+			return "unchanged", fp
+		}
+	}
+
+	moveLayer(tmpName, fileName)
+
+	return status, fp
+}
+
+// layerFingerprint returns a fingerprint of the geometries and attributes
+// of a shapefile. As features are not written in a stable order, the
+// fingerprint does not depend on the order of the features.
+func layerFingerprint(shpFile string) (string, error) {
+	shpF, err := os.Open(shpFile)
+	if err != nil {
+		return "", err
+	}
+	defer shpF.Close()
+
+	dbfF, err := os.Open(strings.TrimSuffix(shpFile, ".shp") + ".dbf")
+	if err != nil {
+		return "", err
+	}
+	defer dbfF.Close()
+
+	shpR := bufio.NewReader(shpF)
+	dbfR := bufio.NewReader(dbfF)
+
+	shpHeader := make([]byte, 100)
+	if _, err := io.ReadFull(shpR, shpHeader); err != nil {
+		return "", err
+	}
+
+	dbfHeader := make([]byte, 32)
+	if _, err := io.ReadFull(dbfR, dbfHeader); err != nil {
+		return "", err
+	}
+
+	numRecords := binary.LittleEndian.Uint32(dbfHeader[4:8])
+	headerLen := int(binary.LittleEndian.Uint16(dbfHeader[8:10]))
+	recordLen := int(binary.LittleEndian.Uint16(dbfHeader[10:12]))
+
+	// field descriptors
+	fieldDescs := make([]byte, headerLen-32)
+	if _, err := io.ReadFull(dbfR, fieldDescs); err != nil {
+		return "", err
+	}
+
+	recHashes := make([][]byte, 0, numRecords)
+	recHeader := make([]byte, 8)
+	record := make([]byte, recordLen)
+
+	for i := uint32(0); i < numRecords; i++ {
+		if _, err := io.ReadFull(shpR, recHeader); err != nil {
+			return "", err
+		}
+
+		// content length is given in 16 bit words, without the record header
+		content := make([]byte, 2*binary.BigEndian.Uint32(recHeader[4:8]))
+		if _, err := io.ReadFull(shpR, content); err != nil {
+			return "", err
+		}
+
+		if _, err := io.ReadFull(dbfR, record); err != nil {
+			return "", err
+		}
+
+		h := sha1.New()
+		h.Write(content)
+		h.Write(record)
+		recHashes = append(recHashes, h.Sum(nil))
+	}
+
+	sort.Slice(recHashes, func(i, j int) bool { return bytes.Compare(recHashes[i], recHashes[j]) < 0 })
+
+	h := sha1.New()
+
+	// shape type and field descriptors
+	h.Write(shpHeader[32:36])
+	h.Write(fieldDescs)
+
+	for _, rec := range recHashes {
+		h.Write(rec)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/jonas-p/go-shp"
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"sort"
+)
+
+// a link between two consecutive trips of a block
+type interline struct {
+	block string
+	from  *gtfs.Trip
+	to    *gtfs.Trip
+}
+
+// WriteInterlines writes one line per pair of consecutive trips of the
+// same block contained in Feed f to <outFile>.interlines.shp, connecting
+// the last stop of the first trip with the first stop of the next trip,
+// together with the layover time between them. Trips generated by
+// frequencies are not considered, as their order in the block is unknown
+func (sw *ShapeWriter) WriteInterlines(f *gtfsparser.Feed, outFile string) int {
+	defer sw.useLayer("interlines")()
+
+	fileName := sw.getOutFileName(outFile, ".interlines.shp")
+	shape := sw.createLayer(fileName, sw.lineType(), "interlines")
+	defer sw.closeLayer(shape, fileName)
+
+	links := sw.getInterlines(f.Trips)
+
+	blockSize := uint8(0)
+	svcSize := uint8(0)
+	tripSize := uint8(0)
+	routeSize := uint8(0)
+	stopSize := uint8(0)
+
+	for _, l := range links {
+		fitSize(&blockSize, len(l.block))
+		fitSize(&svcSize, len(sw.ids.get("service", l.from.Service.Id())))
+		for _, trip := range []*gtfs.Trip{l.from, l.to} {
+			fitSize(&tripSize, len(sw.ids.get("trip", trip.Id)))
+			fitSize(&routeSize, len(sw.ids.get("route", trip.Route.Id)))
+		}
+		fitSize(&stopSize, len(sw.ids.get("stop", l.from.StopTimes[len(l.from.StopTimes)-1].Stop().Id)))
+		fitSize(&stopSize, len(sw.ids.get("stop", l.to.StopTimes[0].Stop().Id)))
+	}
+
+	shape.SetFields([]shp.Field{
+		shp.StringField(sw.fldName("Block_id"), blockSize),
+		shp.StringField(sw.fldName("Service_id"), svcSize),
+		shp.StringField(sw.fldName("From_trip"), tripSize),
+		shp.StringField(sw.fldName("To_trip"), tripSize),
+		shp.StringField(sw.fldName("From_route"), routeSize),
+		shp.StringField(sw.fldName("To_route"), routeSize),
+		shp.StringField(sw.fldName("From_stop"), stopSize),
+		shp.StringField(sw.fldName("To_stop"), stopSize),
+		shp.StringField(sw.fldName("Arr"), 9),
+		shp.StringField(sw.fldName("Dep"), 9),
+		shp.FloatField(sw.fldName("Layover"), 32, 2),
+		shp.FloatField(sw.fldName("Km"), 32, 3),
+		shp.NumberField(sw.fldName("Interline"), 1),
+	})
+
+	n := 0
+
+	for _, l := range links {
+		last := l.from.StopTimes[len(l.from.StopTimes)-1]
+		first := l.to.StopTimes[0]
+
+		if !hasCoord(last.Stop()) || !hasCoord(first.Stop()) {
+			continue
+		}
+
+		points := []shp.Point{*sw.gtfsStopToShpPoint(last.Stop()), *sw.gtfsStopToShpPoint(first.Stop())}
+		shape.Write(sw.newLine(points, nil))
+
+		start := sw.getServiceDays(l.from.Service).start
+		arr := sw.normalizeTime(last.Arrival_time().SecondsSinceMidnight(), l.from.Route.Agency, last.Stop(), start)
+		dep := sw.normalizeTime(first.Departure_time().SecondsSinceMidnight(), l.to.Route.Agency, first.Stop(), start)
+
+		shape.WriteAttribute(n, 0, l.block)
+		shape.WriteAttribute(n, 1, sw.ids.get("service", l.from.Service.Id()))
+		shape.WriteAttribute(n, 2, sw.ids.get("trip", l.from.Id))
+		shape.WriteAttribute(n, 3, sw.ids.get("trip", l.to.Id))
+		shape.WriteAttribute(n, 4, sw.ids.get("route", l.from.Route.Id))
+		shape.WriteAttribute(n, 5, sw.ids.get("route", l.to.Route.Id))
+		shape.WriteAttribute(n, 6, sw.ids.get("stop", last.Stop().Id))
+		shape.WriteAttribute(n, 7, sw.ids.get("stop", first.Stop().Id))
+		shape.WriteAttribute(n, 8, isoTime(arr))
+		shape.WriteAttribute(n, 9, isoTime(dep))
+		sw.writeFloatAttr(shape, n, 10, float64(dep-arr)/60.0)
+		sw.writeFloatAttr(shape, n, 11, haversine(float64(last.Stop().Lat), float64(last.Stop().Lon), float64(first.Stop().Lat), float64(first.Stop().Lon))/1000.0)
+
+		if l.from.Route != l.to.Route {
+			shape.WriteAttribute(n, 12, 1)
+		} else {
+			shape.WriteAttribute(n, 12, 0)
+		}
+
+		n = n + 1
+	}
+
+	return n
+}
+
+// return the links between consecutive trips of the same block and
+// service, ordered by block, service and time
+func (sw *ShapeWriter) getInterlines(trips map[string]*gtfs.Trip) []interline {
+	type blockKey struct {
+		block string
+		svc   *gtfs.Service
+	}
+
+	blocks := make(map[blockKey][]*gtfs.Trip)
+
+	for _, trip := range trips {
+		if trip.Block_id == nil || len(*trip.Block_id) == 0 || len(trip.StopTimes) == 0 {
+			continue
+		}
+		if trip.Frequencies != nil && len(*trip.Frequencies) > 0 {
+			continue
+		}
+		if len(sw.motMap) > 0 && !sw.motMap[trip.Route.Type] {
+			continue
+		}
+
+		key := blockKey{*trip.Block_id, trip.Service}
+		blocks[key] = append(blocks[key], trip)
+	}
+
+	keys := make([]blockKey, 0, len(blocks))
+	for key := range blocks {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].block == keys[j].block {
+			return keys[i].svc.Id() < keys[j].svc.Id()
+		}
+		return keys[i].block < keys[j].block
+	})
+
+	ret := make([]interline, 0)
+
+	for _, key := range keys {
+		blockTrips := blocks[key]
+		sort.Slice(blockTrips, func(i, j int) bool {
+			a := blockTrips[i].StopTimes[0].Departure_time().SecondsSinceMidnight()
+			b := blockTrips[j].StopTimes[0].Departure_time().SecondsSinceMidnight()
+			if a == b {
+				return blockTrips[i].Id < blockTrips[j].Id
+			}
+			return a < b
+		})
+
+		for i := 1; i < len(blockTrips); i++ {
+			ret = append(ret, interline{key.block, blockTrips[i-1], blockTrips[i]})
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,149 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/jonas-p/go-shp"
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"math"
+	"sort"
+)
+
+// WriteLabelPoints writes one label anchor point per route variant
+// contained in Feed f to <outFile>.labels.shp, placed at the midpoint
+// along the variant's line, together with the route's short name and
+// colors and the direction of the line at the anchor
+func (sw *ShapeWriter) WriteLabelPoints(f *gtfsparser.Feed, outFile string) int {
+	defer sw.useLayer("labels")()
+
+	fileName := sw.getOutFileName(outFile, ".labels.shp")
+	shape := sw.createLayer(fileName, shp.POINT, "labels")
+	defer sw.closeLayer(shape, fileName)
+
+	aggrShapes, routeShapes := sw.getAggrShapes(f.Trips, f)
+
+	// with a single feature per route, only the representative variant
+	// of each route gets a label
+	var representative map[*gtfs.Route]string
+	if sw.opts.RouteGeometry != RouteGeomVariants {
+		representative = make(map[*gtfs.Route]string, len(routeShapes))
+		for r, shapes := range routeShapes {
+			variantIDs := make([]string, 0, len(shapes))
+			for id := range shapes {
+				variantIDs = append(variantIDs, id)
+			}
+			representative[r] = sw.representativeVariant(r, variantIDs, aggrShapes)
+		}
+	}
+
+	ids := make([]string, 0, len(aggrShapes))
+	for id := range aggrShapes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	idSize := uint8(0)
+	shortNameSize := uint8(0)
+	variantSize := uint8(0)
+
+	for _, aggrShape := range aggrShapes {
+		for _, r := range aggrShape.Routes {
+			fitSize(&idSize, len(sw.ids.get("route", r.Id)))
+			fitSize(&shortNameSize, len(r.Short_name))
+			fitSize(&variantSize, len(sw.variantName(aggrShape, r)))
+		}
+	}
+
+	shape.SetFields([]shp.Field{
+		shp.StringField(sw.fldName("Route_id"), idSize),
+		shp.StringField(sw.fldName("Short_name"), shortNameSize),
+		shp.StringField(sw.fldName("Color"), 6),
+		shp.StringField(sw.fldName("Text_color"), 6),
+		shp.StringField(sw.fldName("Variant"), variantSize),
+		shp.FloatField(sw.fldName("Angle"), 32, 2),
+	})
+
+	n := 0
+
+	for _, id := range ids {
+		aggrShape := aggrShapes[id]
+		points := sw.gtfsShapePointsToShpLinePoints(aggrShape.Shape.Points, aggrShape.From, aggrShape.To)
+
+		if len(points) == 0 {
+			continue
+		}
+
+		anchor, angle := lineMidpoint(points)
+
+		routeIDs := make([]string, 0, len(aggrShape.Routes))
+		for rid := range aggrShape.Routes {
+			routeIDs = append(routeIDs, rid)
+		}
+		sort.Strings(routeIDs)
+
+		for _, rid := range routeIDs {
+			r := aggrShape.Routes[rid]
+			if representative != nil && representative[r] != id {
+				continue
+			}
+
+			shape.Write(&shp.Point{X: anchor.X, Y: anchor.Y})
+
+			shape.WriteAttribute(n, 0, sw.ids.get("route", r.Id))
+			shape.WriteAttribute(n, 1, r.Short_name)
+			shape.WriteAttribute(n, 2, r.Color)
+			shape.WriteAttribute(n, 3, r.Text_color)
+			shape.WriteAttribute(n, 4, sw.variantName(aggrShape, r))
+			sw.writeFloatAttr(shape, n, 5, angle)
+
+			n = n + 1
+		}
+	}
+
+	return n
+}
+
+// return the point halfway along a line, together with the direction of
+// the line at this point in degrees counterclockwise from the x axis,
+// normalized to (-90, 90] so labels are never upside down
+func lineMidpoint(points []shp.Point) (shp.Point, float64) {
+	total := 0.0
+	for i := 1; i < len(points); i++ {
+		total += math.Hypot(points[i].X-points[i-1].X, points[i].Y-points[i-1].Y)
+	}
+
+	if total == 0 {
+		return points[0], math.NaN()
+	}
+
+	half := total / 2
+	l := 0.0
+
+	for i := 1; i < len(points); i++ {
+		a := points[i-1]
+		b := points[i]
+		segL := math.Hypot(b.X-a.X, b.Y-a.Y)
+
+		if l+segL >= half && segL > 0 {
+			t := (half - l) / segL
+			angle := math.Atan2(b.Y-a.Y, b.X-a.X) * 180 / math.Pi
+
+			if angle > 90 {
+				angle -= 180
+			} else if angle <= -90 {
+				angle += 180
+			}
+
+			return shp.Point{X: a.X + (b.X-a.X)*t, Y: a.Y + (b.Y-a.Y)*t}, angle
+		}
+
+		l += segL
+	}
+
+	return points[len(points)-1], math.NaN()
+}
@@ -0,0 +1,99 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"math"
+)
+
+// check whether trip is a loop, ending at the stop (or station) it
+// started from
+func isLoopTrip(trip *gtfs.Trip) bool {
+	if len(trip.StopTimes) < 2 {
+		return false
+	}
+
+	first := trip.StopTimes[0].Stop()
+	last := trip.StopTimes[len(trip.StopTimes)-1].Stop()
+
+	if first == last {
+		return true
+	}
+
+	if first.Parent_station != nil && first.Parent_station == last.Parent_station {
+		return true
+	}
+
+	return first.Parent_station == last || last.Parent_station == first
+}
+
+// return the measures of the part of its shape trip uses, NaN if the
+// whole shape is used. Loops always use the whole shape, as the
+// shape_dist_traveled of their terminus may refer to either end of it
+func tripShapeRange(trip *gtfs.Trip) (float64, float64) {
+	if len(trip.StopTimes) == 0 || isLoopTrip(trip) {
+		return math.NaN(), math.NaN()
+	}
+
+	first := trip.StopTimes[0]
+	last := trip.StopTimes[len(trip.StopTimes)-1]
+
+	if !first.HasDistanceTraveled() || !last.HasDistanceTraveled() {
+		return math.NaN(), math.NaN()
+	}
+
+	return float64(first.Shape_dist_traveled()), float64(last.Shape_dist_traveled())
+}
+
+// return the direction of a loop shape, "cw" for clockwise and "ccw" for
+// counterclockwise, by the sign of the area enclosed by it
+func loopDirection(points gtfs.ShapePoints) string {
+	if len(points) < 3 {
+		return ""
+	}
+
+	cosLat := math.Cos(float64(points[0].Lat) * DEG_TO_RAD)
+
+	a := 0.0
+	for i := range points {
+		p := points[i]
+		q := points[(i+1)%len(points)]
+		a += float64(p.Lon)*cosLat*float64(q.Lat) - float64(q.Lon)*cosLat*float64(p.Lat)
+	}
+
+	if a > 0 {
+		return "ccw"
+	} else if a < 0 {
+		return "cw"
+	}
+
+	return ""
+}
+
+// return the nominal start stop of the loop trips of route r in an
+// aggregated shape, the stop most of them start from
+func (sw *ShapeWriter) loopStart(as *AggrShape, r *gtfs.Route) *gtfs.Stop {
+	counts := make(map[*gtfs.Stop]int)
+
+	var ret *gtfs.Stop
+
+	for _, trip := range as.Trips {
+		if sw.groupRoute(trip.Route) != r || !isLoopTrip(trip) {
+			continue
+		}
+
+		stop := trip.StopTimes[0].Stop()
+		counts[stop]++
+
+		if ret == nil || counts[stop] > counts[ret] || counts[stop] == counts[ret] && stop.Id < ret.Id {
+			ret = stop
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"fmt"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"runtime"
+	"sort"
+)
+
+// number of trips processed between two memory checks
+const memCheckInterval = 5000
+
+// return the number of heap bytes currently in use
+func memInUse() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// panic if the memory limit is exceeded, stage describes what is
+// currently done. The command line tool reports the panic and exits
+// with status 1
+func (sw *ShapeWriter) checkMem(stage string) {
+	if sw.opts.MaxMem == 0 || memInUse() <= sw.opts.MaxMem {
+		return
+	}
+
+	// only fail if the memory is still in use after a collection
+	runtime.GC()
+
+	if inUse := memInUse(); inUse > sw.opts.MaxMem {
+		panic(fmt.Sprintf("Memory limit of %d MB exceeded while %s (%d MB in use)", sw.opts.MaxMem>>20, stage, inUse>>20))
+	}
+}
+
+// return the key of the batch trip is written in under a memory limit:
+// its shape, or its route for trips without a shape
+func tripBatchKey(trip *gtfs.Trip) string {
+	if trip.Shape != nil {
+		return trip.Shape.Id
+	}
+	return "\x00" + trip.Route.Id
+}
+
+// split trips into the batches they are written in. Without a memory
+// limit, all trips form a single batch. Under a memory limit, each batch
+// holds the trips sharing a shape (or the trips without a shape of a
+// route), ordered by trip ID, so geometries computed for a trip only
+// have to be kept until the end of its batch
+func (sw *ShapeWriter) tripBatches(trips map[string]*gtfs.Trip) [][]*gtfs.Trip {
+	all := make([]*gtfs.Trip, 0, len(trips))
+	for _, trip := range trips {
+		all = append(all, trip)
+	}
+
+	if sw.opts.MaxMem == 0 {
+		return [][]*gtfs.Trip{all}
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		a, b := tripBatchKey(all[i]), tripBatchKey(all[j])
+		if a != b {
+			return a < b
+		}
+		return all[i].Id < all[j].Id
+	})
+
+	ret := make([][]*gtfs.Trip, 0)
+	start := 0
+
+	for i := 1; i <= len(all); i++ {
+		if i == len(all) || tripBatchKey(all[i]) != tripBatchKey(all[start]) {
+			ret = append(ret, all[start:i])
+			start = i
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,252 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"github.com/pebbe/go-proj-4/proj/v5"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// descriptions of the layer kinds, used as metadata abstracts
+var layerAbstracts = map[string]string{
+	"trips":       "Explicit trips, one line per trip.",
+	"routes":      "Route shapes, one line per route and shape variant.",
+	"shapes":      "Aggregated shapes, one line per distinct trip geometry.",
+	"stations":    "Stations and stops.",
+	"stopevents":  "Stop events, one point per stop time.",
+	"labels":      "Label anchor points of the route shapes.",
+	"stopchains":  "Straight lines through the stops of each stop pattern.",
+	"interlines":  "Interlining connections between consecutive trips of a block.",
+	"buffers":     "Corridor polygons around the routes.",
+	"corridors":   "Corridor center lines with the summed service of all routes running along them.",
+	"shapepoints": "Points of the GTFS shapes.",
+	"tripgeoms":   "Trip geometries shared by several trips.",
+}
+
+// FGDC metadata of a layer, as read by ArcGIS from .shp.xml files
+type fgdcMetadata struct {
+	XMLName xml.Name `xml:"metadata"`
+
+	Origin   string `xml:"idinfo>citation>citeinfo>origin"`
+	PubDate  string `xml:"idinfo>citation>citeinfo>pubdate"`
+	Title    string `xml:"idinfo>citation>citeinfo>title"`
+	Edition  string `xml:"idinfo>citation>citeinfo>edition,omitempty"`
+	GeoForm  string `xml:"idinfo>citation>citeinfo>geoform"`
+	OnLink   string `xml:"idinfo>citation>citeinfo>onlink,omitempty"`
+	Abstract string `xml:"idinfo>descript>abstract"`
+	Purpose  string `xml:"idinfo>descript>purpose"`
+	BegDate  string `xml:"idinfo>timeperd>timeinfo>rngdates>begdate"`
+	EndDate  string `xml:"idinfo>timeperd>timeinfo>rngdates>enddate"`
+	Current  string `xml:"idinfo>timeperd>current"`
+	Progress string `xml:"idinfo>status>progress"`
+	Update   string `xml:"idinfo>status>update"`
+
+	Bounding *fgdcBounding `xml:"idinfo>spdom>bounding,omitempty"`
+
+	ThemeKt   string   `xml:"idinfo>keywords>theme>themekt"`
+	ThemeKeys []string `xml:"idinfo>keywords>theme>themekey"`
+	AccConst  string   `xml:"idinfo>accconst"`
+	UseConst  string   `xml:"idinfo>useconst"`
+
+	Direct   string `xml:"spdoinfo>direct"`
+	SdtsType string `xml:"spdoinfo>ptvctinf>sdtsterm>sdtstype"`
+	PtvctCnt int    `xml:"spdoinfo>ptvctinf>sdtsterm>ptvctcnt"`
+
+	GeogUnit string `xml:"spref>horizsys>geograph>geogunit,omitempty"`
+	MapProj  string `xml:"spref>horizsys>planar>mapproj>mapprojn,omitempty"`
+
+	EntTypL string     `xml:"eainfo>detailed>enttyp>enttypl"`
+	EntTypD string     `xml:"eainfo>detailed>enttyp>enttypd"`
+	Attrs   []fgdcAttr `xml:"eainfo>detailed>attr"`
+
+	ProcDesc string `xml:"dataqual>lineage>procstep>procdesc"`
+	ProcDate string `xml:"dataqual>lineage>procstep>procdate"`
+
+	MetD    string `xml:"metainfo>metd"`
+	MetStdN string `xml:"metainfo>metstdn"`
+	MetStdV string `xml:"metainfo>metstdv"`
+}
+
+// geographic bounding box of a layer, in degrees
+type fgdcBounding struct {
+	West  float64 `xml:"westbc"`
+	East  float64 `xml:"eastbc"`
+	North float64 `xml:"northbc"`
+	South float64 `xml:"southbc"`
+}
+
+// description of an attribute column
+type fgdcAttr struct {
+	Label  string `xml:"attrlabl"`
+	Def    string `xml:"attrdef"`
+	Source string `xml:"attrdefs"`
+	Domain string `xml:"attrdomv>udom"`
+}
+
+// WriteMetadata writes FGDC metadata for all shapefile layers written so
+// far into <layer>.shp.xml sidecar files, as read by ArcGIS and required
+// by some geoportals. The citation and time period are taken from the
+// feed_info.txt of Feed f, params describes the conversion parameters
+func (sw *ShapeWriter) WriteMetadata(f *gtfsparser.Feed, params string) {
+	now := time.Now()
+
+	for _, l := range sw.layers {
+		meta := sw.layerMetadata(f, l, params, now)
+
+		file, err := sw.createFile(l.path + ".xml")
+		if err != nil {
+			panic(fmt.Sprintf("Could not open metadata file for writing (%s)", err))
+		}
+
+		file.WriteString(xml.Header)
+
+		enc := xml.NewEncoder(file)
+		enc.Indent("", "  ")
+		err = enc.Encode(meta)
+
+		file.Close()
+
+		if err != nil {
+			panic(fmt.Sprintf("Could not write metadata file (%s)", err))
+		}
+	}
+}
+
+// return the metadata of a written layer
+func (sw *ShapeWriter) layerMetadata(f *gtfsparser.Feed, l LayerSummary, params string, now time.Time) fgdcMetadata {
+	title := strings.TrimSuffix(l.File, ".shp")
+
+	meta := fgdcMetadata{
+		Origin:    "Unknown",
+		PubDate:   fgdcDate(now),
+		Title:     title,
+		GeoForm:   "vector digital data",
+		Abstract:  layerAbstracts[l.kind],
+		Purpose:   "Converted from a GTFS public transit feed with gtfs2shp.",
+		BegDate:   "Unknown",
+		EndDate:   "Unknown",
+		Current:   "publication date",
+		Progress:  "Complete",
+		Update:    "Unknown",
+		ThemeKt:   "None",
+		ThemeKeys: []string{"public transport", "GTFS"},
+		AccConst:  "None",
+		UseConst:  "See the license of the GTFS feed.",
+		Direct:    "Vector",
+		SdtsType:  sdtsType(l.kind),
+		PtvctCnt:  l.Geometries,
+		EntTypL:   l.File,
+		EntTypD:   layerAbstracts[l.kind],
+		ProcDesc:  "gtfs2shp " + params,
+		ProcDate:  fgdcDate(now),
+		MetD:      fgdcDate(now),
+		MetStdN:   "FGDC Content Standard for Digital Geospatial Metadata",
+		MetStdV:   "FGDC-STD-001-1998",
+	}
+
+	if len(f.FeedInfos) > 0 {
+		info := f.FeedInfos[0]
+		if len(info.Publisher_name) > 0 {
+			meta.Origin = info.Publisher_name
+		}
+		if info.Publisher_url != nil {
+			meta.OnLink = info.Publisher_url.String()
+		}
+		meta.Edition = info.Version
+		if !info.Start_date.IsEmpty() {
+			meta.BegDate = fgdcGtfsDate(info.Start_date)
+		}
+		if !info.End_date.IsEmpty() {
+			meta.EndDate = fgdcGtfsDate(info.End_date)
+		}
+	}
+
+	if l.outProj == nil {
+		meta.GeogUnit = "Decimal degrees"
+	} else {
+		meta.MapProj = sw.projNames[l.outProj]
+		if _, err := strconv.Atoi(meta.MapProj); err == nil {
+			meta.MapProj = "EPSG:" + meta.MapProj
+		}
+	}
+
+	if len(l.Extent) == 4 {
+		meta.Bounding = sw.geographicBounds(l)
+	}
+
+	for _, entry := range sw.dictionary {
+		if entry.File != l.File {
+			continue
+		}
+		for _, col := range entry.Columns {
+			domain := col.Type
+			if len(col.Unit) > 0 {
+				domain += ", " + col.Unit
+			}
+			meta.Attrs = append(meta.Attrs, fgdcAttr{col.Name, col.Description, col.Source, domain})
+		}
+	}
+
+	return meta
+}
+
+// return the SDTS type of the features of a layer kind
+func sdtsType(kind string) string {
+	switch kind {
+	case "stations", "stopevents", "labels", "shapepoints":
+		return "Entity point"
+	case "buffers":
+		return "G-polygon"
+	}
+	return "String"
+}
+
+// return the extent of a layer in WGS84 degrees, nil if it cannot be
+// determined
+func (sw *ShapeWriter) geographicBounds(l LayerSummary) *fgdcBounding {
+	if l.outProj == nil {
+		return &fgdcBounding{West: l.Extent[0], East: l.Extent[2], North: l.Extent[3], South: l.Extent[1]}
+	}
+
+	ret := fgdcBounding{West: math.Inf(1), East: math.Inf(-1), North: math.Inf(-1), South: math.Inf(1)}
+
+	// proj4 is not safe for concurrent use
+	sw.projMutex.Lock()
+	defer sw.projMutex.Unlock()
+
+	for _, x := range []float64{l.Extent[0], l.Extent[2]} {
+		for _, y := range []float64{l.Extent[1], l.Extent[3]} {
+			lon, lat, err := proj.Transform2(l.outProj, sw.wgs84Proj, x, y)
+			if err != nil {
+				return nil
+			}
+			lon, lat = proj.RadToDeg(lon), proj.RadToDeg(lat)
+
+			ret.West, ret.East = math.Min(ret.West, lon), math.Max(ret.East, lon)
+			ret.South, ret.North = math.Min(ret.South, lat), math.Max(ret.North, lat)
+		}
+	}
+
+	return &ret
+}
+
+// return a time as an FGDC calendar date
+func fgdcDate(t time.Time) string {
+	return t.Format("20060102")
+}
+
+// return a GTFS date as an FGDC calendar date
+func fgdcGtfsDate(d gtfs.Date) string {
+	return fmt.Sprintf("%04d%02d%02d", d.Year(), d.Month(), d.Day())
+}
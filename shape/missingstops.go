@@ -0,0 +1,163 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/jonas-p/go-shp"
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+)
+
+// MissingStopPolicy defines the treatment of stop times referencing
+// stops missing from the feed, which lenient parsing may leave behind
+type MissingStopPolicy int
+
+const (
+	// MissingStopsSkip removes the stop times of missing stops, stop-based
+	// geometries connect their neighbours
+	MissingStopsSkip MissingStopPolicy = iota
+
+	// MissingStopsBreak removes the stop times of missing stops and
+	// breaks stop-based geometries into several parts at them, and at
+	// stops without coordinates
+	MissingStopsBreak
+
+	// MissingStopsDrop drops trips referencing missing stops
+	MissingStopsDrop
+)
+
+// MissingStopStats counts the stop times referencing missing stops and
+// their treatment
+type MissingStopStats struct {
+	StopTimes    int `json:"stop_times"`    // removed stop times
+	Trips        int `json:"trips"`         // trips with missing stops
+	DroppedTrips int `json:"dropped_trips"` // trips dropped with MissingStopsDrop
+	Breaks       int `json:"breaks"`        // breaks in written stop-based trip geometries
+}
+
+// HandleMissingStops removes the stop times referencing missing stops
+// from the trips of Feed f, or drops the affected trips, according to
+// the MissingStops write option. Must be called before any output is
+// written. The counts are added to the JSON summary
+func (sw *ShapeWriter) HandleMissingStops(f *gtfsparser.Feed) MissingStopStats {
+	for id, trip := range f.Trips {
+		missing := 0
+		for _, st := range trip.StopTimes {
+			if st.Stop() == nil {
+				missing++
+			}
+		}
+
+		if missing == 0 {
+			continue
+		}
+
+		sw.missingStops.Trips++
+		sw.missingStops.StopTimes += missing
+
+		if sw.opts.MissingStops == MissingStopsDrop {
+			delete(f.Trips, id)
+			sw.missingStops.DroppedTrips++
+			continue
+		}
+
+		stopTimes := make(gtfs.StopTimes, 0, len(trip.StopTimes)-missing)
+		gap := false
+
+		for _, st := range trip.StopTimes {
+			if st.Stop() == nil {
+				gap = true
+				continue
+			}
+
+			// remember where stops are missing, to break lines there
+			if gap && len(stopTimes) > 0 {
+				if sw.stopGaps == nil {
+					sw.stopGaps = make(map[*gtfs.Trip]map[int]bool)
+				}
+				if sw.stopGaps[trip] == nil {
+					sw.stopGaps[trip] = make(map[int]bool)
+				}
+				sw.stopGaps[trip][len(stopTimes)] = true
+			}
+
+			gap = false
+			stopTimes = append(stopTimes, st)
+		}
+
+		trip.StopTimes = stopTimes
+	}
+
+	return sw.missingStops
+}
+
+// return the stops of trip with coordinates, split into the parts of
+// its stop-based geometry. With MissingStopsBreak, the stops are split
+// at missing stops and stops without coordinates, and parts of a single
+// stop are dropped. Otherwise, there is a single part
+func (sw *ShapeWriter) stationParts(trip *gtfs.Trip) [][]*gtfs.Stop {
+	breakLines := sw.opts.MissingStops == MissingStopsBreak
+
+	parts := make([][]*gtfs.Stop, 0, 1)
+	cur := make([]*gtfs.Stop, 0, len(trip.StopTimes))
+
+	addPart := func() {
+		if len(cur) > 1 || (!breakLines && len(cur) > 0) {
+			parts = append(parts, cur)
+		}
+		cur = make([]*gtfs.Stop, 0, len(trip.StopTimes))
+	}
+
+	for i, st := range trip.StopTimes {
+		// skip stops without coordinates, which would be placed at 0,0
+		if !hasCoord(st.Stop()) {
+			if breakLines {
+				addPart()
+			}
+			continue
+		}
+
+		if breakLines && sw.stopGaps[trip][i] {
+			addPart()
+		}
+
+		cur = append(cur, st.Stop())
+	}
+
+	addPart()
+
+	return parts
+}
+
+// return the length in meters of the lines through the stops of parts
+func stationPartsMeterLength(parts [][]*gtfs.Stop) float64 {
+	mlen := 0.0
+
+	for _, part := range parts {
+		for i := 1; i < len(part); i++ {
+			mlen += haversine(float64(part[i-1].Lat), float64(part[i-1].Lon), float64(part[i].Lat), float64(part[i].Lon))
+		}
+	}
+
+	return mlen
+}
+
+// return the reprojected lines through the stops of parts
+func (sw *ShapeWriter) stationPartsToShpLines(parts [][]*gtfs.Stop) [][]shp.Point {
+	ret := make([][]shp.Point, 0, len(parts))
+
+	for _, part := range parts {
+		points := make([]shp.Point, 0, len(part))
+		for _, stop := range part {
+			x, y := sw.project(float64(stop.Lat), float64(stop.Lon))
+			points = append(points, shp.Point{X: x, Y: y})
+		}
+		ret = append(ret, points)
+	}
+
+	return ret
+}
@@ -0,0 +1,22 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+// ModeClass returns the class of a GTFS route type (including the
+// extended route types), which is either "water", "aerial", "funicular"
+// or "land"
+func ModeClass(t int16) string {
+	switch {
+	case t == 4 || (t >= 1000 && t < 1100) || (t >= 1200 && t < 1300):
+		return "water"
+	case t == 6 || (t >= 1300 && t < 1400):
+		return "aerial"
+	case t == 7 || (t >= 1400 && t < 1500):
+		return "funicular"
+	}
+	return "land"
+}
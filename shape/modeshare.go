@@ -0,0 +1,137 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// network and vehicle km of the routes of one agency and route type
+type modeShare struct {
+	routes map[*gtfs.Route]bool
+	shapes map[string]bool // distinct aggregated shapes
+	trips  int
+	netLen float64 // meters, each aggregated shape counted once
+	totLen float64 // vehicle meters
+}
+
+// WriteModeShareCsv writes the network km and vehicle km per route type
+// contained in Feed f into <outFile>.modeshare.csv, both for all agencies
+// and per agency, together with their shares of the whole network. A
+// shape variant used by several routes of the same type counts once
+// towards the network km
+func (sw *ShapeWriter) WriteModeShareCsv(f *gtfsparser.Feed, typeMap map[int16]string, outFile string) {
+	csvFile, err := sw.createFile(sw.getOutFileName(outFile, ".modeshare.csv"))
+
+	if err != nil {
+		panic(fmt.Sprintf("Could not open CSV file for writing (%s)", err))
+	}
+	defer csvFile.Close()
+
+	aggrShapes, routeShapes := sw.getAggrShapes(f.Trips, f)
+
+	type shareKey struct {
+		all    bool
+		agency *gtfs.Agency // nil for routes without an agency
+		typ    int16
+	}
+
+	shares := make(map[shareKey]*modeShare)
+	total := &modeShare{routes: make(map[*gtfs.Route]bool), shapes: make(map[string]bool)}
+
+	for route, shapes := range routeShapes {
+		for _, key := range []shareKey{{true, nil, route.Type}, {false, route.Agency, route.Type}} {
+			s, ok := shares[key]
+			if !ok {
+				s = &modeShare{routes: make(map[*gtfs.Route]bool), shapes: make(map[string]bool)}
+				shares[key] = s
+			}
+			s.add(route, shapes, aggrShapes)
+		}
+		total.add(route, shapes, aggrShapes)
+	}
+
+	keys := make([]shareKey, 0, len(shares))
+	for key := range shares {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].all != keys[j].all {
+			return keys[i].all
+		}
+		if keys[i].agency != keys[j].agency {
+			idI, _, _ := sw.agencyVals(keys[i].agency)
+			idJ, _, _ := sw.agencyVals(keys[j].agency)
+			return idI < idJ
+		}
+		return keys[i].typ < keys[j].typ
+	})
+
+	csvwriter := csv.NewWriter(csvFile)
+
+	headers := []string{sw.fldName("Agency_id"), sw.fldName("Agency_name"), sw.fldName("Type"), sw.fldName("Num_routes"), sw.fldName("Frequency"), sw.fldName("Km_net"), sw.fldName("Km_tot"), sw.fldName("Share_net"), sw.fldName("Share_tot")}
+	csvwriter.Write(headers)
+	sw.addDictionaryCsv(filepath.Base(csvFile.Name()), "modeshare", headers)
+
+	row := func(agencyID string, agencyName string, typeName string, s *modeShare) []string {
+		return []string{
+			agencyID,
+			agencyName,
+			typeName,
+			strconv.Itoa(len(s.routes)),
+			strconv.Itoa(s.trips),
+			sw.formatFloat(s.netLen / 1000.0),
+			sw.formatFloat(s.totLen / 1000.0),
+			sw.formatFloat(s.netLen / total.netLen),
+			sw.formatFloat(s.totLen / total.totLen),
+		}
+	}
+
+	for _, key := range keys {
+		typeName := strconv.FormatInt(int64(key.typ), 10)
+		if str, ok := typeMap[key.typ]; ok {
+			typeName = str
+		}
+
+		if key.all {
+			csvwriter.Write(row("*", "", typeName, shares[key]))
+		} else {
+			agencyID, agencyName, _ := sw.agencyVals(key.agency)
+			csvwriter.Write(row(agencyID, agencyName, typeName, shares[key]))
+		}
+	}
+
+	csvwriter.Write(row("*", "", "*", total))
+
+	csvwriter.Flush()
+
+	if err := csvwriter.Error(); err != nil {
+		panic(fmt.Sprintf("Could not write CSV file (%s)", err))
+	}
+}
+
+// add route with its aggregated shapes to s
+func (s *modeShare) add(route *gtfs.Route, shapes map[string]bool, aggrShapes map[string]*AggrShape) {
+	s.routes[route] = true
+
+	for id := range shapes {
+		as := aggrShapes[id]
+		s.trips += as.RouteUniqueTripCount[route]
+		s.totLen += as.MeterLength * float64(as.RouteTripCount[route])
+
+		if !s.shapes[id] {
+			s.shapes[id] = true
+			s.netLen += as.MeterLength
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"runtime"
+)
+
+// number of items per worker parallelOrdered computes ahead of the
+// flushed item, to bound the memory held by computed items
+const orderedWindowPerWorker = 4
+
+// parallelOrdered computes n items in parallel workers and hands them
+// to flush in order, in the calling goroutine. A panic in compute is
+// raised again in the calling goroutine
+func parallelOrdered(n int, compute func(i int) interface{}, flush func(i int, item interface{})) {
+	workers := runtime.NumCPU()
+	if workers > n {
+		workers = n
+	}
+
+	if workers < 2 {
+		for i := 0; i < n; i++ {
+			flush(i, compute(i))
+		}
+		return
+	}
+
+	type result struct {
+		item     interface{}
+		panicked interface{}
+	}
+
+	results := make([]chan result, n)
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+
+	jobs := make(chan int)
+	window := make(chan struct{}, workers*orderedWindowPerWorker)
+	done := make(chan struct{})
+
+	// stops handing out jobs if flush panics
+	defer close(done)
+
+	go func() {
+		defer close(jobs)
+
+		for i := 0; i < n; i++ {
+			select {
+			case window <- struct{}{}:
+			case <-done:
+				return
+			}
+
+			select {
+			case jobs <- i:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range jobs {
+				results[i] <- func() (r result) {
+					defer func() {
+						if p := recover(); p != nil {
+							r.panicked = p
+						}
+					}()
+
+					r.item = compute(i)
+					return r
+				}()
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		r := <-results[i]
+		<-window
+
+		if r.panicked != nil {
+			panic(r.panicked)
+		}
+
+		flush(i, r.item)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/jonas-p/go-shp"
+	"strings"
+)
+
+// overlap ratio of the quadtree node halves, as used by shapelib
+const qixSplitRatio = 0.55
+
+// maximum quadtree depth, as used by shapelib
+const qixMaxDepth = 12
+
+// a quadtree node of a .qix spatial index
+type qixNode struct {
+	bounds   shp.Box
+	ids      []int32
+	subNodes []*qixNode
+}
+
+// writeQix writes a quadtree spatial index for the shapefile shpFile into
+// a .qix file next to it. The format is the one written by shapelib's
+// shptree and read by MapServer, GDAL/OGR, QGIS and GeoServer.
+func (sw *ShapeWriter) writeQix(shpFile string) error {
+	reader, err := shp.Open(shpFile)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	boxes := make([]shp.Box, 0)
+	null := make(map[int]bool)
+	for reader.Next() {
+		i, s := reader.Shape()
+		if _, ok := s.(*shp.Null); ok {
+			null[i] = true
+		}
+		boxes = append(boxes, s.BBox())
+	}
+
+	depth := 0
+	for maxNodes := 1; maxNodes*4 < len(boxes); maxNodes *= 2 {
+		depth++
+	}
+	if depth > qixMaxDepth {
+		depth = qixMaxDepth
+	}
+	if depth < 1 {
+		depth = 1
+	}
+
+	root := &qixNode{bounds: reader.BBox()}
+
+	for i, box := range boxes {
+		if !null[i] {
+			root.add(int32(i), box, depth)
+		}
+	}
+
+	root.trim()
+
+	file, err := sw.createFile(strings.TrimSuffix(shpFile, ".shp") + ".qix")
+	if err != nil {
+		return fmt.Errorf("could not open spatial index for writing (%s)", err)
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+
+	// header: signature, byte order (1 = LSB), version, 3 reserved bytes
+	w.Write([]byte{'S', 'Q', 'T', 1, 1, 0, 0, 0})
+	binary.Write(w, binary.LittleEndian, int32(len(boxes)))
+	binary.Write(w, binary.LittleEndian, int32(depth))
+
+	root.write(w)
+
+	return w.Flush()
+}
+
+// add a shape with the given bounding box to the tree below n
+func (n *qixNode) add(id int32, box shp.Box, depth int) {
+	if depth > 1 {
+		for _, sub := range n.subNodes {
+			if contains(sub.bounds, box) {
+				sub.add(id, box, depth-1)
+				return
+			}
+		}
+
+		if len(n.subNodes) == 0 {
+			half1, half2 := splitBounds(n.bounds)
+			quad1, quad2 := splitBounds(half1)
+			quad3, quad4 := splitBounds(half2)
+
+			for _, quad := range []shp.Box{quad1, quad2, quad3, quad4} {
+				if contains(quad, box) {
+					n.subNodes = []*qixNode{{bounds: quad1}, {bounds: quad2}, {bounds: quad3}, {bounds: quad4}}
+					n.add(id, box, depth)
+					return
+				}
+			}
+		}
+	}
+
+	n.ids = append(n.ids, id)
+}
+
+// remove empty sub nodes, return true if n itself is empty
+func (n *qixNode) trim() bool {
+	subNodes := make([]*qixNode, 0, len(n.subNodes))
+	for _, sub := range n.subNodes {
+		if !sub.trim() {
+			subNodes = append(subNodes, sub)
+		}
+	}
+	n.subNodes = subNodes
+
+	return len(n.ids) == 0 && len(n.subNodes) == 0
+}
+
+// return the number of bytes of all serialized sub nodes of n
+func (n *qixNode) subNodeSize() int32 {
+	ret := int32(0)
+	for _, sub := range n.subNodes {
+		ret += 4*8 + int32(len(sub.ids)+3)*4 + sub.subNodeSize()
+	}
+	return ret
+}
+
+// serialize n and its sub nodes
+func (n *qixNode) write(w *bufio.Writer) {
+	binary.Write(w, binary.LittleEndian, n.subNodeSize())
+	binary.Write(w, binary.LittleEndian, []float64{n.bounds.MinX, n.bounds.MinY, n.bounds.MaxX, n.bounds.MaxY})
+	binary.Write(w, binary.LittleEndian, int32(len(n.ids)))
+	binary.Write(w, binary.LittleEndian, n.ids)
+	binary.Write(w, binary.LittleEndian, int32(len(n.subNodes)))
+
+	for _, sub := range n.subNodes {
+		sub.write(w)
+	}
+}
+
+// split a box into two overlapping halves along its longer axis
+func splitBounds(b shp.Box) (shp.Box, shp.Box) {
+	a := b
+	c := b
+
+	if b.MaxX-b.MinX > b.MaxY-b.MinY {
+		a.MaxX = b.MinX + (b.MaxX-b.MinX)*qixSplitRatio
+		c.MinX = b.MaxX - (b.MaxX-b.MinX)*qixSplitRatio
+	} else {
+		a.MaxY = b.MinY + (b.MaxY-b.MinY)*qixSplitRatio
+		c.MinY = b.MaxY - (b.MaxY-b.MinY)*qixSplitRatio
+	}
+
+	return a, c
+}
+
+// check whether box b is contained in box a
+func contains(a shp.Box, b shp.Box) bool {
+	return b.MinX >= a.MinX && b.MaxX <= a.MaxX && b.MinY >= a.MinY && b.MaxY <= a.MaxY
+}
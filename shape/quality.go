@@ -0,0 +1,74 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"math"
+)
+
+// return the largest distance in meters between consecutive shape points
+// of an aggregated shape (within the part of the shape its trips use),
+// and the largest distance in meters of a stop of its trips to the shape.
+// Large values hint at coarse or misplaced geometries
+func shapeQuality(as *AggrShape) (float64, float64) {
+	pts := as.Shape.Points
+	if len(pts) == 0 {
+		return math.NaN(), math.NaN()
+	}
+
+	// include the neighbours of the clipped range, the line is clipped
+	// between them
+	first, last := clipRange(pts, as.From, as.To)
+	if first > 0 {
+		first--
+	}
+	if last < len(pts)-1 {
+		last++
+	}
+
+	maxGap := 0.0
+	for i := first + 1; i <= last; i++ {
+		maxGap = math.Max(maxGap, haversineP(pts[i-1], pts[i]))
+	}
+
+	// a single point is treated as a segment of length 0
+	segs := make([]Segment, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		a := pts[i]
+		if i > first {
+			a = pts[i-1]
+		} else if first < last {
+			continue
+		}
+		segs = append(segs, Segment{ALat: float64(a.Lat), ALon: float64(a.Lon), BLat: float64(pts[i].Lat), BLon: float64(pts[i].Lon)})
+	}
+
+	maxStopDist := math.NaN()
+	seen := make(map[*gtfs.Stop]bool)
+
+	for _, trip := range as.Trips {
+		for _, st := range trip.StopTimes {
+			stop := st.Stop()
+			if seen[stop] || !hasCoord(stop) {
+				continue
+			}
+			seen[stop] = true
+
+			d := math.Inf(1)
+			for _, s := range segs {
+				d = math.Min(d, distToSegment(float64(stop.Lat), float64(stop.Lon), s))
+			}
+
+			if math.IsNaN(maxStopDist) || d > maxStopDist {
+				maxStopDist = d
+			}
+		}
+	}
+
+	return maxGap, maxStopDist
+}
@@ -0,0 +1,286 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"html/template"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tolerance in meters of the simplification of the report map lines
+const reportSimplify = 25
+
+// the conversion report, see WriteReport
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<link rel="stylesheet" href="https://unpkg.com/leaflet@1.9.4/dist/leaflet.css">
+<script src="https://unpkg.com/leaflet@1.9.4/dist/leaflet.js"></script>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+td.num { text-align: right; }
+#map { height: 500px; margin-bottom: 2em; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Converted {{.Created}} with gtfs2shp.</p>
+
+<h2>Feed</h2>
+<table>
+{{range .Feed}}<tr><th>{{index . 0}}</th><td>{{index . 1}}</td></tr>
+{{end}}</table>
+
+<h2>Network</h2>
+<div id="map"></div>
+
+<h2>Modes</h2>
+<table>
+<tr><th>Route type</th><th>Routes</th><th>Trips over the service period</th><th>Network km</th><th>Vehicle km</th></tr>
+{{range .Modes}}<tr><td>{{.Type}}</td><td class="num">{{.Routes}}</td><td class="num">{{.Trips}}</td><td class="num">{{.NetKm}}</td><td class="num">{{.TotKm}}</td></tr>
+{{end}}</table>
+
+<h2>Layers</h2>
+<table>
+<tr><th>File</th><th>Geometries</th></tr>
+{{range .Layers}}<tr><td>{{.File}}</td><td class="num">{{.Geometries}}</td></tr>
+{{end}}</table>
+
+<h2>Warnings</h2>
+{{if .Warnings}}<ul>
+{{range .Warnings}}<li>{{.}}</li>
+{{end}}</ul>{{else}}<p>None.</p>{{end}}
+
+<script>
+var network = {{.Network}};
+var map = L.map("map");
+L.tileLayer("https://tile.openstreetmap.org/{z}/{x}/{y}.png", {
+  maxZoom: 19,
+  attribution: "&copy; OpenStreetMap contributors"
+}).addTo(map);
+var lines = L.geoJSON(network, {
+  style: function(f) { return {color: f.properties.color, weight: 3}; },
+  onEachFeature: function(f, l) { l.bindTooltip(f.properties.routes); }
+}).addTo(map);
+if (lines.getBounds().isValid()) {
+  map.fitBounds(lines.getBounds());
+} else {
+  map.setView([0, 0], 2);
+}
+</script>
+</body>
+</html>
+`))
+
+// statistics of one route type in the report
+type reportMode struct {
+	Type   string
+	Routes int
+	Trips  int
+	NetKm  string
+	TotKm  string
+}
+
+// WriteReport writes a self-contained HTML conversion report to
+// <outFile>.report.html, with a summary of Feed f, statistics per route
+// type, the layers written so far, the given warnings and a map preview
+// of the aggregated shapes. The map geometries are embedded as GeoJSON,
+// only Leaflet and the background tiles are loaded from the web
+func (sw *ShapeWriter) WriteReport(f *gtfsparser.Feed, typeMap map[int16]string, warnings []string, outFile string) {
+	file, err := sw.createFile(sw.getOutFileName(outFile, ".report.html"))
+	if err != nil {
+		panic(fmt.Sprintf("Could not open report file for writing (%s)", err))
+	}
+	defer file.Close()
+
+	aggrShapes, routeShapes := sw.getAggrShapes(f.Trips, f)
+
+	network, err := json.Marshal(sw.reportNetwork(aggrShapes))
+	if err != nil {
+		panic(fmt.Sprintf("Could not write report file (%s)", err))
+	}
+
+	title := "GTFS conversion report"
+	if len(f.FeedInfos) > 0 && len(f.FeedInfos[0].Publisher_name) > 0 {
+		title += ": " + f.FeedInfos[0].Publisher_name
+	}
+
+	if err := reportTemplate.Execute(file, struct {
+		Title    string
+		Created  string
+		Feed     [][2]string
+		Modes    []reportMode
+		Layers   []LayerSummary
+		Warnings []string
+		Network  template.JS
+	}{
+		title,
+		time.Now().Format("2006-01-02 15:04"),
+		sw.reportFeedSummary(f),
+		sw.reportModes(routeShapes, aggrShapes, typeMap),
+		sw.layers,
+		warnings,
+		template.JS(network),
+	}); err != nil {
+		panic(fmt.Sprintf("Could not write report file (%s)", err))
+	}
+}
+
+// return the rows of the feed summary table of the report
+func (sw *ShapeWriter) reportFeedSummary(f *gtfsparser.Feed) [][2]string {
+	ret := make([][2]string, 0)
+
+	if len(f.FeedInfos) > 0 {
+		info := f.FeedInfos[0]
+		if len(info.Publisher_name) > 0 {
+			ret = append(ret, [2]string{"Publisher", info.Publisher_name})
+		}
+		if len(info.Version) > 0 {
+			ret = append(ret, [2]string{"Version", info.Version})
+		}
+	}
+
+	agencies := make([]string, 0, len(f.Agencies))
+	for _, a := range f.Agencies {
+		agencies = append(agencies, a.Name)
+	}
+	sort.Strings(agencies)
+
+	ret = append(ret, [2]string{"Agencies", strings.Join(agencies, ", ")})
+
+	var first, last gtfs.Date
+	for _, trip := range f.Trips {
+		days := sw.getServiceDays(trip.Service)
+		if days.start.IsEmpty() || days.end.IsEmpty() {
+			continue
+		}
+		if first.IsEmpty() || days.start.GetTime().Before(first.GetTime()) {
+			first = days.start
+		}
+		if last.IsEmpty() || days.end.GetTime().After(last.GetTime()) {
+			last = days.end
+		}
+	}
+
+	if !first.IsEmpty() {
+		ret = append(ret, [2]string{"Service period", isoDate(first) + " to " + isoDate(last)})
+	}
+
+	for _, c := range []struct {
+		name string
+		n    int
+	}{
+		{"Routes", len(f.Routes)},
+		{"Trips", len(f.Trips)},
+		{"Stops", len(f.Stops)},
+		{"Shapes", len(f.Shapes)},
+	} {
+		ret = append(ret, [2]string{c.name, strconv.Itoa(c.n)})
+	}
+
+	return ret
+}
+
+// return the statistics per route type of the report
+func (sw *ShapeWriter) reportModes(routeShapes map[*gtfs.Route]map[string]bool, aggrShapes map[string]*AggrShape, typeMap map[int16]string) []reportMode {
+	shares := make(map[int16]*modeShare)
+
+	for route, shapes := range routeShapes {
+		s, ok := shares[route.Type]
+		if !ok {
+			s = &modeShare{routes: make(map[*gtfs.Route]bool), shapes: make(map[string]bool)}
+			shares[route.Type] = s
+		}
+		s.add(route, shapes, aggrShapes)
+	}
+
+	types := make([]int16, 0, len(shares))
+	for t := range shares {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	ret := make([]reportMode, 0, len(types))
+
+	for _, t := range types {
+		typeName := strconv.FormatInt(int64(t), 10)
+		if str, ok := typeMap[t]; ok {
+			typeName = str
+		}
+
+		s := shares[t]
+		ret = append(ret, reportMode{typeName, len(s.routes), s.trips, strconv.FormatFloat(s.netLen/1000, 'f', 1, 64), strconv.FormatFloat(s.totLen/1000, 'f', 1, 64)})
+	}
+
+	return ret
+}
+
+// return the aggregated shapes as a GeoJSON feature collection in WGS84,
+// simplified for the report map
+func (sw *ShapeWriter) reportNetwork(aggrShapes map[string]*AggrShape) interface{} {
+	ids := make([]string, 0, len(aggrShapes))
+	for id := range aggrShapes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	features := make([]interface{}, 0, len(ids))
+
+	for _, id := range ids {
+		as := aggrShapes[id]
+
+		line := clipShape(as.Shape.Points, as.From, as.To)
+		coords := make([][2]float64, 0)
+		for _, k := range simplifyKeepingStops(line, nil, reportSimplify) {
+			// GeoJSON coordinates are lon, lat, rounded to about a meter
+			lon, _ := strconv.ParseFloat(strconv.FormatFloat(line[k][1], 'f', 5, 64), 64)
+			lat, _ := strconv.ParseFloat(strconv.FormatFloat(line[k][0], 'f', 5, 64), 64)
+			coords = append(coords, [2]float64{lon, lat})
+		}
+		if len(coords) < 2 {
+			continue
+		}
+
+		routeIDs := make([]string, 0, len(as.Routes))
+		for rid := range as.Routes {
+			routeIDs = append(routeIDs, rid)
+		}
+		sort.Strings(routeIDs)
+
+		names := make([]string, 0, len(routeIDs))
+		for _, rid := range routeIDs {
+			r := as.Routes[rid]
+			if len(r.Short_name) > 0 {
+				names = append(names, r.Short_name)
+			} else {
+				names = append(names, r.Long_name)
+			}
+		}
+
+		features = append(features, map[string]interface{}{
+			"type":     "Feature",
+			"geometry": map[string]interface{}{"type": "LineString", "coordinates": coords},
+			"properties": map[string]interface{}{
+				"routes": strings.Join(names, ", "),
+				"color":  styleColor(as.Routes[routeIDs[0]]),
+			},
+		})
+	}
+
+	return map[string]interface{}{"type": "FeatureCollection", "features": features}
+}
@@ -0,0 +1,143 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/jonas-p/go-shp"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"sort"
+)
+
+// RouteGeometry defines which geometry represents a route in outputs
+// with a single feature per route
+type RouteGeometry int
+
+const (
+	// RouteGeomVariants writes a route shape and a label point per
+	// variant, and buffers cover all variants
+	RouteGeomVariants RouteGeometry = iota
+
+	// RouteGeomLongest represents each route by its longest variant
+	RouteGeomLongest
+
+	// RouteGeomMostFrequent represents each route by the variant used
+	// by most trips
+	RouteGeomMostFrequent
+
+	// RouteGeomUnion represents each route by all of its variants, as a
+	// single multi-part line
+	RouteGeomUnion
+)
+
+// return the ID of the aggregated shape representing route among its
+// variants ids, as selected by RouteGeometry. The union is represented
+// by the most frequent variant. Ties are broken by the other criterion,
+// then by ID
+func (sw *ShapeWriter) representativeVariant(route *gtfs.Route, ids []string, aggrShapes map[string]*AggrShape) string {
+	sorted := append([]string{}, ids...)
+	sort.Strings(sorted)
+
+	longest := sw.opts.RouteGeometry == RouteGeomLongest
+
+	better := func(a *AggrShape, b *AggrShape) bool {
+		if longest && a.MeterLength != b.MeterLength {
+			return a.MeterLength > b.MeterLength
+		}
+		if a.RouteTripCount[route] != b.RouteTripCount[route] {
+			return a.RouteTripCount[route] > b.RouteTripCount[route]
+		}
+		return a.MeterLength > b.MeterLength
+	}
+
+	ret := ""
+	for _, id := range sorted {
+		if ret == "" || better(aggrShapes[id], aggrShapes[ret]) {
+			ret = id
+		}
+	}
+
+	return ret
+}
+
+// merge the route shape features of the variants of a route, given with
+// the IDs of their aggregated shapes, into the single feature
+// representing the route
+func (sw *ShapeWriter) mergeRouteShapeFeatures(ids []string, features []routeShapeFeature, aggrShapes map[string]*AggrShape) routeShapeFeature {
+	byID := make(map[string]routeShapeFeature, len(features))
+	for i, feature := range features {
+		byID[ids[i]] = feature
+	}
+
+	ret := byID[sw.representativeVariant(features[0].route, ids, aggrShapes)]
+
+	attrs := make(attrRow, len(ret.attrs))
+	for fld, val := range ret.attrs {
+		attrs[fld] = val
+	}
+
+	// the single feature of a route is identified by the route alone
+	attrs.WriteAttribute(0, 27, featureID(ret.route.Id, ret.layerName))
+	ret.attrs = attrs
+
+	if sw.opts.RouteGeometry != RouteGeomUnion || len(features) == 1 {
+		return ret
+	}
+
+	parts := make([][]shp.Point, 0, len(features))
+	zs := make([]float64, 0)
+	freq := 0
+	meters := 0.0
+	vehicleMeters := 0.0
+
+	for _, feature := range features {
+		p, z := lineParts(feature.line)
+		parts = append(parts, p...)
+		zs = append(zs, z...)
+
+		as := feature.aggrShape
+		freq += as.RouteTripCount[feature.route]
+		meters += as.MeterLength
+		vehicleMeters += as.MeterLength * float64(as.RouteTripCount[feature.route])
+	}
+
+	attrs.WriteAttribute(0, 4, freq)
+	sw.writeFloatAttr(attrs, 0, 5, meters/1000.0)
+	sw.writeFloatAttr(attrs, 0, 6, vehicleMeters/1000.0)
+
+	if sw.opts.ExtentAttrs {
+		sw.writeExtentAttrsParts(attrs, 0, ret.customFld-numExtentFlds, parts)
+	}
+
+	ret.line = sw.newLineParts(parts, zs)
+
+	return ret
+}
+
+// return the parts of a line geometry, and its Z values if it has them
+func lineParts(line shp.Shape) ([][]shp.Point, []float64) {
+	var points []shp.Point
+	var offsets []int32
+	var zs []float64
+
+	switch l := line.(type) {
+	case *shp.PolyLine:
+		points, offsets = l.Points, l.Parts
+	case *shp.PolyLineZ:
+		points, offsets, zs = l.Points, l.Parts, l.ZArray
+	}
+
+	ret := make([][]shp.Point, len(offsets))
+	for i, start := range offsets {
+		end := int32(len(points))
+		if i+1 < len(offsets) {
+			end = offsets[i+1]
+		}
+		ret[i] = points[start:end]
+	}
+
+	return ret, zs
+}
@@ -0,0 +1,179 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// RouteGroups maps route IDs to the ID of the line group they are
+// marketed as
+type RouteGroups map[string]string
+
+// a group of routes aggregated into a single route
+type routeGroup struct {
+	route   *gtfs.Route
+	rep     *gtfs.Route
+	members int
+}
+
+// ReadRouteGroups reads a CSV file grouping routes into lines. The file
+// must have a header containing at least the columns route_id and
+// group_id. Routes not listed are not grouped.
+func ReadRouteGroups(path string) (RouteGroups, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open route group file (%s)", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read header of route group file %s (%s)", path, err)
+	}
+
+	routeIDCol := -1
+	groupIDCol := -1
+
+	for i, name := range header {
+		switch name {
+		case "route_id":
+			routeIDCol = i
+		case "group_id":
+			groupIDCol = i
+		}
+	}
+
+	if routeIDCol < 0 || groupIDCol < 0 {
+		return nil, fmt.Errorf("route group file %s must contain the columns route_id and group_id", path)
+	}
+
+	ret := make(RouteGroups)
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read route group file %s (%s)", path, err)
+		}
+
+		if routeIDCol >= len(record) || groupIDCol >= len(record) || len(record[groupIDCol]) == 0 {
+			continue
+		}
+
+		ret[record[routeIDCol]] = record[groupIDCol]
+	}
+
+	return ret, nil
+}
+
+// build the aggregated routes for all route groups in feed f. Groups
+// are taken from the RouteGroups option and, if RouteGroupField is
+// set, from this additional field in routes.txt. Panics if a group ID
+// is also the ID of a route, as both would be written with the same
+// Route_id
+func (sw *ShapeWriter) initRouteGroups(f *gtfsparser.Feed) {
+	if sw.groups != nil {
+		return
+	}
+
+	sw.groups = make(map[*gtfs.Route]*routeGroup)
+
+	groupIDs := make(map[string]string)
+	for routeID, groupID := range sw.opts.RouteGroups {
+		groupIDs[routeID] = groupID
+	}
+
+	if len(sw.opts.RouteGroupField) > 0 {
+		for routeID, groupID := range f.RoutesAddFlds[sw.opts.RouteGroupField] {
+			if _, ok := groupIDs[routeID]; !ok && len(groupID) > 0 {
+				groupIDs[routeID] = groupID
+			}
+		}
+	}
+
+	members := make(map[string][]*gtfs.Route)
+	for routeID, groupID := range groupIDs {
+		if r, ok := f.Routes[routeID]; ok {
+			members[groupID] = append(members[groupID], r)
+		}
+	}
+
+	for groupID, routes := range members {
+		if _, ok := f.Routes[groupID]; ok {
+			panic(fmt.Sprintf("Route group ID %s is also a route ID", groupID))
+		}
+
+		sort.Slice(routes, func(i, j int) bool { return routes[i].Id < routes[j].Id })
+
+		// the group inherits the attributes of its first route
+		groupRoute := *routes[0]
+		groupRoute.Id = groupID
+
+		names := make([]string, 0)
+		seen := make(map[string]bool)
+		for _, r := range routes {
+			if len(r.Short_name) > 0 && !seen[r.Short_name] {
+				seen[r.Short_name] = true
+				names = append(names, r.Short_name)
+			}
+		}
+		groupRoute.Short_name = strings.Join(names, ",")
+
+		group := &routeGroup{&groupRoute, routes[0], len(routes)}
+
+		for _, r := range routes {
+			sw.groups[r] = group
+		}
+		sw.groups[&groupRoute] = group
+	}
+}
+
+// return the route r is aggregated into, which is r itself if it
+// is not part of a route group
+func (sw *ShapeWriter) groupRoute(r *gtfs.Route) *gtfs.Route {
+	if group, ok := sw.groups[r]; ok {
+		return group.route
+	}
+	return r
+}
+
+// return the number of routes aggregated into route r
+func (sw *ShapeWriter) numGroupMembers(r *gtfs.Route) int {
+	if group, ok := sw.groups[r]; ok && group.route == r {
+		return group.members
+	}
+	return 1
+}
+
+// return the value of the additional routes.txt field fld for route r.
+// Route groups use the values of their first route
+func (sw *ShapeWriter) routeAddFld(f *gtfsparser.Feed, fld string, r *gtfs.Route) string {
+	if group, ok := sw.groups[r]; ok && group.route == r {
+		r = group.rep
+	}
+
+	if vals, ok := f.RoutesAddFlds[fld]; ok {
+		if val, ok := vals[r.Id]; ok {
+			return val
+		}
+	}
+
+	return ""
+}
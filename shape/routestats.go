@@ -0,0 +1,158 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"strconv"
+)
+
+// RouteStats holds statistics aggregated over one or more routes
+type RouteStats struct {
+	NumRoutes       int
+	TotLength       float64 // total vehicle meters
+	NetLength       float64 // summed length of the distinct route variants
+	MaxLength       float64 // length of the longest route variant
+	TotFreq         int     // number of trips over the service period
+	UniqueFreq      int     // number of trips, without trips marked as not counted
+	Dir0Freq        int     // number of trips in direction 0
+	Dir1Freq        int     // number of trips in direction 1
+	WheelchairTrips int
+	WheelchairStops int
+	BikesTrips      int
+	NumStops        int
+	PeakVehicles    int     // estimated peak number of simultaneous vehicles
+	InLength        float64 // vehicle meters within the boundary
+}
+
+// Add adds the statistics of o to rs
+func (rs *RouteStats) Add(o RouteStats) {
+	rs.NumRoutes += o.NumRoutes
+	rs.TotLength += o.TotLength
+	rs.NetLength += o.NetLength
+	if o.MaxLength > rs.MaxLength {
+		rs.MaxLength = o.MaxLength
+	}
+	rs.TotFreq += o.TotFreq
+	rs.UniqueFreq += o.UniqueFreq
+	rs.Dir0Freq += o.Dir0Freq
+	rs.Dir1Freq += o.Dir1Freq
+	rs.WheelchairTrips += o.WheelchairTrips
+	rs.WheelchairStops += o.WheelchairStops
+	rs.BikesTrips += o.BikesTrips
+	rs.NumStops += o.NumStops
+	rs.PeakVehicles += o.PeakVehicles
+	rs.InLength += o.InLength
+}
+
+// aggregate the statistics of a single route over its shapes
+func (sw *ShapeWriter) getRouteStats(route *gtfs.Route, shapes map[string]bool, aggrShapes map[string]*AggrShape) RouteStats {
+	ret := RouteStats{NumRoutes: sw.numGroupMembers(route)}
+
+	for s := range shapes {
+		aggrShp := aggrShapes[s]
+		ret.TotFreq += aggrShp.RouteTripCount[route]
+		ret.UniqueFreq += aggrShp.RouteUniqueTripCount[route]
+		ret.Dir0Freq += aggrShp.Dir0TripCount[route]
+		ret.Dir1Freq += aggrShp.Dir1TripCount[route]
+		ret.TotLength += aggrShp.MeterLength * float64(aggrShp.RouteTripCount[route])
+		ret.NetLength += aggrShp.MeterLength
+		if aggrShp.MeterLength > ret.MaxLength {
+			ret.MaxLength = aggrShp.MeterLength
+		}
+		ret.WheelchairTrips += aggrShp.WheelchairAccessibleTrips[route]
+		ret.WheelchairStops += aggrShp.WheelchairAccessibleStops[route]
+		ret.BikesTrips += aggrShp.BikesAllowedTrips[route]
+		ret.NumStops += aggrShp.NumStops[route]
+		if sw.opts.Boundary != nil {
+			ret.InLength += aggrShp.MeterLength * sw.opts.Boundary.share(aggrShp) * float64(aggrShp.RouteTripCount[route])
+		}
+	}
+
+	return ret
+}
+
+// return the absolute difference between the trips in both directions,
+// relative to the number of trips with a direction
+func (rs RouteStats) dirImbalance() float64 {
+	diff := rs.Dir0Freq - rs.Dir1Freq
+	if diff < 0 {
+		diff = -diff
+	}
+	return float64(diff) / float64(rs.Dir0Freq+rs.Dir1Freq)
+}
+
+// return the average distance in meters between two consecutive stops
+// served by the trips of rs
+func (rs RouteStats) stopSpacing() float64 {
+	return stopSpacing(rs.TotLength, rs.NumStops, rs.TotFreq)
+}
+
+// return the average stop spacing of numTrips trips with a total length
+// of length meters, serving numStops stops in total
+func stopSpacing(length float64, numStops int, numTrips int) float64 {
+	return length / float64(numStops-numTrips)
+}
+
+// return the route overview CSV values of rs, in the order Frequency,
+// Km_len, Km_tot, Km_max, Wchair_tr, Wchair_st, Dir_diff, Dir_imbal,
+// Stop_dist, Vehicles, Bikes_tr, Num_routes, Km_net, Trips_day. days is
+// the length of the service period in days
+func (sw *ShapeWriter) routeStatsVals(rs RouteStats, days float64) []string {
+	return []string{
+		strconv.FormatInt(int64(rs.UniqueFreq), 10),
+		sw.formatFloat((rs.TotLength / float64(rs.TotFreq)) / 1000.0),
+		sw.formatFloat(rs.TotLength / 1000.0),
+		sw.formatFloat(rs.MaxLength / 1000.0),
+		sw.formatFloat(float64(rs.WheelchairTrips) / float64(rs.TotFreq)),
+		sw.formatFloat(float64(rs.WheelchairStops) / float64(rs.NumStops)),
+		strconv.FormatInt(int64(rs.Dir0Freq-rs.Dir1Freq), 10),
+		sw.formatFloat(rs.dirImbalance()),
+		sw.formatFloat(rs.stopSpacing()),
+		strconv.FormatInt(int64(rs.PeakVehicles), 10),
+		sw.formatFloat(float64(rs.BikesTrips) / float64(rs.TotFreq)),
+		strconv.FormatInt(int64(rs.NumRoutes), 10),
+		sw.formatFloat(rs.NetLength / 1000.0),
+		sw.formatFloat(float64(rs.UniqueFreq) / days),
+	}
+}
+
+// return a route overview CSV summary row
+func (sw *ShapeWriter) routeTotalsRow(rs RouteStats, days float64, name string, typeName string, numAddFlds int) []string {
+	vals := sw.routeStatsVals(rs, days)
+
+	row := []string{"*", "", name, typeName}
+	row = append(row, vals[:4]...)
+	row = append(row, "", "", "")
+	row = append(row, vals[4:11]...)
+
+	for i := 0; i < numAddFlds; i++ {
+		row = append(row, "")
+	}
+
+	row = append(row, vals[11:]...)
+	row = append(row, sw.boundaryVals(rs)...)
+
+	for range sw.customAttrs {
+		row = append(row, "")
+	}
+
+	return row
+}
+
+// return the route overview CSV values Km_in and Km_out of rs, or
+// nothing if no boundary is set
+func (sw *ShapeWriter) boundaryVals(rs RouteStats) []string {
+	if sw.opts.Boundary == nil {
+		return nil
+	}
+
+	return []string{
+		sw.formatFloat(rs.InLength / 1000.0),
+		sw.formatFloat((rs.TotLength - rs.InLength) / 1000.0),
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/patrickbr/gtfsparser"
+	"io"
+	"os"
+	"strconv"
+)
+
+// RouteTypeMap reclassifies route types, either of single routes or of
+// all routes of a type
+type RouteTypeMap struct {
+	// New route type by route ID, takes precedence over ByType
+	ByRoute map[string]int16
+
+	// New route type by original route type
+	ByType map[int16]int16
+}
+
+// ReadRouteTypeMap reads a CSV file reclassifying route types. The file
+// must have a header containing the column new_route_type and at least
+// one of the columns route_id and route_type. Each row reclassifies
+// either the route with the given route ID or, if the route ID is empty,
+// all routes with the given route type.
+func ReadRouteTypeMap(path string) (*RouteTypeMap, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open route type file (%s)", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read header of route type file %s (%s)", path, err)
+	}
+
+	routeIDCol := -1
+	typeCol := -1
+	newTypeCol := -1
+
+	for i, name := range header {
+		switch name {
+		case "route_id":
+			routeIDCol = i
+		case "route_type":
+			typeCol = i
+		case "new_route_type":
+			newTypeCol = i
+		}
+	}
+
+	if newTypeCol < 0 || (routeIDCol < 0 && typeCol < 0) {
+		return nil, fmt.Errorf("route type file %s must contain the column new_route_type and the column route_id or route_type", path)
+	}
+
+	ret := &RouteTypeMap{ByRoute: make(map[string]int16), ByType: make(map[int16]int16)}
+
+	get := func(record []string, col int) string {
+		if col < 0 || col >= len(record) {
+			return ""
+		}
+		return record[col]
+	}
+
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read route type file %s (%s)", path, err)
+		}
+
+		newType, err := strconv.ParseInt(get(record, newTypeCol), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid new_route_type '%s' in line %d of route type file %s", get(record, newTypeCol), line, path)
+		}
+
+		if id := get(record, routeIDCol); len(id) > 0 {
+			ret.ByRoute[id] = int16(newType)
+			continue
+		}
+
+		t, err := strconv.ParseInt(get(record, typeCol), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route_type '%s' in line %d of route type file %s", get(record, typeCol), line, path)
+		}
+
+		ret.ByType[int16(t)] = int16(newType)
+	}
+
+	return ret, nil
+}
+
+// ReclassifyRouteTypes changes the types of the routes of Feed f as given
+// by RouteTypeMap m. Call it before writing, so route type filters and
+// route type names apply to the new types. Returns a description of the
+// changes, by route ID
+func ReclassifyRouteTypes(f *gtfsparser.Feed, m *RouteTypeMap) map[string]string {
+	ret := make(map[string]string)
+
+	for id, route := range f.Routes {
+		newType, ok := m.ByRoute[id]
+		if !ok {
+			newType, ok = m.ByType[route.Type]
+		}
+
+		if !ok || newType == route.Type {
+			continue
+		}
+
+		ret[id] = fmt.Sprintf("reclassified from route type %d to %d", route.Type, newType)
+		route.Type = newType
+	}
+
+	return ret
+}
@@ -0,0 +1,245 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/patrickbr/gtfsparser"
+	"math"
+	"sort"
+)
+
+// meters per degree latitude
+const metersPerDeg = 111319.49
+
+// maximum number of entries of an R-tree node
+const rtreeNodeCap = 16
+
+// Segment is a line segment between two WGS84 coordinates
+type Segment struct {
+	ALat, ALon float64
+	BLat, BLon float64
+	ID         string // ID of the geometry the segment belongs to
+	Idx        int    // position of the segment in its geometry
+}
+
+// a bounding box in degrees
+type rect struct {
+	minLat, minLon float64
+	maxLat, maxLon float64
+}
+
+// an R-tree node, either with child nodes or with segment ids
+type rtreeNode struct {
+	bounds   rect
+	children []*rtreeNode
+	segs     []int
+}
+
+// SegmentIndex is a static R-tree over line segments, for nearest
+// segment and distance queries on GTFS geometries. Distances are
+// given in meters.
+type SegmentIndex struct {
+	root *rtreeNode
+	segs []Segment
+}
+
+// NewSegmentIndex bulk loads an index over segs
+func NewSegmentIndex(segs []Segment) *SegmentIndex {
+	idx := &SegmentIndex{segs: segs}
+
+	nodes := make([]*rtreeNode, len(segs))
+	for i, s := range segs {
+		nodes[i] = &rtreeNode{bounds: s.bounds(), segs: []int{i}}
+	}
+
+	leaves := packNodes(nodes, func(group []*rtreeNode) *rtreeNode {
+		n := &rtreeNode{bounds: group[0].bounds}
+		for _, c := range group {
+			n.bounds = n.bounds.extend(c.bounds)
+			n.segs = append(n.segs, c.segs...)
+		}
+		return n
+	})
+
+	for len(leaves) > 1 {
+		leaves = packNodes(leaves, func(group []*rtreeNode) *rtreeNode {
+			n := &rtreeNode{bounds: group[0].bounds, children: group}
+			for _, c := range group {
+				n.bounds = n.bounds.extend(c.bounds)
+			}
+			return n
+		})
+	}
+
+	if len(leaves) == 1 {
+		idx.root = leaves[0]
+	}
+
+	return idx
+}
+
+// NewShapeIndex returns an index over the segments of all shapes in
+// Feed f, with the shape IDs as segment IDs
+func NewShapeIndex(f *gtfsparser.Feed) *SegmentIndex {
+	segs := make([]Segment, 0)
+
+	for _, shp := range f.Shapes {
+		for i := 1; i < len(shp.Points); i++ {
+			a := shp.Points[i-1]
+			b := shp.Points[i]
+			segs = append(segs, Segment{float64(a.Lat), float64(a.Lon), float64(b.Lat), float64(b.Lon), shp.Id, i - 1})
+		}
+	}
+
+	return NewSegmentIndex(segs)
+}
+
+// group nodes into parents of at most rtreeNodeCap nodes each, using
+// sort-tile-recursive packing
+func packNodes(nodes []*rtreeNode, parent func([]*rtreeNode) *rtreeNode) []*rtreeNode {
+	numParents := (len(nodes) + rtreeNodeCap - 1) / rtreeNodeCap
+	numSlices := int(math.Ceil(math.Sqrt(float64(numParents))))
+	sliceSize := numSlices * rtreeNodeCap
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].bounds.minLon+nodes[i].bounds.maxLon < nodes[j].bounds.minLon+nodes[j].bounds.maxLon
+	})
+
+	ret := make([]*rtreeNode, 0, numParents)
+
+	for i := 0; i < len(nodes); i += sliceSize {
+		slice := nodes[i:int(math.Min(float64(i+sliceSize), float64(len(nodes))))]
+
+		sort.Slice(slice, func(i, j int) bool {
+			return slice[i].bounds.minLat+slice[i].bounds.maxLat < slice[j].bounds.minLat+slice[j].bounds.maxLat
+		})
+
+		for j := 0; j < len(slice); j += rtreeNodeCap {
+			group := make([]*rtreeNode, 0, rtreeNodeCap)
+			group = append(group, slice[j:int(math.Min(float64(j+rtreeNodeCap), float64(len(slice))))]...)
+			ret = append(ret, parent(group))
+		}
+	}
+
+	return ret
+}
+
+// Within returns all segments within dist meters of a coordinate
+func (idx *SegmentIndex) Within(lat float64, lon float64, dist float64) []Segment {
+	ret := make([]Segment, 0)
+
+	idx.visit(lat, lon, dist, func(id int, d float64) bool {
+		ret = append(ret, idx.segs[id])
+		return true
+	})
+
+	return ret
+}
+
+// Any checks whether any segment is within dist meters of a coordinate
+func (idx *SegmentIndex) Any(lat float64, lon float64, dist float64) bool {
+	found := false
+
+	idx.visit(lat, lon, dist, func(id int, d float64) bool {
+		found = true
+		return false
+	})
+
+	return found
+}
+
+// Nearest returns the segment nearest to a coordinate and its distance,
+// considering only segments within maxDist meters. ok is false if there
+// is no such segment.
+func (idx *SegmentIndex) Nearest(lat float64, lon float64, maxDist float64) (seg Segment, dist float64, ok bool) {
+	dist = maxDist
+
+	idx.visit(lat, lon, maxDist, func(id int, d float64) bool {
+		if d <= dist {
+			seg = idx.segs[id]
+			dist = d
+			ok = true
+		}
+		return true
+	})
+
+	return seg, dist, ok
+}
+
+// call cb for all segments within dist meters of a coordinate, with the
+// segment id and its distance, until cb returns false
+func (idx *SegmentIndex) visit(lat float64, lon float64, dist float64, cb func(int, float64) bool) {
+	if idx.root == nil {
+		return
+	}
+
+	cosLat := math.Max(math.Cos(lat*DEG_TO_RAD), 0.01)
+	query := rect{
+		lat - dist/metersPerDeg, lon - dist/metersPerDeg/cosLat,
+		lat + dist/metersPerDeg, lon + dist/metersPerDeg/cosLat,
+	}
+
+	stack := []*rtreeNode{idx.root}
+
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if !n.bounds.intersects(query) {
+			continue
+		}
+
+		stack = append(stack, n.children...)
+
+		for _, id := range n.segs {
+			if d := distToSegment(lat, lon, idx.segs[id]); d <= dist {
+				if !cb(id, d) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// return the bounding box of a segment
+func (s Segment) bounds() rect {
+	return rect{math.Min(s.ALat, s.BLat), math.Min(s.ALon, s.BLon), math.Max(s.ALat, s.BLat), math.Max(s.ALon, s.BLon)}
+}
+
+// return the union of two boxes
+func (r rect) extend(o rect) rect {
+	return rect{math.Min(r.minLat, o.minLat), math.Min(r.minLon, o.minLon), math.Max(r.maxLat, o.maxLat), math.Max(r.maxLon, o.maxLon)}
+}
+
+// check whether two boxes intersect
+func (r rect) intersects(o rect) bool {
+	return r.minLat <= o.maxLat && o.minLat <= r.maxLat && r.minLon <= o.maxLon && o.minLon <= r.maxLon
+}
+
+// return the approximate distance in meters between a coordinate and a
+// segment, using an equirectangular projection around the coordinate
+func distToSegment(lat float64, lon float64, s Segment) float64 {
+	cosLat := math.Cos(lat * DEG_TO_RAD)
+
+	ax := (s.ALon - lon) * cosLat * metersPerDeg
+	ay := (s.ALat - lat) * metersPerDeg
+	bx := (s.BLon - lon) * cosLat * metersPerDeg
+	by := (s.BLat - lat) * metersPerDeg
+
+	dx := bx - ax
+	dy := by - ay
+
+	t := 0.0
+	if dx != 0 || dy != 0 {
+		t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/(dx*dx+dy*dy)))
+	}
+
+	px := ax + t*dx
+	py := ay + t*dy
+
+	return math.Sqrt(px*px + py*py)
+}
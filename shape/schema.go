@@ -0,0 +1,228 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/jonas-p/go-shp"
+	"strings"
+)
+
+// SchemaLatest is the latest output schema version, see SCHEMA.md
+const SchemaLatest = 3
+
+// versions in which columns were added to the output layers. Columns
+// not listed here (including additional route fields and custom
+// attributes) are part of every schema version
+var columnVersions = map[string]map[string]int{
+	"trips": {
+		"Mode_class": 2, "Num_trips": 2,
+		"Mon": 2, "Tue": 2, "Wed": 2, "Thu": 2, "Fri": 2, "Sat": 2, "Sun": 2, "Holiday": 2,
+		"Start_date": 2, "Start_ep": 2, "End_date": 2, "End_ep": 2, "First_dep": 2, "Dep_sec": 2,
+		"Km": 3, "Runtime": 3, "Speed": 3, "Geom_src": 3, "Geom_id": 3, "Service_id": 3, "Days": 3, "Feat_id": 3,
+		"Min_x": 2, "Min_y": 2, "Max_x": 2, "Max_y": 2, "Cent_x": 2, "Cent_y": 2,
+	},
+	"routes": {
+		"Mode_class": 2, "Dir_diff": 2, "Dir_imbal": 2, "Hw_exact": 2, "Hw_freq": 2, "Stop_dist": 2, "Vehicles": 3, "Variant": 3, "Bikes_tr": 3,
+		"Max_gap": 3, "Max_stop_d": 3, "Loop": 3, "Loop_dir": 3, "Loop_start": 3, "Loop_km": 3, "Headsign": 3, "Feat_id": 3,
+		"Avg_delay": 2, "Punctual": 2, "Hw_min": 3, "Hw_max": 3, "Hw_med": 3,
+		"Min_x": 2, "Min_y": 2, "Max_x": 2, "Max_y": 2, "Cent_x": 2, "Cent_y": 2,
+	},
+	"shapes": {
+		"Variant": 3, "Max_gap": 3, "Max_stop_d": 3,
+		"Frequency": 3, "Num_routes": 3, "Km_len": 3, "Km_tot": 3, "Km_day": 3, "Headsign": 3, "Feat_id": 3,
+		"Min_x": 2, "Min_y": 2, "Max_x": 2, "Max_y": 2, "Cent_x": 2, "Cent_y": 2,
+	},
+	"stations": {
+		"Loc_name": 2, "Has_transf": 3, "Transfers": 3, "Has_pathw": 3, "Pathways": 3, "Group_id": 3, "Frequency": 3, "Wchair_tr": 3, "Bikes_tr": 3, "Feat_id": 3,
+	},
+	"overview": {
+		"Agency_id": 3, "Dir_diff": 2, "Dir_imbal": 2, "Stop_dist": 2, "Vehicles": 3, "Bikes_tr": 3, "Num_routes": 2, "Km_net": 2, "Trips_day": 3, "Km_in": 3, "Km_out": 3,
+	},
+}
+
+// attrWriter receives the attributes of features, by row and full
+// schema field index
+type attrWriter interface {
+	WriteAttribute(row int, field int, value interface{}) error
+}
+
+// the attributes of a single feature by full schema field index,
+// buffered until the feature is written. The row is ignored
+type attrRow map[int]interface{}
+
+// WriteAttribute sets an attribute of the buffered feature
+func (r attrRow) WriteAttribute(row int, field int, value interface{}) error {
+	r[field] = value
+	return nil
+}
+
+// a shapefile layer which only writes the columns of the selected
+// output schema version, and only the features matching the filter
+// expression. Attributes are written with the field indices of the
+// full schema.
+type layer struct {
+	*shpWriter
+	drop map[string]bool // dropped field names, as written to the DBF
+	idx  []int           // output field index per full schema field, -1 if dropped
+
+	kind   string      // layer kind, as in columnVersions
+	fields []shp.Field // written fields
+
+	// if a filter is set, each feature is held back until it is
+	// complete, and only written if it matches
+	where   *Where
+	names   map[string]int // full schema field index by lower-cased name
+	pending shp.Shape
+	attrs   map[int]interface{}
+	rows    int // number of written features
+	skipped int // number of features not matching the filter
+}
+
+// return the names (as written to the DBF) of the columns of layer kind
+// which are not part of the selected schema version
+func (sw *ShapeWriter) droppedColumns(kind string) map[string]bool {
+	ret := make(map[string]bool)
+
+	if sw.opts.Schema == 0 || sw.opts.Schema >= SchemaLatest {
+		return ret
+	}
+
+	for name, version := range columnVersions[kind] {
+		if version > sw.opts.Schema {
+			ret[dbfFieldName(sw.fldName(name))] = true
+		}
+	}
+
+	return ret
+}
+
+// return a field name as written to the DBF
+func dbfFieldName(name string) string {
+	fld := shp.StringField(name, 1)
+	return fld.String()
+}
+
+// SetFields sets the fields of the layer, without the dropped columns.
+// The filter is only applied if the layer has all fields it references
+func (l *layer) SetFields(fields []shp.Field) error {
+	if l.where != nil {
+		l.names = make(map[string]int, len(fields))
+		for i, fld := range fields {
+			l.names[strings.ToLower(fld.String())] = i
+		}
+
+		if !l.where.appliesTo(l.names) {
+			l.where = nil
+		}
+	}
+
+	if len(l.drop) == 0 {
+		l.fields = fields
+		return l.shpWriter.SetFields(fields)
+	}
+
+	kept := make([]shp.Field, 0, len(fields))
+	l.idx = make([]int, len(fields))
+
+	for i, fld := range fields {
+		if l.drop[fld.String()] {
+			l.idx[i] = -1
+			continue
+		}
+		l.idx[i] = len(kept)
+		kept = append(kept, fld)
+	}
+
+	l.fields = kept
+	return l.shpWriter.SetFields(kept)
+}
+
+// Write starts a new feature with geometry s
+func (l *layer) Write(s shp.Shape) int32 {
+	if l.where == nil {
+		return l.shpWriter.Write(s)
+	}
+
+	l.flush()
+	l.pending = s
+	l.attrs = make(map[int]interface{})
+
+	return int32(l.rows)
+}
+
+// write the pending feature if it matches the filter
+func (l *layer) flush() {
+	if l.pending == nil {
+		return
+	}
+
+	match := l.where.Match(func(name string) interface{} {
+		return l.attrs[l.names[name]]
+	})
+
+	if match {
+		l.shpWriter.Write(l.pending)
+		for field, value := range l.attrs {
+			l.writeAttribute(l.rows, field, value)
+		}
+		l.rows++
+	} else {
+		l.skipped++
+	}
+
+	l.pending = nil
+}
+
+// WriteAttribute writes an attribute, given by its full schema field
+// index. Attributes of dropped columns are ignored
+func (l *layer) WriteAttribute(row int, field int, value interface{}) error {
+	if l.where != nil {
+		l.attrs[field] = value
+		return nil
+	}
+
+	return l.writeAttribute(row, field, value)
+}
+
+// write an attribute into the output row, given by its full schema field
+// index
+func (l *layer) writeAttribute(row int, field int, value interface{}) error {
+	if l.idx == nil {
+		return l.shpWriter.WriteAttribute(row, field, value)
+	}
+
+	if field >= len(l.idx) || l.idx[field] < 0 {
+		return nil
+	}
+
+	return l.shpWriter.WriteAttribute(row, l.idx[field], value)
+}
+
+// return a function which removes the columns not part of the selected
+// schema version from rows of the CSV output kind, given its header
+func (sw *ShapeWriter) csvSchemaFilter(kind string, header []string) func([]string) []string {
+	drop := sw.droppedColumns(kind)
+
+	if len(drop) == 0 {
+		return func(row []string) []string { return row }
+	}
+
+	keep := make([]bool, len(header))
+	for i, name := range header {
+		keep[i] = !drop[dbfFieldName(name)]
+	}
+
+	return func(row []string) []string {
+		ret := make([]string, 0, len(row))
+		for i, val := range row {
+			if i >= len(keep) || keep[i] {
+				ret = append(ret, val)
+			}
+		}
+		return ret
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/jonas-p/go-shp"
+	"github.com/patrickbr/gtfsparser"
+	"math"
+)
+
+// fraction of the network extent used as the default schematic grid size
+const schematicGridRatio = 1.0 / 200
+
+// WriteSchematic writes an experimental octilinear schematic of the
+// aggregated shapes contained in Feed f to <outFile>.schematic.shp. Lines
+// are simplified, snapped to a grid and only use horizontal, vertical and
+// diagonal (45 degree) segments in the output projection.
+func (sw *ShapeWriter) WriteSchematic(f *gtfsparser.Feed, outFile string) int {
+	defer sw.useLayer("schematic")()
+
+	aggrShapes, _ := sw.getAggrShapes(f.Trips, f)
+
+	lines := make(map[string][]shp.Point, len(aggrShapes))
+	box := shp.Box{MinX: math.Inf(1), MinY: math.Inf(1), MaxX: math.Inf(-1), MaxY: math.Inf(-1)}
+
+	for id, aggrShape := range aggrShapes {
+		lines[id] = sw.gtfsShapePointsToShpLinePoints(aggrShape.Shape.Points, aggrShape.From, aggrShape.To)
+		if len(lines[id]) > 0 {
+			box.Extend(shp.BBoxFromPoints(lines[id]))
+		}
+	}
+
+	grid := sw.opts.SchematicGrid
+	if grid <= 0 {
+		grid = math.Max(box.MaxX-box.MinX, box.MaxY-box.MinY) * schematicGridRatio
+	}
+
+	fileName := sw.getOutFileName(outFile, ".schematic.shp")
+	shape := sw.createLayer(fileName, shp.POLYLINE, "shapes")
+	defer sw.closeLayer(shape, fileName)
+
+	shape.SetFields(sw.getFieldSizesForShapes(aggrShapes))
+
+	n := 0
+	days := sw.servicePeriodDays(aggrShapes)
+
+	for id, aggrShape := range aggrShapes {
+		points := octilinearize(lines[id], grid)
+		if len(points) < 2 {
+			continue
+		}
+
+		shape.Write(shp.NewPolyLine([][]shp.Point{points}))
+
+		sw.writeAggrShapeAttrs(shape, n, aggrShape, days)
+
+		n = n + 1
+	}
+
+	return n
+}
+
+// return an octilinear version of a line, with vertices on a grid of
+// the given size
+func octilinearize(points []shp.Point, grid float64) []shp.Point {
+	if grid <= 0 || math.IsInf(grid, 0) || math.IsNaN(grid) {
+		return points
+	}
+
+	snapped := make([]shp.Point, 0, len(points))
+	for _, p := range points {
+		snapped = append(snapped, shp.Point{X: math.Round(p.X/grid) * grid, Y: math.Round(p.Y/grid) * grid})
+	}
+
+	simplified := simplifyLine(dedupPoints(snapped), grid)
+
+	ret := make([]shp.Point, 0, len(simplified)*2)
+
+	for i, p := range simplified {
+		if i > 0 {
+			// replace each segment by a diagonal and an axis-parallel part
+			prev := simplified[i-1]
+			dx := p.X - prev.X
+			dy := p.Y - prev.Y
+			diag := math.Min(math.Abs(dx), math.Abs(dy))
+
+			if diag > 0 && diag < math.Max(math.Abs(dx), math.Abs(dy)) {
+				ret = append(ret, shp.Point{X: prev.X + math.Copysign(diag, dx), Y: prev.Y + math.Copysign(diag, dy)})
+			}
+		}
+		ret = append(ret, p)
+	}
+
+	return removeCollinear(dedupPoints(ret))
+}
+
+// remove consecutive duplicate points
+func dedupPoints(points []shp.Point) []shp.Point {
+	ret := make([]shp.Point, 0, len(points))
+	for i, p := range points {
+		if i == 0 || p != points[i-1] {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// remove inner points lying on a straight line between their neighbors
+func removeCollinear(points []shp.Point) []shp.Point {
+	if len(points) < 3 {
+		return points
+	}
+
+	ret := []shp.Point{points[0]}
+	for i := 1; i < len(points)-1; i++ {
+		a := ret[len(ret)-1]
+		b := points[i]
+		c := points[i+1]
+		if (b.X-a.X)*(c.Y-b.Y)-(b.Y-a.Y)*(c.X-b.X) != 0 {
+			ret = append(ret, b)
+		}
+	}
+
+	return append(ret, points[len(points)-1])
+}
+
+// simplify a line with the Douglas-Peucker algorithm
+func simplifyLine(points []shp.Point, epsilon float64) []shp.Point {
+	if len(points) < 3 {
+		return points
+	}
+
+	maxDist := 0.0
+	maxI := 0
+
+	for i := 1; i < len(points)-1; i++ {
+		if d := pointSegDist(points[i], points[0], points[len(points)-1]); d > maxDist {
+			maxDist = d
+			maxI = i
+		}
+	}
+
+	if maxDist <= epsilon {
+		return []shp.Point{points[0], points[len(points)-1]}
+	}
+
+	left := simplifyLine(points[:maxI+1], epsilon)
+	right := simplifyLine(points[maxI:], epsilon)
+
+	return append(left[:len(left)-1], right...)
+}
+
+// return the euclidean distance between point p and the segment a, b
+func pointSegDist(p shp.Point, a shp.Point, b shp.Point) float64 {
+	dx := b.X - a.X
+	dy := b.Y - a.Y
+
+	t := 0.0
+	if dx != 0 || dy != 0 {
+		t = math.Max(0, math.Min(1, ((p.X-a.X)*dx+(p.Y-a.Y)*dy)/(dx*dx+dy*dy)))
+	}
+
+	return math.Hypot(a.X+t*dx-p.X, a.Y+t*dy-p.Y)
+}
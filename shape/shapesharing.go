@@ -0,0 +1,122 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// length of the geometry hashes in the shape sharing report
+const geomHashLen = 16
+
+// WriteShapeSharingCsv writes a report of the shapes contained in Feed f
+// into <outFile>.shape_sharing.csv, with the number of routes and trips
+// referencing each shape and a hash of its geometry. Shapes with the same
+// geometry under different shape IDs are listed as duplicates of each
+// other, unused shapes have no routes and trips
+func (sw *ShapeWriter) WriteShapeSharingCsv(f *gtfsparser.Feed, outFile string) {
+	csvFile, err := sw.createFile(sw.getOutFileName(outFile, ".shape_sharing.csv"))
+
+	if err != nil {
+		panic(fmt.Sprintf("Could not open CSV file for writing (%s)", err))
+	}
+	defer csvFile.Close()
+
+	routes := make(map[*gtfs.Shape]map[*gtfs.Route]bool)
+	trips := make(map[*gtfs.Shape]int)
+
+	for _, trip := range f.Trips {
+		if trip.Shape == nil {
+			continue
+		}
+		if routes[trip.Shape] == nil {
+			routes[trip.Shape] = make(map[*gtfs.Route]bool)
+		}
+		routes[trip.Shape][trip.Route] = true
+		trips[trip.Shape]++
+	}
+
+	shapes := make([]*gtfs.Shape, 0, len(f.Shapes))
+	for _, s := range f.Shapes {
+		shapes = append(shapes, s)
+	}
+	sort.Slice(shapes, func(i, j int) bool { return shapes[i].Id < shapes[j].Id })
+
+	hashes := make(map[*gtfs.Shape]string, len(shapes))
+	byHash := make(map[string][]string)
+
+	for _, s := range shapes {
+		hash := geomHash(s.Points)
+		hashes[s] = hash
+		byHash[hash] = append(byHash[hash], sw.ids.get("shape", s.Id))
+	}
+
+	csvwriter := csv.NewWriter(csvFile)
+
+	headers := []string{sw.fldName("Shape_id"), sw.fldName("Num_routes"), sw.fldName("RouteIds"), sw.fldName("Num_trips"), sw.fldName("Num_points"), sw.fldName("Geom_hash"), sw.fldName("Duplicates")}
+	csvwriter.Write(headers)
+	sw.addDictionaryCsv(filepath.Base(csvFile.Name()), "shapesharing", headers)
+
+	for _, s := range shapes {
+		id := sw.ids.get("shape", s.Id)
+
+		routeIds := make([]string, 0, len(routes[s]))
+		for r := range routes[s] {
+			routeIds = append(routeIds, sw.ids.get("route", r.Id))
+		}
+		sort.Strings(routeIds)
+
+		dups := make([]string, 0)
+		for _, other := range byHash[hashes[s]] {
+			if other != id {
+				dups = append(dups, other)
+			}
+		}
+
+		csvwriter.Write([]string{
+			id,
+			strconv.Itoa(len(routeIds)),
+			strings.Join(routeIds, ","),
+			strconv.Itoa(trips[s]),
+			strconv.Itoa(len(s.Points)),
+			hashes[s],
+			strings.Join(dups, ","),
+		})
+	}
+
+	csvwriter.Flush()
+
+	if err := csvwriter.Error(); err != nil {
+		panic(fmt.Sprintf("Could not write CSV file (%s)", err))
+	}
+}
+
+// return a hash of the coordinates of shape points, ignoring their
+// sequence numbers and measures
+func geomHash(points gtfs.ShapePoints) string {
+	h := sha1.New()
+	buf := make([]byte, 8)
+
+	for _, p := range points {
+		binary.LittleEndian.PutUint32(buf, math.Float32bits(p.Lat))
+		binary.LittleEndian.PutUint32(buf[4:], math.Float32bits(p.Lon))
+		h.Write(buf)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:geomHashLen]
+}
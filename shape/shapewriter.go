@@ -13,161 +13,717 @@ import (
 	"github.com/patrickbr/gtfsparser"
 	"github.com/patrickbr/gtfsparser/gtfs"
 	"github.com/pebbe/go-proj-4/proj/v5"
+	"io"
 	"math"
-	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 var wgs84 = "+proj=longlat +ellps=WGS84 +datum=WGS84 +no_defs"
 
+// OutputLayers are the layers whose projection and MOT filter can be
+// overridden
+var OutputLayers = []string{"trips", "routes", "shapes", "stations", "schematic", "stopevents", "labels", "stopchains", "interlines", "buffers", "corridors", "shapepoints"}
+
 // ShapeWriter writes shapes to a shapefile
 type ShapeWriter struct {
 	outProj   *proj.Proj
 	wgs84Proj *proj.Proj
+	defProj   *proj.Proj
+	layerProj map[string]*proj.Proj
+	projNames map[*proj.Proj]string
+	projMutex sync.Mutex
 	motMap    map[int16]bool
+	defMots   map[int16]bool
+	layerMots map[string]map[int16]bool
 	fldMap    map[string]string
+	opts      WriteOptions
+	ids       *idMapper
+	nearIdx   *SegmentIndex
+	groups    map[*gtfs.Route]*routeGroup
+	svcDays   serviceDaysCache
+	tzs       tzCache
+	layers    []LayerSummary
+	filtered  int
+	stopModes map[*gtfs.Stop]map[int16]bool
+
+	// positions of removed missing stops in the stop times of trips
+	stopGaps     map[*gtfs.Trip]map[int]bool
+	missingStops MissingStopStats
+
+	dictionary []DictionaryEntry
+
+	customAttrs []customAttr
+}
+
+// WriteOptions holds optional output settings of a ShapeWriter
+type WriteOptions struct {
+	// Observed trip delays. If set, average delay and punctuality
+	// attributes are added to the route shapes
+	TripDelays TripDelays
+
+	// Maximum delay in seconds for an observation to count as punctual.
+	// Observations more than 60 seconds early never count as punctual
+	PunctualityThreshold float64
+
+	// If set, the minimum, maximum and median headway of the departures
+	// within this service window are added to the route shapes
+	HeadwayWindow *HeadwayWindow
+
+	// Only write one representative trip per route, direction and stop
+	// pattern in the explicit trips output
+	RepresentativeTrips bool
+
+	// Write water, aerial and funicular route shapes into separate files
+	SplitModeClasses bool
+
+	// Aggregate the route shapes of direction 0 and direction 1 trips
+	// separately and write them into separate files
+	SplitDirection bool
+
+	// Orient route shape variants in the direction of direction_id=0
+	// travel, reversing variants mostly travelled in direction 1
+	NormalizeDirection bool
+
+	// Write the stations served by each route type into separate files
+	SplitStationsByMode bool
+
+	// Append per-route-type and grand total rows to the route overview CSV
+	OverviewTotals bool
+
+	// Stop location types to output, empty keeps all
+	StopLocTypes map[int8]bool
+
+	// If set, only output stops within NearRouteDist meters of
+	// the geometries of the route with this ID
+	NearRoute     string
+	NearRouteDist float64
+
+	// If set, only output stops within this circle
+	Around *Circle
+
+	// Round output coordinates to Precision decimal places
+	RoundCoords bool
+	Precision   int
+
+	// Write a .qix spatial index for each shapefile
+	SpatialIndex bool
+
+	// Add bounding box and centroid attributes to line features
+	ExtentAttrs bool
+
+	// Representation of missing (undefined) numeric values
+	MissingValues MissingValuePolicy
+
+	// Treatment of non-ASCII or overly long IDs
+	IDSanitization IDSanitization
+
+	// Maximum length of output IDs if IDSanitization is used
+	MaxIDLength int
+
+	// Geometry of trips without a shape in the explicit trips output
+	ShapelessTrips ShapelessPolicy
+
+	// Treatment of stop times referencing stops missing from the feed
+	MissingStops MissingStopPolicy
+
+	// Write each distinct geometry of the explicit trips only once into a
+	// separate layer, referenced by the trips with a Geom_id attribute
+	SharedTripGeoms bool
+
+	// Width in meters of the corridor buffers around the routes, per
+	// route type in BufferWidths, or BufferWidth for other types. Routes
+	// with a width of 0 get no buffer
+	BufferWidth  float64
+	BufferWidths map[int16]float64
+
+	// Distance in meters within which the aggregated shapes of different
+	// routes are dissolved into a single corridor line by WriteCorridors
+	CorridorTolerance float64
+
+	// Timezone (like Europe/Berlin) of the output departure and arrival
+	// times, or StopTimezones for the local time of each stop. If empty,
+	// times are written in the timezone of the agency, as given in GTFS
+	Timezone string
+
+	// Aggregate routes into line groups, keyed by route ID. Routes
+	// can also be grouped by the additional routes.txt field
+	// RouteGroupField, like network_id
+	RouteGroups     RouteGroups
+	RouteGroupField string
+
+	// Additional trips.txt and stops.txt fields written to the explicit
+	// trips and to the stations
+	TripAddFlds []string
+	StopAddFlds []string
+
+	// Languages (like de or en) of the stop name translations from
+	// translations.txt written as one name column each to the stations
+	StopNameLangs []string
+
+	// Holiday dates for the holiday operation flag of explicit trips.
+	// If empty, service added on weekdays not covered by the regular
+	// weekly pattern of a trip counts as holiday operation
+	Holidays map[gtfs.Date]bool
+
+	// Only replace layers whose contents changed compared to the
+	// layers of a previous run, as read by ReadSummaryJSON
+	Incremental bool
+	PrevLayers  []LayerSummary
+
+	// Grid size of the schematic output in units of the output
+	// projection, 0 derives it from the network extent
+	SchematicGrid float64
+
+	// Douglas-Peucker tolerance in meters for simplifying the lines of
+	// the explicit trips, route shapes and aggregated shapes, 0 disables
+	// simplification. The vertex nearest to each served stop is always
+	// retained
+	Simplify float64
+
+	// Replace existing output files
+	Force bool
+
+	// Geometry representing each route in the route shapes, label
+	// points and buffers. By default, route shapes and label points are
+	// written per variant and buffers cover all variants
+	RouteGeometry RouteGeometry
+
+	// Output schema version, see SCHEMA.md. 0 selects SchemaLatest
+	Schema int
+
+	// Maximum heap memory in bytes, 0 means no limit. Under a limit,
+	// explicit trips are written in batches of trips sharing a shape,
+	// with geometries only cached within a batch; if the limit is
+	// exceeded, writing is aborted with an error
+	MaxMem uint64
+
+	// Shape point elevations, line layers created from shapes are
+	// written with Z values unless Force2D is set
+	Elevations Elevations
+	Force2D    bool
+
+	// Only write features whose attributes match this expression, in
+	// layers having all fields referenced by it
+	Where *Where
+
+	// Boundary polygon, the route overview CSV is extended with the
+	// vehicle km inside and outside of it
+	Boundary *Boundary
 }
 
-type RouteStats struct {
-	TotLength float64
-	TotFreq   int
+// MissingValuePolicy defines how missing numeric values are written
+type MissingValuePolicy int
+
+const (
+	// MissingNaN writes missing values as NaN
+	MissingNaN MissingValuePolicy = iota
+
+	// MissingEmpty writes missing values as empty values, which are
+	// read as NULL from shapefiles
+	MissingEmpty
+
+	// MissingMinusOne writes missing values as -1
+	MissingMinusOne
+)
+
+// ShapelessPolicy defines the geometry of trips without a shape
+type ShapelessPolicy int
+
+const (
+	// ShapelessStraight connects the stops of a trip by straight lines
+	ShapelessStraight ShapelessPolicy = iota
+
+	// ShapelessGreatCircle connects the stops of a trip by great circle
+	// arcs, densified to points at most 1 km apart
+	ShapelessGreatCircle
+
+	// ShapelessSkip does not write trips without a shape
+	ShapelessSkip
+)
+
+// names of the GTFS stop location types
+var locTypeNames = map[int8]string{
+	0: "stop",
+	1: "station",
+	2: "entrance",
+	3: "node",
+	4: "boarding_area",
 }
 
+// trips more than this many seconds early never count as punctual
+const maxPunctualEarliness = 60.0
+
 // NewShapeWriter creates a new ShapeWriter, writing in the specified projection (as proj4 string)
 func NewShapeWriter(projection string, motMap map[int16]bool, fldMap map[string]string) *ShapeWriter {
 	sw := ShapeWriter{
-		motMap: motMap,
-		fldMap: fldMap,
+		motMap:    motMap,
+		defMots:   motMap,
+		layerMots: make(map[string]map[int16]bool),
+		fldMap:    fldMap,
+		ids:       newIDMapper(IDKeep, maxFieldSize),
+		layerProj: make(map[string]*proj.Proj),
+		projNames: map[*proj.Proj]string{nil: "4326"},
 	}
 
+	sw.defProj = sw.initProj(projection)
+	sw.outProj = sw.defProj
+
+	return &sw
+}
+
+// SetLayerProjection overrides the output projection (as SRID or proj4
+// string) of the given layer, one of OutputLayers. The stations CSV
+// follows the stations layer, the trip geometries follow the trips layer
+func (sw *ShapeWriter) SetLayerProjection(layer string, projection string) error {
+	if err := checkOutputLayer(layer); err != nil {
+		return err
+	}
+
+	sw.layerProj[layer] = sw.initProj(projection)
+	return nil
+}
+
+// SetLayerMOTs overrides the MOT filter of the given layer, one of
+// OutputLayers, like the station context of a single mode's routes. An
+// empty motMap writes all MOTs
+func (sw *ShapeWriter) SetLayerMOTs(layer string, motMap map[int16]bool) error {
+	if err := checkOutputLayer(layer); err != nil {
+		return err
+	}
+
+	sw.layerMots[layer] = motMap
+	return nil
+}
+
+// return an error if layer is not one of OutputLayers
+func checkOutputLayer(layer string) error {
+	for _, l := range OutputLayers {
+		if l == layer {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown layer '%s', expected one of %s", layer, strings.Join(OutputLayers, ", "))
+}
+
+// return the projection for the given projection (as SRID or proj4
+// string), nil for WGS84
+func (sw *ShapeWriter) initProj(projection string) *proj.Proj {
 	/**
 	 * NOTE: go-proj-4 does not yet support pj_is_latlong(), which
 	 * means we have no secure way the test whether the user requested
 	 * latlng output. If EPSG:4326 is defined in another way than tested
 	 * here, it will reproject the coordinates to latlng in radians!
 	 */
-	if projection != "4326" && projection != wgs84 {
-		// we need reprojection of coordinates
+	if projection == "4326" || projection == wgs84 {
+		return nil
+	}
 
-		var targetProj *proj.Proj
+	// we need reprojection of coordinates
+	if sw.wgs84Proj == nil {
 		wgs84, err := proj.NewProj(wgs84)
 		if err != nil {
 			panic(fmt.Sprintf("Could not init WGS84 projection, maybe proj4 is not available? (%s)", err))
 		}
+		sw.wgs84Proj = wgs84
+	}
 
-		if _, err := strconv.Atoi(projection); err == nil {
-			// srid supplied
-			pr, err := proj.NewProj("+init=epsg:" + projection)
-			if err != nil {
-				panic(fmt.Sprintf("Could not init projection with SRID %s", projection))
-			}
-			targetProj = pr
-		} else {
-			// treat as proj4 string
-			pr, err := proj.NewProj(projection)
-			if err != nil {
-				panic(fmt.Sprintf("Could not init projection %s (%s)", projection, err))
-			}
-			targetProj = pr
+	if _, err := strconv.Atoi(projection); err == nil {
+		// srid supplied
+		pr, err := proj.NewProj("+init=epsg:" + projection)
+		if err != nil {
+			panic(fmt.Sprintf("Could not init projection with SRID %s", projection))
 		}
+		sw.projNames[pr] = projection
+		return pr
+	}
 
-		sw.wgs84Proj = wgs84
-		sw.outProj = targetProj
+	// treat as proj4 string
+	pr, err := proj.NewProj(projection)
+	if err != nil {
+		panic(fmt.Sprintf("Could not init projection %s (%s)", projection, err))
 	}
+	sw.projNames[pr] = projection
+	return pr
+}
 
-	return &sw
+// switch the output projection and the MOT filter to the ones of layer,
+// the defaults if they were not overridden. Returns a function switching
+// back to the defaults, to be deferred
+func (sw *ShapeWriter) useLayer(layer string) func() {
+	sw.switchLayer(layer)
+	return func() { sw.switchLayer("") }
+}
+
+func (sw *ShapeWriter) switchLayer(layer string) {
+	if pr, ok := sw.layerProj[layer]; ok {
+		sw.outProj = pr
+	} else {
+		sw.outProj = sw.defProj
+	}
+
+	if len(sw.layerMots) == 0 {
+		return
+	}
+
+	if mots, ok := sw.layerMots[layer]; ok {
+		sw.motMap = mots
+	} else {
+		sw.motMap = sw.defMots
+	}
+
+	// the stop modes depend on the MOT filter
+	sw.stopModes = nil
+}
+
+// SetWriteOpts sets the optional output settings
+func (sw *ShapeWriter) SetWriteOpts(opts WriteOptions) {
+	sw.opts = opts
+	sw.ids = newIDMapper(opts.IDSanitization, opts.MaxIDLength)
+}
+
+// WriteIDMapCsv writes a CSV mapping all IDs changed by the ID
+// sanitization back to their original values
+func (sw *ShapeWriter) WriteIDMapCsv(outFile string) {
+	csvFile, err := sw.createFile(sw.getOutFileName(outFile, ".ids.csv"))
+
+	if err != nil {
+		panic(fmt.Sprintf("Could not open CSV file for writing (%s)", err))
+	}
+	defer csvFile.Close()
+
+	sw.ids.writeCsv(csvFile)
+}
+
+// MapIDs assigns the output IDs of all agencies, routes, trips, stops,
+// shapes and services of Feed f under the ID sanitization. Call it after
+// SetWriteOpts and before writing, so IDs made unique by a suffix do not
+// depend on the order they are written in. IDs not contained in f are
+// assigned when first written
+func (sw *ShapeWriter) MapIDs(f *gtfsparser.Feed) {
+	if sw.ids.mode == IDKeep {
+		return
+	}
+
+	ids := make([]string, 0, len(f.Agencies))
+	for id := range f.Agencies {
+		ids = append(ids, id)
+	}
+	sw.ids.reserve("agency", ids)
+
+	ids = make([]string, 0, len(f.Routes))
+	for id := range f.Routes {
+		ids = append(ids, id)
+	}
+	sw.ids.reserve("route", ids)
+
+	ids = make([]string, 0, len(f.Trips))
+	for id := range f.Trips {
+		ids = append(ids, id)
+	}
+	sw.ids.reserve("trip", ids)
+
+	ids = make([]string, 0, len(f.Stops))
+	for id := range f.Stops {
+		ids = append(ids, id)
+	}
+	sw.ids.reserve("stop", ids)
+
+	ids = make([]string, 0, len(f.Shapes))
+	for id := range f.Shapes {
+		ids = append(ids, id)
+	}
+	sw.ids.reserve("shape", ids)
+
+	ids = make([]string, 0, len(f.Services))
+	for id := range f.Services {
+		ids = append(ids, id)
+	}
+	sw.ids.reserve("service", ids)
 }
 
 // WriteTripsExplicit writes the shapes contained in Feed f to outFile, with each trip as an
 // explicit geometry with all trip attributes
 func (sw *ShapeWriter) WriteTripsExplicit(f *gtfsparser.Feed, outFile string) int {
-	shape, err := shp.Create(sw.getShapeFileName(outFile), shp.POLYLINE)
+	defer sw.useLayer("trips")()
 
-	if err != nil {
-		panic(fmt.Sprintf("Could not open shapefile for writing (%s)", err))
+	fileName := sw.getShapeFileName(outFile)
+	shape := sw.createLayer(fileName, sw.lineType(), "trips")
+	defer sw.closeLayer(shape, fileName)
+
+	trips := f.Trips
+	var patternCount map[string]int
+
+	if sw.opts.RepresentativeTrips {
+		trips, patternCount = sw.getRepresentativeTrips(f.Trips)
+	}
+
+	fields := sw.getFieldSizesForTrips(trips)
+	if sw.opts.RepresentativeTrips {
+		fields = append(fields, shp.NumberField(sw.fldName("Num_trips"), 10))
+	}
+
+	// with shared geometries, each distinct trip geometry is only written
+	// once into a separate layer, and referenced by its ID
+	var geoms *tripGeomLayer
+	geomFld := len(fields)
+	if sw.opts.SharedTripGeoms {
+		fields = append(fields, shp.NumberField(sw.fldName("Geom_id"), 10))
+		geoms = sw.createTripGeomLayer(trips, outFile)
+		defer sw.closeLayer(geoms.shape, geoms.fileName)
+	}
+
+	addFld := len(fields)
+	if len(sw.opts.TripAddFlds) > 0 {
+		tripIDs := make([]string, 0, len(trips))
+		for id := range trips {
+			tripIDs = append(tripIDs, id)
+		}
+		fields = append(fields, sw.addFldFields(f.TripsAddFlds, sw.opts.TripAddFlds, tripIDs)...)
 	}
-	defer shape.Close()
 
-	shape.SetFields(sw.getFieldSizesForTrips(f.Trips))
+	extentFld := len(fields)
+	fields = append(fields, sw.getExtentFields()...)
+
+	customFld := len(fields)
+	fields = append(fields, sw.getCustomAttrFields(func(visit func(*gtfs.Trip, *gtfs.Route, *AggrShape)) {
+		for _, trip := range trips {
+			if len(sw.motMap) == 0 || sw.motMap[trip.Route.Type] {
+				visit(trip, trip.Route, nil)
+			}
+		}
+	})...)
+
+	shape.SetFields(fields)
 
 	n := 0
-	calcedShapes := make(map[string]*shp.PolyLine)
 
-	// iterate through trips
-	for _, trip := range f.Trips {
-		if len(sw.motMap) > 0 && !sw.motMap[trip.Route.Type] {
-			continue
+	// geometries and lengths by tripGeomKey
+	calcedShapes := make(map[string]shp.Shape)
+	calcedLengths := make(map[string]float64)
+
+	// iterate through trips, in batches sharing a geometry cache
+	checked := 0
+	for _, batch := range sw.tripBatches(trips) {
+		// under a memory limit, geometries are only cached within a batch
+		if sw.opts.MaxMem > 0 {
+			calcedShapes = make(map[string]shp.Shape)
+			calcedLengths = make(map[string]float64)
 		}
 
-		if trip.Shape != nil {
-			from := math.NaN()
-			to := math.NaN()
+		for _, trip := range batch {
+			if sw.opts.MaxMem > 0 && checked%memCheckInterval == 0 {
+				sw.checkMem("writing trips")
+			}
+			checked++
+
+			if len(sw.motMap) > 0 && !sw.motMap[trip.Route.Type] {
+				continue
+			}
+
+			if trip.Shape == nil && sw.opts.ShapelessTrips == ShapelessSkip {
+				continue
+			}
+
+			geomSrc := "shape"
+			if trip.Shape == nil {
+				geomSrc = "straight"
+				if sw.opts.ShapelessTrips == ShapelessGreatCircle {
+					geomSrc = "great_circle"
+				}
+			}
+
+			// prevent re-calcing of polylines for each trip. Trips sharing
+			// a shape may use different parts of it
+			key, from, to := sw.tripGeomKey(trip)
+			line, ok := calcedShapes[key]
+			meters := calcedLengths[key]
+
+			if !ok {
+				if trip.Shape != nil {
+					line = sw.newLine(sw.shapeLine(trip.Shape, from, to, servedStops(trip)))
+					meters = shapeMeterLength(trip.Shape.Points, from, to)
+				} else {
+					// use station positions as polyline anchors
+					parts := sw.stationParts(trip)
+					if geomSrc == "great_circle" {
+						line = sw.newLineParts(sw.stationPartsToGreatCircles(parts), nil)
+					} else {
+						line = sw.newLineParts(sw.stationPartsToShpLines(parts), nil)
+					}
+					meters = stationPartsMeterLength(parts)
+
+					if len(parts) > 1 {
+						sw.missingStops.Breaks += len(parts) - 1
+					}
+				}
+
+				calcedShapes[key] = line
+				calcedLengths[key] = meters
+			}
+
+			if geoms != nil {
+				shape.Write(&shp.Null{})
+				shape.WriteAttribute(n, geomFld, geoms.get(key, trip, line, meters))
+			} else {
+				shape.Write(line)
+			}
+
+			shape.WriteAttribute(n, 0, sw.ids.get("trip", trip.Id))
+			shape.WriteAttribute(n, 1, trip.Headsign)
+			shape.WriteAttribute(n, 2, trip.Short_name)
+			shape.WriteAttribute(n, 3, trip.Direction_id)
+			shape.WriteAttribute(n, 4, trip.Block_id)
+			shape.WriteAttribute(n, 5, trip.Wheelchair_accessible)
+			shape.WriteAttribute(n, 6, trip.Bikes_allowed)
+			shape.WriteAttribute(n, 7, trip.Route.Short_name)
+			shape.WriteAttribute(n, 8, trip.Route.Long_name)
+			shape.WriteAttribute(n, 9, trip.Route.Desc)
+			shape.WriteAttribute(n, 10, trip.Route.Type)
+			shape.WriteAttribute(n, 11, trip.Route.Url)
+			shape.WriteAttribute(n, 12, trip.Route.Color)
+			shape.WriteAttribute(n, 13, trip.Route.Text_color)
+			shape.WriteAttribute(n, 14, ModeClass(trip.Route.Type))
+
+			// operation days, starting with monday
+			days := sw.getServiceDays(trip.Service)
+			for i := 0; i < 7; i++ {
+				shape.WriteAttribute(n, 15+i, boolToInt(days.weekdays[(i+1)%7]))
+			}
+			shape.WriteAttribute(n, 22, boolToInt(days.holiday))
+
+			// service period and first departure
+			sw.writeDateAttrs(shape, n, 23, days.start)
+			sw.writeDateAttrs(shape, n, 25, days.end)
 			if len(trip.StopTimes) > 0 {
-				from = float64(trip.StopTimes[0].Shape_dist_traveled())
-				to = float64(trip.StopTimes[len(trip.StopTimes)-1].Shape_dist_traveled())
+				dep := sw.normalizeTime(trip.StopTimes[0].Departure_time().SecondsSinceMidnight(), trip.Route.Agency, trip.StopTimes[0].Stop(), days.start)
+				shape.WriteAttribute(n, 27, isoTime(dep))
+				shape.WriteAttribute(n, 28, dep)
 			}
-			points := sw.gtfsShapePointsToShpLinePoints(trip.Shape.Points, from, to)
-			parts := [][]shp.Point{points}
 
-			// prevent re-calcing of polylines for each trips
-			if val, ok := calcedShapes[trip.Shape.Id]; ok {
-				shape.Write(val)
+			// length, scheduled runtime and average speed
+			minutes := math.NaN()
+			if len(trip.StopTimes) > 1 {
+				minutes = float64(trip.StopTimes[len(trip.StopTimes)-1].Arrival_time().SecondsSinceMidnight()-trip.StopTimes[0].Departure_time().SecondsSinceMidnight()) / 60.0
+			}
+			sw.writeFloatAttr(shape, n, 29, meters/1000.0)
+			sw.writeFloatAttr(shape, n, 30, minutes)
+			if minutes > 0 {
+				sw.writeFloatAttr(shape, n, 31, (meters/1000.0)/(minutes/60.0))
 			} else {
-				calcedShapes[trip.Shape.Id] = shp.NewPolyLine(parts)
-				shape.Write(calcedShapes[trip.Shape.Id])
+				sw.writeFloatAttr(shape, n, 31, math.NaN())
 			}
-		} else {
-			// use station positions as polyline anchors
-			points := sw.gtfsStationPointsToShpLinePoints(trip.StopTimes)
-			parts := [][]shp.Point{points}
-
-			shape.Write(shp.NewPolyLine(parts))
-		}
-
-		shape.WriteAttribute(n, 0, trip.Id)
-		shape.WriteAttribute(n, 1, trip.Headsign)
-		shape.WriteAttribute(n, 2, trip.Short_name)
-		shape.WriteAttribute(n, 3, trip.Direction_id)
-		shape.WriteAttribute(n, 4, trip.Block_id)
-		shape.WriteAttribute(n, 5, trip.Wheelchair_accessible)
-		shape.WriteAttribute(n, 6, trip.Bikes_allowed)
-		shape.WriteAttribute(n, 7, trip.Route.Short_name)
-		shape.WriteAttribute(n, 8, trip.Route.Long_name)
-		shape.WriteAttribute(n, 9, trip.Route.Desc)
-		shape.WriteAttribute(n, 10, trip.Route.Type)
-		shape.WriteAttribute(n, 11, trip.Route.Url)
-		shape.WriteAttribute(n, 12, trip.Route.Color)
-		shape.WriteAttribute(n, 13, trip.Route.Text_color)
+			shape.WriteAttribute(n, 32, geomSrc)
 
-		n = n + 1
+			// service and condensed operation days
+			shape.WriteAttribute(n, 33, sw.ids.get("service", trip.Service.Id()))
+			shape.WriteAttribute(n, 34, days.text())
+			shape.WriteAttribute(n, 35, featureID(trip.Route.Id, trip.Id))
+
+			if sw.opts.RepresentativeTrips {
+				shape.WriteAttribute(n, 36, patternCount[trip.Id])
+			}
+
+			sw.writeAddFldAttrs(shape, n, addFld, f.TripsAddFlds, sw.opts.TripAddFlds, trip.Id)
+
+			sw.writeExtentAttrs(shape, n, extentFld, linePoints(line))
+			sw.writeCustomAttrs(shape, n, customFld, trip, trip.Route, nil)
+
+			n = n + 1
+		}
 	}
 
 	return n
 }
 
+// return one representative trip per route, direction and stop pattern, together
+// with the number of trips each representative stands for, keyed by trip ID
+func (sw *ShapeWriter) getRepresentativeTrips(trips map[string]*gtfs.Trip) (map[string]*gtfs.Trip, map[string]int) {
+	patterns := make(map[string]*gtfs.Trip)
+	counts := make(map[string]int)
+
+	for _, trip := range trips {
+		key := trip.Route.Id + "\x00" + strconv.Itoa(int(trip.Direction_id))
+		for _, st := range trip.StopTimes {
+			key += "\x00" + st.Stop().Id
+		}
+
+		counts[key] += 1
+
+		// use the trip with the smallest ID as representative, to be deterministic
+		if rep, ok := patterns[key]; !ok || trip.Id < rep.Id {
+			patterns[key] = trip
+		}
+	}
+
+	ret := make(map[string]*gtfs.Trip, len(patterns))
+	retCounts := make(map[string]int, len(patterns))
+
+	for key, trip := range patterns {
+		ret[trip.Id] = trip
+		retCounts[trip.Id] = counts[key]
+	}
+
+	return ret, retCounts
+}
+
+// WriteRouteOverviewCsv writes a CSV file with one line per route next to outFile
 func (sw *ShapeWriter) WriteRouteOverviewCsv(f *gtfsparser.Feed, typeMap map[int16]string, routeAddFlds []string, outFile string) {
-	csvFile, err := os.Create(sw.getCsvFileName(outFile))
+	csvFile, err := sw.createFile(sw.getCsvFileName(outFile))
 
 	if err != nil {
 		panic(fmt.Sprintf("Could not open CSV file for writing (%s)", err))
 	}
+	defer csvFile.Close()
+
+	sw.writeRouteOverviewCsv(f, typeMap, routeAddFlds, csvFile, filepath.Base(csvFile.Name()))
+}
+
+// WriteRouteOverviewCsvTo writes the route overview CSV to w
+func (sw *ShapeWriter) WriteRouteOverviewCsvTo(f *gtfsparser.Feed, typeMap map[int16]string, routeAddFlds []string, w io.Writer) {
+	sw.writeRouteOverviewCsv(f, typeMap, routeAddFlds, w, "-")
+}
 
-	csvwriter := csv.NewWriter(csvFile)
+// write the route overview CSV to w, named fileName in the dictionary
+func (sw *ShapeWriter) writeRouteOverviewCsv(f *gtfsparser.Feed, typeMap map[int16]string, routeAddFlds []string, w io.Writer, fileName string) {
+	csvwriter := csv.NewWriter(w)
 
-	headers := []string{sw.fldName("Route_id"), sw.fldName("Short_name"), sw.fldName("Long_name"), sw.fldName("Type"), sw.fldName("Frequency"), sw.fldName("Km_len"), sw.fldName("Km_tot"), sw.fldName("Km_max"), sw.fldName("Agency_name"), sw.fldName("Agency_url"), sw.fldName("Wchair_tr"), sw.fldName("Wchair_st")}
+	headers := []string{sw.fldName("Route_id"), sw.fldName("Short_name"), sw.fldName("Long_name"), sw.fldName("Type"), sw.fldName("Frequency"), sw.fldName("Km_len"), sw.fldName("Km_tot"), sw.fldName("Km_max"), sw.fldName("Agency_id"), sw.fldName("Agency_name"), sw.fldName("Agency_url"), sw.fldName("Wchair_tr"), sw.fldName("Wchair_st"), sw.fldName("Dir_diff"), sw.fldName("Dir_imbal"), sw.fldName("Stop_dist"), sw.fldName("Vehicles"), sw.fldName("Bikes_tr")}
 
 	for _, field := range routeAddFlds {
 		headers = append(headers, sw.fldName(field))
 	}
 
-	csvwriter.Write(headers)
+	if sw.opts.OverviewTotals {
+		headers = append(headers, sw.fldName("Num_routes"), sw.fldName("Km_net"), sw.fldName("Trips_day"))
+	}
+
+	if sw.opts.Boundary != nil {
+		headers = append(headers, sw.fldName("Km_in"), sw.fldName("Km_out"))
+	}
+
+	for _, attr := range sw.customAttrs {
+		headers = append(headers, sw.fldName(attr.name))
+	}
+
+	filter := sw.csvSchemaFilter("overview", headers)
+
+	csvwriter.Write(filter(headers))
+	sw.addDictionaryCsv(fileName, "overview", filter(headers))
 
 	aggrShapes, routeShapes := sw.getAggrShapes(f.Trips, f)
 
+	typeTotals := make(map[int16]*RouteStats)
+	total := RouteStats{}
+	peaks := sw.getPeakVehicles(f.Trips)
+	days := sw.servicePeriodDays(aggrShapes)
+
 	for route, shapes := range routeShapes {
-		vals := []string{route.Id, route.Short_name, route.Long_name}
+		vals := []string{sw.ids.get("route", route.Id), route.Short_name, route.Long_name}
 
 		if str, ok := typeMap[route.Type]; ok {
 			vals = append(vals, str)
@@ -175,201 +731,753 @@ func (sw *ShapeWriter) WriteRouteOverviewCsv(f *gtfsparser.Feed, typeMap map[int
 			vals = append(vals, strconv.FormatInt(int64(route.Type), 10))
 		}
 
-		totFreq := 0
-		uniqueAggregatedFreq := 0
-		totMeterLength := 0.0
-		totMeterLengthSingular := 0.0
-		maxMeterLength := 0.0
-		wheelchairTripsTot := 0
-		wheelchairStopsTot := 0
-		numStopsTot := 0
+		stats := sw.getRouteStats(route, shapes, aggrShapes)
+		stats.PeakVehicles = peaks[route]
+		statVals := sw.routeStatsVals(stats, days)
+		vals = append(vals, statVals[:4]...)
 
-		for s, _ := range shapes {
-			aggrShp := aggrShapes[s]
-			totFreq += aggrShp.RouteTripCount[route]
+		agencyID, agencyName, agencyURL := sw.agencyVals(route.Agency)
+		vals = append(vals, agencyID, agencyName, agencyURL)
 
-			uniqueAggregatedFreq += aggrShp.RouteUniqueTripCount[route]
+		vals = append(vals, statVals[4:11]...)
 
-			totMeterLength += aggrShp.MeterLength * float64(aggrShp.RouteTripCount[route])
-			totMeterLengthSingular += aggrShp.MeterLength
-			if aggrShp.MeterLength > maxMeterLength {
-				maxMeterLength = aggrShp.MeterLength
-			}
-			wheelchairTripsTot += aggrShp.WheelchairAccessibleTrips[route]
-			wheelchairStopsTot += aggrShp.WheelchairAccessibleStops[route]
-			numStopsTot += aggrShp.NumStops[route]
+		for _, field := range routeAddFlds {
+			vals = append(vals, sw.routeAddFld(f, field, route))
 		}
 
-		vals = append(vals, strconv.FormatInt(int64(uniqueAggregatedFreq), 10))
-		vals = append(vals, strconv.FormatFloat(((totMeterLength)/float64(totFreq)) / float64(1000), 'f', 10, 64))
-		vals = append(vals, strconv.FormatFloat(totMeterLength / 1000.0, 'f', 10, 64))
-		vals = append(vals, strconv.FormatFloat(maxMeterLength / 1000.0, 'f', 10, 64))
-		vals = append(vals, route.Agency.Name)
-		if route.Agency.Url != nil {
-			vals = append(vals, route.Agency.Url.String())
-		} else {
-			vals = append(vals, "")
+		if sw.opts.OverviewTotals {
+			vals = append(vals, statVals[11:]...)
+
+			if _, ok := typeTotals[route.Type]; !ok {
+				typeTotals[route.Type] = &RouteStats{}
+			}
+			typeTotals[route.Type].Add(stats)
+			total.Add(stats)
 		}
 
-		vals = append(vals, strconv.FormatFloat(float64(wheelchairTripsTot)/float64(totFreq), 'f', 10, 64))
-		vals = append(vals, strconv.FormatFloat(float64(wheelchairStopsTot)/float64(numStopsTot), 'f', 10, 64))
+		vals = append(vals, sw.boundaryVals(stats)...)
 
-		for _, field := range routeAddFlds {
-			vald := ""
-			if vals, ok := f.RoutesAddFlds[field]; ok {
-				if val, ok := vals[route.Id]; ok {
-					vald = val
-				}
-			}
+		vals = append(vals, sw.getCustomAttrVals(nil, route, nil)...)
 
-			vals = append(vals, vald)
+		csvwriter.Write(filter(vals))
+	}
+
+	if sw.opts.OverviewTotals {
+		types := make([]int, 0, len(typeTotals))
+		for t := range typeTotals {
+			types = append(types, int(t))
 		}
+		sort.Ints(types)
 
-		csvwriter.Write(vals)
+		for _, t := range types {
+			typeName := strconv.FormatInt(int64(t), 10)
+			if str, ok := typeMap[int16(t)]; ok {
+				typeName = str
+			}
+			csvwriter.Write(filter(sw.routeTotalsRow(*typeTotals[int16(t)], days, "Total "+typeName, typeName, len(routeAddFlds))))
+		}
+
+		csvwriter.Write(filter(sw.routeTotalsRow(total, days, "Total", "*", len(routeAddFlds))))
 	}
 
 	csvwriter.Flush()
-	csvFile.Close()
+
+	if err := csvwriter.Error(); err != nil {
+		panic(fmt.Sprintf("Could not write CSV file (%s)", err))
+	}
 }
 
+// WriteRouteShapes writes the shapes contained in Feed f to outFile, with a distinct
+// geometry for each route using a shape
 func (sw *ShapeWriter) WriteRouteShapes(f *gtfsparser.Feed, typeMap map[int16]string, routeAddFlds []string, outFile string) int {
-	shape, err := shp.Create(sw.getShapeFileName(outFile), shp.POLYLINE)
+	defer sw.useLayer("routes")()
 
-	if err != nil {
-		panic(fmt.Sprintf("Could not open shapefile for writing (%s)", err))
+	// output layers, keyed by mode class if water, aerial and
+	// funicular routes are written into separate files
+	layers := make(map[string]*layer)
+	fileNames := make(map[string]string)
+	rows := make(map[string]int)
+
+	var fields []shp.Field
+
+	getLayer := func(name string) *layer {
+		if layer, ok := layers[name]; ok {
+			return layer
+		}
+
+		fileName := sw.getShapeFileName(outFile)
+		if len(name) > 0 {
+			fileName = sw.getOutFileName(outFile, "."+name+".shp")
+		}
+
+		layer := sw.createLayer(fileName, sw.lineType(), "routes")
+		layer.SetFields(fields)
+		layers[name] = layer
+		fileNames[name] = fileName
+		return layer
 	}
-	defer shape.Close()
+
+	defer func() {
+		r := recover()
+
+		for name, layer := range layers {
+			sw.finishLayer(layer, fileNames[name], r != nil)
+		}
+
+		if r != nil {
+			panic(r)
+		}
+	}()
+
+	sw.routeShapeStream(f, typeMap, routeAddFlds, func(flds []shp.Field) {
+		fields = flds
+		getLayer("")
+	}, func(feature routeShapeFeature) {
+		shape := getLayer(feature.layerName)
+		n := rows[feature.layerName]
+
+		shape.Write(feature.line)
+
+		for fld, val := range feature.attrs {
+			shape.WriteAttribute(n, fld, val)
+		}
+
+		rows[feature.layerName] = n + 1
+	})
 
 	n := 0
+	for _, rowCount := range rows {
+		n += rowCount
+	}
 
-	// get aggreshape map
-	// aggrShapes, routeStats := sw.getAggrShapes(f.Trips)
-	aggrShapes, _ := sw.getAggrShapes(f.Trips, f)
-	shape.SetFields(sw.getFieldSizesForRouteShapes(aggrShapes, typeMap, routeAddFlds, f))
+	return n
+}
 
-	for _, aggrShape := range aggrShapes {
-		points := sw.gtfsShapePointsToShpLinePoints(aggrShape.Shape.Points, aggrShape.From, aggrShape.To)
-		parts := [][]shp.Point{points}
+// compute the route shape features of Feed f, hand the fields of the
+// route shapes layer to setFields and then each feature, including its
+// custom attributes, to emit. The features are computed in parallel and
+// emitted in the order of the aggregated shape IDs, in the calling
+// goroutine. This is the common base of WriteRouteShapes and
+// StreamRouteShapes
+func (sw *ShapeWriter) routeShapeStream(f *gtfsparser.Feed, typeMap map[int16]string, routeAddFlds []string, setFields func([]shp.Field), emit func(routeShapeFeature)) {
+	aggrShapes, routeShapes := sw.aggregateTrips(f.Trips, f, sw.opts.SplitDirection)
+	fields := sw.getFieldSizesForRouteShapes(aggrShapes, typeMap, routeAddFlds, f)
+	fields = append(fields, sw.getExtentFields()...)
+	fields = append(fields, sw.getCustomAttrFields(func(visit func(*gtfs.Trip, *gtfs.Route, *AggrShape)) {
+		for _, aggrShape := range aggrShapes {
+			for _, r := range aggrShape.Routes {
+				visit(nil, r, aggrShape)
+			}
+		}
+	})...)
 
-		for _, r := range aggrShape.Routes {
-			shape.Write(shp.NewPolyLine(parts))
+	peaks := sw.getPeakVehicles(f.Trips)
 
-			shape.WriteAttribute(n, 0, r.Id)
-			shape.WriteAttribute(n, 1, r.Short_name)
-			shape.WriteAttribute(n, 2, r.Long_name)
-			if str, ok := typeMap[r.Type]; ok {
-				shape.WriteAttribute(n, 3, str)
-			} else {
-				shape.WriteAttribute(n, 3, strconv.FormatInt(int64(r.Type), 10))
+	routeStats := make(map[*gtfs.Route]RouteStats, len(routeShapes))
+	for route, shapes := range routeShapes {
+		stats := sw.getRouteStats(route, shapes, aggrShapes)
+		stats.PeakVehicles = peaks[route]
+		routeStats[route] = stats
+	}
+
+	setFields(fields)
+
+	ids := make([]string, 0, len(aggrShapes))
+	for id := range aggrShapes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	emitFeature := func(feature routeShapeFeature) {
+		sw.writeCustomAttrs(feature.attrs, 0, feature.customFld, nil, feature.route, feature.aggrShape)
+		emit(feature)
+	}
+
+	// with a single feature per route, the variants are collected and
+	// merged once all of them are computed, separately per output layer
+	type variantKey struct {
+		route *gtfs.Route
+		layer string
+	}
+	variantIDs := make(map[variantKey][]string)
+	variants := make(map[variantKey][]routeShapeFeature)
+
+	// Custom attributes are computed when emitting, as AttrComputers
+	// need not be safe for concurrent use
+	parallelOrdered(len(ids), func(i int) interface{} {
+		return sw.getRouteShapeFeatures(f, aggrShapes[ids[i]], typeMap, routeAddFlds, routeStats)
+	}, func(i int, item interface{}) {
+		for _, feature := range item.([]routeShapeFeature) {
+			if sw.opts.RouteGeometry == RouteGeomVariants {
+				emitFeature(feature)
+				continue
 			}
+			key := variantKey{feature.route, feature.layerName}
+			variantIDs[key] = append(variantIDs[key], ids[i])
+			variants[key] = append(variants[key], feature)
+		}
+	})
 
-			// number of trips
-			shape.WriteAttribute(n, 4, aggrShape.RouteTripCount[r])
+	keys := make([]variantKey, 0, len(variants))
+	for key := range variants {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route.Id != keys[j].route.Id {
+			return keys[i].route.Id < keys[j].route.Id
+		}
+		return keys[i].layer < keys[j].layer
+	})
 
-			// length in km
-			shape.WriteAttribute(n, 5, aggrShape.MeterLength / 1000.0)
+	for _, key := range keys {
+		emitFeature(sw.mergeRouteShapeFeatures(variantIDs[key], variants[key], aggrShapes))
+	}
+}
 
-			// route tot travelled in km
-			shape.WriteAttribute(n, 6, (float64(aggrShape.RouteTripCount[r])*aggrShape.MeterLength) / 1000.0)
+// a route shape feature, computed before it is written
+type routeShapeFeature struct {
+	layerName string
+	route     *gtfs.Route
+	aggrShape *AggrShape
+	line      shp.Shape
+	attrs     attrRow
+	customFld int // field index of the first custom attribute
+}
 
-			// agency name
-			shape.WriteAttribute(n, 7, r.Agency.Name)
+// return the route shape features of an aggregated shape, one per
+// route, ordered by route ID
+func (sw *ShapeWriter) getRouteShapeFeatures(f *gtfsparser.Feed, aggrShape *AggrShape, typeMap map[int16]string, routeAddFlds []string, routeStats map[*gtfs.Route]RouteStats) []routeShapeFeature {
+	points, zs := sw.shapeLine(aggrShape.Shape, aggrShape.From, aggrShape.To, aggrShapeStops(aggrShape))
+	line := sw.newLine(points, zs)
+	maxGap, maxStopDist := shapeQuality(aggrShape)
 
-			// agency url
-			shape.WriteAttribute(n, 8, r.Agency.Url.String())
+	// the line in reverse order, only built if needed
+	var reversed shp.Shape
 
-			// wheelchair trips
-			shape.WriteAttribute(n, 9, float64(aggrShape.WheelchairAccessibleTrips[r])/float64(aggrShape.RouteTripCount[r]))
+	routeIDs := make([]string, 0, len(aggrShape.Routes))
+	for id := range aggrShape.Routes {
+		routeIDs = append(routeIDs, id)
+	}
+	sort.Strings(routeIDs)
 
-			// wheelchair stops
-			shape.WriteAttribute(n, 10, float64(aggrShape.WheelchairAccessibleStops[r])/float64(aggrShape.NumStops[r]))
+	ret := make([]routeShapeFeature, 0, len(routeIDs))
 
-			i := 11
+	for _, routeID := range routeIDs {
+		r := aggrShape.Routes[routeID]
 
-			for _, field := range routeAddFlds {
-				if flds, ok := f.RoutesAddFlds[field]; ok {
-					if val, ok := flds[r.Id]; ok {
-						shape.WriteAttribute(n, i, val)
-					} else {
-						shape.WriteAttribute(n, i, "")
-					}
-				} else {
-					shape.WriteAttribute(n, i, "")
-				}
-				i += 1
+		layerNames := make([]string, 0, 2)
+		if sw.opts.SplitModeClasses && ModeClass(r.Type) != "land" {
+			layerNames = append(layerNames, ModeClass(r.Type))
+		}
+		if aggrShape.Direction >= 0 {
+			layerNames = append(layerNames, "dir"+strconv.Itoa(int(aggrShape.Direction)))
+		}
+		layerName := strings.Join(layerNames, ".")
+
+		attrs := make(attrRow)
+
+		attrs.WriteAttribute(0, 0, sw.ids.get("route", r.Id))
+		attrs.WriteAttribute(0, 1, r.Short_name)
+		attrs.WriteAttribute(0, 2, r.Long_name)
+		if str, ok := typeMap[r.Type]; ok {
+			attrs.WriteAttribute(0, 3, str)
+		} else {
+			attrs.WriteAttribute(0, 3, strconv.FormatInt(int64(r.Type), 10))
+		}
+
+		// number of trips
+		attrs.WriteAttribute(0, 4, aggrShape.RouteTripCount[r])
+
+		// length in km
+		sw.writeFloatAttr(attrs, 0, 5, aggrShape.MeterLength/1000.0)
+
+		// route tot travelled in km
+		sw.writeFloatAttr(attrs, 0, 6, (float64(aggrShape.RouteTripCount[r])*aggrShape.MeterLength)/1000.0)
+
+		_, agencyName, agencyURL := sw.agencyVals(r.Agency)
+
+		// agency name
+		attrs.WriteAttribute(0, 7, agencyName)
+
+		// agency url
+		attrs.WriteAttribute(0, 8, agencyURL)
+
+		// wheelchair trips
+		sw.writeFloatAttr(attrs, 0, 9, float64(aggrShape.WheelchairAccessibleTrips[r])/float64(aggrShape.RouteTripCount[r]))
+
+		// wheelchair stops
+		sw.writeFloatAttr(attrs, 0, 10, float64(aggrShape.WheelchairAccessibleStops[r])/float64(aggrShape.NumStops[r]))
+
+		// mode class
+		attrs.WriteAttribute(0, 11, ModeClass(r.Type))
+
+		// direction imbalance of the whole route
+		attrs.WriteAttribute(0, 12, routeStats[r].Dir0Freq-routeStats[r].Dir1Freq)
+		sw.writeFloatAttr(attrs, 0, 13, routeStats[r].dirImbalance())
+
+		// average headways of exact_times=1 and exact_times=0 frequency blocks
+		sw.writeFloatAttr(attrs, 0, 14, aggrShape.HeadwayExactSum[r]/aggrShape.HeadwayExactDur[r])
+		sw.writeFloatAttr(attrs, 0, 15, aggrShape.HeadwayFreqSum[r]/aggrShape.HeadwayFreqDur[r])
+
+		// average stop spacing in meters
+		sw.writeFloatAttr(attrs, 0, 16, stopSpacing(aggrShape.MeterLength*float64(aggrShape.RouteTripCount[r]), aggrShape.NumStops[r], aggrShape.RouteTripCount[r]))
+
+		// estimated peak vehicles of the whole route
+		attrs.WriteAttribute(0, 17, routeStats[r].PeakVehicles)
+		attrs.WriteAttribute(0, 18, sw.variantName(aggrShape, r))
+
+		// bikes allowed trips
+		sw.writeFloatAttr(attrs, 0, 19, float64(aggrShape.BikesAllowedTrips[r])/float64(aggrShape.RouteTripCount[r]))
+
+		// geometry quality of the variant
+		sw.writeFloatAttr(attrs, 0, 20, maxGap)
+		sw.writeFloatAttr(attrs, 0, 21, maxStopDist)
+
+		// loop attributes, the loop length is the variant length
+		if aggrShape.Loop {
+			attrs.WriteAttribute(0, 22, 1)
+			attrs.WriteAttribute(0, 23, loopDirection(aggrShape.Shape.Points))
+			if stop := sw.loopStart(aggrShape, r); stop != nil {
+				attrs.WriteAttribute(0, 24, sw.ids.get("stop", stop.Id))
 			}
+			sw.writeFloatAttr(attrs, 0, 25, aggrShape.MeterLength/1000.0)
+		} else {
+			attrs.WriteAttribute(0, 22, 0)
+			sw.writeFloatAttr(attrs, 0, 25, math.NaN())
+		}
 
-			n = n + 1
+		// direction label of the variant
+		attrs.WriteAttribute(0, 26, sw.commonHeadsign(aggrShape, r))
+
+		// stable ID of the route and variant
+		attrs.WriteAttribute(0, 27, featureID(r.Id, shapeVariantKey(aggrShape)))
+
+		i := 28
+
+		for _, field := range routeAddFlds {
+			attrs.WriteAttribute(0, i, sw.routeAddFld(f, field, r))
+			i += 1
+		}
+
+		if sw.opts.TripDelays != nil {
+			sw.writeNullFloatAttr(attrs, 0, i, aggrShape.DelaySum[r]/float64(aggrShape.DelayObs[r]))
+			sw.writeNullFloatAttr(attrs, 0, i+1, float64(aggrShape.PunctualObs[r])/float64(aggrShape.DelayObs[r]))
+			i += 2
+		}
+
+		if sw.opts.HeadwayWindow != nil {
+			hwMin, hwMax, hwMed := sw.headwayStats(aggrShape, r)
+			sw.writeFloatAttr(attrs, 0, i, hwMin)
+			sw.writeFloatAttr(attrs, 0, i+1, hwMax)
+			sw.writeFloatAttr(attrs, 0, i+2, hwMed)
+			i += 3
 		}
+
+		i = sw.writeExtentAttrs(attrs, 0, i, points)
+
+		featureLine := line
+		if sw.opts.NormalizeDirection && aggrShape.Dir1TripCount[r] > aggrShape.Dir0TripCount[r] {
+			if reversed == nil {
+				reversed = sw.newLine(reversePoints(points), reverseFloats(zs))
+			}
+			featureLine = reversed
+		}
+
+		ret = append(ret, routeShapeFeature{layerName, r, aggrShape, featureLine, attrs, i})
 	}
 
-	return n
+	return ret
 }
 
 // WriteShapes writes the shapes contained in Feed f to outFile, with each shape containing
 // aggregrated trip/route information
 func (sw *ShapeWriter) WriteShapes(f *gtfsparser.Feed, outFile string) int {
-	shape, err := shp.Create(sw.getShapeFileName(outFile), shp.POLYLINE)
+	defer sw.useLayer("shapes")()
+
+	// get aggreshape map
+	aggrShapes, _ := sw.getAggrShapes(f.Trips, f)
+
+	fileName := sw.getShapeFileName(outFile)
+	shape := sw.createLayer(fileName, sw.lineType(), "shapes")
+	defer sw.closeLayer(shape, fileName)
+
+	n := 0
+
+	fields := append(sw.getFieldSizesForShapes(aggrShapes), sw.getExtentFields()...)
+	shape.SetFields(append(fields, sw.getCustomAttrFields(func(visit func(*gtfs.Trip, *gtfs.Route, *AggrShape)) {
+		for _, aggrShape := range aggrShapes {
+			visit(nil, nil, aggrShape)
+		}
+	})...))
+
+	days := sw.servicePeriodDays(aggrShapes)
+
+	for _, aggrShape := range aggrShapes {
+		points, zs := sw.shapeLine(aggrShape.Shape, aggrShape.From, aggrShape.To, aggrShapeStops(aggrShape))
+
+		shape.Write(sw.newLine(points, zs))
+
+		i := sw.writeAggrShapeAttrs(shape, n, aggrShape, days)
+		sw.writeCustomAttrs(shape, n, sw.writeExtentAttrs(shape, n, i, points), nil, nil, aggrShape)
+
+		n = n + 1
+	}
+
+	return n
+}
+
+// write the attributes of an aggregated shape, as given by
+// getFieldSizesForShapes, and return the next free field. days is the
+// length of the service period for the daily vehicle km
+func (sw *ShapeWriter) writeAggrShapeAttrs(shape *layer, n int, aggrShape *AggrShape, days float64) int {
+	shape.WriteAttribute(n, 0, sw.ids.get("shape", aggrShape.Shape.Id))
+	shape.WriteAttribute(n, 1, sw.getTripIdsString(aggrShape))
+	shape.WriteAttribute(n, 2, sw.getRouteIdsString(aggrShape))
+	shape.WriteAttribute(n, 3, aggrShape.GetShortNamesString())
+	shape.WriteAttribute(n, 4, sw.variantName(aggrShape, nil))
+
+	maxGap, maxStopDist := shapeQuality(aggrShape)
+	sw.writeFloatAttr(shape, n, 5, maxGap)
+	sw.writeFloatAttr(shape, n, 6, maxStopDist)
+
+	// number of trips over the service period, over all routes
+	trips := 0
+	for _, count := range aggrShape.RouteTripCount {
+		trips += count
+	}
+
+	shape.WriteAttribute(n, 7, trips)
+	shape.WriteAttribute(n, 8, len(aggrShape.Routes))
+	sw.writeFloatAttr(shape, n, 9, aggrShape.MeterLength/1000.0)
+	sw.writeFloatAttr(shape, n, 10, float64(trips)*aggrShape.MeterLength/1000.0)
+	sw.writeFloatAttr(shape, n, 11, float64(trips)*aggrShape.MeterLength/1000.0/days)
+	shape.WriteAttribute(n, 12, sw.commonHeadsign(aggrShape, nil))
+	shape.WriteAttribute(n, 13, featureID(shapeVariantKey(aggrShape)))
+
+	return 14
+}
+
+// WriteStops writes the stations contained in Feed f to outFile
+func (sw *ShapeWriter) WriteStops(f *gtfsparser.Feed, outFile string) int {
+	defer sw.useLayer("stations")()
+
+	sw.initNearIdx(f)
+	sw.initStopModes(f)
+
+	if !sw.opts.SplitStationsByMode {
+		return sw.writeStopsLayer(f, sw.getShapeFileNameStations(outFile), -1)
+	}
+
+	n := 0
+	for _, t := range sw.servedModes() {
+		n += sw.writeStopsLayer(f, sw.getOutFileName(outFile, ".stations."+strconv.Itoa(int(t))+".shp"), t)
+	}
+
+	return n
+}
+
+// write the stops contained in Feed f into the layer fileName. If mode is
+// not negative, only stops served by this route type are written
+func (sw *ShapeWriter) writeStopsLayer(f *gtfsparser.Feed, fileName string, mode int16) int {
+	shape := sw.createLayer(fileName, shp.POINT, "stations")
+	defer sw.closeLayer(shape, fileName)
+
+	n := 0
+
+	groups := stationGroups(f)
+
+	fields := sw.getFieldSizesForStops(f.Stops, groups)
+	addFld := len(fields)
+	if len(sw.opts.StopAddFlds) > 0 || len(sw.opts.StopNameLangs) > 0 {
+		stopIDs := make([]string, 0, len(f.Stops))
+		stops := make([]*gtfs.Stop, 0, len(f.Stops))
+		for id, stop := range f.Stops {
+			if sw.keepStop(stop) {
+				stopIDs = append(stopIDs, id)
+				stops = append(stops, stop)
+			}
+		}
+		fields = append(fields, sw.addFldFields(f.StopsAddFlds, sw.opts.StopAddFlds, stopIDs)...)
+		fields = append(fields, sw.stopNameFields(stops)...)
+	}
+
+	shape.SetFields(fields)
+
+	transfers, pathways := stopTransferCounts(f)
+	access := sw.getStopAccess(f)
+
+	for _, stop := range f.Stops {
+		if !sw.keepStop(stop) || (mode >= 0 && !sw.stopModes[stop][mode]) {
+			continue
+		}
+
+		point := sw.gtfsStopToShpPoint(stop)
+
+		shape.Write(point)
+
+		shape.WriteAttribute(n, 0, sw.ids.get("stop", stop.Id))
+		shape.WriteAttribute(n, 1, stop.Code)
+		shape.WriteAttribute(n, 2, stop.Name)
+		shape.WriteAttribute(n, 3, stop.Desc)
+		shape.WriteAttribute(n, 4, stop.Zone_id)
+		shape.WriteAttribute(n, 5, stop.Url)
+		shape.WriteAttribute(n, 6, stop.Location_type)
+		if stop.Parent_station != nil {
+			shape.WriteAttribute(n, 7, sw.ids.get("stop", stop.Parent_station.Id))
+		}
+		shape.WriteAttribute(n, 8, stop.Timezone)
+		shape.WriteAttribute(n, 9, stop.Wheelchair_boarding)
+		shape.WriteAttribute(n, 10, locTypeNames[stop.Location_type])
+
+		// transfers.txt and pathways.txt records of the stop
+		shape.WriteAttribute(n, 11, boolToInt(transfers[stop] > 0))
+		shape.WriteAttribute(n, 12, transfers[stop])
+		shape.WriteAttribute(n, 13, boolToInt(pathways[stop] > 0))
+		shape.WriteAttribute(n, 14, pathways[stop])
+		shape.WriteAttribute(n, 15, sw.ids.get("stop", groups[stop].Id))
+
+		wheelchair, bikes := access[stop].shares()
+		shape.WriteAttribute(n, 16, access[stop].numTrips())
+		sw.writeFloatAttr(shape, n, 17, wheelchair)
+		sw.writeFloatAttr(shape, n, 18, bikes)
+		shape.WriteAttribute(n, 19, featureID(stop.Id))
+
+		nameFld := sw.writeAddFldAttrs(shape, n, addFld, f.StopsAddFlds, sw.opts.StopAddFlds, stop.Id)
+		for i, lang := range sw.opts.StopNameLangs {
+			shape.WriteAttribute(n, nameFld+i, stopNameIn(stop, lang))
+		}
+
+		n = n + 1
+	}
+
+	return n
+}
+
+// build the route grid for the near route stop filter, if requested
+func (sw *ShapeWriter) initNearIdx(f *gtfsparser.Feed) {
+	if len(sw.opts.NearRoute) > 0 && sw.nearIdx == nil {
+		sw.nearIdx = sw.getRouteIndex(f, sw.opts.NearRoute)
+	}
+}
+
+// WriteStopsCsv writes the stops contained in Feed f into a CSV file, with
+// both their WGS84 and their projected coordinates
+func (sw *ShapeWriter) WriteStopsCsv(f *gtfsparser.Feed, outFile string) int {
+	csvFile, err := sw.createFile(sw.getOutFileName(outFile, ".stations.csv"))
 
 	if err != nil {
-		panic(fmt.Sprintf("Could not open shapefile for writing (%s)", err))
+		panic(fmt.Sprintf("Could not open CSV file for writing (%s)", err))
+	}
+	defer csvFile.Close()
+
+	return sw.writeStopsCsv(f, csvFile, filepath.Base(csvFile.Name()))
+}
+
+// WriteStopsCsvTo writes the stations CSV to w
+func (sw *ShapeWriter) WriteStopsCsvTo(f *gtfsparser.Feed, w io.Writer) int {
+	return sw.writeStopsCsv(f, w, "-")
+}
+
+// write the stations CSV to w, named fileName in the dictionary
+func (sw *ShapeWriter) writeStopsCsv(f *gtfsparser.Feed, w io.Writer, fileName string) int {
+	defer sw.useLayer("stations")()
+
+	csvwriter := csv.NewWriter(w)
+
+	headers := []string{"Id", "Code", "Name", "Desc", "Zone_id", "Url", "Location_type", "Parent_station", "Timezone", "Wheelchair_boarding", "Loc_name", "Lat", "Lon", "X", "Y"}
+	headers = append(headers, sw.opts.StopAddFlds...)
+	for _, lang := range sw.opts.StopNameLangs {
+		headers = append(headers, stopNameFldPrefix+lang)
+	}
+	for i, header := range headers {
+		headers[i] = sw.fldName(header)
 	}
-	defer shape.Close()
+
+	csvwriter.Write(headers)
+	sw.addDictionaryCsv(fileName, "stationscsv", headers)
+
+	sw.initNearIdx(f)
+	sw.initStopModes(f)
 
 	n := 0
 
-	// get aggreshape map
-	aggrShapes, _ := sw.getAggrShapes(f.Trips, f)
-	shape.SetFields(sw.getFieldSizesForShapes(aggrShapes))
+	for _, stop := range f.Stops {
+		if !sw.keepStop(stop) {
+			continue
+		}
 
-	for _, aggrShape := range aggrShapes {
-		points := sw.gtfsShapePointsToShpLinePoints(aggrShape.Shape.Points, aggrShape.From, aggrShape.To)
-		parts := [][]shp.Point{points}
+		url := ""
+		if stop.Url != nil {
+			url = stop.Url.String()
+		}
+
+		parent := ""
+		if stop.Parent_station != nil {
+			parent = sw.ids.get("stop", stop.Parent_station.Id)
+		}
+
+		x, y := sw.project(float64(stop.Lat), float64(stop.Lon))
+
+		row := []string{
+			sw.ids.get("stop", stop.Id),
+			stop.Code,
+			stop.Name,
+			stop.Desc,
+			stop.Zone_id,
+			url,
+			strconv.Itoa(int(stop.Location_type)),
+			parent,
+			stop.Timezone.GetTzString(),
+			strconv.Itoa(int(stop.Wheelchair_boarding)),
+			locTypeNames[stop.Location_type],
+			strconv.FormatFloat(float64(stop.Lat), 'f', -1, 32),
+			strconv.FormatFloat(float64(stop.Lon), 'f', -1, 32),
+			strconv.FormatFloat(x, 'f', -1, 64),
+			strconv.FormatFloat(y, 'f', -1, 64),
+		}
+
+		for _, fld := range sw.opts.StopAddFlds {
+			row = append(row, addFldVal(f.StopsAddFlds, fld, stop.Id))
+		}
+		for _, lang := range sw.opts.StopNameLangs {
+			row = append(row, stopNameIn(stop, lang))
+		}
+
+		csvwriter.Write(row)
+
+		n = n + 1
+	}
+
+	csvwriter.Flush()
+
+	if err := csvwriter.Error(); err != nil {
+		panic(fmt.Sprintf("Could not write CSV file (%s)", err))
+	}
+
+	return n
+}
+
+// check whether a stop should be written
+func (sw *ShapeWriter) keepStop(stop *gtfs.Stop) bool {
+	if len(sw.opts.StopLocTypes) > 0 && !sw.opts.StopLocTypes[stop.Location_type] {
+		return false
+	}
+
+	// only keep stops served by the considered MOTs, their stations and
+	// station entrances
+	if len(sw.motMap) > 0 && len(sw.stopModes[stop]) == 0 {
+		return false
+	}
+
+	if sw.nearIdx != nil && !sw.nearIdx.Any(float64(stop.Lat), float64(stop.Lon), sw.opts.NearRouteDist) {
+		return false
+	}
+
+	if sw.opts.Around != nil && !sw.opts.Around.Contains(float64(stop.Lat), float64(stop.Lon)) {
+		return false
+	}
+
+	return true
+}
+
+// return a segment index over the geometries of all trips of a route, using
+// the station positions for trips without a shape
+func (sw *ShapeWriter) getRouteIndex(f *gtfsparser.Feed, routeID string) *SegmentIndex {
+	route, ok := f.Routes[routeID]
+	if !ok {
+		panic(fmt.Sprintf("Route %s not found", routeID))
+	}
+
+	segs := make([]Segment, 0)
+	added := make(map[*gtfs.Shape]bool)
+
+	for _, trip := range f.Trips {
+		if trip.Route != route {
+			continue
+		}
+
+		if trip.Shape != nil {
+			if added[trip.Shape] {
+				continue
+			}
+			added[trip.Shape] = true
+
+			for i := 1; i < len(trip.Shape.Points); i++ {
+				a := trip.Shape.Points[i-1]
+				b := trip.Shape.Points[i]
+				segs = append(segs, Segment{float64(a.Lat), float64(a.Lon), float64(b.Lat), float64(b.Lon), trip.Shape.Id, i - 1})
+			}
+		} else {
+			for i := 1; i < len(trip.StopTimes); i++ {
+				a := trip.StopTimes[i-1].Stop()
+				b := trip.StopTimes[i].Stop()
+				segs = append(segs, Segment{float64(a.Lat), float64(a.Lon), float64(b.Lat), float64(b.Lon), trip.Id, i - 1})
+			}
+		}
+	}
 
-		shape.Write(shp.NewPolyLine(parts))
+	return NewSegmentIndex(segs)
+}
 
-		shape.WriteAttribute(n, 0, aggrShape.Shape.Id)
-		shape.WriteAttribute(n, 1, aggrShape.GetTripIdsString())
-		shape.WriteAttribute(n, 2, aggrShape.GetRouteIdsString())
-		shape.WriteAttribute(n, 3, aggrShape.GetShortNamesString())
+// WriteShapePoints writes every vertex of the shapes contained in Feed f as a
+// measured point to outFile, with the shape_dist_traveled as measure
+func (sw *ShapeWriter) WriteShapePoints(f *gtfsparser.Feed, outFile string) int {
+	defer sw.useLayer("shapepoints")()
 
-		n = n + 1
+	fileName := sw.getShapeFileNameShapePoints(outFile)
+	var shapeType shp.ShapeType = shp.POINTM
+	if sw.hasZ() {
+		shapeType = shp.POINTZ
 	}
 
-	return n
-}
+	shape := sw.createLayer(fileName, shapeType, "shapepoints")
+	defer sw.closeLayer(shape, fileName)
 
-// WriteStops writes the stations contained in Feed f to outFile
-func (sw *ShapeWriter) WriteStops(f *gtfsparser.Feed, outFile string) int {
-	shape, err := shp.Create(sw.getShapeFileNameStations(outFile), shp.POINT)
+	// only keep shapes used by trips of the requested MOTs
+	shapes := make(map[string]*gtfs.Shape)
+	for _, trip := range f.Trips {
+		if trip.Shape != nil && (len(sw.motMap) == 0 || sw.motMap[trip.Route.Type]) {
+			shapes[trip.Shape.Id] = trip.Shape
+		}
+	}
 
-	if err != nil {
-		panic(fmt.Sprintf("Could not open shapefile for writing (%s)", err))
+	idSize := uint8(0)
+	for id := range shapes {
+		fitSize(&idSize, len(sw.ids.get("shape", id)))
 	}
-	defer shape.Close()
+
+	shape.SetFields([]shp.Field{
+		shp.StringField(sw.fldName("Shape_id"), idSize),
+		shp.NumberField(sw.fldName("Seq"), 10),
+		shp.FloatField(sw.fldName("Dist"), 32, 5),
+	})
 
 	n := 0
 
-	// get aggreshape map
-	shape.SetFields(sw.getFieldSizesForStops(f.Stops))
+	for _, s := range shapes {
+		for _, p := range s.Points {
+			x, y := sw.project(float64(p.Lat), float64(p.Lon))
+			m := float64(p.Dist_traveled)
 
-	for _, stop := range f.Stops {
-		point := sw.gtfsStopToShpPoint(stop)
+			if math.IsNaN(m) {
+				// "no data" measure as defined by the shapefile spec
+				m = -1e39
+			}
 
-		shape.Write(point)
+			if sw.hasZ() {
+				// missing elevations are written as 0
+				z := sw.opts.Elevations[s.Id][p.Sequence]
+				shape.Write(&shp.PointZ{X: x, Y: y, Z: z, M: m})
+			} else {
+				shape.Write(&shp.PointM{X: x, Y: y, M: m})
+			}
 
-		shape.WriteAttribute(n, 0, stop.Id)
-		shape.WriteAttribute(n, 1, stop.Code)
-		shape.WriteAttribute(n, 2, stop.Name)
-		shape.WriteAttribute(n, 3, stop.Desc)
-		shape.WriteAttribute(n, 4, stop.Zone_id)
-		shape.WriteAttribute(n, 5, stop.Url)
-		shape.WriteAttribute(n, 6, stop.Location_type)
-		shape.WriteAttribute(n, 7, stop.Parent_station)
-		shape.WriteAttribute(n, 8, stop.Timezone)
-		shape.WriteAttribute(n, 9, stop.Wheelchair_boarding)
+			shape.WriteAttribute(n, 0, sw.ids.get("shape", s.Id))
+			shape.WriteAttribute(n, 1, int(p.Sequence))
+			sw.writeNullFloatAttr(shape, n, 2, float64(p.Dist_traveled))
 
-		n = n + 1
+			n = n + 1
+		}
 	}
 
 	return n
@@ -377,11 +1485,27 @@ func (sw *ShapeWriter) WriteStops(f *gtfsparser.Feed, outFile string) int {
 
 // return aggregrated shapes from GTFS trips
 func (sw *ShapeWriter) getAggrShapes(trips map[string]*gtfs.Trip, feed *gtfsparser.Feed) (map[string]*AggrShape, map[*gtfs.Route]map[string]bool) {
+	return sw.aggregateTrips(trips, feed, false)
+}
+
+// return aggregated shapes from GTFS trips. If byDirection is set, trips
+// of direction 0 and 1 are aggregated separately
+func (sw *ShapeWriter) aggregateTrips(trips map[string]*gtfs.Trip, feed *gtfsparser.Feed, byDirection bool) (map[string]*AggrShape, map[*gtfs.Route]map[string]bool) {
+	sw.initRouteGroups(feed)
+
 	ret := make(map[string]*AggrShape)
 	routeShapes := make(map[*gtfs.Route]map[string]bool)
 
 	// iterate through all trips
+	checked := 0
 	for _, trip := range trips {
+		if sw.opts.MaxMem > 0 && checked%memCheckInterval == 0 {
+			sw.checkMem("aggregating trips")
+		}
+		checked++
+
+		route := sw.groupRoute(trip.Route)
+
 		if trip.Shape == nil || (len(sw.motMap) > 0 && !sw.motMap[trip.Route.Type]) || len(trip.StopTimes) < 2 {
 			continue
 		}
@@ -394,76 +1518,120 @@ func (sw *ShapeWriter) getAggrShapes(trips map[string]*gtfs.Trip, feed *gtfspars
 			}
 		}
 
-		aggrShapeId := trip.Shape.Id
+		from, to := tripShapeRange(trip)
 
-		if trip.StopTimes[0].HasDistanceTraveled() && trip.StopTimes[len(trip.StopTimes)-1].HasDistanceTraveled() {
-			from := strconv.FormatFloat(float64(trip.StopTimes[0].Shape_dist_traveled()), 'f', 1, 64)
-			to := strconv.FormatFloat(float64(trip.StopTimes[len(trip.StopTimes)-1].Shape_dist_traveled()), 'f', 1, 64)
-			aggrShapeId += "%%%%%" + from + ":" + to
+		direction := int8(-1)
+		if byDirection && trip.Direction_id >= 0 {
+			direction = trip.Direction_id
 		}
 
-		if _, ok := routeShapes[trip.Route]; !ok {
-			routeShapes[trip.Route] = make(map[string]bool)
+		aggrShapeId := aggrShapeKey(trip.Shape.Id, from, to, direction)
+
+		if _, ok := routeShapes[route]; !ok {
+			routeShapes[route] = make(map[string]bool)
 		}
 
-		routeShapes[trip.Route][aggrShapeId] = true
+		routeShapes[route][aggrShapeId] = true
 
 		// check if shape is already present
 		if _, ok := ret[aggrShapeId]; !ok {
 			ret[aggrShapeId] = NewAggrShape()
 			ret[aggrShapeId].Shape = trip.Shape
-			ret[aggrShapeId].From = float64(trip.StopTimes[0].Shape_dist_traveled())
-			ret[aggrShapeId].To = float64(trip.StopTimes[len(trip.StopTimes)-1].Shape_dist_traveled())
+			ret[aggrShapeId].From = from
+			ret[aggrShapeId].To = to
+			ret[aggrShapeId].Loop = isLoopTrip(trip)
+			ret[aggrShapeId].Direction = direction
 
 			ret[aggrShapeId].CalcMeterLength()
 		}
 
 		ret[aggrShapeId].Trips[trip.Id] = trip
-		ret[aggrShapeId].Routes[trip.Route.Id] = trip.Route
+		ret[aggrShapeId].Routes[route.Id] = route
 
-		if _, ok := ret[aggrShapeId].WheelchairAccessibleTrips[trip.Route]; !ok {
-			ret[aggrShapeId].WheelchairAccessibleTrips[trip.Route] = 0
+		for _, delay := range sw.opts.TripDelays[trip.Id] {
+			ret[aggrShapeId].DelayObs[route] += 1
+			ret[aggrShapeId].DelaySum[route] += delay
+			if delay >= -maxPunctualEarliness && delay <= sw.opts.PunctualityThreshold {
+				ret[aggrShapeId].PunctualObs[route] += 1
+			}
+		}
+
+		if _, ok := ret[aggrShapeId].WheelchairAccessibleTrips[route]; !ok {
+			ret[aggrShapeId].WheelchairAccessibleTrips[route] = 0
 		}
 
-		if _, ok := ret[aggrShapeId].WheelchairAccessibleStops[trip.Route]; !ok {
-			ret[aggrShapeId].WheelchairAccessibleStops[trip.Route] = 0
+		if _, ok := ret[aggrShapeId].WheelchairAccessibleStops[route]; !ok {
+			ret[aggrShapeId].WheelchairAccessibleStops[route] = 0
 		}
 
-		if _, ok := ret[aggrShapeId].NumStops[trip.Route]; !ok {
-			ret[aggrShapeId].NumStops[trip.Route] = 0
+		if _, ok := ret[aggrShapeId].NumStops[route]; !ok {
+			ret[aggrShapeId].NumStops[route] = 0
 		}
 
-		if _, ok := ret[aggrShapeId].RouteTripCount[trip.Route]; !ok {
-			ret[aggrShapeId].RouteTripCount[trip.Route] = 0
+		if _, ok := ret[aggrShapeId].RouteTripCount[route]; !ok {
+			ret[aggrShapeId].RouteTripCount[route] = 0
 		}
 
 		start := trip.Service.GetFirstActiveDate()
 		end := trip.Service.GetLastActiveDate()
 		endT := end.GetTime()
 
+		numTrips := generatedTrips(trip)
+
+		if trip.Frequencies != nil {
+			for _, freq := range *trip.Frequencies {
+				dur := float64(freq.End_time.SecondsSinceMidnight() - freq.Start_time.SecondsSinceMidnight())
+				if dur <= 0 || freq.Headway_secs <= 0 {
+					continue
+				}
+
+				if freq.Exact_times {
+					ret[aggrShapeId].HeadwayExactSum[route] += dur * float64(freq.Headway_secs)
+					ret[aggrShapeId].HeadwayExactDur[route] += dur
+				} else {
+					ret[aggrShapeId].HeadwayFreqSum[route] += dur * float64(freq.Headway_secs)
+					ret[aggrShapeId].HeadwayFreqDur[route] += dur
+				}
+			}
+		}
+
 		for d := start; !d.GetTime().After(endT); d = d.GetOffsettedDate(1) {
 			if trip.Service.IsActiveOn(d) {
-				ret[aggrShapeId].RouteTripCount[trip.Route] += 1
+				ret[aggrShapeId].RouteTripCount[route] += numTrips
+
+				if trip.Direction_id == 0 {
+					ret[aggrShapeId].Dir0TripCount[route] += numTrips
+				} else if trip.Direction_id == 1 {
+					ret[aggrShapeId].Dir1TripCount[route] += numTrips
+				}
 
 				vals, ok := feed.TripsAddFlds["__trip_count_no_count"]
 				if ok {
 					val, ok := vals[trip.Id]
 					if !ok || val != "1" {
-						ret[aggrShapeId].RouteUniqueTripCount[trip.Route] += 1
+						ret[aggrShapeId].RouteUniqueTripCount[route] += numTrips
 					}
 				} else {
-					ret[aggrShapeId].RouteUniqueTripCount[trip.Route] += 1
+					ret[aggrShapeId].RouteUniqueTripCount[route] += numTrips
 				}
 
-				ret[aggrShapeId].NumStops[trip.Route] += numOnOffStops
+				ret[aggrShapeId].NumStops[route] += numOnOffStops * numTrips
 
 				if trip.Wheelchair_accessible == 1 {
-					ret[aggrShapeId].WheelchairAccessibleTrips[trip.Route] += 1
+					ret[aggrShapeId].WheelchairAccessibleTrips[route] += numTrips
+				}
+
+				if trip.Bikes_allowed == 1 {
+					ret[aggrShapeId].BikesAllowedTrips[route] += numTrips
 				}
 
+				// only count served stops, as in NumStops
 				for _, st := range trip.StopTimes {
+					if st.Drop_off_type() == 1 && st.Pickup_type() == 1 {
+						continue
+					}
 					if st.Stop().Wheelchair_boarding == 1 || (st.Stop().Parent_station != nil && st.Stop().Parent_station.Wheelchair_boarding == 1) {
-						ret[aggrShapeId].WheelchairAccessibleStops[trip.Route] += 1
+						ret[aggrShapeId].WheelchairAccessibleStops[route] += numTrips
 					}
 				}
 			}
@@ -475,13 +1643,63 @@ func (sw *ShapeWriter) getAggrShapes(trips map[string]*gtfs.Trip, feed *gtfspars
 
 // returns a shapefile geometry from a GTFS shape, reprojected
 func (sw *ShapeWriter) gtfsShapePointsToShpLinePoints(gtfsshape gtfs.ShapePoints, from float64, to float64) []shp.Point {
+	clipped := clipShape(gtfsshape, from, to)
+	ret := make([]shp.Point, 0, len(clipped))
+
+	for _, p := range clipped {
+		x, y := sw.project(p[0], p[1])
+		ret = append(ret, shp.Point{X: x, Y: y})
+	}
+
+	return ret
+}
+
+// returns the lat, lon coordinates of a GTFS shape clipped to the
+// measures from and to
+func clipShape(gtfsshape gtfs.ShapePoints, from float64, to float64) [][2]float64 {
+	first, last := clipRange(gtfsshape, from, to)
+
+	ret := make([][2]float64, 0)
+
+	if first > 0 {
+		latdiff := float64(gtfsshape[first].Lat) - float64(gtfsshape[first-1].Lat)
+		londiff := float64(gtfsshape[first].Lon) - float64(gtfsshape[first-1].Lon)
+
+		dMeasure := float64(gtfsshape[first].Dist_traveled) - float64(gtfsshape[first-1].Dist_traveled)
+
+		lat := float64(gtfsshape[first-1].Lat) + latdiff/dMeasure*((from)-float64(gtfsshape[first-1].Dist_traveled))
+		lon := float64(gtfsshape[first-1].Lon) + londiff/dMeasure*((from)-float64(gtfsshape[first-1].Dist_traveled))
+
+		ret = append(ret, [2]float64{lat, lon})
+	}
+
+	for i := first; i <= last; i++ {
+		ret = append(ret, [2]float64{float64(gtfsshape[i].Lat), float64(gtfsshape[i].Lon)})
+	}
+
+	if last < len(gtfsshape)-1 {
+		latdiff := float64(gtfsshape[last+1].Lat) - float64(gtfsshape[last].Lat)
+		londiff := float64(gtfsshape[last+1].Lon) - float64(gtfsshape[last].Lon)
+
+		dMeasure := float64(gtfsshape[last+1].Dist_traveled) - float64(gtfsshape[last].Dist_traveled)
+
+		lat := float64(gtfsshape[last].Lat) + latdiff/dMeasure*((to)-float64(gtfsshape[last].Dist_traveled))
+		lon := float64(gtfsshape[last].Lon) + londiff/dMeasure*((to)-float64(gtfsshape[last].Dist_traveled))
+
+		ret = append(ret, [2]float64{lat, lon})
+	}
+
+	return ret
+}
+
+// return the first and last shape point fully within the measures from
+// and to, the line is clipped between them and their neighbours
+func clipRange(gtfsshape gtfs.ShapePoints, from float64, to float64) (int, int) {
 	first := 0
 	last := len(gtfsshape) - 1
 
 	haveFirst := false
 
-	ret := make([]shp.Point, 0)
-
 	if !math.IsNaN(from) && !math.IsNaN(to) {
 		for i := 0; i < len(gtfsshape); i++ {
 			if math.IsNaN(float64(gtfsshape[i].Dist_traveled)) {
@@ -502,131 +1720,128 @@ func (sw *ShapeWriter) gtfsShapePointsToShpLinePoints(gtfsshape gtfs.ShapePoints
 		}
 	}
 
-	if first > 0 {
-		latdiff := float64(gtfsshape[first].Lat) - float64(gtfsshape[first-1].Lat)
-		londiff := float64(gtfsshape[first].Lon) - float64(gtfsshape[first-1].Lon)
-
-		dMeasure := float64(gtfsshape[first].Dist_traveled) - float64(gtfsshape[first-1].Dist_traveled)
+	return first, last
+}
 
-		lat := float64(gtfsshape[first-1].Lat) + latdiff/dMeasure*((from)-float64(gtfsshape[first-1].Dist_traveled))
-		lon := float64(gtfsshape[first-1].Lon) + londiff/dMeasure*((from)-float64(gtfsshape[first-1].Dist_traveled))
+// returns the output coordinates of a lat/lon pair, reprojected and
+// snapped to the output precision grid
+func (sw *ShapeWriter) project(lat float64, lon float64) (float64, float64) {
+	x, y := lon, lat
 
-		if sw.outProj != nil {
-			x, y, _ := proj.Transform2(sw.wgs84Proj, sw.outProj, proj.DegToRad(float64(lon)), proj.DegToRad(float64(lat)))
-			ret = append(ret, shp.Point{x, y})
-		} else {
-			ret = append(ret, shp.Point{float64(lon), float64(lat)})
-		}
+	if sw.outProj != nil {
+		// proj4 is not safe for concurrent use
+		sw.projMutex.Lock()
+		x, y, _ = proj.Transform2(sw.wgs84Proj, sw.outProj, proj.DegToRad(lon), proj.DegToRad(lat))
+		sw.projMutex.Unlock()
 	}
 
-	for i := first; i <= last; i++ {
-		if sw.outProj != nil {
-			x, y, _ := proj.Transform2(sw.wgs84Proj, sw.outProj, proj.DegToRad(float64(gtfsshape[i].Lon)), proj.DegToRad(float64(gtfsshape[i].Lat)))
-			ret = append(ret, shp.Point{x, y})
-		} else {
-			ret = append(ret, shp.Point{float64(gtfsshape[i].Lon), float64(gtfsshape[i].Lat)})
-		}
+	if sw.opts.RoundCoords {
+		x = roundTo(x, sw.opts.Precision)
+		y = roundTo(y, sw.opts.Precision)
 	}
 
-	if last < len(gtfsshape)-1 {
-		latdiff := float64(gtfsshape[last+1].Lat) - float64(gtfsshape[last].Lat)
-		londiff := float64(gtfsshape[last+1].Lon) - float64(gtfsshape[last].Lon)
-
-		dMeasure := float64(gtfsshape[last+1].Dist_traveled) - float64(gtfsshape[last].Dist_traveled)
+	return x, y
+}
 
-		lat := float64(gtfsshape[last].Lat) + latdiff/dMeasure*((to)-float64(gtfsshape[last].Dist_traveled))
-		lon := float64(gtfsshape[last].Lon) + londiff/dMeasure*((to)-float64(gtfsshape[last].Dist_traveled))
+// round a value to the given number of decimal places
+func roundTo(val float64, places int) float64 {
+	f := math.Pow(10, float64(places))
+	return math.Floor(val*f+0.5) / f
+}
 
-		if sw.outProj != nil {
-			x, y, _ := proj.Transform2(sw.wgs84Proj, sw.outProj, proj.DegToRad(float64(lon)), proj.DegToRad(float64(lat)))
-			ret = append(ret, shp.Point{x, y})
-		} else {
-			ret = append(ret, shp.Point{float64(lon), float64(lat)})
-		}
+// return a reversed copy of points
+func reversePoints(points []shp.Point) []shp.Point {
+	ret := make([]shp.Point, len(points))
+	for i, p := range points {
+		ret[len(points)-1-i] = p
 	}
-
 	return ret
 }
 
-// returns a shapefile geometry from a GTFS shape, reprojected
-func (sw *ShapeWriter) gtfsStopToShpPoint(stop *gtfs.Stop) *shp.Point {
-	if sw.outProj != nil {
-		x, y, _ := proj.Transform2(sw.wgs84Proj, sw.outProj, proj.DegToRad(float64(stop.Lon)), proj.DegToRad(float64(stop.Lat)))
-		return &shp.Point{X: x, Y: y}
+// return a reversed copy of vals
+func reverseFloats(vals []float64) []float64 {
+	ret := make([]float64, len(vals))
+	for i, v := range vals {
+		ret[len(vals)-1-i] = v
 	}
-	return &shp.Point{X: float64(stop.Lon), Y: float64(stop.Lat)}
+	return ret
 }
 
-/**
- * Returns a shapefile geometry from a GTFS station list (if shapes are not available in the feed), reprojected
- */
-func (sw *ShapeWriter) gtfsStationPointsToShpLinePoints(stoptimes gtfs.StopTimes) []shp.Point {
-	ret := make([]shp.Point, len(stoptimes))
-	for i, st := range stoptimes {
-		if sw.outProj != nil {
-			x, y, _ := proj.Transform2(sw.wgs84Proj, sw.outProj, proj.DegToRad(float64(st.Stop().Lon)), proj.DegToRad(float64(st.Stop().Lat)))
-			ret[i].Y = y
-			ret[i].X = x
-		} else {
-			ret[i].Y = float64(st.Stop().Lat)
-			ret[i].X = float64(st.Stop().Lon)
-		}
+// return the ID, name and URL of agency, empty if a route has no agency
+func (sw *ShapeWriter) agencyVals(agency *gtfs.Agency) (string, string, string) {
+	if agency == nil {
+		return "", "", ""
 	}
 
-	return ret
+	url := ""
+	if agency.Url != nil {
+		url = agency.Url.String()
+	}
+
+	return sw.ids.get("agency", agency.Id), agency.Name, url
+}
+
+// returns a shapefile geometry from a GTFS shape, reprojected
+func (sw *ShapeWriter) gtfsStopToShpPoint(stop *gtfs.Stop) *shp.Point {
+	x, y := sw.project(float64(stop.Lat), float64(stop.Lon))
+	return &shp.Point{X: x, Y: y}
+}
+
+// check whether a stop has coordinates, missing coordinates are
+// either NaN or 0,0
+func hasCoord(stop *gtfs.Stop) bool {
+	return !math.IsNaN(float64(stop.Lat)) && !math.IsNaN(float64(stop.Lon)) && (stop.Lat != 0 || stop.Lon != 0)
 }
 
 /**
  * Calculate the optimal shapefile attribute field sizes to hold stop attributes
  */
-func (sw *ShapeWriter) getFieldSizesForStops(stops map[string]*gtfs.Stop) []shp.Field {
-	idSize := uint8(0)
-	codeSize := uint8(0)
-	nameSize := uint8(0)
-	descSize := uint8(0)
-	zoneIDSize := uint8(0)
-	urlSize := uint8(0)
-	parentStationSize := uint8(0)
-	timezoneSize := uint8(0)
-
+func (sw *ShapeWriter) getFieldSizesForStops(stops map[string]*gtfs.Stop, groups map[*gtfs.Stop]*gtfs.Stop) []shp.Field {
+	stopSl := make([]*gtfs.Stop, 0, len(stops))
 	for _, st := range stops {
-		if uint8(min(254, len(st.Id))) > idSize {
-			idSize = uint8(min(254, len(st.Id)))
-		}
-		if uint8(min(254, len(st.Code))) > codeSize {
-			codeSize = uint8(min(254, len(st.Code)))
-		}
-		if uint8(min(254, len(st.Name))) > nameSize {
-			nameSize = uint8(min(254, len(st.Name)))
+		if sw.keepStop(st) {
+			stopSl = append(stopSl, st)
 		}
-		if uint8(min(254, len(st.Desc))) > descSize {
-			descSize = uint8(min(254, len(st.Desc)))
-		}
-		if uint8(min(254, len(st.Zone_id))) > zoneIDSize {
-			zoneIDSize = uint8(min(254, len(st.Zone_id)))
-		}
-		if st.Url != nil && uint8(min(254, len(st.Url.String()))) > urlSize {
-			urlSize = uint8(min(254, len(st.Url.String())))
-		}
-		if st.Parent_station != nil && uint8(min(254, len(st.Parent_station.Id))) > parentStationSize {
-			parentStationSize = uint8(min(254, len(st.Parent_station.Id)))
+	}
+
+	sizes := parallelFieldSizes(len(stopSl), 9, func(i int, sizes []uint8) {
+		st := stopSl[i]
+		fitSize(&sizes[0], len(sw.ids.get("stop", st.Id)))
+		fitSize(&sizes[1], len(st.Code))
+		fitSize(&sizes[2], len(st.Name))
+		fitSize(&sizes[3], len(st.Desc))
+		fitSize(&sizes[4], len(st.Zone_id))
+		if st.Url != nil {
+			fitSize(&sizes[5], len(st.Url.String()))
 		}
-		if uint8(min(254, len(st.Timezone.GetTzString()))) > timezoneSize {
-			timezoneSize = uint8(min(254, len(st.Timezone.GetTzString())))
+		if st.Parent_station != nil {
+			fitSize(&sizes[6], len(sw.ids.get("stop", st.Parent_station.Id)))
 		}
-	}
+		fitSize(&sizes[7], len(st.Timezone.GetTzString()))
+		fitSize(&sizes[8], len(sw.ids.get("stop", groups[st].Id)))
+	})
 
 	return []shp.Field{
-		shp.StringField(sw.fldName("Id"), idSize),
-		shp.StringField(sw.fldName("Code"), codeSize),
-		shp.StringField(sw.fldName("Name"), nameSize),
-		shp.StringField(sw.fldName("Desc"), descSize),
-		shp.StringField(sw.fldName("Zone_id"), zoneIDSize),
-		shp.StringField(sw.fldName("Url"), urlSize),
+		shp.StringField(sw.fldName("Id"), sizes[0]),
+		shp.StringField(sw.fldName("Code"), sizes[1]),
+		shp.StringField(sw.fldName("Name"), sizes[2]),
+		shp.StringField(sw.fldName("Desc"), sizes[3]),
+		shp.StringField(sw.fldName("Zone_id"), sizes[4]),
+		shp.StringField(sw.fldName("Url"), sizes[5]),
 		shp.NumberField(sw.fldName("Location_type"), 1),
-		shp.StringField(sw.fldName("Parent_station"), parentStationSize),
-		shp.StringField(sw.fldName("Timezone"), timezoneSize),
+		shp.StringField(sw.fldName("Parent_station"), sizes[6]),
+		shp.StringField(sw.fldName("Timezone"), sizes[7]),
 		shp.StringField(sw.fldName("Wheelchair_boarding"), 1),
+		shp.StringField(sw.fldName("Loc_name"), 13),
+		shp.NumberField(sw.fldName("Has_transf"), 1),
+		shp.NumberField(sw.fldName("Transfers"), 10),
+		shp.NumberField(sw.fldName("Has_pathw"), 1),
+		shp.NumberField(sw.fldName("Pathways"), 10),
+		shp.StringField(sw.fldName("Group_id"), sizes[8]),
+		shp.NumberField(sw.fldName("Frequency"), 32),
+		shp.FloatField(sw.fldName("Wchair_tr"), 32, 10),
+		shp.FloatField(sw.fldName("Bikes_tr"), 32, 10),
+		shp.StringField(sw.fldName("Feat_id"), featIDLen),
 	}
 }
 
@@ -634,66 +1849,72 @@ func (sw *ShapeWriter) getFieldSizesForStops(stops map[string]*gtfs.Stop) []shp.
  * Calculate the optimal shapefile attribute field sizes to hold trip/route fields
  */
 func (sw *ShapeWriter) getFieldSizesForTrips(trips map[string]*gtfs.Trip) []shp.Field {
-	idSize := uint8(0)
-	headsignSize := uint8(0)
-	shortNameSize := uint8(0)
-	blockIDSize := uint8(0)
-	rShortNameSize := uint8(0)
-	rLongNameSize := uint8(0)
-	rDescSize := uint8(0)
-	rURLSize := uint8(0)
-	rColorSize := uint8(0)
-	rTextColorSize := uint8(0)
+	tripSl := make([]*gtfs.Trip, 0, len(trips))
+	for _, t := range trips {
+		tripSl = append(tripSl, t)
+	}
 
-	for _, st := range trips {
-		if uint8(min(254, len(st.Id))) > idSize {
-			idSize = uint8(min(254, len(st.Id)))
-		}
-		if uint8(min(254, len(*st.Headsign))) > headsignSize {
-			headsignSize = uint8(min(254, len(*st.Headsign)))
-		}
-		if st.Short_name != nil && uint8(min(254, len(*st.Short_name))) > shortNameSize {
-			shortNameSize = uint8(min(254, len(*st.Short_name)))
-		}
-		if st.Block_id != nil && uint8(min(254, len(*st.Block_id))) > blockIDSize {
-			blockIDSize = uint8(min(254, len(*st.Block_id)))
+	sizes := parallelFieldSizes(len(tripSl), 11, func(i int, sizes []uint8) {
+		t := tripSl[i]
+		fitSize(&sizes[0], len(sw.ids.get("trip", t.Id)))
+		if t.Headsign != nil {
+			fitSize(&sizes[1], len(*t.Headsign))
 		}
-		if uint8(min(254, len(st.Route.Short_name))) > rShortNameSize {
-			rShortNameSize = uint8(min(254, len(st.Route.Short_name)))
+		if t.Short_name != nil {
+			fitSize(&sizes[2], len(*t.Short_name))
 		}
-		if uint8(min(254, len(st.Route.Long_name))) > rLongNameSize {
-			rLongNameSize = uint8(min(254, len(st.Route.Long_name)))
+		if t.Block_id != nil {
+			fitSize(&sizes[3], len(*t.Block_id))
 		}
-		if uint8(min(254, len(st.Route.Desc))) > rDescSize {
-			rDescSize = uint8(min(254, len(st.Route.Desc)))
+		fitSize(&sizes[4], len(t.Route.Short_name))
+		fitSize(&sizes[5], len(t.Route.Long_name))
+		fitSize(&sizes[6], len(t.Route.Desc))
+		if t.Route.Url != nil {
+			fitSize(&sizes[7], len(t.Route.Url.String()))
 		}
-		if st.Route.Url != nil && (uint8(min(254, len(st.Route.Url.String()))) > rURLSize) {
-			rURLSize = uint8(min(254, len(st.Route.Url.String())))
-		}
-		if uint8(min(254, len(st.Route.Color))) > rColorSize {
-			rColorSize = uint8(min(254, len(st.Route.Color)))
-		}
-		if uint8(min(254, len(st.Route.Text_color))) > rTextColorSize {
-			rTextColorSize = uint8(min(254, len(st.Route.Text_color)))
-		}
-	}
+		fitSize(&sizes[8], len(t.Route.Color))
+		fitSize(&sizes[9], len(t.Route.Text_color))
+		fitSize(&sizes[10], len(sw.ids.get("service", t.Service.Id())))
+	})
 
-	return []shp.Field{
-		shp.StringField(sw.fldName("Id"), idSize),
-		shp.StringField(sw.fldName("Headsign"), headsignSize),
-		shp.StringField(sw.fldName("ShortName"), shortNameSize),
+	flds := []shp.Field{
+		shp.StringField(sw.fldName("Id"), sizes[0]),
+		shp.StringField(sw.fldName("Headsign"), sizes[1]),
+		shp.StringField(sw.fldName("ShortName"), sizes[2]),
 		shp.NumberField(sw.fldName("Dir_id"), 1),
-		shp.StringField(sw.fldName("BlockId"), blockIDSize),
+		shp.StringField(sw.fldName("BlockId"), sizes[3]),
 		shp.NumberField(sw.fldName("Wheelchr_a"), 1),
 		shp.NumberField(sw.fldName("Bikes_alwd"), 1),
-		shp.StringField(sw.fldName("R_ShrtName"), rShortNameSize),
-		shp.StringField(sw.fldName("R_LongName"), rLongNameSize),
-		shp.StringField(sw.fldName("R_Desc"), rDescSize),
+		shp.StringField(sw.fldName("R_ShrtName"), sizes[4]),
+		shp.StringField(sw.fldName("R_LongName"), sizes[5]),
+		shp.StringField(sw.fldName("R_Desc"), sizes[6]),
 		shp.NumberField(sw.fldName("R_Type"), 16),
-		shp.StringField(sw.fldName("R_URL"), rURLSize),
-		shp.StringField(sw.fldName("R_Color"), rColorSize),
-		shp.StringField(sw.fldName("R_TextColor"), rTextColorSize),
+		shp.StringField(sw.fldName("R_URL"), sizes[7]),
+		shp.StringField(sw.fldName("R_Color"), sizes[8]),
+		shp.StringField(sw.fldName("R_TextColor"), sizes[9]),
+		shp.StringField(sw.fldName("Mode_class"), 9),
 	}
+
+	for i := 0; i < 7; i++ {
+		flds = append(flds, shp.NumberField(sw.fldName(weekdayFlds[(i+1)%7]), 1))
+	}
+
+	return append(flds,
+		shp.NumberField(sw.fldName("Holiday"), 1),
+		shp.StringField(sw.fldName("Start_date"), 10),
+		shp.NumberField(sw.fldName("Start_ep"), 12),
+		shp.StringField(sw.fldName("End_date"), 10),
+		shp.NumberField(sw.fldName("End_ep"), 12),
+		shp.StringField(sw.fldName("First_dep"), 9),
+		shp.NumberField(sw.fldName("Dep_sec"), 6),
+		shp.FloatField(sw.fldName("Km"), 32, 3),
+		shp.FloatField(sw.fldName("Runtime"), 32, 2),
+		shp.FloatField(sw.fldName("Speed"), 32, 2),
+		shp.StringField(sw.fldName("Geom_src"), 12),
+		shp.StringField(sw.fldName("Service_id"), sizes[10]),
+		shp.StringField(sw.fldName("Days"), 32),
+		shp.StringField(sw.fldName("Feat_id"), featIDLen),
+	)
 }
 
 /**
@@ -704,17 +1925,15 @@ func (sw *ShapeWriter) getFieldSizesForShapes(shapes map[string]*AggrShape) []sh
 	tIdsSize := uint8(0)
 	rIdsSize := uint8(0)
 	rShortNamesSize := uint8(0)
+	variantSize := uint8(0)
+	headsignSize := uint8(0)
 
 	for _, s := range shapes {
-		if uint8(min(254, len(s.Shape.Id))) > idSize {
-			idSize = uint8(min(254, len(s.Shape.Id)))
-		}
-		if uint8(min(254, len(s.GetTripIdsString()))) > tIdsSize {
-			tIdsSize = uint8(min(254, len(s.GetTripIdsString())))
-		}
-		if uint8(min(254, len(s.GetRouteIdsString()))) > rIdsSize {
-			rIdsSize = uint8(min(254, len(s.GetRouteIdsString())))
-		}
+		fitSize(&idSize, len(sw.ids.get("shape", s.Shape.Id)))
+		fitSize(&variantSize, len(sw.variantName(s, nil)))
+		fitSize(&headsignSize, len(sw.commonHeadsign(s, nil)))
+		fitSize(&tIdsSize, len(sw.getTripIdsString(s)))
+		fitSize(&rIdsSize, len(sw.getRouteIdsString(s)))
 		if uint8(min(254, len(s.GetShortNamesString()))) > rShortNamesSize {
 			rShortNamesSize = uint8(min(254, len(s.GetShortNamesString())))
 		}
@@ -725,6 +1944,16 @@ func (sw *ShapeWriter) getFieldSizesForShapes(shapes map[string]*AggrShape) []sh
 		shp.StringField(sw.fldName("TripIds"), tIdsSize),
 		shp.StringField(sw.fldName("RouteIds"), rIdsSize),
 		shp.StringField(sw.fldName("RouteNames"), rShortNamesSize),
+		shp.StringField(sw.fldName("Variant"), variantSize),
+		shp.FloatField(sw.fldName("Max_gap"), 32, 2),
+		shp.FloatField(sw.fldName("Max_stop_d"), 32, 2),
+		shp.NumberField(sw.fldName("Frequency"), 32),
+		shp.NumberField(sw.fldName("Num_routes"), 10),
+		shp.FloatField(sw.fldName("Km_len"), 64, 10),
+		shp.FloatField(sw.fldName("Km_tot"), 64, 10),
+		shp.FloatField(sw.fldName("Km_day"), 64, 10),
+		shp.StringField(sw.fldName("Headsign"), headsignSize),
+		shp.StringField(sw.fldName("Feat_id"), featIDLen),
 	}
 }
 
@@ -738,13 +1967,21 @@ func (sw *ShapeWriter) getFieldSizesForRouteShapes(shapes map[string]*AggrShape,
 	TypeNameSize := uint8(0)
 	AgencyNameSize := uint8(0)
 	AgencyUrlSize := uint8(0)
+	variantSize := uint8(0)
+	loopStartSize := uint8(0)
+	headsignSize := uint8(0)
 
 	addFldsSizes := make(map[string]uint8, len(routeAddFlds))
 
 	for _, s := range shapes {
 		for _, r := range s.Routes {
-			if uint8(min(254, len(r.Id))) > idSize {
-				idSize = uint8(min(254, len(r.Id)))
+			fitSize(&idSize, len(sw.ids.get("route", r.Id)))
+			fitSize(&variantSize, len(sw.variantName(s, r)))
+			fitSize(&headsignSize, len(sw.commonHeadsign(s, r)))
+			if s.Loop {
+				if stop := sw.loopStart(s, r); stop != nil {
+					fitSize(&loopStartSize, len(sw.ids.get("stop", stop.Id)))
+				}
 			}
 			if uint8(min(254, len(r.Short_name))) > shortNameSize {
 				shortNameSize = uint8(min(254, len(r.Short_name)))
@@ -762,20 +1999,17 @@ func (sw *ShapeWriter) getFieldSizesForRouteShapes(shapes map[string]*AggrShape,
 					TypeNameSize = uint8(min(254, len(istr)))
 				}
 			}
-			if uint8(min(254, len(r.Agency.Name))) > AgencyNameSize {
-				AgencyNameSize = uint8(min(254, len(r.Agency.Name)))
+			_, agencyName, agencyURL := sw.agencyVals(r.Agency)
+			if uint8(min(254, len(agencyName))) > AgencyNameSize {
+				AgencyNameSize = uint8(min(254, len(agencyName)))
 			}
-			if uint8(min(254, len(r.Agency.Url.String()))) > AgencyUrlSize {
-				AgencyUrlSize = uint8(min(254, len(r.Agency.Url.String())))
+			if uint8(min(254, len(agencyURL))) > AgencyUrlSize {
+				AgencyUrlSize = uint8(min(254, len(agencyURL)))
 			}
 
 			for _, field := range routeAddFlds {
-				if flds, ok := f.RoutesAddFlds[field]; ok {
-					if val, ok := flds[r.Id]; ok {
-						if uint8(min(254, len(val))) > addFldsSizes[field] {
-							addFldsSizes[field] = uint8(min(254, len(val)))
-						}
-					}
+				if val := sw.routeAddFld(f, field, r); uint8(min(254, len(val))) > addFldsSizes[field] {
+					addFldsSizes[field] = uint8(min(254, len(val)))
 				}
 			}
 		}
@@ -793,15 +2027,178 @@ func (sw *ShapeWriter) getFieldSizesForRouteShapes(shapes map[string]*AggrShape,
 		shp.StringField(sw.fldName("Agency_url"), AgencyUrlSize),
 		shp.FloatField(sw.fldName("Wchair_tr"), 32, 10),
 		shp.FloatField(sw.fldName("Wchair_st"), 32, 10),
+		shp.StringField(sw.fldName("Mode_class"), 9),
+		shp.NumberField(sw.fldName("Dir_diff"), 32),
+		shp.FloatField(sw.fldName("Dir_imbal"), 32, 10),
+		shp.FloatField(sw.fldName("Hw_exact"), 32, 2),
+		shp.FloatField(sw.fldName("Hw_freq"), 32, 2),
+		shp.FloatField(sw.fldName("Stop_dist"), 32, 2),
+		shp.NumberField(sw.fldName("Vehicles"), 10),
+		shp.StringField(sw.fldName("Variant"), variantSize),
+		shp.FloatField(sw.fldName("Bikes_tr"), 32, 10),
+		shp.FloatField(sw.fldName("Max_gap"), 32, 2),
+		shp.FloatField(sw.fldName("Max_stop_d"), 32, 2),
+		shp.NumberField(sw.fldName("Loop"), 1),
+		shp.StringField(sw.fldName("Loop_dir"), 3),
+		shp.StringField(sw.fldName("Loop_start"), loopStartSize),
+		shp.FloatField(sw.fldName("Loop_km"), 64, 10),
+		shp.StringField(sw.fldName("Headsign"), headsignSize),
+		shp.StringField(sw.fldName("Feat_id"), featIDLen),
 	}
 
 	for _, field := range routeAddFlds {
 		flds = append(flds, shp.StringField(sw.fldName(field), addFldsSizes[field]))
 	}
 
+	if sw.opts.TripDelays != nil {
+		flds = append(flds, shp.FloatField(sw.fldName("Avg_delay"), 32, 2))
+		flds = append(flds, shp.FloatField(sw.fldName("Punctual"), 32, 10))
+	}
+
+	if sw.opts.HeadwayWindow != nil {
+		flds = append(flds, shp.FloatField(sw.fldName("Hw_min"), 32, 2))
+		flds = append(flds, shp.FloatField(sw.fldName("Hw_max"), 32, 2))
+		flds = append(flds, shp.FloatField(sw.fldName("Hw_med"), 32, 2))
+	}
+
 	return flds
 }
 
+// create a shapefile layer of the given kind, which only writes the
+// columns of the selected schema version. The layer is written to a
+// temporary file first, which replaces fileName once it is complete
+func (sw *ShapeWriter) createLayer(fileName string, t shp.ShapeType, kind string) *layer {
+	sw.checkOverwrite(fileName)
+	if sw.opts.SpatialIndex {
+		sw.checkOverwrite(strings.TrimSuffix(fileName, ".shp") + ".qix")
+	}
+
+	shape, err := createShp(tmpLayerName(fileName), t)
+
+	if err != nil {
+		panic(fmt.Sprintf("Could not open shapefile for writing (%s)", err))
+	}
+
+	return &layer{shpWriter: shape, drop: sw.droppedColumns(kind), kind: kind, where: sw.opts.Where}
+}
+
+// close a shapefile layer, to be deferred after createLayer. If the
+// writer panicked, the incomplete layer is discarded
+func (sw *ShapeWriter) closeLayer(shape *layer, fileName string) {
+	r := recover()
+
+	sw.finishLayer(shape, fileName, r != nil)
+
+	if r != nil {
+		panic(r)
+	}
+}
+
+// close a shapefile layer and move it to fileName, add it to the summary
+// and write its spatial index, if requested. In incremental mode, the
+// layer only replaces an existing layer if its contents changed. Failed
+// layers are discarded
+func (sw *ShapeWriter) finishLayer(shape *layer, fileName string, failed bool) {
+	if shape.where != nil && !failed {
+		shape.flush()
+		sw.filtered += shape.skipped
+	}
+
+	box := shape.BBox()
+	err := shape.Close()
+
+	if failed {
+		removeLayer(tmpLayerName(fileName))
+		return
+	}
+
+	if err != nil {
+		removeLayer(tmpLayerName(fileName))
+		panic(fmt.Sprintf("Could not write shapefile %s (%s)", fileName, err))
+	}
+
+	status := ""
+	fingerprint := ""
+
+	if sw.opts.Incremental {
+		status, fingerprint = sw.replaceLayer(fileName)
+	} else {
+		moveLayer(tmpLayerName(fileName), fileName)
+	}
+
+	sw.addLayerSummary(fileName, shape.kind, box, status, fingerprint)
+	sw.addDictionaryLayer(filepath.Base(fileName), shape.kind, shape.fields)
+
+	if sw.opts.SpatialIndex && (status != "unchanged" || !fileExists(strings.TrimSuffix(fileName, ".shp")+".qix")) {
+		if err := sw.writeQix(fileName); err != nil {
+			panic(fmt.Sprintf("Could not write spatial index (%s)", err))
+		}
+	}
+}
+
+// write a float attribute, applying the missing value policy to undefined values
+func (sw *ShapeWriter) writeFloatAttr(shape attrWriter, row int, fld int, val float64) {
+	if math.IsNaN(val) || math.IsInf(val, 0) {
+		switch sw.opts.MissingValues {
+		case MissingEmpty:
+			return
+		case MissingMinusOne:
+			val = -1
+		}
+	}
+	shape.WriteAttribute(row, fld, val)
+}
+
+// write a float attribute which is left empty (NULL) if undefined,
+// unless the missing value policy is MissingMinusOne
+func (sw *ShapeWriter) writeNullFloatAttr(shape attrWriter, row int, fld int, val float64) {
+	if (math.IsNaN(val) || math.IsInf(val, 0)) && sw.opts.MissingValues == MissingNaN {
+		return
+	}
+	sw.writeFloatAttr(shape, row, fld, val)
+}
+
+// format a float for CSV output, applying the missing value policy to undefined values
+func (sw *ShapeWriter) formatFloat(val float64) string {
+	if math.IsNaN(val) || math.IsInf(val, 0) {
+		switch sw.opts.MissingValues {
+		case MissingEmpty:
+			return ""
+		case MissingMinusOne:
+			val = -1
+		}
+	}
+	return strconv.FormatFloat(val, 'f', 10, 64)
+}
+
+// return a comma separated list of the output IDs of the trips contained in as
+func (sw *ShapeWriter) getTripIdsString(as *AggrShape) string {
+	if sw.ids.mode == IDKeep {
+		return as.GetTripIdsString()
+	}
+
+	ids := make([]string, 0, len(as.Trips))
+	for id := range as.Trips {
+		ids = append(ids, sw.ids.get("trip", id))
+	}
+
+	return strings.Join(ids, ",")
+}
+
+// return a comma separated list of the output IDs of the routes contained in as
+func (sw *ShapeWriter) getRouteIdsString(as *AggrShape) string {
+	if sw.ids.mode == IDKeep {
+		return as.GetRouteIdsString()
+	}
+
+	ids := make([]string, 0, len(as.Routes))
+	for id := range as.Routes {
+		ids = append(ids, sw.ids.get("route", id))
+	}
+
+	return strings.Join(ids, ",")
+}
+
 func (sw *ShapeWriter) fldName(f string) string {
 	if n, ok := sw.fldMap[f]; ok {
 		return n
@@ -810,36 +2207,42 @@ func (sw *ShapeWriter) fldName(f string) string {
 }
 
 /**
- * Return the sanitized output file name from the user-provided output file
+ * Return the sanitized output file name with the given suffix from the user-provided output file
  */
-func (sw *ShapeWriter) getShapeFileName(in string) string {
+func (sw *ShapeWriter) getOutFileName(in string, suffix string) string {
 	name := filepath.Base(in)
 	name = strings.TrimSuffix(name, filepath.Ext(name))
-	name = fmt.Sprint(name, ".shp")
+	name = fmt.Sprint(name, suffix)
 	name = filepath.Join(filepath.Dir(in), name)
 	return name
 }
 
+/**
+ * Return the sanitized output file name from the user-provided output file
+ */
+func (sw *ShapeWriter) getShapeFileName(in string) string {
+	return sw.getOutFileName(in, ".shp")
+}
+
 /**
  * Return the sanitized stations output file name from the user-provided output file
  */
 func (sw *ShapeWriter) getShapeFileNameStations(in string) string {
-	name := filepath.Base(in)
-	name = strings.TrimSuffix(name, filepath.Ext(name))
-	name = fmt.Sprint(name, ".stations.shp")
-	name = filepath.Join(filepath.Dir(in), name)
-	return name
+	return sw.getOutFileName(in, ".stations.shp")
+}
+
+/**
+ * Return the sanitized shape points output file name from the user-provided output file
+ */
+func (sw *ShapeWriter) getShapeFileNameShapePoints(in string) string {
+	return sw.getOutFileName(in, ".shapepoints.shp")
 }
 
 /**
  * Return the sanitized aggregate CSV output file name from the user-provided output file
  */
 func (sw *ShapeWriter) getCsvFileName(in string) string {
-	name := filepath.Base(in)
-	name = strings.TrimSuffix(name, filepath.Ext(name))
-	name = fmt.Sprint(name, ".csv")
-	name = filepath.Join(filepath.Dir(in), name)
-	return name
+	return sw.getOutFileName(in, ".csv")
 }
 
 func min(a, b int) int {
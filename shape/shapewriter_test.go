@@ -0,0 +1,2436 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/jonas-p/go-shp"
+	"github.com/patrickbr/gtfs2shp/internal/testfeed"
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// a small feed: bus route 1 runs twice along a shape through stops A, B
+// and C, operated as one block; tram route 2 runs once from A to C
+// without a shape. Both run on weekdays of the first week of 2024
+func fixtureFeed(t *testing.T) *gtfsparser.Feed {
+	t.Helper()
+
+	return testfeed.New().
+		Stop("A", "Alpha", 50.0, 8.0).
+		Stop("B", "Beta", 50.0, 8.01).
+		Stop("C", "Gamma", 50.0, 8.02).
+		Station("S", "Alpha Station", 50.0, 8.0, "A").
+		Route("r1", "1", 3).
+		Route("r2", "2", 0).
+		Calendar("wd", "1111100", "20240101", "20240107").
+		Shape("sh1", [2]float64{50.0, 8.0}, [2]float64{50.0, 8.01}, [2]float64{50.0, 8.02}).
+		Trip("t1", "r1", "wd", "sh1",
+			testfeed.StopTime{Stop: "A", Arr: "08:00:00", Dep: "08:00:00", Dist: "0"},
+			testfeed.StopTime{Stop: "B", Arr: "08:05:00", Dep: "08:05:00", Dist: "1"},
+			testfeed.StopTime{Stop: "C", Arr: "08:10:00", Dep: "08:10:00", Dist: "2"}).
+		Trip("t2", "r1", "wd", "sh1",
+			testfeed.StopTime{Stop: "A", Arr: "08:30:00", Dep: "08:30:00", Dist: "0"},
+			testfeed.StopTime{Stop: "B", Arr: "08:35:00", Dep: "08:35:00", Dist: "1"},
+			testfeed.StopTime{Stop: "C", Arr: "08:40:00", Dep: "08:40:00", Dist: "2"}).
+		Trip("t3", "r2", "wd", "", testfeed.At("A", "09:00:00"), testfeed.At("C", "09:12:00")).
+		Set("trips.txt", "t1", "block_id", "b1").
+		Set("trips.txt", "t2", "block_id", "b1").
+		Feed(t)
+}
+
+// return a shape writer with opts writing to a temporary directory
+func fixtureWriter(t *testing.T, motMap map[int16]bool, opts WriteOptions) (*ShapeWriter, string) {
+	t.Helper()
+
+	sw := NewShapeWriter("4326", motMap, map[string]string{})
+	sw.SetWriteOpts(opts)
+
+	return sw, filepath.Join(t.TempDir(), "out.shp")
+}
+
+// read the attributes of all features of a shapefile, keyed by field name
+func readLayer(t *testing.T, fileName string) []map[string]string {
+	t.Helper()
+
+	r, err := shp.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	ret := make([]map[string]string, 0)
+	fields := r.Fields()
+
+	for r.Next() {
+		n, _ := r.Shape()
+		row := make(map[string]string, len(fields))
+		for i, f := range fields {
+			row[f.String()] = strings.TrimSpace(r.ReadAttribute(n, i))
+		}
+		ret = append(ret, row)
+	}
+
+	return ret
+}
+
+// read all records of a CSV file, including the header
+func readCsv(t *testing.T, fileName string) [][]string {
+	t.Helper()
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	recs, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return recs
+}
+
+// return the rows with field fld equal to val
+func rowsWith(rows []map[string]string, fld string, val string) []map[string]string {
+	ret := make([]map[string]string, 0)
+	for _, row := range rows {
+		if row[fld] == val {
+			ret = append(ret, row)
+		}
+	}
+	return ret
+}
+
+func parseFloat(t *testing.T, s string) float64 {
+	t.Helper()
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		t.Fatalf("could not parse %q as float", s)
+	}
+	return f
+}
+
+func TestGetAggrShapes(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, _ := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+
+	aggrShapes, routeShapes := sw.getAggrShapes(feed.Trips, feed)
+
+	// the trip without a shape is not aggregated
+	if len(aggrShapes) != 1 {
+		t.Fatalf("got %d aggregated shapes, want 1", len(aggrShapes))
+	}
+
+	for _, as := range aggrShapes {
+		if len(as.Trips) != 2 {
+			t.Errorf("got %d trips, want 2", len(as.Trips))
+		}
+
+		// two trips on five weekdays
+		if got := as.RouteTripCount[feed.Routes["r1"]]; got != 10 {
+			t.Errorf("got trip count %d, want 10", got)
+		}
+
+		want := haversine(50.0, 8.0, 50.0, 8.02)
+		if math.Abs(as.MeterLength-want) > 1 {
+			t.Errorf("got length %f, want %f", as.MeterLength, want)
+		}
+	}
+
+	if len(routeShapes[feed.Routes["r1"]]) != 1 {
+		t.Errorf("route r1 has %d shapes, want 1", len(routeShapes[feed.Routes["r1"]]))
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	feed := fixtureFeed(t)
+
+	aggrShapes := Aggregate(feed, AggregateOptions{})
+	if len(aggrShapes) != 1 {
+		t.Fatalf("got %d aggregated shapes, want 1", len(aggrShapes))
+	}
+
+	for _, as := range aggrShapes {
+		if got := as.RouteTripCount[feed.Routes["r1"]]; got != 10 {
+			t.Errorf("got trip count %d, want 10", got)
+		}
+	}
+
+	// no route of the feed is a ferry
+	if aggrShapes := Aggregate(feed, AggregateOptions{MOTs: map[int16]bool{4: true}}); len(aggrShapes) != 0 {
+		t.Errorf("got %d aggregated shapes, want 0", len(aggrShapes))
+	}
+}
+
+func TestGetAggrShapesFrequencies(t *testing.T) {
+	feed := testfeed.New().
+		Stop("A", "Alpha", 50.0, 8.0).
+		Stop("B", "Beta", 50.0, 8.01).
+		Route("r1", "1", 3).
+		Calendar("wd", "1000000", "20240101", "20240101").
+		Shape("sh1", [2]float64{50.0, 8.0}, [2]float64{50.0, 8.01}).
+		Trip("t1", "r1", "wd", "sh1", testfeed.At("A", "06:00:00"), testfeed.At("B", "06:05:00")).
+		Frequency("t1", "06:00:00", "07:00:00", 600, true).
+		Feed(t)
+
+	sw, _ := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+	aggrShapes, _ := sw.getAggrShapes(feed.Trips, feed)
+
+	for _, as := range aggrShapes {
+		// one trip every 10 minutes for an hour on a single day
+		if got := as.RouteTripCount[feed.Routes["r1"]]; got != 6 {
+			t.Errorf("got trip count %d, want 6", got)
+		}
+	}
+}
+
+func TestWriteShapes(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+
+	if n := sw.WriteShapes(feed, out); n != 1 {
+		t.Fatalf("wrote %d shapes, want 1", n)
+	}
+
+	rows := readLayer(t, out)
+	if len(rows) != 1 {
+		t.Fatalf("read %d shapes, want 1", len(rows))
+	}
+
+	row := rows[0]
+	if row["Id"] != "sh1" || row["RouteIds"] != "r1" || row["Frequency"] != "10" || row["Num_routes"] != "1" {
+		t.Errorf("unexpected attributes %v", row)
+	}
+
+	// five service days from monday to friday
+	kmTot := parseFloat(t, row["Km_tot"])
+	if math.Abs(parseFloat(t, row["Km_day"])-kmTot/5) > 1e-6 {
+		t.Errorf("got Km_day %s, want %f", row["Km_day"], kmTot/5)
+	}
+}
+
+func TestWriteRouteShapes(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+
+	if n := sw.WriteRouteShapes(feed, map[int16]string{3: "Bus"}, nil, out); n != 1 {
+		t.Fatalf("wrote %d route shapes, want 1", n)
+	}
+
+	rows := readLayer(t, out)
+	if len(rows) != 1 {
+		t.Fatalf("read %d route shapes, want 1", len(rows))
+	}
+
+	row := rows[0]
+	if row["Route_id"] != "r1" || row["Type"] != "Bus" || row["Frequency"] != "10" || row["Mode_class"] != "land" {
+		t.Errorf("unexpected attributes %v", row)
+	}
+
+	// the stops are on the shape
+	if d := parseFloat(t, row["Max_stop_d"]); d > 1 {
+		t.Errorf("got stop distance %f, want 0", d)
+	}
+}
+
+func TestStreamRouteShapes(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, _ := fixtureWriter(t, map[int16]bool{}, WriteOptions{Schema: 2})
+
+	features := make([]Feature, 0)
+	for feature := range sw.StreamRouteShapes(feed, map[int16]string{3: "Bus"}, nil) {
+		if feature.Err != nil {
+			t.Fatal(feature.Err)
+		}
+		features = append(features, feature)
+	}
+
+	if len(features) != 1 {
+		t.Fatalf("streamed %d route shapes, want 1", len(features))
+	}
+
+	feature := features[0]
+	if feature.Route != feed.Routes["r1"] || feature.Attributes["Route_id"] != "r1" || feature.Attributes["Type"] != "Bus" {
+		t.Errorf("unexpected feature %v", feature)
+	}
+	if _, ok := feature.Attributes["Headsign"]; ok {
+		t.Errorf("schema version 3 column Headsign in schema version 2 feature")
+	}
+	if pts := feature.Geometry.(*shp.PolyLine).Points; len(pts) != 3 {
+		t.Errorf("got %d points, want 3", len(pts))
+	}
+}
+
+func TestExpandAddFlds(t *testing.T) {
+	feed := testfeed.New().
+		Stop("A", "Alpha", 50.0, 8.0).
+		Stop("B", "Beta", 50.0, 8.01).
+		Route("r1", "1", 3).
+		Calendar("wd", "1111100", "20240101", "20240107").
+		Trip("t1", "r1", "wd", "", testfeed.At("A", "08:00:00"), testfeed.At("B", "08:05:00")).
+		Set("routes.txt", "r1", "route_branding_url", "https://example.com/1").
+		Set("routes.txt", "r1", "route_branding_color", "FF0000").
+		Set("routes.txt", "r1", "vehicle_type", "articulated").
+		Feed(t)
+
+	got := ExpandAddFlds(feed.RoutesAddFlds, append([]string{"contract_id", "vehicle_type"}, RouteExtensionFlds...))
+	want := []string{"contract_id", "vehicle_type", "route_branding_color", "route_branding_url", "network_id"}
+
+	if strings.Join(got, ";") != strings.Join(want, ";") {
+		t.Errorf("got fields %v, want %v", got, want)
+	}
+}
+
+func TestWriteRouteShapesRouteGeometry(t *testing.T) {
+	// a short variant of route 1 only serving A and B
+	feed := fixtureFeed(t)
+	feed.Shapes["sh2"] = &gtfs.Shape{Id: "sh2", Points: gtfs.ShapePoints{{Lat: 50.0, Lon: 8.0, Sequence: 1, Dist_traveled: 0}, {Lat: 50.0, Lon: 8.01, Sequence: 2, Dist_traveled: 1}}}
+	for _, id := range []string{"s1", "s2", "s3"} {
+		trip := *feed.Trips["t1"]
+		trip.Id = id
+		trip.Shape = feed.Shapes["sh2"]
+		trip.StopTimes = trip.StopTimes[:2]
+		feed.Trips[id] = &trip
+	}
+
+	for _, c := range []struct {
+		geom   RouteGeometry
+		points int
+		parts  int32
+		freq   string
+	}{
+		{RouteGeomLongest, 3, 1, "10"},
+		{RouteGeomMostFrequent, 2, 1, "15"},
+		{RouteGeomUnion, 5, 2, "25"},
+	} {
+		sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{RouteGeometry: c.geom})
+		if n := sw.WriteRouteShapes(feed, map[int16]string{}, nil, out); n != 1 {
+			t.Errorf("wrote %d route shapes with route geometry %d, want 1", n, c.geom)
+			continue
+		}
+
+		r, err := shp.Open(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Next()
+		_, s := r.Shape()
+		line := s.(*shp.PolyLine)
+		freq := r.ReadAttribute(0, 4)
+		r.Close()
+
+		if len(line.Points) != c.points || line.NumParts != c.parts || freq != c.freq {
+			t.Errorf("got %d points in %d parts and frequency %s with route geometry %d, want %d, %d and %s", len(line.Points), line.NumParts, freq, c.geom, c.points, c.parts, c.freq)
+		}
+	}
+}
+
+func TestWriteRouteShapesHeadways(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{
+		HeadwayWindow: &HeadwayWindow{Date: gtfs.NewDate(1, 1, 2024), Start: 7 * 3600, End: 9 * 3600},
+	})
+
+	sw.WriteRouteShapes(feed, map[int16]string{}, nil, out)
+
+	rows := readLayer(t, out)
+	if len(rows) != 1 {
+		t.Fatalf("read %d route shapes, want 1", len(rows))
+	}
+
+	for _, fld := range []string{"Hw_min", "Hw_max", "Hw_med"} {
+		if hw := parseFloat(t, rows[0][fld]); hw != 1800 {
+			t.Errorf("got %s %f, want 1800", fld, hw)
+		}
+	}
+}
+
+func TestWriteRouteShapesLoop(t *testing.T) {
+	// a counterclockwise loop, the terminus refers to the shape start
+	feed := testfeed.New().
+		Stop("A", "Alpha", 50.0, 8.0).
+		Stop("B", "Beta", 50.0, 8.01).
+		Stop("D", "Delta", 50.01, 8.0).
+		Route("r1", "1", 3).
+		Calendar("wd", "1111100", "20240101", "20240107").
+		Shape("sh1", [2]float64{50.0, 8.0}, [2]float64{50.0, 8.01}, [2]float64{50.01, 8.01}, [2]float64{50.01, 8.0}, [2]float64{50.0, 8.0}).
+		Trip("t1", "r1", "wd", "sh1",
+			testfeed.StopTime{Stop: "A", Arr: "08:00:00", Dep: "08:00:00", Dist: "0"},
+			testfeed.StopTime{Stop: "B", Arr: "08:05:00", Dep: "08:05:00", Dist: "1"},
+			testfeed.StopTime{Stop: "D", Arr: "08:10:00", Dep: "08:10:00", Dist: "3"},
+			testfeed.StopTime{Stop: "A", Arr: "08:15:00", Dep: "08:15:00", Dist: "0"}).
+		Feed(t)
+
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+
+	if n := sw.WriteRouteShapes(feed, map[int16]string{}, nil, out); n != 1 {
+		t.Fatalf("wrote %d route shapes, want 1", n)
+	}
+
+	row := readLayer(t, out)[0]
+	if row["Loop"] != "1" || row["Loop_dir"] != "ccw" || row["Loop_start"] != "A" {
+		t.Errorf("unexpected attributes %v", row)
+	}
+
+	want := 0.02 * metersPerDeg * (1 + math.Cos(50*DEG_TO_RAD)) / 1000
+	if l := parseFloat(t, row["Loop_km"]); math.Abs(l-want) > 0.01 || parseFloat(t, row["Km_len"]) != l {
+		t.Errorf("got loop length %f km, want %f km", l, want)
+	}
+}
+
+func TestWriteRouteShapesSplitDirection(t *testing.T) {
+	feed := fixtureFeed(t)
+	feed.Trips["t1"].Direction_id = 0
+	feed.Trips["t2"].Direction_id = 1
+
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{SplitDirection: true})
+
+	if n := sw.WriteRouteShapes(feed, map[int16]string{}, nil, out); n != 2 {
+		t.Fatalf("wrote %d route shapes, want 2", n)
+	}
+
+	if rows := readLayer(t, out); len(rows) != 0 {
+		t.Errorf("got %d route shapes without direction, want 0", len(rows))
+	}
+
+	for _, dir := range []string{"dir0", "dir1"} {
+		rows := readLayer(t, strings.TrimSuffix(out, ".shp")+"."+dir+".shp")
+		if len(rows) != 1 || rows[0]["Frequency"] != "5" {
+			t.Errorf("unexpected %s route shapes %v", dir, rows)
+		}
+	}
+}
+
+func TestFeatureIDs(t *testing.T) {
+	featIDs := func(feed *gtfsparser.Feed, opts WriteOptions) (map[string]string, string) {
+		sw, out := fixtureWriter(t, map[int16]bool{}, opts)
+		sw.WriteRouteShapes(feed, map[int16]string{}, nil, out)
+
+		ret := make(map[string]string)
+		for _, row := range readLayer(t, out) {
+			ret[row["Route_id"]] = row["Feat_id"]
+		}
+
+		sw, out = fixtureWriter(t, map[int16]bool{}, opts)
+		sw.WriteShapes(feed, out)
+
+		return ret, readLayer(t, out)[0]["Feat_id"]
+	}
+
+	routes, shape := featIDs(fixtureFeed(t), WriteOptions{})
+	if len(routes["r1"]) != featIDLen || len(shape) != featIDLen || routes["r1"] == shape {
+		t.Fatalf("unexpected feature IDs %v and %s", routes, shape)
+	}
+
+	// another route joining the variant keeps the IDs of the others
+	feed := fixtureFeed(t)
+	feed.Trips["t2"].Route = feed.Routes["r2"]
+
+	joined, joinedShape := featIDs(feed, WriteOptions{})
+	if joined["r1"] != routes["r1"] || joinedShape != shape {
+		t.Errorf("feature IDs changed to %v and %s", joined, joinedShape)
+	}
+	if len(joined["r2"]) != featIDLen || joined["r2"] == joined["r1"] {
+		t.Errorf("unexpected feature ID %s of the new route", joined["r2"])
+	}
+
+	// a single feature per route is identified by the route
+	single, _ := featIDs(fixtureFeed(t), WriteOptions{RouteGeometry: RouteGeomLongest})
+	if single["r1"] != featureID("r1", "") {
+		t.Errorf("got feature ID %s, want %s", single["r1"], featureID("r1", ""))
+	}
+
+	// stations are identified by their stop
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+	sw.WriteStops(fixtureFeed(t), out)
+
+	rows := readLayer(t, sw.getShapeFileNameStations(out))
+	if row := rowsWith(rows, "Id", "B")[0]; row["Feat_id"] != featureID("B") {
+		t.Errorf("got station feature ID %s, want %s", row["Feat_id"], featureID("B"))
+	}
+}
+
+func TestMapIDs(t *testing.T) {
+	want := map[string]string{"x_": "x_", "x\u00e4": "x__2", "x\u00f6": "x__3"}
+
+	// the output IDs do not depend on the order the IDs are written in
+	for _, order := range [][]string{{"x\u00f6", "x\u00e4", "x_"}, {"x_", "x\u00e4", "x\u00f6"}} {
+		feed := fixtureFeed(t)
+		for _, id := range order {
+			feed.Stops[id] = &gtfs.Stop{Id: id, Name: id, Lat: 50, Lon: 8}
+		}
+
+		sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{IDSanitization: IDSanitize})
+		sw.MapIDs(feed)
+
+		for _, id := range order {
+			if got := sw.ids.get("stop", id); got != want[id] {
+				t.Errorf("got output ID %s for %q, want %s", got, id, want[id])
+			}
+		}
+
+		sw.WriteIDMapCsv(out)
+
+		recs := readCsv(t, sw.getOutFileName(out, ".ids.csv"))
+		if len(recs) != 3 || recs[1][1] != "x__2" || recs[2][1] != "x__3" {
+			t.Errorf("unexpected ID map %v", recs)
+		}
+	}
+}
+
+func TestPreParsedFeeds(t *testing.T) {
+	if opts := ParseOptions(WriteOptions{}, nil); opts.KeepAddFlds {
+		t.Error("additional fields kept without writing any")
+	}
+	if opts := ParseOptions(WriteOptions{}, []string{"network_id"}); !opts.KeepAddFlds {
+		t.Error("additional route fields not kept")
+	}
+
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{RouteGroups: RouteGroups{"r1": "L1"}})
+	sw.WriteRouteShapes(fixtureFeed(t), map[int16]string{}, nil, out)
+
+	// the route groups are rebuilt for another feed
+	sw.FeedChanged()
+	out = filepath.Join(t.TempDir(), "other.shp")
+	sw.WriteRouteShapes(fixtureFeed(t), map[int16]string{}, nil, out)
+
+	if rows := readLayer(t, out); len(rows) != 1 || rows[0]["Route_id"] != "L1" {
+		t.Errorf("unexpected route shapes %v", rows)
+	}
+}
+
+func TestRouteGroupsIDCollision(t *testing.T) {
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{RouteGroups: RouteGroups{"r1": "r2"}})
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("no error for a group ID which is also a route ID")
+		}
+	}()
+
+	sw.WriteRouteShapes(fixtureFeed(t), map[int16]string{}, nil, out)
+}
+
+func TestWriteRouteShapesNormalizeDirection(t *testing.T) {
+	// the shape of the trip in direction 1 runs from east to west
+	feed := testfeed.New().
+		Stop("A", "Alpha", 50.0, 8.0).
+		Stop("B", "Beta", 50.0, 8.01).
+		Route("r1", "1", 3).
+		Calendar("wd", "1111100", "20240101", "20240107").
+		Shape("back", [2]float64{50.0, 8.01}, [2]float64{50.0, 8.0}).
+		Trip("t1", "r1", "wd", "back", testfeed.At("B", "08:00:00"), testfeed.At("A", "08:05:00")).
+		Set("trips.txt", "t1", "direction_id", "1").
+		Feed(t)
+
+	firstX := func(normalize bool) float64 {
+		sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{NormalizeDirection: normalize})
+		sw.WriteRouteShapes(feed, map[int16]string{}, nil, out)
+
+		r, err := shp.Open(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		r.Next()
+		_, s := r.Shape()
+		return s.(*shp.PolyLine).Points[0].X
+	}
+
+	if x := firstX(false); math.Abs(x-8.01) > 1e-6 {
+		t.Errorf("got first point at %f, want 8.01", x)
+	}
+	if x := firstX(true); math.Abs(x-8.0) > 1e-6 {
+		t.Errorf("got first point at %f with normalized direction, want 8.0", x)
+	}
+}
+
+func TestSimplifyKeepingStops(t *testing.T) {
+	// a straight line with a stop at its third vertex
+	feed := testfeed.New().
+		Stop("A", "Alpha", 50.0, 8.0).
+		Stop("B", "Beta", 50.0, 8.006).
+		Stop("C", "Gamma", 50.0, 8.01).
+		Route("r1", "1", 3).
+		Calendar("wd", "1111100", "20240101", "20240107").
+		Shape("sh1", [2]float64{50.0, 8.0}, [2]float64{50.0, 8.003}, [2]float64{50.0, 8.006}, [2]float64{50.0, 8.01}).
+		Trip("t1", "r1", "wd", "sh1", testfeed.At("A", "08:00:00"), testfeed.At("B", "08:03:00"), testfeed.At("C", "08:05:00")).
+		Feed(t)
+
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{Simplify: 10})
+	sw.WriteShapes(feed, out)
+
+	r, err := shp.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	r.Next()
+	_, s := r.Shape()
+	if pts := s.(*shp.PolyLine).Points; len(pts) != 3 || math.Abs(pts[1].X-8.006) > 1e-6 {
+		t.Errorf("got simplified line %v, want the vertex at stop B retained", pts)
+	}
+
+	// the middle vertex deviates about 5.5 meters from the line
+	line := [][2]float64{{50.0, 8.0}, {50.00005, 8.002}, {50.0, 8.004}}
+	stop := &gtfs.Stop{Id: "x", Lat: 50.0, Lon: 8.0021}
+
+	for _, c := range []struct {
+		eps   float64
+		stops []*gtfs.Stop
+		want  string
+	}{
+		{10, nil, "[0 2]"},
+		{1, nil, "[0 1 2]"},
+		{10, []*gtfs.Stop{stop}, "[0 1 2]"},
+	} {
+		if got := fmt.Sprint(simplifyKeepingStops(line, c.stops, c.eps)); got != c.want {
+			t.Errorf("got retained vertices %s with tolerance %f and %d stops, want %s", got, c.eps, len(c.stops), c.want)
+		}
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+
+	sw.WriteShapes(feed, out)
+	sw.WriteReport(feed, map[int16]string{3: "Bus"}, []string{"Excluded 2 trips <early>"}, out)
+
+	b, err := os.ReadFile(sw.getOutFileName(out, ".report.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	html := string(b)
+
+	for _, want := range []string{
+		"<td>Bus</td><td class=\"num\">1</td><td class=\"num\">10</td>",
+		"<td>out.shp</td>",
+		"<li>Excluded 2 trips &lt;early&gt;</li>",
+		`"coordinates":[[8,50],[8.02,50]]`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("report does not contain %s", want)
+		}
+	}
+}
+
+func TestClipToStopRanges(t *testing.T) {
+	feed := testfeed.New().
+		Stop("A", "Alpha", 50.0, 8.0).
+		Stop("B", "Beta", 50.0001, 8.01).
+		Stop("C", "Gamma", 50.0, 8.02).
+		Stop("D", "Delta", 50.0, 8.03).
+		Route("r1", "5", 3).
+		Route("r2", "6", 3).
+		Calendar("wd", "1111100", "20240101", "20240107").
+		Shape("sh1", [2]float64{50.0, 8.0}, [2]float64{50.0, 8.015}, [2]float64{50.0, 8.03}).
+		Trip("t1", "r1", "wd", "sh1", testfeed.At("A", "08:00:00"), testfeed.At("B", "08:05:00"),
+			testfeed.At("C", "08:10:00"), testfeed.At("D", "08:15:00")).
+		Trip("t2", "r1", "wd", "sh1", testfeed.At("A", "09:00:00"), testfeed.At("D", "09:15:00")).
+		Trip("t3", "r2", "wd", "sh1", testfeed.At("A", "10:00:00"), testfeed.At("D", "10:15:00")).
+		Feed(t)
+
+	ranges, err := ParseStopRanges(feed, "5:Beta", "5:C")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sw, _ := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+
+	if clipped, dropped := sw.ClipToStopRanges(feed, ranges); clipped != 1 || dropped != 1 {
+		t.Errorf("clipped %d and dropped %d trips, want 1 and 1", clipped, dropped)
+	}
+
+	t1 := feed.Trips["t1"]
+	if len(t1.StopTimes) != 2 || t1.StopTimes[0].Stop().Id != "B" || t1.StopTimes[1].Stop().Id != "C" {
+		t.Errorf("t1 was not clipped to B and C")
+	}
+
+	pts := t1.Shape.Points
+	if len(pts) != 3 || math.Abs(float64(pts[0].Lon)-8.01) > 1e-6 || math.Abs(float64(pts[2].Lon)-8.02) > 1e-6 {
+		t.Errorf("unexpected clipped shape %v", pts)
+	}
+
+	// the shape is still used by the route not clipped
+	if feed.Trips["t3"].Shape != feed.Shapes["sh1"] {
+		t.Errorf("shape of t3 changed")
+	}
+
+	if _, err := ParseStopRanges(feed, "Omega", ""); err == nil {
+		t.Errorf("expected an error for an unknown stop")
+	}
+}
+
+func TestWriteRouteShapesHeadsign(t *testing.T) {
+	feed := testfeed.New().
+		Stop("A", "Alpha", 50.0, 8.0).
+		Stop("B", "Beta", 50.0, 8.01).
+		Route("r1", "1", 3).
+		Calendar("wd", "1111100", "20240101", "20240107").
+		Shape("sh1", [2]float64{50.0, 8.0}, [2]float64{50.0, 8.01}).
+		Trip("t1", "r1", "wd", "sh1", testfeed.At("A", "08:00:00"), testfeed.At("B", "08:05:00")).
+		Set("trips.txt", "t1", "trip_headsign", "Depot").
+		Trip("t2", "r1", "wd", "sh1", testfeed.At("A", "09:00:00"), testfeed.At("B", "09:05:00")).
+		Set("trips.txt", "t2", "trip_headsign", "Beta").
+		Trip("t3", "r1", "wd", "sh1", testfeed.At("A", "10:00:00"), testfeed.At("B", "10:05:00")).
+		Set("trips.txt", "t3", "trip_headsign", "Beta").
+		Feed(t)
+
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+	sw.WriteRouteShapes(feed, map[int16]string{}, nil, out)
+
+	rows := readLayer(t, out)
+	if len(rows) != 1 || rows[0]["Headsign"] != "Beta" {
+		t.Errorf("unexpected route shapes %v", rows)
+	}
+
+	sw, out = fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+	sw.WriteShapes(feed, out)
+
+	rows = readLayer(t, out)
+	if len(rows) != 1 || rows[0]["Headsign"] != "Beta" {
+		t.Errorf("unexpected shapes %v", rows)
+	}
+}
+
+func TestWriteMetadata(t *testing.T) {
+	feed := fixtureFeed(t)
+	feed.FeedInfos = append(feed.FeedInfos, &gtfs.FeedInfo{Publisher_name: "Test Publisher", Version: "2024-01"})
+
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+	sw.WriteRouteShapes(feed, map[int16]string{}, nil, out)
+	sw.WriteMetadata(feed, "-r")
+
+	data, err := os.ReadFile(out + ".xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var meta fgdcMetadata
+	if err := xml.Unmarshal(data, &meta); err != nil {
+		t.Fatal(err)
+	}
+
+	if meta.Origin != "Test Publisher" || meta.Edition != "2024-01" || meta.ProcDesc != "gtfs2shp -r" {
+		t.Errorf("unexpected citation %+v", meta)
+	}
+
+	if meta.PtvctCnt != 1 || meta.Bounding == nil || math.Abs(meta.Bounding.West-8.0) > 1e-6 {
+		t.Errorf("unexpected layer statistics %+v", meta)
+	}
+
+	if len(meta.Attrs) == 0 || meta.Attrs[0].Label != "Route_id" {
+		t.Errorf("unexpected attributes %v", meta.Attrs)
+	}
+}
+
+func TestWriteRouteShapesMOTFilter(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, out := fixtureWriter(t, map[int16]bool{0: true}, WriteOptions{})
+
+	// the tram route has no shape
+	if n := sw.WriteRouteShapes(feed, map[int16]string{}, nil, out); n != 0 {
+		t.Errorf("wrote %d route shapes, want 0", n)
+	}
+}
+
+func TestWriteTripsExplicit(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+
+	if n := sw.WriteTripsExplicit(feed, out); n != 3 {
+		t.Fatalf("wrote %d trips, want 3", n)
+	}
+
+	rows := readLayer(t, out)
+
+	t1 := rowsWith(rows, "Id", "t1")
+	if len(t1) != 1 {
+		t.Fatalf("found %d rows for t1, want 1", len(t1))
+	}
+	if t1[0]["First_dep"] != "08:00:00" || t1[0]["Dep_sec"] != "28800" || t1[0]["Geom_src"] != "shape" || t1[0]["Mon"] != "1" || t1[0]["Sat"] != "0" {
+		t.Errorf("unexpected attributes %v", t1[0])
+	}
+	if t1[0]["Service_id"] != "wd" || t1[0]["Days"] != "Mo-Fr" {
+		t.Errorf("unexpected service attributes %v", t1[0])
+	}
+	if r := parseFloat(t, t1[0]["Runtime"]); r != 10 {
+		t.Errorf("got runtime %f, want 10", r)
+	}
+
+	t3 := rowsWith(rows, "Id", "t3")
+	if len(t3) != 1 || t3[0]["Geom_src"] != "straight" {
+		t.Errorf("unexpected attributes %v", t3)
+	}
+}
+
+func TestTripBatches(t *testing.T) {
+	feed := fixtureFeed(t)
+
+	sw, _ := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+	if batches := sw.tripBatches(feed.Trips); len(batches) != 1 || len(batches[0]) != 3 {
+		t.Errorf("got %d batches without a memory limit, want 1", len(batches))
+	}
+
+	// under a memory limit, trips sharing a shape form a batch
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{MaxMem: 1 << 40})
+
+	batches := sw.tripBatches(feed.Trips)
+	if len(batches) != 2 || len(batches[0]) != 1 || batches[0][0].Id != "t3" || len(batches[1]) != 2 || batches[1][0].Id != "t1" || batches[1][1].Id != "t2" {
+		t.Fatalf("unexpected batches %v", batches)
+	}
+
+	if n := sw.WriteTripsExplicit(feed, out); n != 3 {
+		t.Fatalf("wrote %d trips, want 3", n)
+	}
+
+	rows := readLayer(t, out)
+	if len(rows) != 3 || rows[0]["Id"] != "t3" || rows[1]["Id"] != "t1" || rows[2]["Id"] != "t2" {
+		t.Errorf("unexpected trips %v", rows)
+	}
+	if rows[1]["Km"] == "" || rows[1]["Km"] != rows[2]["Km"] {
+		t.Errorf("trips of a batch have different lengths %s and %s", rows[1]["Km"], rows[2]["Km"])
+	}
+}
+
+func TestWriteTripsExplicitSharedGeoms(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{SharedTripGeoms: true})
+
+	sw.WriteTripsExplicit(feed, out)
+
+	rows := readLayer(t, out)
+	geoms := readLayer(t, sw.getOutFileName(out, ".tripgeoms.shp"))
+
+	// t1 and t2 share their geometry
+	if len(geoms) != 2 {
+		t.Fatalf("wrote %d trip geometries, want 2", len(geoms))
+	}
+
+	t1 := rowsWith(rows, "Id", "t1")
+	t2 := rowsWith(rows, "Id", "t2")
+	if len(t1) != 1 || len(t2) != 1 || t1[0]["Geom_id"] != t2[0]["Geom_id"] {
+		t.Errorf("t1 and t2 do not share their geometry: %v %v", t1, t2)
+	}
+}
+
+func TestHandleMissingStops(t *testing.T) {
+	build := func() *gtfsparser.Feed {
+		feed := testfeed.New().
+			Stop("A", "Alpha", 50.0, 8.0).
+			Stop("B", "Beta", 50.0, 8.01).
+			Stop("C", "Gamma", 50.0, 8.02).
+			Stop("D", "Delta", 50.0, 8.03).
+			Route("r1", "1", 3).
+			Calendar("wd", "1000000", "20240101", "20240101").
+			Trip("t1", "r1", "wd", "", testfeed.At("A", "06:00:00"), testfeed.At("B", "06:05:00"),
+				testfeed.At("C", "06:10:00"), testfeed.At("D", "06:15:00")).
+			Feed(t)
+
+		// a stop time whose stop was dropped while parsing, between B and C
+		trip := feed.Trips["t1"]
+		sts := append(gtfs.StopTimes{}, trip.StopTimes[:2]...)
+		sts = append(sts, gtfs.StopTime{})
+		trip.StopTimes = append(sts, trip.StopTimes[2:]...)
+
+		return feed
+	}
+
+	for _, tc := range []struct {
+		policy MissingStopPolicy
+		trips  int
+		parts  int
+	}{
+		{MissingStopsSkip, 1, 1},
+		{MissingStopsBreak, 1, 2},
+		{MissingStopsDrop, 0, 0},
+	} {
+		feed := build()
+		sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{MissingStops: tc.policy})
+
+		stats := sw.HandleMissingStops(feed)
+		if stats.StopTimes != 1 || stats.Trips != 1 {
+			t.Errorf("policy %d: got stats %+v", tc.policy, stats)
+		}
+
+		if n := sw.WriteTripsExplicit(feed, out); n != tc.trips {
+			t.Fatalf("policy %d: wrote %d trips, want %d", tc.policy, n, tc.trips)
+		}
+
+		if tc.trips == 0 {
+			continue
+		}
+
+		r, err := shp.Open(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Next()
+		_, geom := r.Shape()
+		r.Close()
+
+		if line, ok := geom.(*shp.PolyLine); !ok || int(line.NumParts) != tc.parts {
+			t.Errorf("policy %d: got geometry %v, want %d parts", tc.policy, geom, tc.parts)
+		}
+
+		if tc.policy == MissingStopsBreak && sw.missingStops.Breaks != 1 {
+			t.Errorf("counted %d breaks, want 1", sw.missingStops.Breaks)
+		}
+
+		// other stop-based layers do not count the breaks again
+		sw.WriteStopChains(feed, out)
+		if tc.policy == MissingStopsBreak && sw.missingStops.Breaks != 1 {
+			t.Errorf("counted %d breaks after writing stop chains, want 1", sw.missingStops.Breaks)
+		}
+	}
+}
+
+func TestClipToStopRangesMissingStops(t *testing.T) {
+	feed := testfeed.New().
+		Stop("A", "Alpha", 50.0, 8.0).
+		Stop("B", "Beta", 50.0, 8.01).
+		Stop("C", "Gamma", 50.0, 8.02).
+		Stop("D", "Delta", 50.0, 8.03).
+		Stop("E", "Epsilon", 50.0, 8.04).
+		Route("r1", "1", 3).
+		Calendar("wd", "1000000", "20240101", "20240101").
+		Trip("t1", "r1", "wd", "", testfeed.At("A", "06:00:00"), testfeed.At("B", "06:05:00"),
+			testfeed.At("C", "06:10:00"), testfeed.At("D", "06:15:00"), testfeed.At("E", "06:20:00")).
+		Feed(t)
+
+	// a stop time whose stop was dropped while parsing, between C and D
+	trip := feed.Trips["t1"]
+	sts := append(gtfs.StopTimes{}, trip.StopTimes[:3]...)
+	sts = append(sts, gtfs.StopTime{})
+	trip.StopTimes = append(sts, trip.StopTimes[3:]...)
+
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{MissingStops: MissingStopsBreak})
+	sw.HandleMissingStops(feed)
+
+	ranges, err := ParseStopRanges(feed, "B", "E")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sw.ClipToStopRanges(feed, ranges)
+
+	if n := sw.WriteTripsExplicit(feed, out); n != 1 {
+		t.Fatalf("wrote %d trips, want 1", n)
+	}
+
+	r, err := shp.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Next()
+	_, geom := r.Shape()
+	r.Close()
+
+	// the line breaks between C and D, not between D and E
+	line, ok := geom.(*shp.PolyLine)
+	if !ok || line.NumParts != 2 || line.Parts[1] != 2 {
+		t.Errorf("got geometry %v, want parts B-C and D-E", geom)
+	}
+}
+
+func TestWriteTripsExplicitRepresentative(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{RepresentativeTrips: true})
+
+	if n := sw.WriteTripsExplicit(feed, out); n != 2 {
+		t.Fatalf("wrote %d trips, want 2", n)
+	}
+
+	rows := rowsWith(readLayer(t, out), "Id", "t1")
+	if len(rows) != 1 || rows[0]["Num_trips"] != "2" {
+		t.Errorf("unexpected attributes %v", rows)
+	}
+}
+
+func TestWriteTripsExplicitWhere(t *testing.T) {
+	feed := fixtureFeed(t)
+
+	where, err := ParseWhere("R_Type = 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{Where: where})
+	sw.WriteTripsExplicit(feed, out)
+
+	rows := readLayer(t, out)
+	if len(rows) != 1 || rows[0]["Id"] != "t3" {
+		t.Errorf("unexpected rows %v", rows)
+	}
+}
+
+func TestParseWhere(t *testing.T) {
+	var color *string
+	attrs := map[string]interface{}{
+		"r_type":     int16(3),
+		"frequency":  60,
+		"short_name": "10",
+		"name":       "Main Line",
+		"color":      color,
+	}
+	get := func(name string) interface{} { return attrs[name] }
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		// AND binds tighter than OR
+		{"R_Type = 3 OR R_Type = 0 AND Frequency > 100", true},
+		{"R_Type = 0 AND Frequency > 100 OR R_Type = 3", true},
+		{"(R_Type = 3 OR R_Type = 0) AND Frequency > 100", false},
+		{"R_Type = 3 AND (Frequency > 100 OR Name = 'Main Line')", true},
+		{"((R_Type = 3))", true},
+		{"NOT R_Type = 0 AND Frequency >= 60", true},
+		{"NOT (R_Type = 3 OR R_Type = 0)", false},
+
+		// IN lists
+		{"R_Type IN (0, 1, 3)", true},
+		{"R_Type IN (0,1)", false},
+		{"R_Type NOT IN (0, 1, 3)", false},
+		{"Name IN ('Main Line', \"Side Line\")", true},
+		{"Name IN ('main line')", false},
+		{"Short_name IN (10)", true},
+
+		// numbers compare numerically, also as numeric strings
+		{"Short_name > 9", true},
+		{"Short_name > '9'", true},
+		{"Frequency = '60'", true},
+		{"Frequency = 6e1", true},
+		{"Frequency <> 60.0", false},
+		{"Frequency != 61", true},
+		{"Frequency == 60", true},
+		{"Frequency < -1", false},
+
+		// other values compare as strings
+		{"Name > 'M'", true},
+		{"Name > 10", true},
+		{"Name < 10", false},
+		{"Name = 'Main Line'", true},
+
+		// NULL never compares
+		{"Color IS NULL", true},
+		{"Color IS NOT NULL", false},
+		{"Color = NULL", false},
+		{"Color IN ('red')", false},
+		{"Missing IS NULL", true},
+
+		// patterns
+		{"Name LIKE 'main%'", true},
+		{"Name LIKE 'Main_Line'", true},
+		{"Name NOT LIKE '%line'", false},
+		{"Name ~ '^Main'", true},
+		{"Name !~ 'Line$'", false},
+		{"Color LIKE '%'", false},
+	}
+
+	for _, test := range tests {
+		w, err := ParseWhere(test.expr)
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		if got := w.Match(get); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.expr, got, test.want)
+		}
+	}
+
+	w, err := ParseWhere("R_Type = 3 AND frequency > 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.appliesTo(map[string]int{"r_type": 0, "frequency": 1}) || w.appliesTo(map[string]int{"r_type": 0}) {
+		t.Errorf("unexpected referenced fields %v", w.fields)
+	}
+}
+
+func TestParseWhereErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"R_Type = 'bus", "unterminated string in filter expression"},
+		{"R_Type # 3", "unexpected character '#' in filter expression"},
+		{"(R_Type = 3", "missing ) in filter expression"},
+		{"R_Type = 3)", "unexpected ')' in filter expression"},
+		{"R_Type = 3 3", "unexpected '3' in filter expression"},
+		{"= 3", "unexpected '=' in filter expression"},
+		{"R_Type =", "unexpected end of filter expression"},
+		{"", "unexpected end of filter expression"},
+		{"R_Type = 3 AND", "unexpected end of filter expression"},
+		{"R_Type = 1.2.3", "invalid number '1.2.3' in filter expression"},
+		{"R_Type IN 3", "expected ( after IN in filter expression"},
+		{"R_Type IN (1 2)", "expected , or ) in IN list of filter expression"},
+		{"R_Type IN (1,", "unexpected end of filter expression"},
+		{"R_Type NOT 3", "expected IN or LIKE after NOT in filter expression"},
+		{"Color IS 3", "expected NULL after IS in filter expression"},
+		{"Name LIKE 3", "expected string after LIKE in filter expression"},
+		{"Name ~ Name", "expected string after ~ in filter expression"},
+		{"Name ~ '('", "invalid regular expression '(' in filter expression"},
+	}
+
+	for _, test := range tests {
+		if _, err := ParseWhere(test.expr); err == nil || err.Error() != test.err {
+			t.Errorf("%s: got error %v, want %s", test.expr, err, test.err)
+		}
+	}
+}
+
+func TestWriteStops(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+
+	if n := sw.WriteStops(feed, out); n != 4 {
+		t.Fatalf("wrote %d stops, want 4", n)
+	}
+
+	rows := readLayer(t, sw.getShapeFileNameStations(out))
+
+	a := rowsWith(rows, "Id", "A")
+	if len(a) != 1 || a[0]["Parent_stat"] != "S" || a[0]["Loc_name"] != "stop" {
+		t.Errorf("unexpected attributes %v", a)
+	}
+}
+
+func TestAround(t *testing.T) {
+	feed := testfeed.New().
+		Stop("A", "Alpha", 50.0, 8.0).
+		Stop("B", "Beta", 50.0, 8.01).
+		Stop("C", "Gamma", 50.0, 8.02).
+		Route("r1", "1", 3).
+		Route("r2", "2", 3).
+		Calendar("wd", "1111100", "20240101", "20240107").
+		Shape("sh1", [2]float64{50.0, 8.0}, [2]float64{50.0, 8.01}, [2]float64{50.0, 8.02}).
+		Trip("t1", "r1", "wd", "sh1", testfeed.At("A", "08:00:00"), testfeed.At("C", "08:10:00")).
+		Trip("t2", "r2", "wd", "", testfeed.At("A", "09:00:00"), testfeed.At("B", "09:05:00")).
+		Feed(t)
+
+	// about 70 m east of C
+	around := &Circle{Lat: 50.0, Lon: 8.021, Radius: 100}
+
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{Around: around})
+	if n := sw.WriteStops(feed, out); n != 1 {
+		t.Fatalf("wrote %d stops, want 1", n)
+	}
+	if rows := readLayer(t, sw.getShapeFileNameStations(out)); rows[0]["Id"] != "C" {
+		t.Errorf("unexpected stop %v", rows[0])
+	}
+
+	// the shapeless trip of route 2 ends at B
+	if n := FilterTripsAround(feed, around); n != 1 || feed.Trips["t1"] == nil {
+		t.Errorf("removed %d trips, remaining %v", n, feed.Trips)
+	}
+}
+
+func TestWriteStopsTransfers(t *testing.T) {
+	feed := fixtureFeed(t)
+	feed.Transfers[gtfs.TransferKey{From_stop: feed.Stops["A"], To_stop: feed.Stops["B"]}] = gtfs.TransferVal{Transfer_type: 2, Min_transfer_time: 120}
+	feed.Transfers[gtfs.TransferKey{From_stop: feed.Stops["A"], To_stop: feed.Stops["C"]}] = gtfs.TransferVal{Transfer_type: 2, Min_transfer_time: 180}
+
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+	sw.WriteStops(feed, out)
+
+	rows := readLayer(t, sw.getShapeFileNameStations(out))
+
+	// the station counts the transfers of its child stop A
+	for id, want := range map[string]string{"A": "2", "B": "1", "S": "2"} {
+		row := rowsWith(rows, "Id", id)[0]
+		if row["Transfers"] != want || row["Has_transf"] != "1" || row["Pathways"] != "0" {
+			t.Errorf("unexpected attributes of %s: %v", id, row)
+		}
+	}
+}
+
+func TestWriteStopsGroups(t *testing.T) {
+	feed := fixtureFeed(t)
+	feed.Pathways["p1"] = &gtfs.Pathway{Id: "p1", From_stop: feed.Stops["S"], To_stop: feed.Stops["B"]}
+
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+	sw.WriteStops(feed, out)
+
+	rows := readLayer(t, sw.getShapeFileNameStations(out))
+
+	// A belongs to station S, which is connected to B by a pathway
+	for id, want := range map[string]string{"A": "B", "B": "B", "S": "B", "C": "C"} {
+		if row := rowsWith(rows, "Id", id)[0]; row["Group_id"] != want {
+			t.Errorf("group of %s is %s, want %s", id, row["Group_id"], want)
+		}
+	}
+}
+
+func TestWriteStopsAccessibility(t *testing.T) {
+	feed := fixtureFeed(t)
+	feed.Trips["t1"].Wheelchair_accessible = 1
+	feed.Trips["t2"].Bikes_allowed = 1
+
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+	sw.WriteStops(feed, out)
+
+	rows := readLayer(t, sw.getShapeFileNameStations(out))
+
+	// B is served by t1 and t2 on 5 days, A and C also by t3
+	for id, want := range map[string][3]float64{"A": {15, 1.0 / 3, 1.0 / 3}, "B": {10, 0.5, 0.5}, "S": {15, 1.0 / 3, 1.0 / 3}} {
+		row := rowsWith(rows, "Id", id)[0]
+		if parseFloat(t, row["Frequency"]) != want[0] || math.Abs(parseFloat(t, row["Wchair_tr"])-want[1]) > 1e-6 || math.Abs(parseFloat(t, row["Bikes_tr"])-want[2]) > 1e-6 {
+			t.Errorf("unexpected attributes of %s: %v", id, row)
+		}
+	}
+}
+
+func TestWriteStopsNameLanguages(t *testing.T) {
+	feed := testfeed.New().
+		Stop("A", "Bahnhof", 46.5, 7.4).
+		Stop("B", "Marktplatz", 46.5, 7.41).
+		Route("r1", "1", 3).
+		Calendar("wd", "1111100", "20240101", "20240107").
+		Trip("t1", "r1", "wd", "", testfeed.At("A", "08:00:00"), testfeed.At("B", "08:05:00")).
+		Add("translations.txt", map[string]string{"table_name": "stops", "field_name": "stop_name", "language": "fr", "translation": "Gare", "record_id": "A"}).
+		Feed(t)
+
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{StopNameLangs: []string{"fr"}})
+	sw.WriteStops(feed, out)
+
+	rows := readLayer(t, sw.getShapeFileNameStations(out))
+	if len(rows) != 2 {
+		t.Fatalf("read %d stops, want 2", len(rows))
+	}
+
+	for _, row := range rows {
+		want := map[string]string{"A": "Gare", "B": ""}[row["Id"]]
+		if row["Name_fr"] != want {
+			t.Errorf("got French name %q of stop %s, want %q", row["Name_fr"], row["Id"], want)
+		}
+	}
+}
+
+func TestWriteStopsMOTFilter(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, out := fixtureWriter(t, map[int16]bool{0: true}, WriteOptions{})
+
+	// the tram stops and the station of A
+	if n := sw.WriteStops(feed, out); n != 3 {
+		t.Errorf("wrote %d stops, want 3", n)
+	}
+
+	if rows := rowsWith(readLayer(t, sw.getShapeFileNameStations(out)), "Id", "B"); len(rows) != 0 {
+		t.Errorf("stop B is not served by trams")
+	}
+}
+
+func TestWriteStopsCsv(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+
+	if n := sw.WriteStopsCsv(feed, out); n != 4 {
+		t.Fatalf("wrote %d stops, want 4", n)
+	}
+
+	recs := readCsv(t, sw.getOutFileName(out, ".stations.csv"))
+	if len(recs) != 5 || recs[0][0] != "Id" {
+		t.Errorf("unexpected CSV %v", recs)
+	}
+}
+
+func TestWriteRouteOverviewCsv(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+
+	sw.WriteRouteOverviewCsv(feed, map[int16]string{}, nil, out)
+
+	recs := readCsv(t, sw.getCsvFileName(out))
+
+	// only routes with shapes are listed
+	if len(recs) != 2 {
+		t.Fatalf("got %d CSV records, want 2", len(recs))
+	}
+
+	row := make(map[string]string)
+	for i, header := range recs[0] {
+		row[header] = recs[1][i]
+	}
+
+	if row["Route_id"] != "r1" || row["Frequency"] != "10" || row["Agency_id"] != "agency" {
+		t.Errorf("unexpected route overview %v", row)
+	}
+}
+
+func TestWriteRouteOverviewCsvTotals(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{OverviewTotals: true})
+
+	sw.WriteRouteOverviewCsv(feed, map[int16]string{}, nil, out)
+
+	recs := readCsv(t, sw.getCsvFileName(out))
+	if len(recs) != 4 {
+		t.Fatalf("got %d CSV records, want 4", len(recs))
+	}
+
+	// r1 runs 10 trips on 5 service days, in both the route and the
+	// summary rows
+	for _, rec := range recs[1:] {
+		row := make(map[string]string)
+		for i, header := range recs[0] {
+			row[header] = rec[i]
+		}
+
+		if row["Frequency"] != "10" || parseFloat(t, row["Trips_day"]) != 2 || row["Num_routes"] != "1" {
+			t.Errorf("unexpected row %v", row)
+		}
+	}
+}
+
+func TestWriteRouteOverviewCsvNoAgency(t *testing.T) {
+	feed := fixtureFeed(t)
+	feed.Routes["r1"].Agency = nil
+
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+
+	sw.WriteRouteShapes(feed, map[int16]string{}, nil, out)
+	sw.WriteRouteOverviewCsv(feed, map[int16]string{}, nil, out)
+
+	recs := readCsv(t, sw.getCsvFileName(out))
+	for i, header := range recs[0] {
+		if strings.HasPrefix(header, "Agency_") && recs[1][i] != "" {
+			t.Errorf("got %s %q for a route without an agency", header, recs[1][i])
+		}
+	}
+}
+
+func TestWriteRouteOverviewCsvBoundary(t *testing.T) {
+	// r3 only uses the first half of sh1
+	feed := testfeed.New().
+		Stop("A", "Alpha", 50.0, 8.0).
+		Stop("B", "Beta", 50.0, 8.01).
+		Stop("C", "Gamma", 50.0, 8.02).
+		Route("r1", "1", 3).
+		Route("r3", "3", 3).
+		Calendar("wd", "1111100", "20240101", "20240107").
+		Shape("sh1", [2]float64{50.0, 8.0}, [2]float64{50.0, 8.01}, [2]float64{50.0, 8.02}).
+		Trip("t1", "r1", "wd", "sh1",
+			testfeed.StopTime{Stop: "A", Arr: "08:00:00", Dep: "08:00:00", Dist: "0"},
+			testfeed.StopTime{Stop: "C", Arr: "08:10:00", Dep: "08:10:00", Dist: "2"}).
+		Trip("t4", "r3", "wd", "sh1",
+			testfeed.StopTime{Stop: "A", Arr: "09:00:00", Dep: "09:00:00", Dist: "0"},
+			testfeed.StopTime{Stop: "B", Arr: "09:05:00", Dep: "09:05:00", Dist: "1"}).
+		Feed(t)
+
+	// the boundary contains the first quarter of sh1
+	boundary := NewBoundary([][][2]float64{{{7.99, 49.99}, {8.005, 49.99}, {8.005, 50.01}, {7.99, 50.01}, {7.99, 49.99}}})
+
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{Boundary: boundary})
+
+	sw.WriteRouteOverviewCsv(feed, map[int16]string{}, nil, out)
+
+	recs := readCsv(t, sw.getCsvFileName(out))
+
+	want := map[string]float64{"r1": 0.25, "r3": 0.5}
+
+	for _, rec := range recs[1:] {
+		row := make(map[string]string)
+		for i, header := range recs[0] {
+			row[header] = rec[i]
+		}
+
+		in := parseFloat(t, row["Km_in"])
+		share := in / (in + parseFloat(t, row["Km_out"]))
+		if math.Abs(share-want[row["Route_id"]]) > 0.01 {
+			t.Errorf("got share %f within the boundary for route %s, want %f", share, row["Route_id"], want[row["Route_id"]])
+		}
+	}
+}
+
+func TestMissingValues(t *testing.T) {
+	for _, tc := range []struct {
+		policy MissingValuePolicy
+		want   string
+	}{
+		{MissingNaN, ""},
+		{MissingEmpty, ""},
+		{MissingMinusOne, "-1"},
+	} {
+		feed := fixtureFeed(t)
+		feed.Shapes["sh1"].Points[1].Dist_traveled = float32(math.NaN())
+
+		sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{MissingValues: tc.policy})
+		sw.WriteShapePoints(feed, out)
+
+		rows := readLayer(t, sw.getShapeFileNameShapePoints(out))
+		if len(rows) != 3 || rows[0]["Dist"] == "" {
+			t.Fatalf("unexpected shape points %v", rows)
+		}
+
+		// points without a distance are written as before by default
+		if d := strings.TrimSpace(rows[1]["Dist"]); (tc.want == "" && d != "") || !strings.HasPrefix(d, tc.want) {
+			t.Errorf("policy %d: got distance %q, want %q", tc.policy, d, tc.want)
+		}
+	}
+}
+
+func TestWriteCalendarCsv(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+
+	sw.WriteCalendarCsv(feed, out)
+
+	recs := readCsv(t, sw.getOutFileName(out, ".calendar.csv"))
+
+	// header and monday to friday
+	if len(recs) != 6 {
+		t.Fatalf("got %d CSV records, want 6", len(recs))
+	}
+	if recs[1][0] != "2024-01-01" || recs[5][0] != "2024-01-05" {
+		t.Errorf("unexpected dates %v", recs)
+	}
+}
+
+func TestWriteHourlyCsv(t *testing.T) {
+	feed := testfeed.New().
+		Stop("A", "Alpha", 50.0, 8.0).
+		Stop("C", "Gamma", 50.0, 8.02).
+		Route("r1", "1", 3).
+		Route("r2", "2", 0).
+		Calendar("wd", "1111100", "20240101", "20240107").
+		Trip("t1", "r1", "wd", "", testfeed.At("A", "08:00:00"), testfeed.At("C", "08:10:00")).
+		Trip("t2", "r1", "wd", "", testfeed.At("A", "08:30:00"), testfeed.At("C", "08:40:00")).
+		Trip("t3", "r2", "wd", "", testfeed.At("A", "24:30:00"), testfeed.At("C", "24:42:00")).
+		Feed(t)
+
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+
+	// tuesday, after the monday trip of route 2 departing after midnight
+	sw.WriteHourlyCsv(feed, gtfs.NewDate(2, 1, 2024), out)
+
+	recs := readCsv(t, sw.getOutFileName(out, ".hourly.csv"))
+	if len(recs) != 3 || len(recs[0]) != 26 || recs[0][2] != "00" || recs[0][25] != "23" {
+		t.Fatalf("unexpected CSV %v", recs)
+	}
+
+	// two trips of route 1 between 8 and 9
+	if recs[1][0] != "r1" || recs[1][10] != "2" {
+		t.Errorf("unexpected route 1 departures %v", recs[1])
+	}
+	if recs[2][0] != "r2" || recs[2][2] != "1" || strings.Count(strings.Join(recs[2][2:], ","), "1") != 1 {
+		t.Errorf("unexpected route 2 departures %v", recs[2])
+	}
+}
+
+func TestWriteStopChains(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+
+	if n := sw.WriteStopChains(feed, out); n != 2 {
+		t.Fatalf("wrote %d stop chains, want 2", n)
+	}
+
+	rows := readLayer(t, sw.getOutFileName(out, ".stopchains.shp"))
+
+	// both trips of route 1 follow the same pattern
+	if r := rows[0]; r["Route_id"] != "r1" || r["Trip_id"] != "t1" || r["Num_stops"] != "3" || r["Num_trips"] != "2" || r["Frequency"] != "10" {
+		t.Errorf("unexpected attributes %v", r)
+	}
+
+	// route 2 has no shape, but a stop chain
+	if r := rows[1]; r["Route_id"] != "r2" || r["From_stop"] != "A" || r["To_stop"] != "C" {
+		t.Errorf("unexpected attributes %v", r)
+	}
+
+	length := 0.02 * metersPerDeg * math.Cos(50*DEG_TO_RAD) / 1000
+	if l := parseFloat(t, rows[1]["Km"]); math.Abs(l-length) > 0.01 {
+		t.Errorf("got length %f km, want %f km", l, length)
+	}
+}
+
+func TestWriteInterlines(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+
+	if n := sw.WriteInterlines(feed, out); n != 1 {
+		t.Fatalf("wrote %d interlines, want 1", n)
+	}
+
+	rows := readLayer(t, sw.getOutFileName(out, ".interlines.shp"))
+	row := rows[0]
+
+	if row["From_trip"] != "t1" || row["To_trip"] != "t2" || row["From_stop"] != "C" || row["To_stop"] != "A" || row["Interline"] != "0" {
+		t.Errorf("unexpected attributes %v", row)
+	}
+	if l := parseFloat(t, row["Layover"]); l != 20 {
+		t.Errorf("got layover %f, want 20", l)
+	}
+}
+
+func TestWriteBuffers(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{BufferWidths: map[int16]float64{3: 200}})
+
+	if n := sw.WriteBuffers(feed, out); n != 1 {
+		t.Fatalf("wrote %d buffers, want 1", n)
+	}
+
+	rows := readLayer(t, sw.getOutFileName(out, ".buffers.shp"))
+	row := rows[0]
+
+	if row["Route_id"] != "r1" || row["R_Type"] != "3" {
+		t.Errorf("unexpected attributes %v", row)
+	}
+
+	// a straight line buffer is a rectangle with two half circles
+	length := 0.02 * metersPerDeg * math.Cos(50*DEG_TO_RAD)
+	want := (2*200*length + math.Pi*200*200) / 1e6
+	if a := parseFloat(t, row["Km2"]); math.Abs(a-want) > want*0.02 {
+		t.Errorf("got area %f km2, want %f km2", a, want)
+	}
+}
+
+func TestWriteCorridors(t *testing.T) {
+	// route 2 runs about 5 m beside route 1 for the first half, then
+	// turns north
+	feed := testfeed.New().
+		Stop("A", "Alpha", 50.0, 8.0).
+		Stop("C", "Gamma", 50.0, 8.02).
+		Stop("D", "Delta", 50.01, 8.01).
+		Route("r1", "1", 3).
+		Route("r2", "2", 3).
+		Calendar("wd", "1111100", "20240101", "20240107").
+		Shape("sh1", [2]float64{50.0, 8.0}, [2]float64{50.0, 8.01}, [2]float64{50.0, 8.02}).
+		Shape("sh2", [2]float64{50.00005, 8.0}, [2]float64{50.00005, 8.01}, [2]float64{50.01, 8.01}).
+		Trip("t1", "r1", "wd", "sh1", testfeed.At("A", "08:00:00"), testfeed.At("C", "08:10:00")).
+		Trip("t2", "r1", "wd", "sh1", testfeed.At("A", "08:30:00"), testfeed.At("C", "08:40:00")).
+		Trip("t3", "r2", "wd", "sh2", testfeed.At("A", "09:00:00"), testfeed.At("D", "09:10:00")).
+		Feed(t)
+
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{CorridorTolerance: 20})
+
+	if n := sw.WriteCorridors(feed, out); n != 3 {
+		t.Fatalf("wrote %d corridors, want 3", n)
+	}
+
+	rows := rowsWith(readLayer(t, sw.getOutFileName(out, ".corridors.shp")), "Num_routes", "2")
+	if len(rows) != 1 {
+		t.Fatalf("got %d shared corridors, want 1", len(rows))
+	}
+
+	if rows[0]["RouteIds"] != "r1,r2" || rows[0]["Frequency"] != "15" {
+		t.Errorf("unexpected attributes %v", rows[0])
+	}
+
+	length := 0.01 * metersPerDeg * math.Cos(50*DEG_TO_RAD) / 1000
+	if l := parseFloat(t, rows[0]["Km_len"]); math.Abs(l-length) > 0.02 {
+		t.Errorf("got length %f km, want %f km", l, length)
+	}
+}
+
+func TestWriteStyle(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+
+	sw.WriteStyle(feed, "https://example.com/out.geojson", out)
+
+	data, err := os.ReadFile(sw.getOutFileName(out, ".style.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var style struct {
+		Version int
+		Sources map[string]struct {
+			Type string
+			Data string
+		}
+		Layers []struct {
+			ID    string
+			Paint map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal(data, &style); err != nil {
+		t.Fatal(err)
+	}
+
+	if style.Version != 8 || style.Sources["gtfs"].Type != "geojson" || style.Sources["gtfs"].Data != "https://example.com/out.geojson" {
+		t.Errorf("unexpected style %s", data)
+	}
+
+	// the bus route has no color of its own
+	color, _ := style.Layers[1].Paint["line-color"].([]interface{})
+	if len(color) != 5 || color[2] != "r1" || color[3] != defaultStyleColor {
+		t.Errorf("unexpected line color %v", style.Layers[1].Paint["line-color"])
+	}
+}
+
+func TestWriteLabelPoints(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+
+	if n := sw.WriteLabelPoints(feed, out); n != 1 {
+		t.Fatalf("wrote %d labels, want 1", n)
+	}
+
+	r, err := shp.Open(sw.getOutFileName(out, ".labels.shp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	r.Next()
+	_, s := r.Shape()
+	p := s.(*shp.Point)
+
+	// halfway along the shape, at stop B
+	if math.Abs(p.X-8.01) > 1e-6 || math.Abs(p.Y-50.0) > 1e-6 {
+		t.Errorf("got label at %f,%f, want 8.01,50", p.X, p.Y)
+	}
+}
+
+func TestServiceDaysText(t *testing.T) {
+	tests := []struct {
+		weekdays [7]bool // sunday first
+		holiday  bool
+		want     string
+	}{
+		{[7]bool{false, true, true, true, true, true, false}, false, "Mo-Fr"},
+		{[7]bool{true, false, false, false, false, false, true}, true, "Sa,Su+holidays"},
+		{[7]bool{true, true, true, true, true, true, true}, false, "Mo-Su"},
+		{[7]bool{false, true, true, false, true, false, false}, false, "Mo,Tu,Th"},
+		{[7]bool{true, true, false, true, true, true, false}, false, "Mo,We-Fr,Su"},
+		{[7]bool{}, false, ""},
+	}
+
+	for _, test := range tests {
+		days := serviceDays{weekdays: test.weekdays, holiday: test.holiday}
+		if got := days.text(); got != test.want {
+			t.Errorf("got %q for %v, want %q", got, test.weekdays, test.want)
+		}
+	}
+}
+
+func TestFilterTrips(t *testing.T) {
+	feed := fixtureFeed(t)
+
+	w, err := ParseTripFilter(`trip_id ~ "^t[12]$" AND route_short_name = '1'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := FilterTrips(feed, w); n != 1 {
+		t.Errorf("removed %d trips, want 1", n)
+	}
+	if _, ok := feed.Trips["t3"]; ok || len(feed.Trips) != 2 {
+		t.Errorf("unexpected trips %v", feed.Trips)
+	}
+
+	if _, err := ParseTripFilter(`Frequency > 3`); err == nil {
+		t.Error("accepted unknown trip attribute")
+	}
+	if _, err := ParseTripFilter(`headsign ~ "("`); err == nil {
+		t.Error("accepted invalid regular expression")
+	}
+}
+
+func TestWriteModeShareCsv(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+
+	sw.WriteModeShareCsv(feed, map[int16]string{3: "Bus"}, out)
+
+	recs := readCsv(t, sw.getOutFileName(out, ".modeshare.csv"))
+
+	// the tram route has no shape, all km are bus km
+	if len(recs) != 4 {
+		t.Fatalf("read %d lines, want 4", len(recs))
+	}
+	if recs[1][0] != "*" || recs[1][2] != "Bus" || recs[2][0] != "agency" || recs[3][2] != "*" {
+		t.Errorf("unexpected rows %v", recs)
+	}
+	if s := parseFloat(t, recs[1][7]); s != 1 {
+		t.Errorf("got network share %f, want 1", s)
+	}
+	if tot, net := parseFloat(t, recs[3][6]), parseFloat(t, recs[3][5]); math.Abs(tot-10*net) > 1e-6 {
+		t.Errorf("got %f vehicle km for %f network km, want 10 trips", tot, net)
+	}
+}
+
+func TestWriteShapeSharingCsv(t *testing.T) {
+	// sh2 repeats the geometry of sh1 under another ID
+	feed := testfeed.New().
+		Stop("A", "Alpha", 50.0, 8.0).
+		Stop("B", "Beta", 50.0, 8.01).
+		Route("r1", "1", 3).
+		Route("r2", "2", 3).
+		Calendar("wd", "1111100", "20240101", "20240107").
+		Shape("sh1", [2]float64{50.0, 8.0}, [2]float64{50.0, 8.01}).
+		Shape("sh2", [2]float64{50.0, 8.0}, [2]float64{50.0, 8.01}).
+		Trip("t1", "r1", "wd", "sh1", testfeed.At("A", "08:00:00"), testfeed.At("B", "08:05:00")).
+		Trip("t2", "r2", "wd", "sh1", testfeed.At("A", "09:00:00"), testfeed.At("B", "09:05:00")).
+		Trip("t3", "r2", "wd", "sh2", testfeed.At("A", "10:00:00"), testfeed.At("B", "10:05:00")).
+		Feed(t)
+
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+	sw.WriteShapeSharingCsv(feed, out)
+
+	recs := readCsv(t, sw.getOutFileName(out, ".shape_sharing.csv"))
+
+	if len(recs) != 3 {
+		t.Fatalf("read %d lines, want 3", len(recs))
+	}
+	if recs[1][0] != "sh1" || recs[1][1] != "2" || recs[1][2] != "r1,r2" || recs[1][3] != "2" || recs[1][6] != "sh2" {
+		t.Errorf("unexpected row %v", recs[1])
+	}
+	if recs[2][0] != "sh2" || recs[2][3] != "1" || recs[2][5] != recs[1][5] || recs[2][6] != "sh1" {
+		t.Errorf("unexpected row %v", recs[2])
+	}
+}
+
+func TestFindSpeeding(t *testing.T) {
+	// about 7.2 km between A and B
+	feed := testfeed.New().
+		Stop("A", "Alpha", 50.0, 8.0).
+		Stop("B", "Beta", 50.0, 8.1).
+		Route("r1", "1", 3).
+		Route("r2", "2", 2).
+		Calendar("wd", "1111100", "20240101", "20240107").
+		Trip("t1", "r1", "wd", "", testfeed.At("A", "08:00:00"), testfeed.At("B", "08:01:00")).
+		Trip("t2", "r1", "wd", "", testfeed.At("A", "09:00:00"), testfeed.At("B", "09:10:00")).
+		Trip("t3", "r2", "wd", "", testfeed.At("A", "10:00:00"), testfeed.At("B", "10:01:00")).
+		Feed(t)
+
+	// rail may run at 300 km/h, t1 implies about 215 km/h with the minute
+	// added for rounding
+	speeding := FindSpeeding(feed, 150, map[int16]float64{2: 300}, true)
+
+	if len(speeding) != 1 || len(speeding["t1"]) == 0 {
+		t.Errorf("unexpected speeding trips %v", speeding)
+	}
+	if _, ok := feed.Trips["t1"]; ok || len(feed.Trips) != 2 {
+		t.Errorf("t1 was not dropped")
+	}
+}
+
+func TestSnapShapeEndpoints(t *testing.T) {
+	// the shape overshoots stop A into a depot and ends 21 m short of C
+	feed := testfeed.New().
+		Stop("A", "Alpha", 50.0, 8.0).
+		Stop("C", "Gamma", 50.0, 8.02).
+		Route("r1", "1", 3).
+		Calendar("wd", "1111100", "20240101", "20240107").
+		Shape("sh1", [2]float64{50.0, 7.99}, [2]float64{50.0, 8.01}, [2]float64{50.0, 8.0197}).
+		Trip("t1", "r1", "wd", "sh1", testfeed.At("A", "08:00:00"), testfeed.At("C", "08:10:00")).
+		Feed(t)
+
+	snapped := SnapShapeEndpoints(feed, 50)
+	if snapped["sh1"] != "trimmed 716 m at the start, extended 21 m at the end" {
+		t.Errorf("unexpected change %q", snapped["sh1"])
+	}
+
+	pts := feed.Shapes["sh1"].Points
+	if len(pts) != 4 || pts[0].Lon != 8.0 || pts[3].Lon != 8.02 {
+		t.Fatalf("unexpected points %v", pts)
+	}
+
+	// the measure of the cut position is interpolated
+	if d := pts[0].Dist_traveled; math.Abs(float64(d)-0.5) > 1e-3 {
+		t.Errorf("got distance %f at the start, want 0.5", d)
+	}
+
+	// stops far from the shape are not snapped
+	if snapped := SnapShapeEndpoints(feed, 0.1); len(snapped) != 0 {
+		t.Errorf("unexpected changes %v", snapped)
+	}
+}
+
+func TestNormalizeShapeDistUnits(t *testing.T) {
+	feed := testfeed.New().
+		Stop("A", "Alpha", 50.0, 8.0).
+		Stop("C", "Gamma", 50.0, 8.02).
+		Route("r1", "1", 3).
+		Calendar("wd", "1111100", "20240101", "20240107").
+		Shape("km", [2]float64{50.0, 8.0}, [2]float64{50.0, 8.01}, [2]float64{50.0, 8.02}).
+		Shape("m", [2]float64{50.0, 8.0}, [2]float64{50.0, 8.01}, [2]float64{50.0, 8.02}).
+		Trip("t1", "r1", "wd", "km", testfeed.At("A", "08:00:00"), testfeed.At("C", "08:10:00")).
+		Trip("t2", "r1", "wd", "m", testfeed.At("A", "09:00:00"), testfeed.At("C", "09:10:00")).
+		Feed(t)
+
+	// about 716 m between the points
+	for i := range feed.Shapes["km"].Points {
+		feed.Shapes["km"].Points[i].Dist_traveled = float32(i) * 0.716
+		feed.Shapes["m"].Points[i].Dist_traveled = float32(i) * 716
+	}
+	feed.Trips["t1"].StopTimes[1].SetShape_dist_traveled(1.432)
+
+	converted := NormalizeShapeDistUnits(feed)
+	if len(converted) != 1 || converted["km"] != "converted from kilometers" {
+		t.Fatalf("unexpected conversions %v", converted)
+	}
+
+	if d := feed.Shapes["km"].Points[2].Dist_traveled; math.Abs(float64(d)-1432) > 0.1 {
+		t.Errorf("got shape distance %f, want 1432", d)
+	}
+	if d := feed.Trips["t1"].StopTimes[1].Shape_dist_traveled(); math.Abs(float64(d)-1432) > 0.1 {
+		t.Errorf("got stop time distance %f, want 1432", d)
+	}
+	if d := feed.Shapes["m"].Points[2].Dist_traveled; d != 1432 {
+		t.Errorf("shape in meters changed to %f", d)
+	}
+}
+
+func TestSetLayerProjection(t *testing.T) {
+	sw := NewShapeWriter("4326", nil, nil)
+
+	if err := sw.SetLayerProjection("stations", "25832"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.SetLayerProjection("depots", "25832"); err == nil {
+		t.Error("expected an error for an unknown layer")
+	}
+
+	restore := sw.useLayer("stations")
+	if sw.outProj == nil {
+		t.Error("expected the stations to be reprojected")
+	}
+	restore()
+
+	sw.useLayer("shapes")
+	if sw.outProj != nil {
+		t.Error("expected the shapes to stay in WGS84")
+	}
+}
+
+func TestSetLayerMOTs(t *testing.T) {
+	feed := fixtureFeed(t)
+
+	// only the tram route (without a shape) is drawn, but stops of all
+	// modes are written, including B only served by the bus
+	sw, out := fixtureWriter(t, map[int16]bool{0: true}, WriteOptions{})
+	if err := sw.SetLayerMOTs("stations", map[int16]bool{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := sw.WriteRouteShapes(feed, map[int16]string{}, nil, out); n != 0 {
+		t.Errorf("wrote %d route shapes, want 0", n)
+	}
+	if n := sw.WriteStops(feed, out); n != 4 {
+		t.Errorf("wrote %d stations, want 4", n)
+	}
+	if len(sw.motMap) != 1 {
+		t.Errorf("the MOT filter was not restored after writing the stations")
+	}
+}
+
+func TestShpWriterRoundTrip(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "out.shp")
+
+	w, err := createShp(fileName, shp.POLYLINE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []shp.Field{
+		shp.StringField("Name", 5),
+		shp.NumberField("Count", 4),
+		shp.FloatField("Len", 10, 2),
+	}
+	if err := w.SetFields(fields); err != nil {
+		t.Fatal(err)
+	}
+
+	line := shp.NewPolyLine([][]shp.Point{{{X: 8, Y: 50}, {X: 8.01, Y: 50.01}}})
+	var null *string
+
+	rows := [][]interface{}{
+		// truncated at a character boundary, too large for the field
+		{"Straße", 123456, 3.14159},
+		{"ab", 42, math.NaN()},
+		{null, int16(-7), float32(2.5)},
+	}
+
+	for i, geom := range []shp.Shape{line, nil, line} {
+		if row := w.Write(geom); int(row) != i {
+			t.Fatalf("got row %d, want %d", row, i)
+		}
+		for fld, val := range rows[i] {
+			if err := w.WriteAttribute(i, fld, val); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := w.WriteAttribute(0, 0, "late"); err == nil {
+		t.Errorf("no error for an attribute written out of order")
+	}
+	if err := w.WriteAttribute(2, 3, "x"); err == nil {
+		t.Errorf("no error for an invalid field")
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := shp.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for i, f := range r.Fields() {
+		if f.String() != fields[i].String() || f.Size != fields[i].Size || f.Fieldtype != fields[i].Fieldtype {
+			t.Errorf("got field %s of type %c and size %d, want %s of type %c and size %d", f.String(), f.Fieldtype, f.Size, fields[i].String(), fields[i].Fieldtype, fields[i].Size)
+		}
+	}
+
+	want := [][]string{{"Stra", "****", "3.14"}, {"ab", "42", "NaN"}, {"", "-7", "2.50"}}
+
+	n := 0
+	for r.Next() {
+		row, geom := r.Shape()
+		if row != n {
+			t.Fatalf("got row %d, want %d", row, n)
+		}
+
+		if n == 1 {
+			if _, ok := geom.(*shp.Null); !ok {
+				t.Errorf("got %T for the NULL shape", geom)
+			}
+		} else if pl, ok := geom.(*shp.PolyLine); !ok || pl.NumPoints != 2 || pl.Points[1] != line.Points[1] {
+			t.Errorf("got geometry %v in row %d", geom, n)
+		}
+
+		for fld := range fields {
+			if got := strings.TrimSpace(r.ReadAttribute(row, fld)); got != want[n][fld] {
+				t.Errorf("got %q in row %d, field %d, want %q", got, n, fld, want[n][fld])
+			}
+		}
+		n++
+	}
+
+	if n != 3 {
+		t.Fatalf("read %d shapes, want 3", n)
+	}
+
+	shpData, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shxData, err := os.ReadFile(strings.TrimSuffix(fileName, ".shp") + ".shx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbfData, err := os.ReadFile(strings.TrimSuffix(fileName, ".shp") + ".dbf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	be := func(b []byte, off int) int { return int(int32(binary.BigEndian.Uint32(b[off:]))) }
+
+	// file lengths are given in 16 bit words
+	if be(shpData, 24)*2 != len(shpData) || be(shxData, 24)*2 != len(shxData) {
+		t.Errorf("header file lengths %d and %d do not match the file sizes %d and %d", be(shpData, 24)*2, be(shxData, 24)*2, len(shpData), len(shxData))
+	}
+
+	if len(shxData) != 100+8*3 {
+		t.Fatalf("got .shx of %d bytes, want %d", len(shxData), 100+8*3)
+	}
+
+	// every .shx entry points to its record and gives its content length
+	for i := 0; i < 3; i++ {
+		offset, length := be(shxData, 100+8*i)*2, be(shxData, 104+8*i)
+
+		if be(shpData, offset) != i+1 || be(shpData, offset+4) != length {
+			t.Errorf("index entry %d (offset %d, length %d) does not match the record", i, offset, length)
+		}
+
+		shapeType := binary.LittleEndian.Uint32(shpData[offset+8:])
+		if i == 1 && (length != 2 || shapeType != uint32(shp.NULL)) {
+			t.Errorf("got NULL record of type %d and length %d", shapeType, length)
+		}
+		if i != 1 && shapeType != uint32(shp.POLYLINE) {
+			t.Errorf("got record of type %d", shapeType)
+		}
+	}
+
+	// the DBF header gives the number of records, the header and the
+	// record length
+	numRecs := binary.LittleEndian.Uint32(dbfData[4:])
+	headerLen := binary.LittleEndian.Uint16(dbfData[8:])
+	recLen := binary.LittleEndian.Uint16(dbfData[10:])
+	if numRecs != 3 || headerLen != 3*32+33 || recLen != 1+5+4+10 {
+		t.Errorf("got DBF header with %d records, header length %d and record length %d", numRecs, headerLen, recLen)
+	}
+	if len(dbfData) != int(headerLen)+3*int(recLen)+1 || dbfData[len(dbfData)-1] != 0x1A {
+		t.Errorf("got DBF of %d bytes, want %d with end of file marker", len(dbfData), int(headerLen)+3*int(recLen)+1)
+	}
+}
+
+func TestShpWriterLimits(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := createShp(filepath.Join(dir, "large.shp"), shp.POINT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pretend the file is close to the maximum size
+	w.shpSize = maxShpFileSize - 10
+
+	if row := w.Write(&shp.Point{X: 8, Y: 50}); row != 0 || w.num != 0 {
+		t.Errorf("wrote row %d beyond the maximum size", w.num)
+	}
+	if err := w.Close(); err == nil || !strings.Contains(err.Error(), "maximum size") {
+		t.Errorf("got error %v, want a size error", err)
+	}
+
+	w, err = createShp(filepath.Join(dir, "wide.shp"), shp.POINT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fields := make([]shp.Field, 0, 300)
+	for i := 0; i < 300; i++ {
+		fields = append(fields, shp.StringField(fmt.Sprintf("F%d", i), 254))
+	}
+	if err := w.SetFields(fields); err == nil {
+		t.Errorf("no error for a DBF record length above %d", maxDbfRecordLength)
+	}
+
+	w.Write(&shp.Point{X: 8, Y: 50})
+	if err := w.SetFields(fields[:1]); err == nil {
+		t.Errorf("no error for fields set after writing geometries")
+	}
+}
+
+func TestParallelOrdered(t *testing.T) {
+	got := make([]int, 0)
+	parallelOrdered(1000, func(i int) interface{} {
+		return i * i
+	}, func(i int, item interface{}) {
+		got = append(got, item.(int))
+	})
+
+	for i, v := range got {
+		if v != i*i {
+			t.Fatalf("got %d at position %d, want %d", v, i, i*i)
+		}
+	}
+	if len(got) != 1000 {
+		t.Fatalf("got %d items, want 1000", len(got))
+	}
+
+	// panics of workers are raised in the calling goroutine
+	defer func() {
+		if r := recover(); r != "failed" {
+			t.Errorf("got panic %v, want failed", r)
+		}
+	}()
+
+	parallelOrdered(100, func(i int) interface{} {
+		if i == 50 {
+			panic("failed")
+		}
+		return i
+	}, func(i int, item interface{}) {})
+}
+
+func TestParallelFieldSizes(t *testing.T) {
+	sizes := parallelFieldSizes(1000, 2, func(i int, sizes []uint8) {
+		fitSize(&sizes[0], i%300)
+		fitSize(&sizes[1], 3)
+	})
+
+	if sizes[0] != maxFieldSize || sizes[1] != 3 {
+		t.Fatalf("got sizes %v, want [%d 3]", sizes, maxFieldSize)
+	}
+
+	// panics of workers are raised in the calling goroutine
+	defer func() {
+		if r := recover(); r != "failed" {
+			t.Errorf("got panic %v, want failed", r)
+		}
+	}()
+
+	parallelFieldSizes(100, 1, func(i int, sizes []uint8) {
+		if i == 50 {
+			panic("failed")
+		}
+	})
+}
+
+func TestExcludeSpecialTrips(t *testing.T) {
+	feed := testfeed.New().
+		Stop("A", "Alpha", 50.0, 8.0).
+		Stop("B", "Beta", 50.0, 8.01).
+		Route("r1", "1", 3).
+		Calendar("wd", "1111100", "20240101", "20240107").
+		Calendar("school", "1111100", "20240101", "20240103").
+		Calendar("event", "0000001", "20240101", "20240107").
+		Shape("sh1", [2]float64{50.0, 8.0}, [2]float64{50.0, 8.01}).
+		Trip("t1", "r1", "wd", "sh1", testfeed.At("A", "08:00:00"), testfeed.At("B", "08:05:00")).
+		Trip("t2", "r1", "school", "sh1", testfeed.At("A", "07:00:00"), testfeed.At("B", "07:05:00")).
+		Trip("t3", "r1", "event", "sh1", testfeed.At("A", "20:00:00"), testfeed.At("B", "20:05:00")).
+		Feed(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "school.csv")
+	if err := os.WriteFile(path, []byte("date,school_day\n20240101,1\n20240102,1\n20240103,1\n20240104,0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	schoolDays, err := ReadSchoolDays(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schoolDays) != 3 {
+		t.Fatalf("got %d school days, want 3", len(schoolDays))
+	}
+
+	rare, school := ExcludeSpecialTrips(feed, 2, schoolDays)
+	if rare != 1 || school != 1 {
+		t.Errorf("excluded %d rare and %d school trips, want 1 and 1", rare, school)
+	}
+
+	if len(feed.Trips) != 1 || feed.Trips["t1"] == nil {
+		t.Errorf("unexpected remaining trips %v", feed.Trips)
+	}
+}
+
+func TestClampToFeedValidity(t *testing.T) {
+	feed := fixtureFeed(t)
+
+	if clamped := ClampToFeedValidity(feed); len(clamped) != 0 {
+		t.Fatalf("clamped %v without feed info", clamped)
+	}
+
+	// valid from wednesday on, without an end
+	feed.FeedInfos = append(feed.FeedInfos, &gtfs.FeedInfo{Start_date: gtfs.NewDate(3, 1, 2024)})
+
+	clamped := ClampToFeedValidity(feed)
+	if len(clamped) != 1 || clamped["wd"] != "active from 2024-01-01 to 2024-01-05" {
+		t.Fatalf("unexpected clamped services %v", clamped)
+	}
+
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+	sw.WriteShapes(feed, out)
+
+	if rows := readLayer(t, out); len(rows) != 1 || rows[0]["Frequency"] != "6" {
+		t.Errorf("unexpected shapes %v", rows)
+	}
+}
+
+func TestReclassifyRouteTypes(t *testing.T) {
+	feed := fixtureFeed(t)
+
+	path := filepath.Join(t.TempDir(), "types.csv")
+	if err := os.WriteFile(path, []byte("route_id,route_type,new_route_type\n,3,700\nr2,,2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ReadRouteTypeMap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := ReclassifyRouteTypes(feed, m)
+	if len(changed) != 2 || changed["r1"] != "reclassified from route type 3 to 700" {
+		t.Fatalf("unexpected changes %v", changed)
+	}
+	if feed.Routes["r2"].Type != 2 {
+		t.Errorf("got route type %d, want 2", feed.Routes["r2"].Type)
+	}
+
+	// the MOT filter applies to the new types
+	sw, out := fixtureWriter(t, map[int16]bool{700: true}, WriteOptions{})
+	if n := sw.WriteRouteShapes(feed, nil, nil, out); n != 1 {
+		t.Errorf("wrote %d route shapes, want 1", n)
+	}
+}
+
+func TestWriteShapePoints(t *testing.T) {
+	feed := fixtureFeed(t)
+
+	// only shapes of the requested MOTs are written
+	sw, out := fixtureWriter(t, map[int16]bool{0: true}, WriteOptions{})
+	if n := sw.WriteShapePoints(feed, out); n != 0 {
+		t.Errorf("wrote %d shape points for trams, want 0", n)
+	}
+
+	sw, out = fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+	if n := sw.WriteShapePoints(feed, out); n != 3 {
+		t.Fatalf("wrote %d shape points, want 3", n)
+	}
+
+	rows := readLayer(t, sw.getShapeFileNameShapePoints(out))
+	if len(rows) != 3 {
+		t.Fatalf("read %d shape points, want 3", len(rows))
+	}
+
+	for i, row := range rows {
+		if row["Shape_id"] != "sh1" || row["Seq"] != strconv.Itoa(i) {
+			t.Errorf("unexpected attributes %v", row)
+		}
+	}
+}
+
+func TestWriteStopEvents(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+
+	// all stop times of all trips
+	if n := sw.WriteStopEvents(feed, nil, out); n != 8 {
+		t.Fatalf("wrote %d stop events, want 8", n)
+	}
+
+	rows := readLayer(t, sw.getOutFileName(out, ".stopevents.shp"))
+	if len(rows) != 8 {
+		t.Fatalf("read %d stop events, want 8", len(rows))
+	}
+
+	b := rowsWith(rowsWith(rows, "Trip_id", "t2"), "Stop_id", "B")
+	if len(b) != 1 || b[0]["Seq"] != "1" || b[0]["Arr"] != "08:35:00" || b[0]["Arr_sec"] != "30900" || b[0]["Dwell"] != "0" || parseFloat(t, b[0]["Dist"]) != 1 {
+		t.Errorf("unexpected attributes %v", b)
+	}
+
+	// only the requested trips
+	sw, out = fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+	if n := sw.WriteStopEvents(feed, map[string]bool{"t3": true}, out); n != 2 {
+		t.Fatalf("wrote %d stop events for t3, want 2", n)
+	}
+
+	rows = readLayer(t, sw.getOutFileName(out, ".stopevents.shp"))
+	if len(rowsWith(rows, "Trip_id", "t3")) != 2 || rowsWith(rows, "Stop_id", "C")[0]["Dep"] != "09:12:00" {
+		t.Errorf("unexpected stop events %v", rows)
+	}
+
+	// only trips of the requested MOTs
+	sw, out = fixtureWriter(t, map[int16]bool{3: true}, WriteOptions{})
+	if n := sw.WriteStopEvents(feed, nil, out); n != 6 {
+		t.Errorf("wrote %d bus stop events, want 6", n)
+	}
+}
+
+func TestWriteSchematic(t *testing.T) {
+	feed := testfeed.New().
+		Stop("A", "Alpha", 50.0, 8.0).
+		Stop("B", "Beta", 50.013, 8.031).
+		Route("r1", "1", 3).
+		Calendar("wd", "1111100", "20240101", "20240107").
+		Shape("sh1", [2]float64{50.0, 8.0}, [2]float64{50.005, 8.02}, [2]float64{50.013, 8.031}).
+		Trip("t1", "r1", "wd", "sh1", testfeed.At("A", "08:00:00"), testfeed.At("B", "08:10:00")).
+		Feed(t)
+
+	grid := 0.001
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{SchematicGrid: grid})
+
+	if n := sw.WriteSchematic(feed, out); n != 1 {
+		t.Fatalf("wrote %d schematic lines, want 1", n)
+	}
+
+	fileName := sw.getOutFileName(out, ".schematic.shp")
+
+	if rows := readLayer(t, fileName); len(rows) != 1 || rows[0]["Id"] != "sh1" {
+		t.Errorf("unexpected attributes %v", rows)
+	}
+
+	r, err := shp.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if !r.Next() {
+		t.Fatal("no schematic line written")
+	}
+	_, s := r.Shape()
+	points := s.(*shp.PolyLine).Points
+
+	if len(points) < 3 {
+		t.Fatalf("got %d points, want a bent line", len(points))
+	}
+
+	onGrid := func(v float64) bool {
+		return math.Abs(v/grid-math.Round(v/grid)) < 1e-6
+	}
+
+	for i, p := range points {
+		if !onGrid(p.X) || !onGrid(p.Y) {
+			t.Errorf("point %v is not on the grid", p)
+		}
+		if i == 0 {
+			continue
+		}
+
+		// horizontal, vertical or diagonal
+		dx := math.Abs(p.X - points[i-1].X)
+		dy := math.Abs(p.Y - points[i-1].Y)
+		if dx > 1e-9 && dy > 1e-9 && math.Abs(dx-dy) > 1e-9 {
+			t.Errorf("segment from %v to %v is not octilinear", points[i-1], p)
+		}
+	}
+
+	if first, last := points[0], points[len(points)-1]; math.Abs(first.X-8.0) > 1e-9 || math.Abs(first.Y-50.0) > 1e-9 || math.Abs(last.X-8.031) > 1e-9 || math.Abs(last.Y-50.013) > 1e-9 {
+		t.Errorf("schematic line runs from %v to %v", first, last)
+	}
+}
+
+func TestWriteSummaryJSON(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+
+	sw.WriteShapes(feed, out)
+	sw.WriteStops(feed, out)
+	sw.WriteSummaryJSON(out)
+
+	data, err := os.ReadFile(sw.getOutFileName(out, ".summary.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var summary struct {
+		Layers []LayerSummary `json:"layers"`
+	}
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(summary.Layers) != 2 {
+		t.Fatalf("got %d layers, want 2", len(summary.Layers))
+	}
+
+	shapes := summary.Layers[0]
+	if shapes.File != "out.shp" || shapes.Geometries != 1 || len(shapes.Extent) != 4 {
+		t.Errorf("unexpected shapes summary %v", shapes)
+	}
+
+	stations := summary.Layers[1]
+	if stations.File != "out.stations.shp" || stations.Geometries != 4 {
+		t.Errorf("unexpected stations summary %v", stations)
+	}
+	if e := stations.Extent; len(e) != 4 || e[0] != 8.0 || e[1] != 50.0 || math.Abs(e[2]-8.02) > 1e-6 || e[3] != 50.0 {
+		t.Errorf("got stations extent %v", e)
+	}
+}
+
+func TestWriteDictionary(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{})
+
+	sw.WriteShapes(feed, out)
+	sw.WriteDictionary(out, "json")
+	sw.WriteDictionary(out, "csv")
+
+	rows := readLayer(t, out)
+
+	data, err := os.ReadFile(sw.getOutFileName(out, ".dictionary.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dict struct {
+		Files []DictionaryEntry `json:"files"`
+	}
+	if err := json.Unmarshal(data, &dict); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dict.Files) != 1 || dict.Files[0].File != "out.shp" {
+		t.Fatalf("unexpected dictionary %v", dict.Files)
+	}
+
+	// every written column is described
+	cols := dict.Files[0].Columns
+	if len(cols) != len(rows[0]) {
+		t.Errorf("got %d dictionary columns, want %d", len(cols), len(rows[0]))
+	}
+	for _, col := range cols {
+		if _, ok := rows[0][col.Name]; !ok {
+			t.Errorf("dictionary column %s was not written", col.Name)
+		}
+		if col.Type == "" {
+			t.Errorf("column %s lacks a type", col.Name)
+		}
+		if col.Name == "Frequency" && (col.Type != "integer" || col.Description == "") {
+			t.Errorf("unexpected Frequency column %v", col)
+		}
+	}
+
+	recs := readCsv(t, sw.getOutFileName(out, ".dictionary.csv"))
+	if len(recs) != len(cols)+1 || recs[0][0] != "file" {
+		t.Fatalf("unexpected dictionary CSV %v", recs)
+	}
+	for i, rec := range recs[1:] {
+		if rec[0] != "out.shp" || rec[1] != cols[i].Name || rec[2] != cols[i].Type {
+			t.Errorf("got dictionary CSV line %v, want column %v", rec, cols[i])
+		}
+	}
+}
+
+func TestWriteIDMapCsv(t *testing.T) {
+	feed := fixtureFeed(t)
+	feed.Stops["xä"] = &gtfs.Stop{Id: "xä", Name: "x", Lat: 50, Lon: 8}
+
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{IDSanitization: IDSanitize})
+	sw.MapIDs(feed)
+	sw.WriteIDMapCsv(out)
+
+	// only changed IDs are listed
+	recs := readCsv(t, sw.getOutFileName(out, ".ids.csv"))
+	if len(recs) != 2 || recs[0][0] != "type" {
+		t.Fatalf("unexpected ID map %v", recs)
+	}
+	if rec := recs[1]; rec[0] != "stop" || rec[1] != sw.ids.get("stop", "xä") || rec[2] != "xä" {
+		t.Errorf("unexpected ID map line %v", rec)
+	}
+}
+
+func TestWriteQix(t *testing.T) {
+	feed := fixtureFeed(t)
+	sw, out := fixtureWriter(t, map[int16]bool{}, WriteOptions{SpatialIndex: true})
+
+	sw.WriteStops(feed, out)
+
+	data, err := os.ReadFile(sw.getOutFileName(out, ".stations.qix"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(data) < 16 || string(data[:8]) != "SQT\x01\x01\x00\x00\x00" {
+		t.Fatalf("unexpected spatial index header %v", data)
+	}
+	if n := binary.LittleEndian.Uint32(data[8:12]); n != 4 {
+		t.Errorf("got %d shapes in spatial index, want 4", n)
+	}
+	if depth := binary.LittleEndian.Uint32(data[12:16]); depth < 1 || depth > qixMaxDepth {
+		t.Errorf("got spatial index depth %d", depth)
+	}
+
+	// a left-over index is not overwritten without force
+	removeLayer(sw.getShapeFileNameStations(out))
+
+	sw, _ = fixtureWriter(t, map[int16]bool{}, WriteOptions{SpatialIndex: true})
+	defer func() {
+		if recover() == nil {
+			t.Error("existing spatial index overwritten")
+		}
+	}()
+	sw.WriteStops(feed, out)
+}
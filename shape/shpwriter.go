@@ -0,0 +1,387 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/jonas-p/go-shp"
+	"math"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maximum size of a .shp or .shx file, offsets and lengths are stored as
+// signed 32 bit numbers of 16 bit words
+const maxShpFileSize = math.MaxInt32 * 2
+
+// maximum length of a DBF record
+const maxDbfRecordLength = math.MaxUint16
+
+// shpWriter writes a shapefile (.shp, .shx and .dbf) with buffered I/O.
+// Unlike go-shp's writer, it supports NULL shapes, writes all integer and
+// float types, truncates overlong strings at character boundaries, pads
+// DBF values as required by the format, and reports size overflows
+// instead of writing corrupt files. Attributes must be written in row
+// order, after the geometry of their row.
+type shpWriter struct {
+	shapeType shp.ShapeType
+	shpFile   *os.File
+	shxFile   *os.File
+	dbfFile   *os.File
+	shp       *bufio.Writer
+	shx       *bufio.Writer
+	dbf       *bufio.Writer
+	shpSize   int64
+	num       int32
+	bbox      shp.Box
+	zRange    valRange
+	mRange    valRange
+	hasBox    bool
+	fields    []shp.Field
+	record    []byte // DBF record of the current row
+	recLen    int
+	dbfInit   bool // whether the DBF header space has been written
+	err       error
+}
+
+// create a new shapefile writer for the shapefile fileName
+func createShp(fileName string, t shp.ShapeType) (*shpWriter, error) {
+	base := strings.TrimSuffix(fileName, ".shp")
+	w := &shpWriter{shapeType: t, shpSize: 100, recLen: 1}
+
+	var err error
+	if w.shpFile, err = os.Create(base + ".shp"); err != nil {
+		return nil, err
+	}
+	if w.shxFile, err = os.Create(base + ".shx"); err != nil {
+		w.shpFile.Close()
+		return nil, err
+	}
+	if w.dbfFile, err = os.Create(base + ".dbf"); err != nil {
+		w.shpFile.Close()
+		w.shxFile.Close()
+		return nil, err
+	}
+
+	w.shp = bufio.NewWriter(w.shpFile)
+	w.shx = bufio.NewWriter(w.shxFile)
+	w.dbf = bufio.NewWriter(w.dbfFile)
+
+	// headers are written on Close
+	w.shp.Write(make([]byte, 100))
+	w.shx.Write(make([]byte, 100))
+
+	return w, nil
+}
+
+// SetFields sets the DBF fields, before any geometry is written
+func (w *shpWriter) SetFields(fields []shp.Field) error {
+	if w.num > 0 {
+		return fmt.Errorf("fields must be set before writing geometries")
+	}
+
+	recLen := 1
+	for _, f := range fields {
+		recLen += int(f.Size)
+	}
+
+	if recLen > maxDbfRecordLength || len(fields)*32+33 > math.MaxUint16 {
+		return fmt.Errorf("too many or too large DBF fields (record length %d)", recLen)
+	}
+
+	w.fields = fields
+	w.recLen = recLen
+
+	return nil
+}
+
+// Write writes a geometry and starts a new DBF record. nil or an empty
+// geometry is written as a NULL shape. Returns the row of the geometry
+func (w *shpWriter) Write(s shp.Shape) int32 {
+	w.flushRecord()
+
+	content := new(bytes.Buffer)
+
+	if isNullShape(s) {
+		binary.Write(content, binary.LittleEndian, int32(shp.NULL))
+	} else {
+		binary.Write(content, binary.LittleEndian, int32(w.shapeType))
+		w.writeShape(content, s)
+	}
+
+	if w.shpSize+8+int64(content.Len()) > maxShpFileSize {
+		if w.err == nil {
+			w.err = fmt.Errorf("shapefile exceeds the maximum size of %d bytes", int64(maxShpFileSize))
+		}
+		return w.num
+	}
+
+	w.num++
+
+	binary.Write(w.shx, binary.BigEndian, []int32{int32(w.shpSize / 2), int32(content.Len() / 2)})
+	binary.Write(w.shp, binary.BigEndian, []int32{w.num, int32(content.Len() / 2)})
+	w.shp.Write(content.Bytes())
+	w.shpSize += 8 + int64(content.Len())
+
+	w.record = bytes.Repeat([]byte{' '}, w.recLen)
+
+	return w.num - 1
+}
+
+// check whether a geometry is written as a NULL shape
+func isNullShape(s shp.Shape) bool {
+	switch g := s.(type) {
+	case nil, *shp.Null:
+		return true
+	case *shp.PolyLine:
+		return g == nil || len(g.Points) == 0
+	case *shp.Polygon:
+		return g == nil || len(g.Points) == 0
+	case *shp.PolyLineZ:
+		return g == nil || len(g.Points) == 0
+	}
+	return false
+}
+
+// write the content of a record (without the shape type) and extend the
+// bounding box and the Z and M ranges
+func (w *shpWriter) writeShape(buf *bytes.Buffer, s shp.Shape) {
+	switch g := s.(type) {
+	case *shp.Point:
+		binary.Write(buf, binary.LittleEndian, g)
+	case *shp.PointM:
+		binary.Write(buf, binary.LittleEndian, g)
+		w.extendRange(&w.mRange, g.M)
+	case *shp.PointZ:
+		binary.Write(buf, binary.LittleEndian, g)
+		w.extendRange(&w.zRange, g.Z)
+		w.extendRange(&w.mRange, g.M)
+	case *shp.PolyLine:
+		binary.Write(buf, binary.LittleEndian, g.Box)
+		binary.Write(buf, binary.LittleEndian, []int32{g.NumParts, g.NumPoints})
+		binary.Write(buf, binary.LittleEndian, g.Parts)
+		binary.Write(buf, binary.LittleEndian, g.Points)
+	case *shp.Polygon:
+		binary.Write(buf, binary.LittleEndian, g.Box)
+		binary.Write(buf, binary.LittleEndian, []int32{g.NumParts, g.NumPoints})
+		binary.Write(buf, binary.LittleEndian, g.Parts)
+		binary.Write(buf, binary.LittleEndian, g.Points)
+	case *shp.PolyLineZ:
+		binary.Write(buf, binary.LittleEndian, g.Box)
+		binary.Write(buf, binary.LittleEndian, []int32{g.NumParts, g.NumPoints})
+		binary.Write(buf, binary.LittleEndian, g.Parts)
+		binary.Write(buf, binary.LittleEndian, g.Points)
+		binary.Write(buf, binary.LittleEndian, g.ZRange)
+		binary.Write(buf, binary.LittleEndian, g.ZArray)
+		binary.Write(buf, binary.LittleEndian, g.MRange)
+		binary.Write(buf, binary.LittleEndian, g.MArray)
+		for _, z := range g.ZArray {
+			w.extendRange(&w.zRange, z)
+		}
+		for _, m := range g.MArray {
+			w.extendRange(&w.mRange, m)
+		}
+	default:
+		panic(fmt.Sprintf("Unsupported geometry type %T", s))
+	}
+
+	box := s.BBox()
+	if !w.hasBox {
+		w.bbox = box
+		w.hasBox = true
+	} else {
+		w.bbox.Extend(box)
+	}
+}
+
+// a range of Z or M values
+type valRange struct {
+	min, max float64
+	set      bool
+}
+
+// extend a value range by v
+func (w *shpWriter) extendRange(r *valRange, v float64) {
+	if v < -1e38 {
+		// "no data" measure
+		return
+	}
+	if !r.set || v < r.min {
+		r.min = v
+	}
+	if !r.set || v > r.max {
+		r.max = v
+	}
+	r.set = true
+}
+
+// WriteAttribute writes an attribute value into the current row
+func (w *shpWriter) WriteAttribute(row int, field int, value interface{}) error {
+	if row != int(w.num)-1 || w.record == nil {
+		return fmt.Errorf("attribute for row %d written out of order", row)
+	}
+
+	if field < 0 || field >= len(w.fields) {
+		return fmt.Errorf("invalid field %d", field)
+	}
+
+	f := w.fields[field]
+	val, ok := formatDbfValue(f, value)
+	if !ok {
+		return nil
+	}
+
+	offset := 1
+	for _, fld := range w.fields[:field] {
+		offset += int(fld.Size)
+	}
+
+	cell := w.record[offset : offset+int(f.Size)]
+
+	if f.Fieldtype == 'C' {
+		copy(cell, val)
+	} else {
+		// numbers are right-aligned
+		copy(cell[len(cell)-len(val):], val)
+	}
+
+	return nil
+}
+
+// format a DBF value fitting into field f, ok is false for NULL values.
+// Overlong strings are truncated, overlong numbers are written as
+// asterisks, as usual in DBF files
+func formatDbfValue(f shp.Field, value interface{}) (string, bool) {
+	rv := reflect.ValueOf(value)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return "", false
+		}
+		rv = rv.Elem()
+	}
+
+	var ret string
+
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		ret = strconv.FormatInt(rv.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		ret = strconv.FormatUint(rv.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		if math.IsNaN(rv.Float()) || math.IsInf(rv.Float(), 0) {
+			ret = "NaN"
+		} else {
+			ret = strconv.FormatFloat(rv.Float(), 'f', int(f.Precision), 64)
+		}
+	case reflect.String:
+		ret = rv.String()
+	default:
+		ret = fmt.Sprint(rv.Interface())
+	}
+
+	if len(ret) <= int(f.Size) {
+		return ret, true
+	}
+
+	if f.Fieldtype != 'C' {
+		return strings.Repeat("*", int(f.Size)), true
+	}
+
+	// cut at a character boundary
+	cut := int(f.Size)
+	for cut > 0 && !utf8.RuneStart(ret[cut]) {
+		cut--
+	}
+
+	return ret[:cut], true
+}
+
+// reserve the space of the DBF header, which is written on Close
+func (w *shpWriter) initDbf() {
+	if !w.dbfInit {
+		w.dbf.Write(make([]byte, len(w.fields)*32+33))
+		w.dbfInit = true
+	}
+}
+
+// write the DBF record of the current row
+func (w *shpWriter) flushRecord() {
+	if w.record != nil {
+		w.initDbf()
+		w.dbf.Write(w.record)
+		w.record = nil
+	}
+}
+
+// BBox returns the bounding box of all written geometries
+func (w *shpWriter) BBox() shp.Box {
+	return w.bbox
+}
+
+// Close writes the file headers and closes all files
+func (w *shpWriter) Close() error {
+	w.flushRecord()
+	w.initDbf()
+
+	// end of file marker
+	w.dbf.Write([]byte{0x1A})
+
+	for _, b := range []*bufio.Writer{w.shp, w.shx, w.dbf} {
+		if err := b.Flush(); err != nil && w.err == nil {
+			w.err = err
+		}
+	}
+
+	w.shpFile.WriteAt(w.shpHeader(w.shpSize), 0)
+	w.shxFile.WriteAt(w.shpHeader(100+8*int64(w.num)), 0)
+	w.dbfFile.WriteAt(w.dbfHeader(), 0)
+
+	for _, f := range []*os.File{w.shpFile, w.shxFile, w.dbfFile} {
+		if err := f.Close(); err != nil && w.err == nil {
+			w.err = err
+		}
+	}
+
+	return w.err
+}
+
+// return the header of a .shp or .shx file with the given size in bytes
+func (w *shpWriter) shpHeader(size int64) []byte {
+	buf := new(bytes.Buffer)
+
+	binary.Write(buf, binary.BigEndian, []int32{9994, 0, 0, 0, 0, 0, int32(size / 2)})
+	binary.Write(buf, binary.LittleEndian, []int32{1000, int32(w.shapeType)})
+	binary.Write(buf, binary.LittleEndian, w.bbox)
+	binary.Write(buf, binary.LittleEndian, []float64{w.zRange.min, w.zRange.max, w.mRange.min, w.mRange.max})
+
+	return buf.Bytes()
+}
+
+// return the DBF header including the field descriptors
+func (w *shpWriter) dbfHeader() []byte {
+	buf := new(bytes.Buffer)
+
+	// version, date of last update (fixed, for reproducible output)
+	buf.Write([]byte{3, 24, 5, 3})
+	binary.Write(buf, binary.LittleEndian, uint32(w.num))
+	binary.Write(buf, binary.LittleEndian, []uint16{uint16(len(w.fields)*32 + 33), uint16(w.recLen)})
+	buf.Write(make([]byte, 20))
+
+	for _, f := range w.fields {
+		binary.Write(buf, binary.LittleEndian, f)
+	}
+
+	buf.WriteByte('\r')
+
+	return buf.Bytes()
+}
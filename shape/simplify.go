@@ -0,0 +1,170 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/jonas-p/go-shp"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"math"
+	"sort"
+)
+
+// returns the reprojected shapefile geometry of a GTFS shape between the
+// measures from and to, together with its elevations as given by
+// shapeElevations. If simplification is enabled, the line is simplified,
+// but the vertex nearest to each of the served stops is always retained,
+// so stops snapped to the unsimplified line stay on it
+func (sw *ShapeWriter) shapeLine(s *gtfs.Shape, from float64, to float64, stops []*gtfs.Stop) ([]shp.Point, []float64) {
+	points := sw.gtfsShapePointsToShpLinePoints(s.Points, from, to)
+	zs := sw.shapeElevations(s, from, to)
+
+	if sw.opts.Simplify <= 0 {
+		return points, zs
+	}
+
+	keep := simplifyKeepingStops(clipShape(s.Points, from, to), stops, sw.opts.Simplify)
+
+	retPoints := make([]shp.Point, len(keep))
+	for i, k := range keep {
+		retPoints[i] = points[k]
+	}
+
+	if zs == nil {
+		return retPoints, nil
+	}
+
+	retZs := make([]float64, len(keep))
+	for i, k := range keep {
+		retZs[i] = zs[k]
+	}
+
+	return retPoints, retZs
+}
+
+// return the stops served by trips, each only once
+func servedStops(trips ...*gtfs.Trip) []*gtfs.Stop {
+	seen := make(map[*gtfs.Stop]bool)
+	ret := make([]*gtfs.Stop, 0)
+
+	for _, trip := range trips {
+		for _, st := range trip.StopTimes {
+			if st.Stop() != nil && !seen[st.Stop()] {
+				seen[st.Stop()] = true
+				ret = append(ret, st.Stop())
+			}
+		}
+	}
+
+	return ret
+}
+
+// return the stops served by the trips of an aggregated shape
+func aggrShapeStops(as *AggrShape) []*gtfs.Stop {
+	ids := make([]string, 0, len(as.Trips))
+	for id := range as.Trips {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	trips := make([]*gtfs.Trip, len(ids))
+	for i, id := range ids {
+		trips[i] = as.Trips[id]
+	}
+
+	return servedStops(trips...)
+}
+
+// simplify a line given as lat, lon coordinates with the Douglas-Peucker
+// algorithm and a tolerance of epsilon meters, and return the indices of
+// the retained vertices. The first and last vertex and the vertex
+// nearest to each of the stops are always retained
+func simplifyKeepingStops(line [][2]float64, stops []*gtfs.Stop, epsilon float64) []int {
+	if len(line) < 3 {
+		ret := make([]int, len(line))
+		for i := range ret {
+			ret[i] = i
+		}
+		return ret
+	}
+
+	minLat, minLon := math.Inf(1), math.Inf(1)
+	maxLat, maxLon := math.Inf(-1), math.Inf(-1)
+
+	for _, p := range line {
+		minLat, maxLat = math.Min(minLat, p[0]), math.Max(maxLat, p[0])
+		minLon, maxLon = math.Min(minLon, p[1]), math.Max(maxLon, p[1])
+	}
+
+	frame := localFrame{lat0: (minLat + maxLat) / 2, lon0: (minLon + maxLon) / 2}
+	frame.cosLat = math.Cos(frame.lat0 * DEG_TO_RAD)
+
+	local := make([]shp.Point, len(line))
+	for i, p := range line {
+		l := frame.toLocal(p)
+		local[i] = shp.Point{X: l.x, Y: l.y}
+	}
+
+	fixed := map[int]bool{0: true, len(line) - 1: true}
+
+	for _, stop := range stops {
+		if !hasCoord(stop) {
+			continue
+		}
+
+		l := frame.toLocal([2]float64{float64(stop.Lat), float64(stop.Lon)})
+		nearest := 0
+		nearestDist := math.Inf(1)
+		for i, p := range local {
+			if d := math.Hypot(p.X-l.x, p.Y-l.y); d < nearestDist {
+				nearest, nearestDist = i, d
+			}
+		}
+		fixed[nearest] = true
+	}
+
+	breaks := make([]int, 0, len(fixed))
+	for i := range fixed {
+		breaks = append(breaks, i)
+	}
+	sort.Ints(breaks)
+
+	// simplify the sections between the retained vertices separately
+	ret := []int{0}
+	for b := 1; b < len(breaks); b++ {
+		ret = append(ret, simplifyIndices(local, breaks[b-1], breaks[b], epsilon)...)
+		ret = append(ret, breaks[b])
+	}
+
+	return ret
+}
+
+// return the indices of the vertices strictly between first and last
+// retained by the Douglas-Peucker algorithm
+func simplifyIndices(points []shp.Point, first int, last int, epsilon float64) []int {
+	if last-first < 2 {
+		return nil
+	}
+
+	maxDist := 0.0
+	maxI := 0
+
+	for i := first + 1; i < last; i++ {
+		if d := pointSegDist(points[i], points[first], points[last]); d > maxDist {
+			maxDist = d
+			maxI = i
+		}
+	}
+
+	if maxDist <= epsilon {
+		return nil
+	}
+
+	ret := simplifyIndices(points, first, maxI, epsilon)
+	ret = append(ret, maxI)
+
+	return append(ret, simplifyIndices(points, maxI, last, epsilon)...)
+}
@@ -0,0 +1,160 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"fmt"
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"math"
+)
+
+// changes of less than this many meters are not applied when snapping
+// shape endpoints
+const minSnapDist = 0.5
+
+// SnapShapeEndpoints trims or extends the shapes of Feed f so they start
+// at the first and end at the last stop of their trips, if the stop is
+// within tolerance meters of the shape. Shapes overshooting into depots
+// are cut at the projection of the terminal stop, shapes ending short of
+// it are extended. Only shapes whose trips all share the same terminal
+// stops are changed. Returns a description of the changes, by shape ID
+func SnapShapeEndpoints(f *gtfsparser.Feed, tolerance float64) map[string]string {
+	type terminals struct {
+		first, last *gtfs.Stop
+		ambiguous   bool
+	}
+
+	shapeTerminals := make(map[*gtfs.Shape]*terminals)
+
+	for _, trip := range f.Trips {
+		if trip.Shape == nil || len(trip.StopTimes) < 2 {
+			continue
+		}
+
+		first := trip.StopTimes[0].Stop()
+		last := trip.StopTimes[len(trip.StopTimes)-1].Stop()
+
+		if t, ok := shapeTerminals[trip.Shape]; !ok {
+			shapeTerminals[trip.Shape] = &terminals{first: first, last: last}
+		} else if t.first != first || t.last != last {
+			t.ambiguous = true
+		}
+	}
+
+	ret := make(map[string]string)
+
+	for shape, t := range shapeTerminals {
+		if t.ambiguous || len(shape.Points) < 2 || !hasCoord(t.first) || !hasCoord(t.last) {
+			continue
+		}
+
+		points, startChange := snapShapeStart(shape.Points, t.first, tolerance)
+
+		// snap the end by snapping the start of the reversed shape
+		reverseShapePoints(points)
+		points, endChange := snapShapeStart(points, t.last, tolerance)
+		reverseShapePoints(points)
+
+		if startChange == 0 && endChange == 0 {
+			continue
+		}
+
+		shape.Points = points
+		ret[shape.Id] = fmt.Sprintf("%s start, %s end", describeSnap(startChange), describeSnap(endChange))
+	}
+
+	return ret
+}
+
+// snap the start of a shape to stop, if the stop is within tolerance
+// meters of the first half of the shape. Returns the new points and the
+// change of the shape length in meters, negative if it was trimmed
+func snapShapeStart(points gtfs.ShapePoints, stop *gtfs.Stop, tolerance float64) (gtfs.ShapePoints, float64) {
+	frame := localFrame{lat0: float64(stop.Lat), lon0: float64(stop.Lon)}
+	frame.cosLat = math.Cos(frame.lat0 * DEG_TO_RAD)
+
+	total := 0.0
+	for i := 1; i < len(points); i++ {
+		total += haversineP(points[i-1], points[i])
+	}
+
+	// find the nearest segment within the first half of the shape
+	best := -1
+	bestT := 0.0
+	bestDist := math.Inf(1)
+	bestLen := 0.0
+
+	length := 0.0
+	origin := localPoint{}
+
+	for i := 1; i < len(points) && length <= total/2; i++ {
+		a := frame.toLocal([2]float64{float64(points[i-1].Lat), float64(points[i-1].Lon)})
+		b := frame.toLocal([2]float64{float64(points[i].Lat), float64(points[i].Lon)})
+		segLen := haversineP(points[i-1], points[i])
+
+		if d := localSegDist(origin, a, b); d < bestDist {
+			dx, dy := b.x-a.x, b.y-a.y
+			t := 0.0
+			if dx != 0 || dy != 0 {
+				t = math.Max(0, math.Min(1, -(a.x*dx+a.y*dy)/(dx*dx+dy*dy)))
+			}
+
+			best, bestT, bestDist, bestLen = i-1, t, d, length+t*segLen
+		}
+
+		length += segLen
+	}
+
+	if best < 0 || bestDist > tolerance {
+		return points, 0
+	}
+
+	stopPoint := gtfs.ShapePoint{Lat: stop.Lat, Lon: stop.Lon, Sequence: points[0].Sequence, Dist_traveled: points[0].Dist_traveled}
+
+	// the stop lies before the start of the shape, extend it
+	if best == 0 && bestT == 0 {
+		if bestDist < minSnapDist {
+			return points, 0
+		}
+		return append(gtfs.ShapePoints{stopPoint}, points...), bestDist
+	}
+
+	if bestLen < minSnapDist && bestDist < minSnapDist {
+		return points, 0
+	}
+
+	// cut the shape at the projection of the stop, keeping the measure
+	// of the cut position
+	a, b := points[best], points[best+1]
+	stopPoint.Sequence = a.Sequence
+	stopPoint.Dist_traveled = a.Dist_traveled + float32(bestT)*(b.Dist_traveled-a.Dist_traveled)
+
+	ret := make(gtfs.ShapePoints, 0, len(points)-best)
+	ret = append(ret, stopPoint)
+	ret = append(ret, points[best+1:]...)
+
+	return ret, -bestLen
+}
+
+// reverse a list of shape points in place
+func reverseShapePoints(points gtfs.ShapePoints) {
+	for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+		points[i], points[j] = points[j], points[i]
+	}
+}
+
+// describe a change of a shape end in meters
+func describeSnap(change float64) string {
+	switch {
+	case change < 0:
+		return fmt.Sprintf("trimmed %.0f m at the", -change)
+	case change > 0:
+		return fmt.Sprintf("extended %.0f m at the", change)
+	}
+	return "unchanged at the"
+}
@@ -0,0 +1,133 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"io"
+	"os"
+	"time"
+)
+
+// SchoolDays holds the dates flagged as school days
+type SchoolDays map[gtfs.Date]bool
+
+// ReadSchoolDays reads a school calendar CSV. The file must have a header
+// containing at least the column date (YYYYMMDD). If it also has a
+// column school_day, only dates with a school_day of 1 are school days,
+// otherwise all listed dates are
+func ReadSchoolDays(path string) (SchoolDays, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open school calendar (%s)", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read header of school calendar %s (%s)", path, err)
+	}
+
+	dateCol := -1
+	flagCol := -1
+
+	for i, name := range header {
+		switch name {
+		case "date":
+			dateCol = i
+		case "school_day":
+			flagCol = i
+		}
+	}
+
+	if dateCol < 0 {
+		return nil, fmt.Errorf("school calendar %s must contain the column date", path)
+	}
+
+	ret := make(SchoolDays)
+
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read school calendar %s (%s)", path, err)
+		}
+
+		if dateCol >= len(record) || len(record[dateCol]) == 0 {
+			continue
+		}
+
+		if flagCol >= 0 && (flagCol >= len(record) || record[flagCol] != "1") {
+			continue
+		}
+
+		t, err := time.Parse("20060102", record[dateCol])
+		if err != nil {
+			return nil, fmt.Errorf("invalid date '%s' in line %d of %s", record[dateCol], line, path)
+		}
+
+		ret[gtfs.NewDate(uint8(t.Day()), uint8(t.Month()), uint16(t.Year()))] = true
+	}
+
+	return ret, nil
+}
+
+// ExcludeSpecialTrips removes the trips of Feed f whose service operates
+// on fewer than minDays days, and the trips whose service only operates
+// on school days, if schoolDays is given. As the trips are removed from
+// the feed, they are excluded from all statistics. Returns the number of
+// trips removed for operating on too few days and for only operating on
+// school days
+func ExcludeSpecialTrips(f *gtfsparser.Feed, minDays int, schoolDays SchoolDays) (int, int) {
+	type serviceClass struct {
+		days       int
+		schoolOnly bool
+	}
+
+	classes := make(map[*gtfs.Service]serviceClass)
+
+	rare := 0
+	school := 0
+
+	for id, trip := range f.Trips {
+		class, ok := classes[trip.Service]
+		if !ok {
+			class.schoolOnly = len(schoolDays) > 0
+
+			start := trip.Service.GetFirstActiveDate()
+			endT := trip.Service.GetLastActiveDate().GetTime()
+
+			for d := start; !d.GetTime().After(endT); d = d.GetOffsettedDate(1) {
+				if trip.Service.IsActiveOn(d) {
+					class.days++
+					class.schoolOnly = class.schoolOnly && schoolDays[d]
+				}
+			}
+
+			class.schoolOnly = class.schoolOnly && class.days > 0
+			classes[trip.Service] = class
+		}
+
+		if class.days < minDays {
+			delete(f.Trips, id)
+			rare++
+		} else if class.schoolOnly {
+			delete(f.Trips, id)
+			school++
+		}
+	}
+
+	return rare, school
+}
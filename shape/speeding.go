@@ -0,0 +1,79 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"fmt"
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+)
+
+// FindSpeeding finds the trips of Feed f with segments between
+// consecutive stops implying a scheduled speed above the limit of their
+// route type, in km/h. def is the limit of route types not in limits, 0
+// means no limit. Distances are measured in a straight line, so the
+// actual speed is even higher. Times in whole minutes may be rounded by
+// up to a minute, so a minute is added to the travel time of such
+// segments. If drop is true, the trips are removed from the feed.
+// Returns a description of the segments, by trip ID
+func FindSpeeding(f *gtfsparser.Feed, def float64, limits map[int16]float64, drop bool) map[string]string {
+	ret := make(map[string]string)
+
+	for id, trip := range f.Trips {
+		limit, ok := limits[trip.Route.Type]
+		if !ok {
+			limit = def
+		}
+		if limit <= 0 {
+			continue
+		}
+
+		n := 0
+		worst := 0.0
+		var from, to *gtfs.Stop
+
+		for i := 1; i < len(trip.StopTimes); i++ {
+			a, b := &trip.StopTimes[i-1], &trip.StopTimes[i]
+			if !hasCoord(a.Stop()) || !hasCoord(b.Stop()) || a.Departure_time().Empty() || b.Arrival_time().Empty() {
+				continue
+			}
+
+			dep, arr := a.Departure_time(), b.Arrival_time()
+			secs := float64(arr.SecondsSinceMidnight() - dep.SecondsSinceMidnight())
+			if dep.Second == 0 && arr.Second == 0 {
+				secs += 60
+			}
+
+			// non-increasing times are not a matter of speed
+			if secs <= 0 {
+				continue
+			}
+
+			dist := haversine(float64(a.Stop().Lat), float64(a.Stop().Lon), float64(b.Stop().Lat), float64(b.Stop().Lon))
+			speed := dist / secs * 3.6
+
+			if speed > limit {
+				n++
+				if speed > worst {
+					worst, from, to = speed, a.Stop(), b.Stop()
+				}
+			}
+		}
+
+		if n == 0 {
+			continue
+		}
+
+		ret[id] = fmt.Sprintf("%d segments faster than %.0f km/h, up to %.0f km/h from stop '%s' to '%s'", n, limit, worst, from.Id, to.Id)
+
+		if drop {
+			delete(f.Trips, id)
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,152 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/jonas-p/go-shp"
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"sort"
+	"strconv"
+)
+
+// a stop pattern of a route, with the trips following it
+type stopPattern struct {
+	rep   *gtfs.Trip // the trip with the smallest ID
+	trips int        // number of trips
+	freq  int        // number of trips over the service period
+}
+
+// WriteStopChains writes one line per route, direction and stop pattern
+// contained in Feed f to <outFile>.stopchains.shp, connecting the
+// consecutive stops of the pattern with straight segments. The lines do
+// not depend on the shapes, so they can be used for schematic analyses
+// and for feeds with poor shape quality
+func (sw *ShapeWriter) WriteStopChains(f *gtfsparser.Feed, outFile string) int {
+	defer sw.useLayer("stopchains")()
+
+	fileName := sw.getOutFileName(outFile, ".stopchains.shp")
+	shape := sw.createLayer(fileName, sw.lineType(), "stopchains")
+	defer sw.closeLayer(shape, fileName)
+
+	patterns := make(map[string]*stopPattern)
+	days := make(map[*gtfs.Service]int)
+
+	for _, trip := range f.Trips {
+		if (len(sw.motMap) > 0 && !sw.motMap[trip.Route.Type]) || len(trip.StopTimes) < 2 {
+			continue
+		}
+
+		key := trip.Route.Id + "\x00" + strconv.Itoa(int(trip.Direction_id))
+		for _, st := range trip.StopTimes {
+			key += "\x00" + st.Stop().Id
+		}
+
+		p, ok := patterns[key]
+		if !ok {
+			p = &stopPattern{rep: trip}
+			patterns[key] = p
+		}
+
+		if _, ok := days[trip.Service]; !ok {
+			days[trip.Service] = activeDays(trip.Service)
+		}
+
+		p.trips++
+		p.freq += days[trip.Service] * generatedTrips(trip)
+
+		// use the trip with the smallest ID as representative, to be deterministic
+		if trip.Id < p.rep.Id {
+			p.rep = trip
+		}
+	}
+
+	sorted := make([]*stopPattern, 0, len(patterns))
+	for _, p := range patterns {
+		sorted = append(sorted, p)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i].rep, sorted[j].rep
+		if a.Route.Id != b.Route.Id {
+			return a.Route.Id < b.Route.Id
+		}
+		if a.Direction_id != b.Direction_id {
+			return a.Direction_id < b.Direction_id
+		}
+		return a.Id < b.Id
+	})
+
+	routeIDSize := uint8(0)
+	shortNameSize := uint8(0)
+	tripIDSize := uint8(0)
+	stopIDSize := uint8(0)
+	for _, p := range sorted {
+		fitSize(&routeIDSize, len(sw.ids.get("route", p.rep.Route.Id)))
+		fitSize(&shortNameSize, len(p.rep.Route.Short_name))
+		fitSize(&tripIDSize, len(sw.ids.get("trip", p.rep.Id)))
+		fitSize(&stopIDSize, len(sw.ids.get("stop", p.rep.StopTimes[0].Stop().Id)))
+		fitSize(&stopIDSize, len(sw.ids.get("stop", p.rep.StopTimes[len(p.rep.StopTimes)-1].Stop().Id)))
+	}
+
+	shape.SetFields([]shp.Field{
+		shp.StringField(sw.fldName("Route_id"), routeIDSize),
+		shp.StringField(sw.fldName("Short_name"), shortNameSize),
+		shp.NumberField(sw.fldName("R_Type"), 16),
+		shp.NumberField(sw.fldName("Dir_id"), 2),
+		shp.StringField(sw.fldName("Trip_id"), tripIDSize),
+		shp.StringField(sw.fldName("From_stop"), stopIDSize),
+		shp.StringField(sw.fldName("To_stop"), stopIDSize),
+		shp.NumberField(sw.fldName("Num_stops"), 10),
+		shp.NumberField(sw.fldName("Num_trips"), 10),
+		shp.NumberField(sw.fldName("Frequency"), 32),
+		shp.FloatField(sw.fldName("Km"), 32, 3),
+	})
+
+	n := 0
+
+	for _, p := range sorted {
+		trip := p.rep
+
+		parts := sw.stationParts(trip)
+		if len(parts) == 0 {
+			continue
+		}
+
+		shape.Write(sw.newLineParts(sw.stationPartsToShpLines(parts), nil))
+
+		shape.WriteAttribute(n, 0, sw.ids.get("route", trip.Route.Id))
+		shape.WriteAttribute(n, 1, trip.Route.Short_name)
+		shape.WriteAttribute(n, 2, trip.Route.Type)
+		shape.WriteAttribute(n, 3, trip.Direction_id)
+		shape.WriteAttribute(n, 4, sw.ids.get("trip", trip.Id))
+		shape.WriteAttribute(n, 5, sw.ids.get("stop", trip.StopTimes[0].Stop().Id))
+		shape.WriteAttribute(n, 6, sw.ids.get("stop", trip.StopTimes[len(trip.StopTimes)-1].Stop().Id))
+		shape.WriteAttribute(n, 7, len(trip.StopTimes))
+		shape.WriteAttribute(n, 8, p.trips)
+		shape.WriteAttribute(n, 9, p.freq)
+		sw.writeFloatAttr(shape, n, 10, stationPartsMeterLength(parts)/1000.0)
+
+		n = n + 1
+	}
+
+	return n
+}
+
+// return the number of days service s is active on
+func activeDays(s *gtfs.Service) int {
+	start := s.GetFirstActiveDate()
+	endT := s.GetLastActiveDate().GetTime()
+
+	ret := 0
+	for d := start; !d.GetTime().After(endT); d = d.GetOffsettedDate(1) {
+		if s.IsActiveOn(d) {
+			ret++
+		}
+	}
+
+	return ret
+}
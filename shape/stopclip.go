@@ -0,0 +1,333 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"fmt"
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"math"
+	"strings"
+)
+
+// StopRange gives the stops the trips of a route are clipped to, by stop
+// ID or name. An empty From keeps the trips from their first stop, an
+// empty To keeps them up to their last stop
+type StopRange struct {
+	From string
+	To   string
+}
+
+// ParseStopRanges parses the stop ranges from the lists of stops from and
+// to, given as "route:stop" entries separated by semicolons, like
+// "5:Central;7:Main Street". Routes are given by ID or short name,
+// entries without a route apply to all routes not listed explicitly.
+// Returns the stop ranges of the routes of Feed f
+func ParseStopRanges(f *gtfsparser.Feed, from string, to string) (map[*gtfs.Route]StopRange, error) {
+	explicit := make(map[*gtfs.Route]StopRange)
+	all := StopRange{}
+
+	parse := func(list string, set func(*StopRange, string)) error {
+		for _, entry := range strings.Split(list, ";") {
+			entry = strings.TrimSpace(entry)
+			if len(entry) == 0 {
+				continue
+			}
+
+			stop := entry
+			var routes []*gtfs.Route
+
+			// stop names may contain colons, only split if the prefix
+			// is a route
+			if i := strings.Index(entry, ":"); i > 0 {
+				routes = findRoutes(f, strings.TrimSpace(entry[:i]))
+				if len(routes) > 0 {
+					stop = strings.TrimSpace(entry[i+1:])
+				}
+			}
+
+			if len(findStops(f, stop)) == 0 {
+				return fmt.Errorf("unknown stop '%s'", stop)
+			}
+
+			if len(routes) == 0 {
+				set(&all, stop)
+				continue
+			}
+
+			for _, r := range routes {
+				rng := explicit[r]
+				set(&rng, stop)
+				explicit[r] = rng
+			}
+		}
+		return nil
+	}
+
+	if err := parse(from, func(r *StopRange, s string) { r.From = s }); err != nil {
+		return nil, err
+	}
+	if err := parse(to, func(r *StopRange, s string) { r.To = s }); err != nil {
+		return nil, err
+	}
+
+	ret := make(map[*gtfs.Route]StopRange)
+
+	for _, r := range f.Routes {
+		rng, ok := explicit[r]
+		if !ok {
+			rng = all
+		}
+		if len(rng.From) > 0 || len(rng.To) > 0 {
+			ret[r] = rng
+		}
+	}
+
+	return ret, nil
+}
+
+// ClipToStopRanges clips the trips of the routes in ranges to the part
+// between their stop range, in whichever order the stops are served.
+// Stop times outside of the range are removed, and shapes are clipped
+// at the projections of the stops onto them. Trips not serving the stops
+// of their range are dropped. The gaps recorded by HandleMissingStops
+// are moved along with the stop times. Returns the number of clipped and
+// dropped trips
+func (sw *ShapeWriter) ClipToStopRanges(f *gtfsparser.Feed, ranges map[*gtfs.Route]StopRange) (int, int) {
+	type clipKey struct {
+		shape *gtfs.Shape
+		a, b  *gtfs.Stop
+	}
+
+	clippedShapes := make(map[clipKey]*gtfs.Shape)
+	usedShapes := make(map[*gtfs.Shape]bool)
+	clipped, dropped := 0, 0
+
+	for id, trip := range f.Trips {
+		rng, ok := ranges[trip.Route]
+		if !ok {
+			if trip.Shape != nil {
+				usedShapes[trip.Shape] = true
+			}
+			continue
+		}
+
+		first, last := 0, len(trip.StopTimes)-1
+
+		if len(rng.From) > 0 || len(rng.To) > 0 {
+			i, j := -1, -1
+			if len(rng.From) > 0 {
+				i = stopIndex(trip, rng.From)
+			}
+			if len(rng.To) > 0 {
+				j = stopIndex(trip, rng.To)
+			}
+
+			switch {
+			case len(rng.From) > 0 && i < 0, len(rng.To) > 0 && j < 0:
+				first, last = -1, -1
+			case len(rng.From) == 0:
+				last = j
+			case len(rng.To) == 0:
+				first = i
+			default:
+				first, last = i, j
+				if first > last {
+					first, last = last, first
+				}
+			}
+		}
+
+		if first < 0 || last <= first {
+			delete(f.Trips, id)
+			delete(sw.stopGaps, trip)
+			dropped++
+			continue
+		}
+
+		if first == 0 && last == len(trip.StopTimes)-1 {
+			if trip.Shape != nil {
+				usedShapes[trip.Shape] = true
+			}
+			continue
+		}
+
+		a := trip.StopTimes[first].Stop()
+		b := trip.StopTimes[last].Stop()
+		trip.StopTimes = trip.StopTimes[first : last+1]
+		sw.clipStopGaps(trip, first, last)
+		clipped++
+
+		if trip.Shape == nil || !hasCoord(a) || !hasCoord(b) {
+			continue
+		}
+
+		key := clipKey{trip.Shape, a, b}
+		shape, ok := clippedShapes[key]
+		if !ok {
+			shape = &gtfs.Shape{
+				Id:     fmt.Sprintf("%s:%s-%s", trip.Shape.Id, a.Id, b.Id),
+				Points: clipShapeToStops(trip.Shape.Points, a, b),
+			}
+			clippedShapes[key] = shape
+			f.Shapes[shape.Id] = shape
+		}
+
+		trip.Shape = shape
+		usedShapes[shape] = true
+	}
+
+	// drop the original shapes no longer used by any trip
+	for key := range clippedShapes {
+		if !usedShapes[key.shape] {
+			delete(f.Shapes, key.shape.Id)
+		}
+	}
+
+	return clipped, dropped
+}
+
+// shift the gaps recorded for trip to its stop times clipped to the
+// positions first to last. Gaps at or before first no longer lie between
+// two kept stops and are dropped
+func (sw *ShapeWriter) clipStopGaps(trip *gtfs.Trip, first int, last int) {
+	gaps, ok := sw.stopGaps[trip]
+	if !ok {
+		return
+	}
+
+	clipped := make(map[int]bool)
+	for i := range gaps {
+		if i > first && i <= last {
+			clipped[i-first] = true
+		}
+	}
+
+	if len(clipped) == 0 {
+		delete(sw.stopGaps, trip)
+	} else {
+		sw.stopGaps[trip] = clipped
+	}
+}
+
+// return the index of the first stop time of trip at the stop given by ID
+// or name, or at a child stop of it. Returns -1 if the trip does not
+// serve the stop
+func stopIndex(trip *gtfs.Trip, stop string) int {
+	for i, st := range trip.StopTimes {
+		if matchesStop(st.Stop(), stop) || (st.Stop() != nil && matchesStop(st.Stop().Parent_station, stop)) {
+			return i
+		}
+	}
+	return -1
+}
+
+func matchesStop(s *gtfs.Stop, stop string) bool {
+	return s != nil && (s.Id == stop || s.Name == stop)
+}
+
+// return the stops of Feed f with ID or name stop
+func findStops(f *gtfsparser.Feed, stop string) []*gtfs.Stop {
+	ret := make([]*gtfs.Stop, 0)
+	for _, s := range f.Stops {
+		if matchesStop(s, stop) {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// return the routes of Feed f with ID or short name route
+func findRoutes(f *gtfsparser.Feed, route string) []*gtfs.Route {
+	if r, ok := f.Routes[route]; ok {
+		return []*gtfs.Route{r}
+	}
+
+	ret := make([]*gtfs.Route, 0)
+	for _, r := range f.Routes {
+		if r.Short_name == route {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+// clip shape points to the part between the projections of stops a and
+// b onto them, b being projected behind a. The measures of the cut
+// positions are interpolated
+func clipShapeToStops(points gtfs.ShapePoints, a *gtfs.Stop, b *gtfs.Stop) gtfs.ShapePoints {
+	if len(points) < 2 {
+		return points
+	}
+
+	i, t := projectStopOnShape(points, a, 0, 0)
+	j, u := projectStopOnShape(points, b, i, t)
+
+	ret := make(gtfs.ShapePoints, 0, j-i+2)
+
+	add := func(p gtfs.ShapePoint) {
+		if l := len(ret); l > 0 && ret[l-1].Lat == p.Lat && ret[l-1].Lon == p.Lon {
+			return
+		}
+		ret = append(ret, p)
+	}
+
+	add(interpolateShapePoint(points, i, t))
+	for k := i + 1; k <= j; k++ {
+		add(points[k])
+	}
+	add(interpolateShapePoint(points, j, u))
+
+	return ret
+}
+
+// return the segment of points (given by the index of its first point)
+// nearest to stop and the position of the projection of stop on it, not
+// before position minT on segment minSeg
+func projectStopOnShape(points gtfs.ShapePoints, stop *gtfs.Stop, minSeg int, minT float64) (int, float64) {
+	frame := localFrame{lat0: float64(stop.Lat), lon0: float64(stop.Lon)}
+	frame.cosLat = math.Cos(frame.lat0 * DEG_TO_RAD)
+
+	best, bestT := minSeg, minT
+	bestDist := math.Inf(1)
+
+	for k := minSeg; k < len(points)-1; k++ {
+		a := frame.toLocal([2]float64{float64(points[k].Lat), float64(points[k].Lon)})
+		b := frame.toLocal([2]float64{float64(points[k+1].Lat), float64(points[k+1].Lon)})
+
+		dx, dy := b.x-a.x, b.y-a.y
+		t := 0.0
+		if dx != 0 || dy != 0 {
+			t = math.Max(0, math.Min(1, -(a.x*dx+a.y*dy)/(dx*dx+dy*dy)))
+		}
+		if k == minSeg {
+			t = math.Max(t, minT)
+		}
+
+		if d := math.Hypot(a.x+t*dx, a.y+t*dy); d < bestDist {
+			best, bestT, bestDist = k, t, d
+		}
+	}
+
+	return best, bestT
+}
+
+// return the point at position t on the segment of points starting at k
+func interpolateShapePoint(points gtfs.ShapePoints, k int, t float64) gtfs.ShapePoint {
+	a := points[k]
+	if k+1 >= len(points) {
+		return a
+	}
+	b := points[k+1]
+
+	return gtfs.ShapePoint{
+		Lat:           a.Lat + float32(t)*(b.Lat-a.Lat),
+		Lon:           a.Lon + float32(t)*(b.Lon-a.Lon),
+		Sequence:      a.Sequence,
+		Dist_traveled: a.Dist_traveled + float32(t)*(b.Dist_traveled-a.Dist_traveled),
+	}
+}
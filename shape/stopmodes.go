@@ -0,0 +1,164 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"math"
+	"sort"
+)
+
+// return the route types (of the considered MOTs) serving each stop. Parent
+// stations get the route types of their stops, and entrances, generic nodes
+// and boarding areas those of their parent station
+func (sw *ShapeWriter) getStopModes(f *gtfsparser.Feed) map[*gtfs.Stop]map[int16]bool {
+	ret := make(map[*gtfs.Stop]map[int16]bool)
+
+	add := func(stop *gtfs.Stop, t int16) {
+		if ret[stop] == nil {
+			ret[stop] = make(map[int16]bool)
+		}
+		ret[stop][t] = true
+	}
+
+	for _, trip := range f.Trips {
+		if len(sw.motMap) > 0 && !sw.motMap[trip.Route.Type] {
+			continue
+		}
+
+		for _, st := range trip.StopTimes {
+			add(st.Stop(), trip.Route.Type)
+			if st.Stop().Parent_station != nil {
+				add(st.Stop().Parent_station, trip.Route.Type)
+			}
+		}
+	}
+
+	for _, stop := range f.Stops {
+		if stop.Location_type < 2 || stop.Parent_station == nil {
+			continue
+		}
+
+		for t := range ret[stop.Parent_station] {
+			add(stop, t)
+		}
+	}
+
+	return ret
+}
+
+// compute the route types serving each stop, if stops are filtered or
+// split by them
+func (sw *ShapeWriter) initStopModes(f *gtfsparser.Feed) {
+	if (len(sw.motMap) > 0 || sw.opts.SplitStationsByMode) && sw.stopModes == nil {
+		sw.stopModes = sw.getStopModes(f)
+	}
+}
+
+// return all route types serving at least one stop, sorted
+func (sw *ShapeWriter) servedModes() []int16 {
+	seen := make(map[int16]bool)
+	ret := make([]int16, 0)
+
+	for _, modes := range sw.stopModes {
+		for t := range modes {
+			if !seen[t] {
+				seen[t] = true
+				ret = append(ret, t)
+			}
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+
+	return ret
+}
+
+// numbers of trips serving a stop over the service period, and of the
+// wheelchair accessible ones and those allowing bikes among them
+type stopAccess struct {
+	trips      int
+	wheelchair int
+	bikes      int
+}
+
+// return the trips (of the considered MOTs) serving each stop over the
+// service period, as counted for the route shapes, and how many of them
+// are wheelchair accessible and allow bikes. Stop times without pickup
+// and drop off are not counted. Parent stations get the trips of their
+// stops, each trip counted once
+func (sw *ShapeWriter) getStopAccess(f *gtfsparser.Feed) map[*gtfs.Stop]*stopAccess {
+	ret := make(map[*gtfs.Stop]*stopAccess)
+	activeDays := make(map[*gtfs.Service]int)
+
+	for _, trip := range f.Trips {
+		if len(sw.motMap) > 0 && !sw.motMap[trip.Route.Type] {
+			continue
+		}
+
+		days, ok := activeDays[trip.Service]
+		if !ok {
+			end := trip.Service.GetLastActiveDate().GetTime()
+			for d := trip.Service.GetFirstActiveDate(); !d.GetTime().After(end); d = d.GetOffsettedDate(1) {
+				if trip.Service.IsActiveOn(d) {
+					days++
+				}
+			}
+			activeDays[trip.Service] = days
+		}
+
+		numTrips := days * generatedTrips(trip)
+		if numTrips == 0 {
+			continue
+		}
+
+		seen := make(map[*gtfs.Stop]bool)
+		for _, st := range trip.StopTimes {
+			if st.Drop_off_type() == 1 && st.Pickup_type() == 1 {
+				continue
+			}
+
+			for _, stop := range []*gtfs.Stop{st.Stop(), st.Stop().Parent_station} {
+				if stop == nil || seen[stop] {
+					continue
+				}
+				seen[stop] = true
+
+				if ret[stop] == nil {
+					ret[stop] = &stopAccess{}
+				}
+				ret[stop].trips += numTrips
+				if trip.Wheelchair_accessible == 1 {
+					ret[stop].wheelchair += numTrips
+				}
+				if trip.Bikes_allowed == 1 {
+					ret[stop].bikes += numTrips
+				}
+			}
+		}
+	}
+
+	return ret
+}
+
+// return the shares of wheelchair accessible trips and trips allowing
+// bikes among the trips serving a stop, NaN if none serves it
+func (a *stopAccess) shares() (float64, float64) {
+	if a == nil || a.trips == 0 {
+		return math.NaN(), math.NaN()
+	}
+	return float64(a.wheelchair) / float64(a.trips), float64(a.bikes) / float64(a.trips)
+}
+
+// return the number of trips serving a stop over the service period
+func (a *stopAccess) numTrips() int {
+	if a == nil {
+		return 0
+	}
+	return a.trips
+}
@@ -0,0 +1,44 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/jonas-p/go-shp"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"strings"
+)
+
+// prefix of the stop name columns per language, followed by the
+// language code
+const stopNameFldPrefix = "Name_"
+
+// return the name of stop in language lang as given in translations.txt,
+// or an empty string if there is no translation
+func stopNameIn(stop *gtfs.Stop, lang string) string {
+	for _, tr := range stop.Translations {
+		if tr.FieldName == "stop_name" && strings.EqualFold(tr.Language.GetLangString(), lang) {
+			return tr.Translation
+		}
+	}
+	return ""
+}
+
+// return the fields of the stop names in the languages of StopNameLangs,
+// sized to fit the names of stops
+func (sw *ShapeWriter) stopNameFields(stops []*gtfs.Stop) []shp.Field {
+	ret := make([]shp.Field, 0, len(sw.opts.StopNameLangs))
+
+	for _, lang := range sw.opts.StopNameLangs {
+		size := uint8(0)
+		for _, stop := range stops {
+			fitSize(&size, len(stopNameIn(stop, lang)))
+		}
+		ret = append(ret, shp.StringField(sw.fldName(stopNameFldPrefix+lang), size))
+	}
+
+	return ret
+}
@@ -0,0 +1,106 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"fmt"
+	"github.com/jonas-p/go-shp"
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"strings"
+)
+
+// number of computed features buffered in feature streams
+const streamBuffer = 64
+
+// Feature is an output feature, as it would be written to a shapefile
+// layer
+type Feature struct {
+	// The layer the feature would be written to, like "water" for
+	// water routes if SplitModeClasses is set or "dir0" if SplitDirection
+	// is set. Empty for the main layer
+	Layer string
+
+	// The route and the aggregated shape of the feature
+	Route *gtfs.Route
+	Shape *AggrShape
+
+	// The geometry in the output projection
+	Geometry shp.Shape
+
+	// The attributes of the selected schema version, by field name as
+	// written to the DBF
+	Attributes map[string]interface{}
+
+	// Set on a final feature without geometry if computing the
+	// features failed
+	Err error
+}
+
+// StreamRouteShapes computes the features WriteRouteShapes would write
+// for Feed f and sends them on the returned channel as soon as they are
+// computed, in the same order. Consumers can process them (e.g. upload
+// them to a tile service) without waiting for a whole layer. Features
+// not matching the Where expression are skipped. The channel is closed
+// after the last feature and must be read until then; the ShapeWriter
+// must not be used otherwise in the meantime
+func (sw *ShapeWriter) StreamRouteShapes(f *gtfsparser.Feed, typeMap map[int16]string, routeAddFlds []string) <-chan Feature {
+	ch := make(chan Feature, streamBuffer)
+
+	go func() {
+		defer close(ch)
+
+		defer func() {
+			if r := recover(); r != nil {
+				ch <- Feature{Err: fmt.Errorf("%v", r)}
+			}
+		}()
+
+		defer sw.useLayer("routes")()
+
+		drop := sw.droppedColumns("routes")
+		var names []string
+		var lowerNames map[string]int
+		where := sw.opts.Where
+
+		sw.routeShapeStream(f, typeMap, routeAddFlds, func(fields []shp.Field) {
+			names = make([]string, len(fields))
+			lowerNames = make(map[string]int, len(fields))
+			for i, fld := range fields {
+				names[i] = fld.String()
+				lowerNames[strings.ToLower(names[i])] = i
+			}
+
+			if where != nil && !where.appliesTo(lowerNames) {
+				where = nil
+			}
+		}, func(feature routeShapeFeature) {
+			if where != nil && !where.Match(func(name string) interface{} {
+				return feature.attrs[lowerNames[name]]
+			}) {
+				return
+			}
+
+			attrs := make(map[string]interface{}, len(feature.attrs))
+			for fld, val := range feature.attrs {
+				if !drop[names[fld]] {
+					attrs[names[fld]] = val
+				}
+			}
+
+			ch <- Feature{
+				Layer:      feature.layerName,
+				Route:      feature.route,
+				Shape:      feature.aggrShape,
+				Geometry:   feature.line,
+				Attributes: attrs,
+			}
+		})
+	}()
+
+	return ch
+}
@@ -0,0 +1,198 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// line color of routes without a color of their own
+const defaultStyleColor = "#555555"
+
+// base line widths in pixels per basic GTFS route type, scaled with the
+// zoom level
+var styleWidths = map[int16]float64{
+	0:  3,   // tram
+	1:  3.5, // subway
+	2:  4,   // rail
+	3:  2,   // bus
+	4:  2.5, // ferry
+	5:  2,   // cable tram
+	6:  2,   // aerial lift
+	7:  2,   // funicular
+	11: 2,   // trolleybus
+	12: 3,   // monorail
+}
+
+// WriteStyle writes a MapLibre GL style to <outFile>.style.json, drawing
+// the route shapes contained in Feed f in their route colors, with line
+// widths depending on the route type. source is the URL of the route
+// shapes, either converted to GeoJSON (if it ends in .geojson or .json),
+// or to vector tiles (a tile URL template with {z}/{x}/{y}, a TileJSON
+// URL or a pmtiles:// URL) with the route shapes in a layer named after
+// the shapefile
+func (sw *ShapeWriter) WriteStyle(f *gtfsparser.Feed, source string, outFile string) {
+	file, err := sw.createFile(sw.getOutFileName(outFile, ".style.json"))
+	if err != nil {
+		panic(fmt.Sprintf("Could not open style file for writing (%s)", err))
+	}
+	defer file.Close()
+
+	aggrShapes, routeShapes := sw.getAggrShapes(f.Trips, f)
+
+	routes := make([]*gtfs.Route, 0, len(routeShapes))
+	for r := range routeShapes {
+		routes = append(routes, r)
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Id < routes[j].Id })
+
+	routeID := []interface{}{"get", sw.fldName("Route_id")}
+
+	var color, width interface{} = defaultStyleColor, styleWidth(3)
+	if len(routes) > 0 {
+		colors := []interface{}{"match", routeID}
+		widths := []interface{}{"match", routeID}
+		for _, r := range routes {
+			id := sw.ids.get("route", r.Id)
+			colors = append(colors, id, styleColor(r))
+			widths = append(widths, id, styleWidth(r.Type))
+		}
+		color = append(colors, defaultStyleColor)
+		width = append(widths, styleWidth(3))
+	}
+
+	src := map[string]interface{}{}
+	layer := map[string]interface{}{
+		"id":     "routes",
+		"type":   "line",
+		"source": "gtfs",
+		"layout": map[string]interface{}{
+			"line-cap":      "round",
+			"line-join":     "round",
+			"line-sort-key": width,
+		},
+		"paint": map[string]interface{}{
+			"line-color": color,
+			"line-width": []interface{}{"interpolate", []interface{}{"exponential", 1.5}, []interface{}{"zoom"},
+				8, []interface{}{"*", 0.5, width},
+				16, []interface{}{"*", 2, width}},
+		},
+	}
+
+	lower := strings.ToLower(source)
+	if strings.HasSuffix(lower, ".geojson") || strings.HasSuffix(lower, ".json") && !strings.Contains(source, "{z}") {
+		src["type"] = "geojson"
+		src["data"] = source
+	} else {
+		src["type"] = "vector"
+		if strings.Contains(source, "{z}") {
+			src["tiles"] = []string{source}
+		} else {
+			src["url"] = source
+		}
+		layer["source-layer"] = strings.TrimSuffix(filepath.Base(sw.getShapeFileName(outFile)), ".shp")
+	}
+
+	style := map[string]interface{}{
+		"version": 8,
+		"name":    filepath.Base(strings.TrimSuffix(outFile, filepath.Ext(outFile))),
+		"sources": map[string]interface{}{"gtfs": src},
+		"layers": []interface{}{
+			map[string]interface{}{
+				"id":    "background",
+				"type":  "background",
+				"paint": map[string]interface{}{"background-color": "#ffffff"},
+			},
+			layer,
+		},
+	}
+
+	if lat, lon, zoom, ok := styleView(aggrShapes); ok {
+		style["center"] = []float64{lon, lat}
+		style["zoom"] = zoom
+	}
+
+	enc := json.NewEncoder(file)
+	enc.SetIndent("", "  ")
+
+	if err := enc.Encode(style); err != nil {
+		panic(fmt.Sprintf("Could not write style file (%s)", err))
+	}
+}
+
+// return the color of route r as a CSS color. GTFS defaults missing route
+// colors to white, which is replaced by the default style color
+func styleColor(r *gtfs.Route) string {
+	if len(r.Color) != 6 || strings.EqualFold(r.Color, "FFFFFF") {
+		return defaultStyleColor
+	}
+	return "#" + strings.ToLower(r.Color)
+}
+
+// return the base line width of route type t, extended route types are
+// mapped to their basic type
+func styleWidth(t int16) float64 {
+	switch {
+	case t >= 100 && t < 200:
+		t = 2
+	case t >= 200 && t < 300, t >= 700 && t < 800:
+		t = 3
+	case t >= 400 && t < 500:
+		t = 1
+	case t >= 800 && t < 900:
+		t = 11
+	case t >= 900 && t < 1000:
+		t = 0
+	case ModeClass(t) == "water":
+		t = 4
+	case ModeClass(t) == "aerial":
+		t = 6
+	case ModeClass(t) == "funicular":
+		t = 7
+	}
+
+	if w, ok := styleWidths[t]; ok {
+		return w
+	}
+	return styleWidths[3]
+}
+
+// return the center and a zoom level showing the bounding box of the
+// aggregated shapes
+func styleView(aggrShapes map[string]*AggrShape) (float64, float64, float64, bool) {
+	minLat, minLon := math.Inf(1), math.Inf(1)
+	maxLat, maxLon := math.Inf(-1), math.Inf(-1)
+
+	for _, as := range aggrShapes {
+		for _, p := range as.Shape.Points {
+			minLat, maxLat = math.Min(minLat, float64(p.Lat)), math.Max(maxLat, float64(p.Lat))
+			minLon, maxLon = math.Min(minLon, float64(p.Lon)), math.Max(maxLon, float64(p.Lon))
+		}
+	}
+
+	if math.IsInf(minLat, 0) {
+		return 0, 0, 0, false
+	}
+
+	// the extent of the box in degrees of longitude, fitted into a
+	// viewport of about 1000 pixels with 256 pixel tiles
+	lat := (minLat + maxLat) / 2
+	span := math.Max(maxLon-minLon, (maxLat-minLat)/math.Cos(lat*DEG_TO_RAD))
+	zoom := 14.0
+	if span > 0 {
+		zoom = math.Max(0, math.Min(16, math.Floor(math.Log2(360*1000/256/span))))
+	}
+
+	return lat, (minLon + maxLon) / 2, zoom, true
+}
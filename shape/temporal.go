@@ -0,0 +1,141 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"fmt"
+	"github.com/jonas-p/go-shp"
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"math"
+	"time"
+)
+
+// write a date as an ISO 8601 string into field fld and as Unix epoch
+// seconds (of midnight UTC) into field fld+1
+func (sw *ShapeWriter) writeDateAttrs(shape *layer, row int, fld int, d gtfs.Date) {
+	if d.IsEmpty() {
+		shape.WriteAttribute(row, fld, "")
+		sw.writeFloatAttr(shape, row, fld+1, math.NaN())
+		return
+	}
+
+	shape.WriteAttribute(row, fld, isoDate(d))
+	shape.WriteAttribute(row, fld+1, int(dateEpoch(d)))
+}
+
+// return a date as an ISO 8601 string
+func isoDate(d gtfs.Date) string {
+	return fmt.Sprintf("%04d-%02d-%02d", d.Year(), d.Month(), d.Day())
+}
+
+// return the Unix epoch seconds of midnight UTC of a date
+func dateEpoch(d gtfs.Date) int64 {
+	return time.Date(int(d.Year()), time.Month(d.Month()), int(d.Day()), 0, 0, 0, 0, time.UTC).Unix()
+}
+
+// return seconds since midnight as an ISO 8601 time string. As in GTFS,
+// times after midnight of the next day have hours >= 24
+func isoTime(secs int) string {
+	if secs < 0 {
+		return "-" + isoTime(-secs)
+	}
+	return fmt.Sprintf("%02d:%02d:%02d", secs/3600, (secs/60)%60, secs%60)
+}
+
+// WriteStopEvents writes one point per stop time of the given trips
+// contained in Feed f to <outFile>.stopevents.shp. If tripIDs is empty,
+// the stop times of all trips are written
+func (sw *ShapeWriter) WriteStopEvents(f *gtfsparser.Feed, tripIDs map[string]bool, outFile string) int {
+	defer sw.useLayer("stopevents")()
+
+	fileName := sw.getOutFileName(outFile, ".stopevents.shp")
+	shape := sw.createLayer(fileName, shp.POINT, "stopevents")
+	defer sw.closeLayer(shape, fileName)
+
+	trips := make([]*gtfs.Trip, 0)
+	for id, trip := range f.Trips {
+		if (len(tripIDs) == 0 || tripIDs[id]) && (len(sw.motMap) == 0 || sw.motMap[trip.Route.Type]) {
+			trips = append(trips, trip)
+		}
+	}
+
+	tripIDSize := uint8(0)
+	stopIDSize := uint8(0)
+	for _, trip := range trips {
+		fitSize(&tripIDSize, len(sw.ids.get("trip", trip.Id)))
+		for _, st := range trip.StopTimes {
+			fitSize(&stopIDSize, len(sw.ids.get("stop", st.Stop().Id)))
+		}
+	}
+
+	shape.SetFields([]shp.Field{
+		shp.StringField(sw.fldName("Trip_id"), tripIDSize),
+		shp.StringField(sw.fldName("Stop_id"), stopIDSize),
+		shp.NumberField(sw.fldName("Seq"), 10),
+		shp.StringField(sw.fldName("Arr"), 9),
+		shp.StringField(sw.fldName("Dep"), 9),
+		shp.NumberField(sw.fldName("Arr_sec"), 6),
+		shp.NumberField(sw.fldName("Dep_sec"), 6),
+		shp.NumberField(sw.fldName("Dwell"), 6),
+		shp.FloatField(sw.fldName("Dist"), 32, 5),
+	})
+
+	n := 0
+
+	for _, trip := range trips {
+		start := sw.getServiceDays(trip.Service).start
+
+		for _, st := range trip.StopTimes {
+			if !hasCoord(st.Stop()) {
+				continue
+			}
+
+			shape.Write(sw.gtfsStopToShpPoint(st.Stop()))
+
+			shape.WriteAttribute(n, 0, sw.ids.get("trip", trip.Id))
+			shape.WriteAttribute(n, 1, sw.ids.get("stop", st.Stop().Id))
+			shape.WriteAttribute(n, 2, st.Sequence())
+
+			arr := st.Arrival_time()
+			dep := st.Departure_time()
+
+			arrSec := sw.normalizeTime(arr.SecondsSinceMidnight(), trip.Route.Agency, st.Stop(), start)
+			depSec := sw.normalizeTime(dep.SecondsSinceMidnight(), trip.Route.Agency, st.Stop(), start)
+
+			if !arr.Empty() {
+				shape.WriteAttribute(n, 3, isoTime(arrSec))
+				shape.WriteAttribute(n, 5, arrSec)
+			} else {
+				sw.writeFloatAttr(shape, n, 5, math.NaN())
+			}
+
+			if !dep.Empty() {
+				shape.WriteAttribute(n, 4, isoTime(depSec))
+				shape.WriteAttribute(n, 6, depSec)
+			} else {
+				sw.writeFloatAttr(shape, n, 6, math.NaN())
+			}
+
+			if !arr.Empty() && !dep.Empty() {
+				shape.WriteAttribute(n, 7, dep.SecondsSinceMidnight()-arr.SecondsSinceMidnight())
+			} else {
+				sw.writeFloatAttr(shape, n, 7, math.NaN())
+			}
+
+			if st.HasDistanceTraveled() {
+				sw.writeFloatAttr(shape, n, 8, float64(st.Shape_dist_traveled()))
+			} else {
+				sw.writeFloatAttr(shape, n, 8, math.NaN())
+			}
+
+			n = n + 1
+		}
+	}
+
+	return n
+}
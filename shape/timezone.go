@@ -0,0 +1,94 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"sync"
+	"time"
+)
+
+// StopTimezones can be given as WriteOptions.Timezone to write times in
+// the local time of each stop
+const StopTimezones = "stop"
+
+// cache of loaded timezones by name
+type tzCache struct {
+	mutex sync.Mutex
+	locs  map[string]*time.Location
+}
+
+// return the location of the timezone name, or nil if it is unknown
+func (sw *ShapeWriter) getLocation(name string) *time.Location {
+	if len(name) == 0 {
+		return nil
+	}
+
+	sw.tzs.mutex.Lock()
+	defer sw.tzs.mutex.Unlock()
+
+	if sw.tzs.locs == nil {
+		sw.tzs.locs = make(map[string]*time.Location)
+	}
+
+	if loc, ok := sw.tzs.locs[name]; ok {
+		return loc
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		loc = nil
+	}
+
+	sw.tzs.locs[name] = loc
+
+	return loc
+}
+
+// return the timezone of a stop, which is inherited from its parent
+// station if it has none
+func (sw *ShapeWriter) stopLocation(stop *gtfs.Stop) *time.Location {
+	for s := stop; s != nil; s = s.Parent_station {
+		if loc := sw.getLocation(s.Timezone.GetTzString()); loc != nil {
+			return loc
+		}
+	}
+	return nil
+}
+
+// convert a GTFS time at stop on service date d, given in seconds since
+// midnight in the timezone of the agency, to the output timezone. The
+// result is still relative to midnight of d, and may be negative or
+// exceed 24 hours. Times are returned unchanged if no output timezone
+// is set
+func (sw *ShapeWriter) normalizeTime(secs int, agency *gtfs.Agency, stop *gtfs.Stop, d gtfs.Date) int {
+	if len(sw.opts.Timezone) == 0 || agency == nil || d.IsEmpty() {
+		return secs
+	}
+
+	src := sw.getLocation(agency.Timezone.GetTzString())
+
+	var dst *time.Location
+	if sw.opts.Timezone == StopTimezones {
+		dst = sw.stopLocation(stop)
+	} else {
+		dst = sw.getLocation(sw.opts.Timezone)
+	}
+
+	if src == nil || dst == nil || src == dst {
+		return secs
+	}
+
+	// GTFS times are measured from noon minus 12 hours of the service date
+	t := d.GetTime()
+	instant := time.Date(t.Year(), t.Month(), t.Day(), 12, 0, 0, 0, src).Add(time.Duration(secs-12*3600) * time.Second)
+
+	_, srcOffset := instant.In(src).Zone()
+	_, dstOffset := instant.In(dst).Zone()
+
+	return secs + dstOffset - srcOffset
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+)
+
+// return the number of transfers.txt and of pathways.txt records
+// referencing each stop, as from or to stop. Records referencing a stop
+// also count for its parent station, records between two stops of the
+// same station count once
+func stopTransferCounts(f *gtfsparser.Feed) (map[*gtfs.Stop]int, map[*gtfs.Stop]int) {
+	transfers := make(map[*gtfs.Stop]int)
+	pathways := make(map[*gtfs.Stop]int)
+
+	for key := range f.Transfers {
+		countStopRecord(transfers, key.From_stop, key.To_stop)
+	}
+
+	for _, pw := range f.Pathways {
+		countStopRecord(pathways, pw.From_stop, pw.To_stop)
+	}
+
+	return transfers, pathways
+}
+
+// return the station group of each stop of Feed f, given by the stop
+// representing the group. Stops are grouped with the topmost station of
+// their parent_station chain, and stations connected by pathways.txt
+// records between their stops are merged. Groups are represented by the
+// top-level stop with the smallest ID
+func stationGroups(f *gtfsparser.Feed) map[*gtfs.Stop]*gtfs.Stop {
+	// union-find over the top-level stops
+	up := make(map[*gtfs.Stop]*gtfs.Stop)
+
+	var find func(*gtfs.Stop) *gtfs.Stop
+	find = func(s *gtfs.Stop) *gtfs.Stop {
+		for s.Parent_station != nil && s.Parent_station != s {
+			s = s.Parent_station
+		}
+		if u, ok := up[s]; ok && u != s {
+			r := find(u)
+			up[s] = r
+			return r
+		}
+		return s
+	}
+
+	for _, pw := range f.Pathways {
+		if pw.From_stop == nil || pw.To_stop == nil {
+			continue
+		}
+
+		a, b := find(pw.From_stop), find(pw.To_stop)
+		if a == b {
+			continue
+		}
+		if b.Id < a.Id {
+			a, b = b, a
+		}
+		up[b] = a
+	}
+
+	ret := make(map[*gtfs.Stop]*gtfs.Stop, len(f.Stops))
+	for _, stop := range f.Stops {
+		ret[stop] = find(stop)
+	}
+
+	return ret
+}
+
+// count a record referencing stops (which may be nil) for each of them
+// and their parent stations, once per stop
+func countStopRecord(counts map[*gtfs.Stop]int, stops ...*gtfs.Stop) {
+	seen := make(map[*gtfs.Stop]bool, 2*len(stops))
+
+	for _, stop := range stops {
+		for s := stop; s != nil && !seen[s]; s = s.Parent_station {
+			seen[s] = true
+			counts[s]++
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"fmt"
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+)
+
+// trip attributes available in trip filters, by lower-cased name
+var tripFilterFields = map[string]func(t *gtfs.Trip) interface{}{
+	"trip_id":          func(t *gtfs.Trip) interface{} { return t.Id },
+	"trip_headsign":    func(t *gtfs.Trip) interface{} { return t.Headsign },
+	"headsign":         func(t *gtfs.Trip) interface{} { return t.Headsign },
+	"trip_short_name":  func(t *gtfs.Trip) interface{} { return t.Short_name },
+	"direction_id":     func(t *gtfs.Trip) interface{} { return tripDirection(t) },
+	"block_id":         func(t *gtfs.Trip) interface{} { return t.Block_id },
+	"service_id":       func(t *gtfs.Trip) interface{} { return t.Service.Id() },
+	"shape_id":         func(t *gtfs.Trip) interface{} { return tripShapeID(t) },
+	"route_id":         func(t *gtfs.Trip) interface{} { return t.Route.Id },
+	"route_short_name": func(t *gtfs.Trip) interface{} { return t.Route.Short_name },
+	"route_long_name":  func(t *gtfs.Trip) interface{} { return t.Route.Long_name },
+	"route_type":       func(t *gtfs.Trip) interface{} { return t.Route.Type },
+	"agency_id":        func(t *gtfs.Trip) interface{} { return tripAgencyID(t) },
+}
+
+// ParseTripFilter parses a filter expression (see ParseWhere) over the
+// GTFS attributes of trips and their routes, like
+// headsign ~ "Airport" OR route_short_name = 'X1'
+func ParseTripFilter(expr string) (*Where, error) {
+	w, err := ParseWhere(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	for name := range w.fields {
+		if _, ok := tripFilterFields[name]; !ok {
+			return nil, fmt.Errorf("unknown trip attribute '%s' in trip filter", name)
+		}
+	}
+
+	return w, nil
+}
+
+// FilterTrips removes all trips not matching w from Feed f, and returns
+// the number of removed trips
+func FilterTrips(f *gtfsparser.Feed, w *Where) int {
+	n := 0
+
+	for id, trip := range f.Trips {
+		match := w.Match(func(name string) interface{} {
+			if get, ok := tripFilterFields[name]; ok {
+				return get(trip)
+			}
+			return nil
+		})
+
+		if !match {
+			delete(f.Trips, id)
+			n++
+		}
+	}
+
+	return n
+}
+
+// return the direction of trip t, nil if it has none
+func tripDirection(t *gtfs.Trip) interface{} {
+	if t.Direction_id < 0 {
+		return nil
+	}
+	return t.Direction_id
+}
+
+// return the shape ID of trip t, nil if it has no shape
+func tripShapeID(t *gtfs.Trip) interface{} {
+	if t.Shape == nil {
+		return nil
+	}
+	return t.Shape.Id
+}
+
+// return the agency ID of trip t, nil if its route has no agency
+func tripAgencyID(t *gtfs.Trip) interface{} {
+	if t.Route.Agency == nil {
+		return nil
+	}
+	return t.Route.Agency.Id
+}
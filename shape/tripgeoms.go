@@ -0,0 +1,102 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/jonas-p/go-shp"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"math"
+	"strconv"
+)
+
+// layer of the distinct trip geometries, referenced by the explicit trips
+// if shared trip geometries are written
+type tripGeomLayer struct {
+	sw       *ShapeWriter
+	shape    *layer
+	fileName string
+	ids      map[string]int // geometry IDs by tripGeomKey
+}
+
+// return a key identifying the geometry of a trip, together with the
+// part of its shape it uses. Trips without a shape are identified by
+// their stops and the positions of missing stops between them
+func (sw *ShapeWriter) tripGeomKey(trip *gtfs.Trip) (string, float64, float64) {
+	from := math.NaN()
+	to := math.NaN()
+
+	if trip.Shape == nil {
+		key := "\x00"
+		for i, st := range trip.StopTimes {
+			if sw.stopGaps[trip][i] {
+				key += "\x00"
+			}
+			key += "\x00" + st.Stop().Id
+		}
+		return key, from, to
+	}
+
+	from, to = tripShapeRange(trip)
+	key := trip.Shape.Id + "\x00" + strconv.FormatFloat(from, 'g', -1, 64) + "\x00" + strconv.FormatFloat(to, 'g', -1, 64)
+
+	// simplified lines depend on the served stops
+	if sw.opts.Simplify > 0 {
+		for _, st := range trip.StopTimes {
+			if st.Stop() != nil {
+				key += "\x00" + st.Stop().Id
+			}
+		}
+	}
+
+	return key, from, to
+}
+
+// create the layer <outFile>.tripgeoms.shp for the distinct geometries
+// of trips, to be closed with closeLayer
+func (sw *ShapeWriter) createTripGeomLayer(trips map[string]*gtfs.Trip, outFile string) *tripGeomLayer {
+	fileName := sw.getOutFileName(outFile, ".tripgeoms.shp")
+	shape := sw.createLayer(fileName, sw.lineType(), "tripgeoms")
+
+	// the filter expression only applies to the trips
+	shape.where = nil
+
+	idSize := uint8(0)
+	for _, trip := range trips {
+		if trip.Shape != nil {
+			fitSize(&idSize, len(sw.ids.get("shape", trip.Shape.Id)))
+		}
+	}
+
+	shape.SetFields([]shp.Field{
+		shp.NumberField(sw.fldName("Geom_id"), 10),
+		shp.StringField(sw.fldName("Shape_id"), idSize),
+		shp.FloatField(sw.fldName("Km"), 32, 3),
+	})
+
+	return &tripGeomLayer{sw: sw, shape: shape, fileName: fileName, ids: make(map[string]int)}
+}
+
+// return the ID of the geometry of trip identified by key, and write
+// the geometry if it is new
+func (g *tripGeomLayer) get(key string, trip *gtfs.Trip, line shp.Shape, meters float64) int {
+	if id, ok := g.ids[key]; ok {
+		return id
+	}
+
+	row := len(g.ids)
+	id := row + 1
+	g.ids[key] = id
+
+	g.shape.Write(line)
+	g.shape.WriteAttribute(row, 0, id)
+	if trip.Shape != nil {
+		g.shape.WriteAttribute(row, 1, g.sw.ids.get("shape", trip.Shape.Id))
+	}
+	g.sw.writeFloatAttr(g.shape, row, 2, meters/1000.0)
+
+	return id
+}
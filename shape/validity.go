@@ -0,0 +1,82 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"fmt"
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+)
+
+// FeedValidity returns the validity window declared in feed_info.txt
+// (feed_start_date and feed_end_date), spanning all feed infos. Either
+// date is empty if it is not declared
+func FeedValidity(f *gtfsparser.Feed) (gtfs.Date, gtfs.Date) {
+	var start, end gtfs.Date
+
+	for i, info := range f.FeedInfos {
+		if info.Start_date.IsEmpty() || (i > 0 && start.IsEmpty()) {
+			start = gtfs.Date{}
+		} else if start.IsEmpty() || info.Start_date.GetTime().Before(start.GetTime()) {
+			start = info.Start_date
+		}
+
+		if info.End_date.IsEmpty() || (i > 0 && end.IsEmpty()) {
+			end = gtfs.Date{}
+		} else if end.IsEmpty() || info.End_date.GetTime().After(end.GetTime()) {
+			end = info.End_date
+		}
+	}
+
+	return start, end
+}
+
+// ClampToFeedValidity restricts the services of Feed f to the validity
+// window declared in feed_info.txt, so days outside of it are not
+// counted in any statistics. Feeds often keep calendars running beyond
+// their declared validity, which would otherwise inflate trip counts
+// and vehicle km. Returns a description of the services active outside
+// the window, by service ID. Feeds without declared dates are unchanged
+func ClampToFeedValidity(f *gtfsparser.Feed) map[string]string {
+	ret := make(map[string]string)
+
+	start, end := FeedValidity(f)
+	if start.IsEmpty() && end.IsEmpty() {
+		return ret
+	}
+
+	before := func(d gtfs.Date) bool {
+		return !start.IsEmpty() && d.GetTime().Before(start.GetTime())
+	}
+	after := func(d gtfs.Date) bool {
+		return !end.IsEmpty() && d.GetTime().After(end.GetTime())
+	}
+
+	for id, s := range f.Services {
+		first, last := s.GetFirstActiveDate(), s.GetLastActiveDate()
+		if first.IsEmpty() || (!before(first) && !after(last)) {
+			continue
+		}
+
+		if !s.Start_date().IsEmpty() && before(s.Start_date()) {
+			s.SetStart_date(start)
+		}
+		if !s.End_date().IsEmpty() && after(s.End_date()) {
+			s.SetEnd_date(end)
+		}
+
+		for d := range s.Exceptions() {
+			if before(d) || after(d) {
+				delete(s.Exceptions(), d)
+			}
+		}
+
+		ret[id] = fmt.Sprintf("active from %s to %s", isoDate(first), isoDate(last))
+	}
+
+	return ret
+}
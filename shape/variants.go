@@ -0,0 +1,113 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"sort"
+	"strings"
+)
+
+// return a human-readable name of an aggregated shape like
+// "12: A → B via C", built from the route names, the terminal stops and
+// the most common headsign of its trips. If route is not nil, only trips
+// of this route are considered
+func (sw *ShapeWriter) variantName(as *AggrShape, route *gtfs.Route) string {
+	var rep *gtfs.Trip
+
+	for _, trip := range as.Trips {
+		if route != nil && sw.groupRoute(trip.Route) != route {
+			continue
+		}
+
+		// the trip with the most stops (ties broken by ID) represents
+		// the variant
+		if rep == nil || len(trip.StopTimes) > len(rep.StopTimes) ||
+			(len(trip.StopTimes) == len(rep.StopTimes) && trip.Id < rep.Id) {
+			rep = trip
+		}
+	}
+
+	names := make([]string, 0)
+	if route != nil {
+		names = append(names, routeName(route))
+	} else {
+		seen := make(map[string]bool)
+		for _, r := range as.Routes {
+			if name := routeName(r); len(name) > 0 && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+	}
+
+	ret := strings.Join(names, ", ")
+
+	if rep == nil || len(rep.StopTimes) == 0 {
+		return ret
+	}
+
+	from := rep.StopTimes[0].Stop().Name
+	to := rep.StopTimes[len(rep.StopTimes)-1].Stop().Name
+
+	// prefer the most common headsign as destination
+	if headsign := sw.commonHeadsign(as, route); len(headsign) > 0 {
+		to = headsign
+	}
+
+	if len(ret) > 0 {
+		ret += ": "
+	}
+
+	ret += from + " → " + to
+
+	if len(rep.StopTimes) > 2 {
+		via := rep.StopTimes[len(rep.StopTimes)/2].Stop().Name
+		if len(via) > 0 && via != from && via != to {
+			ret += " via " + via
+		}
+	}
+
+	return ret
+}
+
+// return the most common headsign of the trips of an aggregated shape
+// (ties broken alphabetically), or an empty string if they have no
+// headsigns. If route is not nil, only trips of this route are considered
+func (sw *ShapeWriter) commonHeadsign(as *AggrShape, route *gtfs.Route) string {
+	headsigns := make(map[string]int)
+
+	for _, trip := range as.Trips {
+		if route != nil && sw.groupRoute(trip.Route) != route {
+			continue
+		}
+
+		if trip.Headsign != nil && len(*trip.Headsign) > 0 {
+			headsigns[*trip.Headsign]++
+		}
+	}
+
+	ret := ""
+	best := 0
+	for headsign, count := range headsigns {
+		if count > best || (count == best && headsign < ret) {
+			ret = headsign
+			best = count
+		}
+	}
+
+	return ret
+}
+
+// return the short name of a route, or its long name if it has no short name
+func routeName(r *gtfs.Route) string {
+	if len(r.Short_name) > 0 {
+		return r.Short_name
+	}
+	return r.Long_name
+}
@@ -0,0 +1,184 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"sort"
+	"strings"
+)
+
+// a running interval in seconds since midnight of the service day
+type interval struct {
+	start int
+	end   int
+}
+
+// getPeakVehicles estimates the peak number of simultaneously running
+// vehicles per route, over all service days. Trips of the same block
+// are operated by the same vehicle, which is counted as running from
+// the start of the first to the end of the last trip of the block.
+func (sw *ShapeWriter) getPeakVehicles(trips map[string]*gtfs.Trip) map[*gtfs.Route]int {
+	ivs := make(map[*gtfs.Route]map[*gtfs.Service][]interval)
+	blocks := make(map[*gtfs.Route]map[*gtfs.Service]map[string]interval)
+
+	for _, trip := range trips {
+		if (len(sw.motMap) > 0 && !sw.motMap[trip.Route.Type]) || len(trip.StopTimes) < 2 {
+			continue
+		}
+
+		route := sw.groupRoute(trip.Route)
+
+		if _, ok := ivs[route]; !ok {
+			ivs[route] = make(map[*gtfs.Service][]interval)
+			blocks[route] = make(map[*gtfs.Service]map[string]interval)
+		}
+
+		tripIvs := tripIntervals(trip)
+
+		if trip.Block_id != nil && len(*trip.Block_id) > 0 && len(tripIvs) == 1 {
+			if _, ok := blocks[route][trip.Service]; !ok {
+				blocks[route][trip.Service] = make(map[string]interval)
+			}
+
+			iv, ok := blocks[route][trip.Service][*trip.Block_id]
+			if !ok {
+				iv = tripIvs[0]
+			}
+			if tripIvs[0].start < iv.start {
+				iv.start = tripIvs[0].start
+			}
+			if tripIvs[0].end > iv.end {
+				iv.end = tripIvs[0].end
+			}
+			blocks[route][trip.Service][*trip.Block_id] = iv
+			continue
+		}
+
+		ivs[route][trip.Service] = append(ivs[route][trip.Service], tripIvs...)
+	}
+
+	for route, svcBlocks := range blocks {
+		for svc, blockIvs := range svcBlocks {
+			for _, iv := range blockIvs {
+				ivs[route][svc] = append(ivs[route][svc], iv)
+			}
+		}
+	}
+
+	ret := make(map[*gtfs.Route]int, len(ivs))
+
+	for route, svcIvs := range ivs {
+		ret[route] = peakOnServiceDays(svcIvs)
+	}
+
+	return ret
+}
+
+// return the maximum number of overlapping intervals on any day, given
+// the intervals per service
+func peakOnServiceDays(svcIvs map[*gtfs.Service][]interval) int {
+	svcs := make([]*gtfs.Service, 0, len(svcIvs))
+	for svc := range svcIvs {
+		svcs = append(svcs, svc)
+	}
+	sort.Slice(svcs, func(i, j int) bool { return svcs[i].Id() < svcs[j].Id() })
+
+	var first, last gtfs.Date
+	for i, svc := range svcs {
+		if i == 0 || svc.GetFirstActiveDate().GetTime().Before(first.GetTime()) {
+			first = svc.GetFirstActiveDate()
+		}
+		if i == 0 || svc.GetLastActiveDate().GetTime().After(last.GetTime()) {
+			last = svc.GetLastActiveDate()
+		}
+	}
+
+	// peak per set of active services, many days share the same set
+	peaks := make(map[string]int)
+	ret := 0
+	lastT := last.GetTime()
+
+	for d := first; !d.GetTime().After(lastT); d = d.GetOffsettedDate(1) {
+		active := make([]string, 0)
+		dayIvs := make([]interval, 0)
+
+		for _, svc := range svcs {
+			if svc.IsActiveOn(d) {
+				active = append(active, svc.Id())
+				dayIvs = append(dayIvs, svcIvs[svc]...)
+			}
+		}
+
+		key := strings.Join(active, "\x00")
+		if _, ok := peaks[key]; !ok {
+			peaks[key] = maxOverlap(dayIvs)
+		}
+
+		if peaks[key] > ret {
+			ret = peaks[key]
+		}
+	}
+
+	return ret
+}
+
+// return the maximum number of overlapping intervals. An interval
+// ending when another starts does not overlap with it
+func maxOverlap(ivs []interval) int {
+	type event struct {
+		t     int
+		delta int
+	}
+
+	events := make([]event, 0, len(ivs)*2)
+	for _, iv := range ivs {
+		events = append(events, event{iv.start, 1}, event{iv.end, -1})
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].t == events[j].t {
+			return events[i].delta < events[j].delta
+		}
+		return events[i].t < events[j].t
+	})
+
+	ret := 0
+	cur := 0
+	for _, e := range events {
+		cur += e.delta
+		if cur > ret {
+			ret = cur
+		}
+	}
+
+	return ret
+}
+
+// return the running intervals of a trip, one for each trip generated
+// by its frequencies
+func tripIntervals(trip *gtfs.Trip) []interval {
+	start := trip.StopTimes[0].Departure_time().SecondsSinceMidnight()
+	end := trip.StopTimes[len(trip.StopTimes)-1].Arrival_time().SecondsSinceMidnight()
+
+	if trip.Frequencies == nil || len(*trip.Frequencies) == 0 {
+		return []interval{{start, end}}
+	}
+
+	ret := make([]interval, 0)
+
+	for _, freq := range *trip.Frequencies {
+		if freq.Headway_secs <= 0 {
+			continue
+		}
+		for t := freq.Start_time.SecondsSinceMidnight(); t < freq.End_time.SecondsSinceMidnight(); t += freq.Headway_secs {
+			ret = append(ret, interval{t, t + end - start})
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,157 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"math"
+	"sync"
+	"time"
+)
+
+// names of the weekday attributes, in the order of time.Weekday
+var weekdayFlds = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+// operation days of a service
+type serviceDays struct {
+	weekdays [7]bool // in the order of time.Weekday
+	holiday  bool
+	start    gtfs.Date // first active date
+	end      gtfs.Date // last active date
+}
+
+// cache of the operation days per service
+type serviceDaysCache struct {
+	mutex sync.Mutex
+	days  map[*gtfs.Service]serviceDays
+}
+
+// return the operation days of service s
+func (sw *ShapeWriter) getServiceDays(s *gtfs.Service) serviceDays {
+	sw.svcDays.mutex.Lock()
+	defer sw.svcDays.mutex.Unlock()
+
+	if sw.svcDays.days == nil {
+		sw.svcDays.days = make(map[*gtfs.Service]serviceDays)
+	}
+
+	if days, ok := sw.svcDays.days[s]; ok {
+		return days
+	}
+
+	start := s.GetFirstActiveDate()
+	end := s.GetLastActiveDate()
+	endT := end.GetTime()
+
+	ret := serviceDays{start: start, end: end}
+
+	// whether the service has a regular weekly pattern
+	weekly := false
+	for i := 0; i < 7; i++ {
+		weekly = weekly || s.Daymap(i)
+	}
+
+	for d := start; !d.GetTime().After(endT); d = d.GetOffsettedDate(1) {
+		if !s.IsActiveOn(d) {
+			continue
+		}
+
+		weekday := int(d.GetTime().Weekday())
+		ret.weekdays[weekday] = true
+
+		if len(sw.opts.Holidays) > 0 {
+			ret.holiday = ret.holiday || sw.opts.Holidays[d]
+		} else if weekly && !s.Daymap(weekday) && s.Exceptions()[d] {
+			// without explicit holidays, count extra service added on a
+			// weekday the weekly pattern does not cover as holiday service
+			ret.holiday = true
+		}
+	}
+
+	sw.svcDays.days[s] = ret
+
+	return ret
+}
+
+// abbreviations of the weekdays in operation day texts, in the order of
+// time.Weekday
+var weekdayAbbrs = []string{"Su", "Mo", "Tu", "We", "Th", "Fr", "Sa"}
+
+// return the operation days as a condensed text like "Mo-Fr" or
+// "Sa,Su+holidays", with runs of three or more days written as ranges
+// from monday to sunday
+func (days serviceDays) text() string {
+	ret := ""
+
+	for i := 0; i < 7; {
+		if !days.weekdays[(i+1)%7] {
+			i++
+			continue
+		}
+
+		j := i
+		for j < 6 && days.weekdays[(j+2)%7] {
+			j++
+		}
+
+		if len(ret) > 0 {
+			ret += ","
+		}
+
+		switch j - i {
+		case 0:
+			ret += weekdayAbbrs[(i+1)%7]
+		case 1:
+			ret += weekdayAbbrs[(i+1)%7] + "," + weekdayAbbrs[(j+1)%7]
+		default:
+			ret += weekdayAbbrs[(i+1)%7] + "-" + weekdayAbbrs[(j+1)%7]
+		}
+
+		i = j + 1
+	}
+
+	if days.holiday {
+		ret += "+holidays"
+	}
+
+	return ret
+}
+
+// return the number of days from the first to the last service date of
+// the trips of the aggregated shapes, NaN if there are none
+func (sw *ShapeWriter) servicePeriodDays(shapes map[string]*AggrShape) float64 {
+	var first, last time.Time
+
+	for _, s := range shapes {
+		for _, trip := range s.Trips {
+			days := sw.getServiceDays(trip.Service)
+			if days.start.IsEmpty() || days.end.IsEmpty() {
+				continue
+			}
+			if first.IsZero() || days.start.GetTime().Before(first) {
+				first = days.start.GetTime()
+			}
+			if last.IsZero() || days.end.GetTime().After(last) {
+				last = days.end.GetTime()
+			}
+		}
+	}
+
+	if first.IsZero() {
+		return math.NaN()
+	}
+
+	return math.Round(last.Sub(first).Hours()/24) + 1
+}
+
+// return 1 if b is true, 0 otherwise
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
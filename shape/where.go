@@ -0,0 +1,481 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package shape
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Where is a parsed SQL-like filter expression over feature attributes,
+// like "R_Type IN (0,1) AND Frequency > 50"
+type Where struct {
+	root   whereNode
+	fields map[string]bool // lower-cased names of all referenced fields
+}
+
+// a node of a filter expression, evaluated to nil, a bool, a float64 or
+// a string. Field values are looked up by their lower-cased name
+type whereNode interface {
+	eval(get func(string) interface{}) interface{}
+}
+
+type whereLit struct{ val interface{} }
+type whereField struct{ name string }
+type whereNot struct{ a whereNode }
+type whereAnd struct{ a, b whereNode }
+type whereOr struct{ a, b whereNode }
+type whereCmp struct {
+	op   string
+	a, b whereNode
+}
+type whereIn struct {
+	a    whereNode
+	list []whereNode
+	not  bool
+}
+type whereLike struct {
+	a   whereNode
+	re  *regexp.Regexp
+	not bool
+}
+type whereNull struct {
+	a   whereNode
+	not bool
+}
+
+// ParseWhere parses a filter expression. Supported are comparisons
+// (=, !=, <>, <, <=, >, >=), [NOT] IN (...), [NOT] LIKE with % and _
+// wildcards, regular expression matches (~ and !~), IS [NOT] NULL, AND,
+// OR, NOT and parentheses. Strings are
+// quoted with single or double quotes, field names are case-insensitive
+func ParseWhere(expr string) (*Where, error) {
+	toks, err := tokenizeWhere(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &whereParser{toks: toks, fields: make(map[string]bool)}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected '%s' in filter expression", p.toks[p.pos].val)
+	}
+
+	return &Where{root: root, fields: p.fields}, nil
+}
+
+// Filtered returns the number of features not written because they did
+// not match the Where filter
+func (sw *ShapeWriter) Filtered() int {
+	return sw.filtered
+}
+
+// Match checks whether a feature with the given attributes, keyed by
+// lower-cased field name, matches the expression
+func (w *Where) Match(get func(string) interface{}) bool {
+	b, ok := w.root.eval(get).(bool)
+	return ok && b
+}
+
+// check whether all fields referenced by the expression are in names
+// (lower-cased)
+func (w *Where) appliesTo(names map[string]int) bool {
+	for name := range w.fields {
+		if _, ok := names[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+type whereTok struct {
+	kind string // "num", "str", "ident", "op"
+	val  string
+}
+
+// split a filter expression into tokens
+func tokenizeWhere(expr string) ([]whereTok, error) {
+	ret := make([]whereTok, 0)
+	rs := []rune(expr)
+
+	for i := 0; i < len(rs); {
+		c := rs[i]
+
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '\'' || c == '"':
+			j := i + 1
+			for j < len(rs) && rs[j] != c {
+				j++
+			}
+			if j == len(rs) {
+				return nil, fmt.Errorf("unterminated string in filter expression")
+			}
+			ret = append(ret, whereTok{"str", string(rs[i+1 : j])})
+			i = j + 1
+		case unicode.IsDigit(c) || c == '.' || (c == '-' && i+1 < len(rs) && (unicode.IsDigit(rs[i+1]) || rs[i+1] == '.')):
+			j := i + 1
+			for j < len(rs) && (unicode.IsDigit(rs[j]) || rs[j] == '.' || rs[j] == 'e' || rs[j] == 'E') {
+				j++
+			}
+			ret = append(ret, whereTok{"num", string(rs[i:j])})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i + 1
+			for j < len(rs) && (unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j]) || rs[j] == '_') {
+				j++
+			}
+			ret = append(ret, whereTok{"ident", string(rs[i:j])})
+			i = j
+		case strings.ContainsRune("<>!=~", c):
+			j := i + 1
+			if j < len(rs) && c != '~' && (rs[j] == '=' || (c == '<' && rs[j] == '>') || (c == '!' && rs[j] == '~')) {
+				j++
+			}
+			ret = append(ret, whereTok{"op", string(rs[i:j])})
+			i = j
+		case c == '(' || c == ')' || c == ',':
+			ret = append(ret, whereTok{"op", string(c)})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character '%c' in filter expression", c)
+		}
+	}
+
+	return ret, nil
+}
+
+type whereParser struct {
+	toks   []whereTok
+	pos    int
+	fields map[string]bool
+}
+
+// check whether the next token is the keyword kw, and consume it
+func (p *whereParser) keyword(kw string) bool {
+	if p.pos < len(p.toks) && p.toks[p.pos].kind == "ident" && strings.EqualFold(p.toks[p.pos].val, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// check whether the next token is the operator op, and consume it
+func (p *whereParser) op(op string) bool {
+	if p.pos < len(p.toks) && p.toks[p.pos].kind == "op" && p.toks[p.pos].val == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *whereParser) parseOr() (whereNode, error) {
+	a, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		b, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		a = whereOr{a, b}
+	}
+	return a, nil
+}
+
+func (p *whereParser) parseAnd() (whereNode, error) {
+	a, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		b, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		a = whereAnd{a, b}
+	}
+	return a, nil
+}
+
+func (p *whereParser) parseNot() (whereNode, error) {
+	if p.keyword("NOT") {
+		a, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return whereNot{a}, nil
+	}
+	return p.parseCmp()
+}
+
+func (p *whereParser) parseCmp() (whereNode, error) {
+	a, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, op := range []string{"=", "==", "!=", "<>", "<", "<=", ">", ">="} {
+		if p.op(op) {
+			b, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			return whereCmp{op, a, b}, nil
+		}
+	}
+
+	if p.op("~") || p.op("!~") {
+		not := p.toks[p.pos-1].val == "!~"
+		if p.pos >= len(p.toks) || p.toks[p.pos].kind != "str" {
+			return nil, fmt.Errorf("expected string after %s in filter expression", p.toks[p.pos-1].val)
+		}
+		re, err := regexp.Compile(p.toks[p.pos].val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression '%s' in filter expression", p.toks[p.pos].val)
+		}
+		p.pos++
+		return whereLike{a, re, not}, nil
+	}
+
+	if p.keyword("IS") {
+		not := p.keyword("NOT")
+		if !p.keyword("NULL") {
+			return nil, fmt.Errorf("expected NULL after IS in filter expression")
+		}
+		return whereNull{a, not}, nil
+	}
+
+	not := p.keyword("NOT")
+
+	if p.keyword("IN") {
+		if !p.op("(") {
+			return nil, fmt.Errorf("expected ( after IN in filter expression")
+		}
+		list := make([]whereNode, 0)
+		for {
+			b, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, b)
+			if p.op(")") {
+				break
+			}
+			if !p.op(",") {
+				return nil, fmt.Errorf("expected , or ) in IN list of filter expression")
+			}
+		}
+		return whereIn{a, list, not}, nil
+	}
+
+	if p.keyword("LIKE") {
+		if p.pos >= len(p.toks) || p.toks[p.pos].kind != "str" {
+			return nil, fmt.Errorf("expected string after LIKE in filter expression")
+		}
+		pattern := regexp.QuoteMeta(p.toks[p.pos].val)
+		pattern = strings.ReplaceAll(strings.ReplaceAll(pattern, "%", ".*"), "_", ".")
+		p.pos++
+		return whereLike{a, regexp.MustCompile("(?is)^" + pattern + "$"), not}, nil
+	}
+
+	if not {
+		return nil, fmt.Errorf("expected IN or LIKE after NOT in filter expression")
+	}
+
+	return a, nil
+}
+
+func (p *whereParser) parseOperand() (whereNode, error) {
+	if p.pos >= len(p.toks) {
+		return nil, fmt.Errorf("unexpected end of filter expression")
+	}
+
+	tok := p.toks[p.pos]
+	p.pos++
+
+	switch tok.kind {
+	case "num":
+		f, err := strconv.ParseFloat(tok.val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s' in filter expression", tok.val)
+		}
+		return whereLit{f}, nil
+	case "str":
+		return whereLit{tok.val}, nil
+	case "ident":
+		if strings.EqualFold(tok.val, "NULL") {
+			return whereLit{nil}, nil
+		}
+		name := strings.ToLower(tok.val)
+		p.fields[name] = true
+		return whereField{name}, nil
+	}
+
+	if tok.val == "(" {
+		a, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.op(")") {
+			return nil, fmt.Errorf("missing ) in filter expression")
+		}
+		return a, nil
+	}
+
+	return nil, fmt.Errorf("unexpected '%s' in filter expression", tok.val)
+}
+
+func (n whereLit) eval(get func(string) interface{}) interface{} { return n.val }
+
+func (n whereField) eval(get func(string) interface{}) interface{} {
+	return normalizeWhereVal(get(n.name))
+}
+
+func (n whereNot) eval(get func(string) interface{}) interface{} {
+	if b, ok := n.a.eval(get).(bool); ok {
+		return !b
+	}
+	return nil
+}
+
+func (n whereAnd) eval(get func(string) interface{}) interface{} {
+	a, _ := n.a.eval(get).(bool)
+	b, _ := n.b.eval(get).(bool)
+	return a && b
+}
+
+func (n whereOr) eval(get func(string) interface{}) interface{} {
+	a, _ := n.a.eval(get).(bool)
+	b, _ := n.b.eval(get).(bool)
+	return a || b
+}
+
+func (n whereCmp) eval(get func(string) interface{}) interface{} {
+	c, ok := compareWhereVals(n.a.eval(get), n.b.eval(get))
+	if !ok {
+		return false
+	}
+
+	switch n.op {
+	case "=", "==":
+		return c == 0
+	case "!=", "<>":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+func (n whereIn) eval(get func(string) interface{}) interface{} {
+	a := n.a.eval(get)
+	if a == nil {
+		return false
+	}
+	for _, b := range n.list {
+		if c, ok := compareWhereVals(a, b.eval(get)); ok && c == 0 {
+			return !n.not
+		}
+	}
+	return n.not
+}
+
+func (n whereLike) eval(get func(string) interface{}) interface{} {
+	a := n.a.eval(get)
+	if a == nil {
+		return false
+	}
+	return n.re.MatchString(whereValString(a)) != n.not
+}
+
+func (n whereNull) eval(get func(string) interface{}) interface{} {
+	return (n.a.eval(get) == nil) != n.not
+}
+
+// convert an attribute value to nil, a float64 or a string
+func normalizeWhereVal(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return nil
+		}
+		return normalizeWhereVal(rv.Elem().Interface())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	}
+
+	return fmt.Sprint(v)
+}
+
+// format a value for string comparisons
+func whereValString(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// compare two values, numerically if both are numbers (or numeric
+// strings), otherwise as strings. ok is false if a value is nil
+func compareWhereVals(a interface{}, b interface{}) (int, bool) {
+	if a == nil || b == nil {
+		return 0, false
+	}
+
+	fa, aNum := whereNum(a)
+	fb, bNum := whereNum(b)
+
+	if aNum && bNum {
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	return strings.Compare(whereValString(a), whereValString(b)), true
+}
+
+// return a value as a number, if possible
+func whereNum(v interface{}) (float64, bool) {
+	switch val := v.(type) {
+	case float64:
+		return val, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
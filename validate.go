@@ -0,0 +1,251 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/patrickbr/gtfsparser"
+	"github.com/patrickbr/gtfsparser/gtfs"
+	"io"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maximum number of validation issues printed
+const maxPrintedIssues = 100
+
+// a problem found in the parsed feed
+type validationIssue struct {
+	entity string
+	id     string
+	reason string
+}
+
+// validateFeed checks the parsed feed for problems which would lead to
+// broken output, like invalid coordinates or dangling references. If
+// drop is true, offending entities (and entities depending on them)
+// are removed from the feed. Routes without an agency are valid, and
+// duplicate IDs are already rejected (or dropped) by the parser.
+func validateFeed(feed *gtfsparser.Feed, drop bool) []validationIssue {
+	issues := make([]validationIssue, 0)
+
+	droppedStops := make(map[*gtfs.Stop]bool)
+	droppedShapes := make(map[*gtfs.Shape]bool)
+
+	for id, stop := range feed.Stops {
+		if !validCoord(float64(stop.Lat), float64(stop.Lon)) {
+			issues = append(issues, validationIssue{"stop", id, fmt.Sprintf("invalid coordinate %f,%f", stop.Lat, stop.Lon)})
+			droppedStops[stop] = true
+		}
+	}
+
+	for id, shp := range feed.Shapes {
+		for _, p := range shp.Points {
+			if !validCoord(float64(p.Lat), float64(p.Lon)) {
+				issues = append(issues, validationIssue{"shape", id, fmt.Sprintf("invalid coordinate %f,%f", p.Lat, p.Lon)})
+				droppedShapes[shp] = true
+				break
+			}
+		}
+	}
+
+	for id, trip := range feed.Trips {
+		reason := ""
+
+		if trip.Route == nil {
+			reason = "no route"
+		} else if trip.Service == nil {
+			reason = "no service"
+		} else {
+			for _, st := range trip.StopTimes {
+				if st.Stop() == nil {
+					reason = "stop time references a missing stop"
+					break
+				}
+				if droppedStops[st.Stop()] {
+					reason = "stop " + st.Stop().Id + " is invalid"
+					break
+				}
+			}
+		}
+
+		if len(reason) > 0 {
+			issues = append(issues, validationIssue{"trip", id, reason})
+			if drop {
+				delete(feed.Trips, id)
+			}
+		} else if drop && trip.Shape != nil && droppedShapes[trip.Shape] {
+			// fall back to station positions
+			trip.Shape = nil
+		}
+	}
+
+	if drop {
+		for stop := range droppedStops {
+			delete(feed.Stops, stop.Id)
+		}
+		for _, stop := range feed.Stops {
+			if stop.Parent_station != nil && droppedStops[stop.Parent_station] {
+				stop.Parent_station = nil
+			}
+		}
+		for shp := range droppedShapes {
+			delete(feed.Shapes, shp.Id)
+		}
+	}
+
+	return issues
+}
+
+// handleNullStops finds stops without coordinates (missing or at 0,0),
+// which would otherwise be written at "Null Island". If inherit is true,
+// such stops inherit the coordinates of their parent station, if
+// possible. All other affected stops are removed from the feed.
+func handleNullStops(feed *gtfsparser.Feed, inherit bool) []validationIssue {
+	issues := make([]validationIssue, 0)
+
+	for id, stop := range feed.Stops {
+		if hasCoord(float64(stop.Lat), float64(stop.Lon)) {
+			continue
+		}
+
+		parent := stop.Parent_station
+
+		if inherit && parent != nil && hasCoord(float64(parent.Lat), float64(parent.Lon)) {
+			stop.Lat = parent.Lat
+			stop.Lon = parent.Lon
+			issues = append(issues, validationIssue{"stop", id, "no coordinates, inherited from parent station " + parent.Id})
+		} else {
+			issues = append(issues, validationIssue{"stop", id, "no coordinates, excluded"})
+		}
+	}
+
+	for _, issue := range issues {
+		if !hasCoord(float64(feed.Stops[issue.id].Lat), float64(feed.Stops[issue.id].Lon)) {
+			delete(feed.Stops, issue.id)
+		}
+	}
+
+	sort.Slice(issues, func(i, j int) bool { return issues[i].id < issues[j].id })
+
+	return issues
+}
+
+// remove consecutive duplicate shape points, which form zero-length
+// segments, and return an issue with the number of removed points for
+// every changed shape
+func dedupShapePoints(feed *gtfsparser.Feed) []validationIssue {
+	issues := make([]validationIssue, 0)
+
+	for id, shape := range feed.Shapes {
+		if len(shape.Points) < 2 {
+			continue
+		}
+
+		points := shape.Points[:1]
+
+		for _, p := range shape.Points[1:] {
+			last := points[len(points)-1]
+			if p.Lat == last.Lat && p.Lon == last.Lon {
+				continue
+			}
+			points = append(points, p)
+		}
+
+		if removed := len(shape.Points) - len(points); removed > 0 {
+			shape.Points = points
+			issues = append(issues, validationIssue{"shape", id, fmt.Sprintf("removed %d duplicate points", removed)})
+		}
+	}
+
+	sort.Slice(issues, func(i, j int) bool { return issues[i].id < issues[j].id })
+
+	return issues
+}
+
+// write validation issues into the QA CSV file with the basename of
+// outFile and extension ext. The file is written even without issues, so
+// that no file of an earlier run is left behind
+func writeQaCsv(outFile string, ext string, issues []validationIssue, replace bool) error {
+	return writeIssuesCsv(strings.TrimSuffix(outFile, filepath.Ext(outFile))+ext, issues, replace)
+}
+
+// write validation issues into a CSV file, replacing an existing file
+// only if replace is set
+func writeIssuesCsv(path string, issues []validationIssue, replace bool) error {
+	file, err := createOutput(path, replace)
+	if err != nil {
+		return fmt.Errorf("could not open CSV file for writing (%s)", err)
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	w.Write([]string{"type", "id", "reason"})
+
+	for _, issue := range issues {
+		w.Write([]string{issue.entity, issue.id, issue.reason})
+	}
+
+	w.Flush()
+
+	return w.Error()
+}
+
+// check whether a lat/lon pair is set, missing coordinates are either
+// NaN or 0,0
+func hasCoord(lat float64, lon float64) bool {
+	return !math.IsNaN(lat) && !math.IsNaN(lon) && (lat != 0 || lon != 0)
+}
+
+// check whether a lat/lon pair is a valid WGS84 coordinate
+func validCoord(lat float64, lon float64) bool {
+	return !math.IsNaN(lat) && !math.IsNaN(lon) && lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180
+}
+
+// return a line like "3 stops" for every kind of entity dropped while
+// parsing with gtfsparser.ParseOptions.DropErroneous
+func droppedEntities(stats gtfsparser.ErrStats) []string {
+	counts := []struct {
+		n    int
+		kind string
+	}{
+		{stats.DroppedAgencies, "agencies"},
+		{stats.DroppedStops, "stops"},
+		{stats.DroppedRoutes, "routes"},
+		{stats.DroppedTrips, "trips"},
+		{stats.DroppedStopTimes, "stop times"},
+		{stats.DroppedFrequencies, "frequencies"},
+		{stats.DroppedServices, "services"},
+		{stats.DroppedShapes, "shapes"},
+		{stats.DroppedTransfers, "transfers"},
+		{stats.DroppedPathways, "pathways"},
+		{stats.DroppedFeedInfos, "feed infos"},
+	}
+
+	ret := make([]string, 0)
+	for _, c := range counts {
+		if c.n > 0 {
+			ret = append(ret, fmt.Sprintf("%d %s", c.n, c.kind))
+		}
+	}
+
+	return ret
+}
+
+// print validation issues to w
+func printIssues(w io.Writer, issues []validationIssue) {
+	for i, issue := range issues {
+		if i == maxPrintedIssues {
+			fmt.Fprintf(w, " ... and %d more\n", len(issues)-maxPrintedIssues)
+			break
+		}
+		fmt.Fprintf(w, " %s '%s': %s\n", issue.entity, issue.id, issue.reason)
+	}
+}
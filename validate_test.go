@@ -0,0 +1,150 @@
+// Copyright 2016 Patrick Brosi
+// Authors: info@patrickbrosi.de
+//
+// Use of this source code is governed by a GPL v2
+// license that can be found in the LICENSE file
+
+package main
+
+import (
+	"github.com/patrickbr/gtfs2shp/internal/testfeed"
+	"github.com/patrickbr/gtfsparser"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// return a small feed with a bus route r1 along shape sh1 and a tram
+// route r2 without a shape, with one trip each
+func fixtureFeed(t *testing.T) *gtfsparser.Feed {
+	t.Helper()
+
+	return testfeed.New().
+		Stop("A", "Alpha", 50.0, 8.0).
+		Stop("B", "Beta", 50.0, 8.01).
+		Stop("C", "Gamma", 50.0, 8.02).
+		Route("r1", "1", 3).
+		Route("r2", "2", 0).
+		Calendar("wd", "1111100", "20240101", "20240107").
+		Shape("sh1", [2]float64{50.0, 8.0}, [2]float64{50.0, 8.01}, [2]float64{50.0, 8.02}).
+		Trip("t1", "r1", "wd", "sh1", testfeed.At("A", "08:00:00"), testfeed.At("B", "08:05:00")).
+		Trip("t2", "r2", "wd", "", testfeed.At("B", "09:00:00"), testfeed.At("C", "09:05:00")).
+		Feed(t)
+}
+
+// sort issues by entity type and ID
+func sortIssues(issues []validationIssue) []validationIssue {
+	sort.Slice(issues, func(i, j int) bool {
+		if issues[i].entity != issues[j].entity {
+			return issues[i].entity < issues[j].entity
+		}
+		return issues[i].id < issues[j].id
+	})
+	return issues
+}
+
+func TestValidateFeed(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(feed *gtfsparser.Feed)
+		want   []validationIssue
+		trips  []string // remaining trips with drop
+		shaped []string // remaining trips with a shape with drop
+	}{
+		{
+			"valid feed",
+			func(feed *gtfsparser.Feed) {},
+			[]validationIssue{},
+			[]string{"t1", "t2"}, []string{"t1"},
+		},
+		{
+			"invalid stop",
+			func(feed *gtfsparser.Feed) { feed.Stops["C"].Lat = 91 },
+			[]validationIssue{{"stop", "C", "invalid coordinate 91.000000,8.020000"}, {"trip", "t2", "stop C is invalid"}},
+			[]string{"t1"}, []string{"t1"},
+		},
+		{
+			"invalid shape",
+			func(feed *gtfsparser.Feed) { feed.Shapes["sh1"].Points[1].Lon = 181 },
+			[]validationIssue{{"shape", "sh1", "invalid coordinate 50.000000,181.000000"}},
+			[]string{"t1", "t2"}, []string{},
+		},
+		{
+			"route without agency",
+			func(feed *gtfsparser.Feed) { feed.Routes["r1"].Agency = nil },
+			[]validationIssue{},
+			[]string{"t1", "t2"}, []string{"t1"},
+		},
+	}
+
+	for _, test := range tests {
+		for _, drop := range []bool{false, true} {
+			feed := fixtureFeed(t)
+			test.modify(feed)
+
+			issues := sortIssues(validateFeed(feed, drop))
+			if !reflect.DeepEqual(issues, test.want) {
+				t.Errorf("%s: got issues %v, want %v", test.name, issues, test.want)
+			}
+
+			trips := make([]string, 0)
+			shaped := make([]string, 0)
+			for id, trip := range feed.Trips {
+				trips = append(trips, id)
+				if trip.Shape != nil {
+					shaped = append(shaped, id)
+				}
+			}
+			sort.Strings(trips)
+			sort.Strings(shaped)
+
+			if !drop {
+				if len(trips) != 2 || len(shaped) != 1 {
+					t.Errorf("%s: feed changed without drop, trips %v", test.name, trips)
+				}
+				continue
+			}
+
+			if !reflect.DeepEqual(trips, test.trips) || !reflect.DeepEqual(shaped, test.shaped) {
+				t.Errorf("%s: got trips %v with shapes %v, want %v with shapes %v", test.name, trips, shaped, test.trips, test.shaped)
+			}
+
+			for _, issue := range test.want {
+				if issue.entity == "stop" && feed.Stops[issue.id] != nil {
+					t.Errorf("%s: invalid stop %s kept", test.name, issue.id)
+				}
+				if issue.entity == "shape" && feed.Shapes[issue.id] != nil {
+					t.Errorf("%s: invalid shape %s kept", test.name, issue.id)
+				}
+			}
+		}
+	}
+}
+
+func TestWriteIssuesCsvExisting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.null_stops.csv")
+	issues := []validationIssue{{"stop", "C", "no coordinates"}}
+
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeIssuesCsv(path, issues, false); err == nil {
+		t.Errorf("replaced an existing file without replace")
+	}
+
+	if err := writeIssuesCsv(path, issues, true); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "type,id,reason\nstop,C,no coordinates\n"; string(content) != want {
+		t.Errorf("got %q, want %q", content, want)
+	}
+}